@@ -3,23 +3,33 @@
 #include <stdlib.h>
 
 void call_update_progress(wrapped_context_t *context) {
-  context->impl.update_progress(context->clientCtx, &context->progress);
+  if (context->impl.update_progress != NULL) {
+    context->impl.update_progress(context->clientCtx, &context->progress);
+  }
 }
 
 void call_notify(wrapped_context_t *context) {
-  context->impl.notify(context->clientCtx, &context->result);
+  if (context->impl.notify != NULL) {
+    context->impl.notify(context->clientCtx, &context->result);
+  }
 }
 
 void call_notify_codegen(wrapped_context_t *context) {
-  context->impl.notify_codegen(context->clientCtx, &context->codegen_result);
+  if (context->impl.notify_codegen != NULL) {
+    context->impl.notify_codegen(context->clientCtx, &context->codegen_result);
+  }
 }
 
 void call_log(wrapped_context_t *context, char *msg) {
-  context->impl.log(context->clientCtx, msg);
+  if (context->impl.log != NULL) {
+    context->impl.log(context->clientCtx, msg);
+  }
 }
 
 void call_update_metadata(wrapped_context_t *context) {
-  context->impl.update_metadata(context->clientCtx, &context->metadata);
+  if (context->impl.update_metadata != NULL) {
+    context->impl.update_metadata(context->clientCtx, &context->metadata);
+  }
 }
 
 char *call_write(wrapped_context_t *context, uint8_t *buffer, int length) {
@@ -70,22 +80,40 @@ void free_codegen_result(codegen_result_t *result) {
   }
 }
 
+wrapped_context_t *new_wrapped_context(client_context_t clientCtx,
+                                       client_impl_t *impl) {
+  wrapped_context_t *wctx = calloc(1, sizeof(wrapped_context_t));
+  if (wctx == NULL) {
+    impl->oom();
+    return NULL;
+  }
+  wctx->clientCtx = clientCtx;
+  wctx->impl = *impl;
+  return wctx;
+}
+
 void free_wrapped_context(wrapped_context_t *wctx) {
   if (wctx != NULL) {
-    if (wctx->codegen_result.result_type == CodeGenSuccessful &&
-        wctx->codegen_result.generated.code != NULL) {
+    if (wctx->codegen_result.generated.code != NULL) {
       free(wctx->codegen_result.generated.code);
-    } else if (wctx->codegen_result.error.error_string != NULL) {
+    }
+
+    if (wctx->codegen_result.error.error_string != NULL) {
       free(wctx->codegen_result.error.error_string);
     }
 
-    if (wctx->result.result_type == Success &&
-        wctx->result.received_text != NULL) {
+    if (wctx->result.received_text != NULL) {
       free(wctx->result.received_text);
-    } else if (wctx->result.err_string != NULL) {
+    }
+
+    if (wctx->result.err_string != NULL) {
       free(wctx->result.err_string);
     }
 
+    if (wctx->metadata.file_name != NULL) {
+      free(wctx->metadata.file_name);
+    }
+
     if (wctx->clientCtx != NULL && wctx->impl.free_client_ctx != NULL) {
       wctx->impl.free_client_ctx(wctx->clientCtx);
     }
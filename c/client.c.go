@@ -4,10 +4,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/psanford/wormhole-william/wormhole"
@@ -21,169 +27,341 @@ func main() {
 
 }
 
-type Command int
+type clientWithContext struct {
+	appContext PendingTransfer
+	client     *wormhole.Client
+}
 
-const (
-	DOWNLOAD Command = 0
-	REJECT   Command = 1
-	CANCEL   Command = 2
-)
+// addPendingTransfer registers a new cancellable transfer for the given
+// context. It returns the context to run the transfer with; the
+// transfer's handle is stored on the context.
+func addPendingTransfer(transfer PendingTransfer) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	transfer.SetTransferID(pendingTransfers.add(cancel))
+	return ctx
+}
 
-type transferContext struct {
-	Commands   chan Command
-	CancelFunc context.CancelFunc
+// goTransfer runs f in a goroutine that Finalize waits for before
+// freeing the transfer's context. f is not run if the transfer has
+// already been finalized.
+func goTransfer(transfer PendingTransfer, f func()) {
+	pendingTransfers.spawn(transfer.TransferID(), f)
 }
 
-type clientWithContext struct {
-	appContext PendingTransfer
-	client     *wormhole.Client
+func setLastError(transferID int32, errorMessage string) {
+	pendingTransfers.setLastError(transferID, errorMessage)
 }
 
-// true - disables direct tcp connection
-const NO_LISTEN = false
+func setCode(transferID int32, code string) {
+	pendingTransfers.setCode(transferID, code)
+}
 
-var pendingTransfers map[unsafe.Pointer]transferContext = map[unsafe.Pointer]transferContext{}
+func setReceivedText(transferID int32, text string) {
+	pendingTransfers.setReceivedText(transferID, text)
+}
 
-func addPendingTransfer(transferRef unsafe.Pointer, cancelFunc context.CancelFunc) {
-	pendingTransfers[transferRef] = transferContext{
-		Commands:   make(chan Command),
-		CancelFunc: cancelFunc,
+func setResult(transferID int32, result int32, text string) {
+	pendingTransfers.setResult(transferID, result, text)
+}
+
+// NewClientWithConfig allocates a context for a transfer that will use
+// the app ID, rendezvous server, transit relay and code length from
+// config. Strings in config are copied, so the caller keeps ownership of
+// them. Unset fields (NULL strings, a passphrase length of 0) fall back
+// to the public magic wormhole defaults.
+//
+// The returned context is passed to one of the Client* functions and is
+// released by Finalize.
+//
+//export NewClientWithConfig
+func NewClientWithConfig(config *C.client_config_t, impl *C.client_impl_t, clientCtx C.client_context_t) *C.wrapped_context_t {
+	wctx := C.new_wrapped_context(clientCtx, impl)
+	if wctx == nil {
+		return nil
 	}
+
+	client := newClientWithConfig(config)
+	wctx.config.app_id = C.CString(client.AppID)
+	wctx.config.rendezvous_url = C.CString(client.RendezvousURL)
+	wctx.config.transit_relay_url = C.CString(client.TransitRelayURL)
+	wctx.config.passphrase_length = C.int32_t(client.PassPhraseComponentLength)
+	if config != nil {
+		wctx.config.relay_only = config.relay_only
+	}
+
+	return wctx
 }
 
+// Finalize cancels the transfer using the context, if it is still
+// running, and releases the context. No callbacks are made for the
+// transfer once Finalize returns, other than free_client_ctx; a
+// callback in progress is waited for, so Finalize must not be called
+// from the context's own callbacks. The transfer's goroutines may
+// still be using the context once they notice the cancellation, so it
+// is freed in the background once they have exited.
+//
 //export Finalize
 func Finalize(transfer *C.wrapped_context_t) {
 	transfer.Log("Finalizing transfer: %p", transfer)
-	transferContext, ok := pendingTransfers[unsafe.Pointer(transfer)]
+	transferContext, ok := pendingTransfers.remove(transfer.TransferID())
 	if !ok {
 		panic("Finalizing an invalid transfer")
 	}
-	close(transferContext.Commands)
-	delete(pendingTransfers, unsafe.Pointer(transfer))
-	transfer.Finalize()
+	transferContext.CancelFunc()
+	go func() {
+		transferContext.goroutines.Wait()
+		transfer.Finalize()
+	}()
 }
 
-func sendText(transfer PendingTransfer, msg string) {
-	ctx := context.Background()
+// notifySendResult waits for the final result of a send and reports it
+// through the notify callback and TransferResult.
+func notifySendResult(ctx context.Context, transfer PendingTransfer, errType C.result_type_t, status chan wormhole.SendResult) {
+	select {
+	case s := <-status:
+		if s.Error != nil {
+			transfer.NotifyError(errType, s.Error)
+		} else if s.OK {
+			transfer.NotifySuccess()
+		} else {
+			transfer.NotifyError(errType, errors.New("Unknown error"))
+		}
+	case <-ctx.Done():
+		transfer.NotifyError(errType, context.Canceled)
+	}
+}
 
+func sendText(ctx context.Context, transfer PendingTransfer, msg string) {
 	code, status, err := transfer.NewClient().SendText(ctx, msg)
 
 	if err != nil {
-		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err.Error())
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
 		return
 	}
 
 	transfer.NotifyCodeGenerated(code)
 
-	go func() {
-		s := <-status
-		if s.Error != nil {
-			transfer.NotifyError(C.SendTextError, s.Error.Error())
-		} else if s.OK {
-			transfer.NotifySuccess()
-		} else {
-			transfer.NotifyError(C.SendTextError, "Unknown error")
-		}
-	}()
+	goTransfer(transfer, func() {
+		notifySendResult(ctx, transfer, C.SendTextError, status)
+	})
 }
 
+// ClientSendText sends a text message. Once the receiver has
+// acknowledged the message (or the send failed) the notify callback is
+// called with the final result, which can also be polled with
+// TransferResult. It returns a handle that can be passed to
+// CancelTransfer.
+//
 //export ClientSendText
-func ClientSendText(transfer *C.wrapped_context_t, msgC *C.char) {
+func ClientSendText(transfer *C.wrapped_context_t, msgC *C.char) C.int32_t {
 	msg := C.GoString(msgC)
-	go sendText(transfer, msg)
+	ctx := addPendingTransfer(transfer)
+	goTransfer(transfer, func() {
+		sendText(ctx, transfer, msg)
+	})
+	return C.int32_t(transfer.TransferID())
 }
 
-func sendFile(transfer PendingTransfer, fileName string) {
-	ctx, cancel := context.WithCancel(context.Background())
-	var logFunc wormhole.LogFunc = transfer.Log
-	ctx = context.WithValue(ctx, "log-func", logFunc)
-	addPendingTransfer(transfer.Reference(), cancel)
-	transferRef := transfer.Reference()
-
+func sendFile(ctx context.Context, transfer PendingTransfer, fileName string) {
 	reader, err := NewNativeReader(transfer)
 
 	if err != nil {
-		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err.Error())
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
 		return
 	}
 
-	code, status, err := transfer.NewClient().SendFile(ctx, fileName, reader, NO_LISTEN, wormhole.WithProgress(transfer.UpdateProgress))
+	code, status, err := transfer.NewClient().SendFile(ctx, fileName, reader, transfer.RelayOnly(), wormhole.WithProgress(transfer.UpdateProgress))
 
 	if err != nil {
-		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err.Error())
+		reader.Close()
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
 		return
 	}
 
 	transfer.NotifyCodeGenerated(code)
 
-	go func() {
-		for msg := range pendingTransfers[transferRef].Commands {
-			switch msg {
-			case CANCEL:
-				reader.Close()
-				// TODO this is sent because the current implementation of the client
-				// does not put an error when the context is cancelled before the
-				// transfer has started
-				// This can be removed if/when the client implements that behaviour
-				status <- wormhole.SendResult{
-					Error: fmt.Errorf(ERR_CONTEXT_CANCELLED),
-				}
-				pendingTransfers[transferRef].CancelFunc()
+	goTransfer(transfer, func() {
+		// The client does not report an error when the context is
+		// cancelled before the transfer has started, so report the
+		// cancellation ourselves rather than waiting on status.
+		select {
+		case s := <-status:
+			reader.Close()
+			if s.Error != nil {
+				transfer.NotifyError(C.SendFileError, s.Error)
+			} else if s.OK {
+				transfer.NotifySuccess()
+			} else {
+				transfer.NotifyError(C.SendFileError, errors.New("Unknown error"))
 			}
+		case <-ctx.Done():
+			reader.Close()
+			transfer.NotifyError(C.SendFileError, context.Canceled)
 		}
-	}()
-
-	go func() {
-		s := <-status
-		if s.Error != nil {
-			transfer.NotifyError(C.SendFileError, s.Error.Error())
-		} else if s.OK {
-			transfer.NotifySuccess()
-		} else {
-			transfer.NotifyError(C.SendFileError, "Unknown error")
-		}
-	}()
+	})
 }
 
+// ClientSendFile sends the file read through the context's read and
+// seek callbacks. It returns a handle that can be passed to
+// CancelTransfer.
+//
 //export ClientSendFile
-func ClientSendFile(transfer *C.wrapped_context_t, fileNameC *C.char) {
+func ClientSendFile(transfer *C.wrapped_context_t, fileNameC *C.char) C.int32_t {
 	fileName := C.GoString(fileNameC)
-	go sendFile(transfer, fileName)
+	ctx := addPendingTransfer(transfer)
+	goTransfer(transfer, func() {
+		sendFile(ctx, transfer, fileName)
+	})
+	return C.int32_t(transfer.TransferID())
 }
 
-func receiveText(transfer PendingTransfer, code string) {
-	ctx := context.Background()
+func sendBuffer(ctx context.Context, transfer PendingTransfer, fileName string, data []byte) {
+	code, status, err := transfer.NewClient().SendFile(ctx, fileName, bytes.NewReader(data), transfer.RelayOnly(), wormhole.WithProgress(transfer.UpdateProgress))
+	if err != nil {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
+		return
+	}
+
+	transfer.NotifyCodeGenerated(code)
+
+	goTransfer(transfer, func() {
+		notifySendResult(ctx, transfer, C.SendFileError, status)
+	})
+}
+
+// ClientSendBuffer sends length bytes starting at buffer as a file named
+// fileName. The bytes are copied before ClientSendBuffer returns, so the
+// caller may reuse buffer immediately. It returns a handle that can be
+// passed to CancelTransfer.
+//
+//export ClientSendBuffer
+func ClientSendBuffer(transfer *C.wrapped_context_t, fileNameC *C.char, buffer *C.uint8_t, length C.int64_t) C.int32_t {
+	fileName := C.GoString(fileNameC)
+	ctx := addPendingTransfer(transfer)
+
+	if length < 0 || length > MAX_BUFFER_LEN {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, fmt.Errorf("buffer length %d out of range", int64(length)))
+		return C.int32_t(transfer.TransferID())
+	}
+
+	data := C.GoBytes(unsafe.Pointer(buffer), C.int(length))
+	goTransfer(transfer, func() {
+		sendBuffer(ctx, transfer, fileName, data)
+	})
+	return C.int32_t(transfer.TransferID())
+}
 
+func receiveText(ctx context.Context, transfer PendingTransfer, code string) {
 	msg, err := transfer.NewClient().Receive(ctx, code, false)
 	if err != nil {
-		transfer.NotifyError(C.ReceiveTextError, err.Error())
+		transfer.NotifyError(C.ReceiveTextError, err)
 		return
 	}
 
 	data, err := ioutil.ReadAll(msg)
 	if err != nil {
-		transfer.NotifyError(C.ReceiveTextError, err.Error())
+		transfer.NotifyError(C.ReceiveTextError, err)
 		return
 	}
 
 	transfer.TextReceived(string(data))
 }
 
+func sendDirectory(ctx context.Context, transfer PendingTransfer, dirPath string) {
+	dirPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
+		return
+	}
+
+	stat, err := os.Stat(dirPath)
+	if err != nil {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
+		return
+	}
+	if !stat.IsDir() {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, fmt.Errorf("%s is not a directory", dirPath))
+		return
+	}
+
+	prefix, dirName := filepath.Split(dirPath)
+
+	var entries []wormhole.DirectoryEntry
+	err = filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		entries = append(entries, wormhole.DirectoryEntry{
+			Path: strings.TrimPrefix(path, prefix),
+			Mode: info.Mode(),
+			Reader: func() (io.ReadCloser, error) {
+				return os.Open(path)
+			},
+		})
+
+		return nil
+	})
+	if err != nil {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
+		return
+	}
+
+	code, status, err := transfer.NewClient().SendDirectory(ctx, dirName, entries, transfer.RelayOnly(), wormhole.WithProgress(transfer.UpdateProgress))
+	if err != nil {
+		transfer.NotifyCodeGenerationFailure(C.CodeGenerationFailed, err)
+		return
+	}
+
+	transfer.NotifyCodeGenerated(code)
+
+	goTransfer(transfer, func() {
+		notifySendResult(ctx, transfer, C.SendDirectoryError, status)
+	})
+}
+
+// ClientSendDirectory zips and sends the directory at dirPath, skipping
+// anything that isn't a regular file. Progress and the final result are
+// reported through the context's update_progress and notify callbacks.
+// It returns a handle that can be passed to CancelTransfer.
+//
+//export ClientSendDirectory
+func ClientSendDirectory(transfer *C.wrapped_context_t, dirPathC *C.char) C.int32_t {
+	dirPath := C.GoString(dirPathC)
+	ctx := addPendingTransfer(transfer)
+	goTransfer(transfer, func() {
+		sendDirectory(ctx, transfer, dirPath)
+	})
+	return C.int32_t(transfer.TransferID())
+}
+
+// ClientRecvText receives a text message. It returns a handle that can
+// be passed to CancelTransfer.
+//
 //export ClientRecvText
-func ClientRecvText(transfer *C.wrapped_context_t, codeC *C.char) {
+func ClientRecvText(transfer *C.wrapped_context_t, codeC *C.char) C.int32_t {
 	code := C.GoString(codeC)
-	go receiveText(transfer, code)
+	ctx := addPendingTransfer(transfer)
+	goTransfer(transfer, func() {
+		receiveText(ctx, transfer, code)
+	})
+	return C.int32_t(transfer.TransferID())
 }
 
-func recvFile(transfer PendingTransfer, code string) {
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	addPendingTransfer(transfer.Reference(), cancelFunc)
-	downloadId := transfer.Reference()
+func recvFile(ctx context.Context, transfer PendingTransfer, code string) {
+	transferContext, ok := pendingTransfers.get(transfer.TransferID())
+	if !ok {
+		return
+	}
 
-	msg, err := transfer.NewClient().Receive(ctx, code, NO_LISTEN, wormhole.WithProgress(transfer.UpdateProgress))
+	msg, err := transfer.NewClient().Receive(ctx, code, transfer.RelayOnly(), wormhole.WithProgress(transfer.UpdateProgress))
 
 	if err != nil {
-		transfer.NotifyError(C.ReceiveFileError, err.Error())
+		transfer.NotifyError(C.ReceiveFileError, err)
 		return
 	}
 
@@ -192,7 +370,7 @@ func recvFile(transfer PendingTransfer, code string) {
 	download := func() {
 		c_buffer, err := transfer.Malloc(MAX_READ_BUFFER_LEN)
 		if err != nil {
-			transfer.NotifyError(C.ReceiveFileError, err.Error())
+			transfer.NotifyError(C.ReceiveFileError, err)
 			return
 		}
 		defer C.free(c_buffer)
@@ -213,7 +391,7 @@ func recvFile(transfer PendingTransfer, code string) {
 		}
 
 		if err != nil && err != io.EOF {
-			transfer.NotifyError(C.ReceiveFileError, err.Error())
+			transfer.NotifyError(C.ReceiveFileError, err)
 			return
 		}
 
@@ -222,40 +400,254 @@ func recvFile(transfer PendingTransfer, code string) {
 
 	reject := func() {
 		msg.Reject()
-		transfer.NotifyError(C.TransferRejected, "Transfer rejected")
+		transfer.NotifyError(C.TransferRejected, errors.New("Transfer rejected"))
 	}
 
-	go func() {
-		for response := range pendingTransfers[downloadId].Commands {
-			switch response {
-			case DOWNLOAD:
-				go download()
-			case REJECT:
-				reject()
-			case CANCEL:
-				pendingTransfers[downloadId].CancelFunc()
+	goTransfer(transfer, func() {
+		for {
+			select {
+			case response := <-transferContext.Commands:
+				switch response {
+				case DOWNLOAD:
+					goTransfer(transfer, download)
+				case REJECT:
+					reject()
+				}
+			case <-transferContext.done:
+				return
 			}
 		}
-	}()
+	})
 }
 
+// ClientRecvFile receives a file, handing its metadata to the context's
+// update_metadata callback. The transfer then waits for AcceptDownload
+// or RejectDownload to be called with the returned handle.
+//
 //export ClientRecvFile
-func ClientRecvFile(pendingTransfer *C.wrapped_context_t, codeC *C.char) {
+func ClientRecvFile(pendingTransfer *C.wrapped_context_t, codeC *C.char) C.int32_t {
+	code := C.GoString(codeC)
+	ctx := addPendingTransfer(pendingTransfer)
+	goTransfer(pendingTransfer, func() {
+		recvFile(ctx, pendingTransfer, code)
+	})
+	return C.int32_t(pendingTransfer.TransferID())
+}
+
+func recvBuffer(ctx context.Context, transfer PendingTransfer, code string, buffer []byte) {
+	msg, err := transfer.NewClient().Receive(ctx, code, transfer.RelayOnly(), wormhole.WithProgress(transfer.UpdateProgress))
+	if err != nil {
+		transfer.NotifyError(C.ReceiveFileError, err)
+		return
+	}
+
+	var errType C.result_type_t = C.ReceiveFileError
+	if msg.Type == wormhole.TransferText {
+		errType = C.ReceiveTextError
+	}
+
+	transfer.UpdateMetadata(msg.Name, msg.UncompressedBytes64)
+
+	if msg.TransferBytes64 > int64(len(buffer)) {
+		msg.Reject()
+		transfer.NotifyError(errType, fmt.Errorf("transfer of %d bytes does not fit in buffer of %d bytes", msg.TransferBytes64, len(buffer)))
+		return
+	}
+
+	n, err := io.ReadFull(msg, buffer[:msg.TransferBytes64])
+	if err != nil {
+		transfer.NotifyError(errType, err)
+		return
+	}
+
+	// io.ReadFull never calls Read for empty files, so read once more to
+	// make sure the final ack is sent to the sender
+	if _, err := msg.Read(buffer[n:]); err != nil && err != io.EOF {
+		transfer.NotifyError(errType, err)
+		return
+	}
+
+	transfer.BufferReceived(n)
+}
+
+// ClientRecvBuffer receives a text message or file into the caller
+// provided buffer of capacity bytes. Transfers larger than capacity are
+// rejected. Otherwise the transfer is accepted without waiting for
+// AcceptDownload, and on success the notify callback's
+// result.buffer_length holds the number of bytes written to buffer.
+//
+// buffer must stay valid until the notify callback has been called.
+// It returns a handle that can be passed to CancelTransfer.
+//
+//export ClientRecvBuffer
+func ClientRecvBuffer(transfer *C.wrapped_context_t, codeC *C.char, buffer *C.uint8_t, capacity C.int64_t) C.int32_t {
 	code := C.GoString(codeC)
-	go recvFile(pendingTransfer, code)
+	ctx := addPendingTransfer(transfer)
+
+	if capacity < 0 || capacity > MAX_BUFFER_LEN {
+		transfer.NotifyError(C.ReceiveFileError, fmt.Errorf("buffer capacity %d out of range", int64(capacity)))
+		return C.int32_t(transfer.TransferID())
+	}
+
+	goBuffer := (*[MAX_BUFFER_LEN]byte)(unsafe.Pointer(buffer))[:capacity:capacity]
+	goTransfer(transfer, func() {
+		recvBuffer(ctx, transfer, code, goBuffer)
+	})
+	return C.int32_t(transfer.TransferID())
 }
 
 //export AcceptDownload
-func AcceptDownload(transferRef unsafe.Pointer) {
-	pendingTransfers[transferRef].Commands <- DOWNLOAD
+func AcceptDownload(transferID C.int32_t) {
+	pendingTransfers.sendCommand(int32(transferID), DOWNLOAD)
 }
 
 //export RejectDownload
-func RejectDownload(transferRef unsafe.Pointer) {
-	pendingTransfers[transferRef].Commands <- REJECT
+func RejectDownload(transferID C.int32_t) {
+	pendingTransfers.sendCommand(int32(transferID), REJECT)
+}
+
+// LastErrorMessage returns the Go error text of the most recent failure
+// of the transfer with the given handle, or NULL if it has not failed.
+// The result_type passed to the notify callbacks is a coarse
+// classification of this error.
+//
+// The returned string is owned by the caller and must be released with
+// WormholeFreeString. Errors are only retained until the transfer is
+// finalized.
+//
+//export LastErrorMessage
+func LastErrorMessage(transferID C.int32_t) *C.char {
+	errorMessage := pendingTransfers.lastError(int32(transferID))
+	if errorMessage == "" {
+		return nil
+	}
+	return C.CString(errorMessage)
+}
+
+// TransferCode returns the wormhole code of the send with the given
+// handle, or NULL while the mailbox is still being created. The Client*
+// send functions return before connecting to the rendezvous server;
+// the code is delivered through the notify_codegen callback and can
+// also be polled here.
+//
+// The returned string is owned by the caller and must be released with
+// WormholeFreeString.
+//
+//export TransferCode
+func TransferCode(transferID C.int32_t) *C.char {
+	code := pendingTransfers.code(int32(transferID))
+	if code == "" {
+		return nil
+	}
+	return C.CString(code)
+}
+
+// ReceivedText returns the text received by the ClientRecvText transfer
+// with the given handle as a buffer of *length bytes. Unlike
+// result.received_text it is not NUL terminated, so text containing NUL
+// bytes can be read without the separate length field. It returns NULL
+// and sets *length to 0 if no text has been received, or the text is
+// empty.
+//
+// The returned buffer is owned by the caller and must be released with
+// WormholeFreeBuffer. Received text is only retained until the transfer
+// is finalized.
+//
+//export ReceivedText
+func ReceivedText(transferID C.int32_t, length *C.int64_t) *C.uint8_t {
+	text := pendingTransfers.receivedText(int32(transferID))
+	*length = C.int64_t(len(text))
+	if text == "" {
+		return nil
+	}
+	return (*C.uint8_t)(C.CBytes([]byte(text)))
+}
+
+// TransferResult returns the final result of the transfer with the
+// given handle: a result_type_t once the notify callback has been
+// called, or a codegen_result_type_t if no code could be allocated.
+// While the transfer is still running it returns TransferInProgress,
+// and UnknownTransfer for handles that were never issued or have been
+// finalized.
+//
+//export TransferResult
+func TransferResult(transferID C.int32_t) C.int32_t {
+	result, finished, ok := pendingTransfers.result(int32(transferID))
+	if !ok {
+		return C.UnknownTransfer
+	}
+	if !finished {
+		return C.TransferInProgress
+	}
+	return C.int32_t(result)
 }
 
+// WormholeNextEvent is a polling alternative to the callbacks in
+// client_impl_t for runtimes that can't be called back from foreign
+// threads. It fills event with the oldest event of the transfer with
+// the given handle, waiting up to timeoutMillis for one to arrive (a
+// negative timeout waits indefinitely, 0 doesn't wait at all).
+// Consecutive progress events are merged, so only the latest progress
+// is reported.
+//
+// It returns 1 if event was filled, 0 on timeout and -1 for unknown or
+// finalized handles. event->text is owned by the caller and must be
+// released with WormholeFreeString.
+//
+//export WormholeNextEvent
+func WormholeNextEvent(transferID C.int32_t, timeoutMillis C.int32_t, event *C.event_t) C.int32_t {
+	t, ok := pendingTransfers.get(int32(transferID))
+	if !ok {
+		return -1
+	}
+
+	timeout := time.Duration(timeoutMillis) * time.Millisecond
+	e, ok := t.Events.next(timeout, t.done)
+	if !ok {
+		select {
+		case <-t.done:
+			return -1
+		default:
+			return 0
+		}
+	}
+
+	event.event_type = C.event_type_t(e.Type)
+	event.transfer_id = transferID
+	event.text = nil
+	if e.Text != "" {
+		event.text = C.CString(e.Text)
+	}
+	event.text_length = C.int64_t(len(e.Text))
+	event.progress.transferred_bytes = C.int64_t(e.Done)
+	event.progress.total_bytes = C.int64_t(e.Total)
+	event.result_type = C.int32_t(e.Result)
+	return 1
+}
+
+// WormholeFreeString releases a string returned by this library to the
+// caller. It must not be used on strings owned by a context.
+//
+//export WormholeFreeString
+func WormholeFreeString(str *C.char) {
+	C.free(unsafe.Pointer(str))
+}
+
+// WormholeFreeBuffer releases a byte buffer returned by this library to
+// the caller. It must not be used on buffers owned by a context.
+//
+//export WormholeFreeBuffer
+func WormholeFreeBuffer(buffer *C.uint8_t) {
+	C.free(unsafe.Pointer(buffer))
+}
+
+// CancelTransfer cancels the context of the transfer with the given
+// handle. The transfer's notify callback is called with
+// TransferCancelled (or the error the transfer was interrupted with).
+//
 //export CancelTransfer
-func CancelTransfer(transferRef unsafe.Pointer) {
-	pendingTransfers[transferRef].Commands <- CANCEL
+func CancelTransfer(transferID C.int32_t) {
+	if transfer, ok := pendingTransfers.get(int32(transferID)); ok {
+		transfer.CancelFunc()
+	}
 }
@@ -18,14 +18,29 @@ typedef struct {
   char *rendezvous_url;
   char *transit_relay_url;
   int32_t passphrase_length;
+  // disables listening for direct connections, all file transfers go
+  // through the transit relay
+  bool relay_only;
 } client_config_t;
 
+// Strings and buffers referenced from the structs below are owned by the
+// wrapped_context_t they are delivered through. They stay valid until the
+// context is released with Finalize and must not be freed by the caller.
+// Values returned directly from an exported function (LastErrorMessage,
+// ReceivedText) are owned by the caller and must be released with
+// WormholeFreeString or WormholeFreeBuffer.
+
 typedef struct {
   int64_t length;
+  // owned by the context
   char *file_name;
 } file_metadata_t;
 
 typedef enum {
+  // returned by TransferResult for transfers that haven't finished yet
+  TransferInProgress = -1,
+  // returned by TransferResult for unknown or finalized handles
+  UnknownTransfer = -2,
   Success = 0,
   SendFileError = 1,
   ReceiveFileError = 2,
@@ -37,27 +52,44 @@ typedef enum {
   TransferCancelledByReceiver = 8,
   TransferCancelledBySender = 9,
   ConnectionRefused = 10,
+  SendDirectoryError = 13,
+  // no direct or relayed connection to the peer could be established
+  TransitFailed = 14,
+  Timeout = 15,
 } result_type_t;
 
 typedef struct {
   result_type_t result_type;
+  // owned by the context
   char *err_string;
+  // owned by the context. NUL terminated, but may also contain NUL bytes
+  // of its own; received_text_length is the length without the
+  // terminator.
   char *received_text;
+  int64_t received_text_length;
+  // number of bytes written to the caller's buffer by ClientRecvBuffer
+  int64_t buffer_length;
 } result_t;
 
 typedef enum {
   CodeGenSuccessful = 0,
   // keep unique enum for all errors
   FailedToGetClient = 11,
-  CodeGenerationFailed = 12
+  CodeGenerationFailed = 12,
+  // same values as the matching result_type_t
+  CodeGenTransferCancelled = 6,
+  CodeGenConnectionRefused = 10,
+  CodeGenTimeout = 15,
 } codegen_result_type_t;
 
 typedef struct {
   codegen_result_type_t result_type;
   struct {
+    // owned by the context
     char *error_string;
   } error;
   struct {
+    // owned by the context
     char *code;
     int32_t transfer_id;
   } generated;
@@ -68,6 +100,28 @@ typedef struct {
   int64_t total_bytes;
 } progress_t;
 
+typedef enum {
+  EventCodeReady = 1,
+  EventProgress = 2,
+  EventVerifier = 3,
+  EventCompleted = 4,
+} event_type_t;
+
+// An event returned by WormholeNextEvent.
+typedef struct {
+  event_type_t event_type;
+  int32_t transfer_id;
+  // EventCodeReady: the code. EventVerifier: the verifier.
+  // EventCompleted: the error message or received text, if any.
+  // Owned by the caller, may be NULL.
+  char *text;
+  int64_t text_length;
+  // EventProgress
+  progress_t progress;
+  // EventCompleted: the result_type_t or codegen_result_type_t
+  int32_t result_type;
+} event_t;
+
 typedef struct {
   int64_t bytes_read;
   const char *error_msg;
@@ -78,6 +132,13 @@ typedef struct {
   const char *error_msg;
 } seek_result_t;
 
+// The Client* transfer functions never block on the network: they return
+// a transfer handle straight away and report the allocated code, progress
+// and result through these callbacks, which are called from Go threads.
+// No callbacks are made for a context once Finalize has returned, and a
+// callback must not call Finalize for the context it is called for.
+// Callers that poll with WormholeNextEvent instead may leave notify,
+// notify_codegen, update_progress, update_metadata and log NULL.
 typedef void (*notifyf)(void *context, result_t *result);
 typedef void (*notifycodegenf)(void *context, codegen_result_t *result);
 typedef void (*update_progressf)(void *context, progress_t *progress);
@@ -106,6 +167,8 @@ typedef struct {
 
 typedef struct _wrapped_context_t {
   client_context_t clientCtx;
+  // handle of the transfer using this context, see CancelTransfer
+  int32_t transfer_id;
 
   client_impl_t impl;
   client_config_t config;
@@ -129,6 +192,9 @@ char *call_write(wrapped_context_t *context, uint8_t *buffer, int32_t length);
 
 void call_log(wrapped_context_t *context, char *msg);
 
+wrapped_context_t *new_wrapped_context(client_context_t clientCtx,
+                                       client_impl_t *impl);
+
 DLL_EXPORT void free_wrapped_context(wrapped_context_t *wctx);
 DLL_EXPORT void free_codegen_result(codegen_result_t *codegen_result);
 DLL_EXPORT void *malloc_or_handle(wrapped_context_t *wctx, size_t len);
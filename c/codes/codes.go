@@ -1,7 +1,18 @@
 package codes
 
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
 type Code int
 
+// The numeric values of these codes are handed to native callers, so
+// new codes must only ever be appended.
 const (
 	ERR_UNKNOWN = Code(iota) - 1
 	OK
@@ -14,6 +25,13 @@ const (
 	ERR_SEND_FILE_RESULT
 	ERR_RECV_FILE
 	ERR_RECV_FILE_DATA
+	ERR_RENDEZVOUS_CONNECT
+	ERR_WRONG_CODE
+	ERR_REJECTED
+	ERR_TRANSIT
+	ERR_CANCELLED
+	ERR_TIMEOUT
+	ERR_PEER_CANCELLED
 )
 
 func (c Code) String() string {
@@ -40,6 +58,75 @@ func (c Code) String() string {
 		return "error during file receive"
 	case ERR_RECV_FILE_DATA:
 		return "error during file receive reading data"
+	case ERR_RENDEZVOUS_CONNECT:
+		return "failed to connect to rendezvous server"
+	case ERR_WRONG_CODE:
+		return "wrong code or decryption failed"
+	case ERR_REJECTED:
+		return "transfer rejected by peer"
+	case ERR_TRANSIT:
+		return "transit connection failed"
+	case ERR_CANCELLED:
+		return "transfer cancelled"
+	case ERR_TIMEOUT:
+		return "transfer timed out"
+	case ERR_PEER_CANCELLED:
+		return "transfer cancelled by peer"
 	}
 	return "unknown error"
 }
+
+// FromError classifies err into one of the fine-grained error codes.
+// It is the only classifier used by the native and wasm bindings, so
+// an error is reported with the same code by both. Errors that don't
+// match any of the codes are reported as fallback; a nil err is OK.
+func FromError(err error, fallback Code) Code {
+	if err == nil {
+		return OK
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ERR_CANCELLED
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return ERR_TIMEOUT
+	}
+
+	var te *wormhole.TransferError
+	if errors.As(err, &te) {
+		switch te.Code {
+		case wormhole.CodeCanceled:
+			return ERR_CANCELLED
+		case wormhole.CodeTimeout:
+			return ERR_TIMEOUT
+		case wormhole.CodeNameplateUnclaimed, wormhole.CodeWrongCode:
+			return ERR_WRONG_CODE
+		case wormhole.CodeRejected, wormhole.CodeDeclined:
+			return ERR_REJECTED
+		case wormhole.CodeTransitFailed:
+			return ERR_TRANSIT
+		case wormhole.CodeNetwork:
+			switch te.Phase {
+			case wormhole.PhaseRendezvous:
+				return ERR_RENDEZVOUS_CONNECT
+			case wormhole.PhaseData:
+				// the peer went away in the middle of the transfer
+				return ERR_PEER_CANCELLED
+			}
+		}
+	}
+
+	if errors.Is(err, wormhole.ErrOfferDeclined) {
+		return ERR_REJECTED
+	} else if errors.Is(err, wormhole.ErrPeerTimeout) {
+		return ERR_TIMEOUT
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		return ERR_PEER_CANCELLED
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ERR_TIMEOUT
+	}
+
+	return fallback
+}
@@ -0,0 +1,97 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// eventType mirrors event_type_t in client.h.
+type eventType int32
+
+const (
+	EVENT_CODE_READY eventType = 1
+	EVENT_PROGRESS   eventType = 2
+	EVENT_VERIFIER   eventType = 3
+	EVENT_COMPLETED  eventType = 4
+)
+
+type transferEvent struct {
+	Type eventType
+	// Text is the code, verifier, error message or received text,
+	// depending on Type.
+	Text   string
+	Done   int64
+	Total  int64
+	Result int32
+}
+
+// eventQueue buffers the events of a transfer for WormholeNextEvent.
+// Consecutive progress events are merged so the queue stays small
+// when the caller only uses callbacks and never polls.
+type eventQueue struct {
+	mu     sync.Mutex
+	events []transferEvent
+	ready  chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *eventQueue) push(e transferEvent) {
+	q.mu.Lock()
+	if n := len(q.events); n > 0 && e.Type == EVENT_PROGRESS && q.events[n-1].Type == EVENT_PROGRESS {
+		q.events[n-1] = e
+	} else {
+		q.events = append(q.events, e)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *eventQueue) pop() (transferEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.events) == 0 {
+		return transferEvent{}, false
+	}
+	e := q.events[0]
+	q.events = q.events[1:]
+	return e, true
+}
+
+// next returns the oldest queued event, waiting up to timeout for one
+// to arrive. A negative timeout waits until an event arrives or done
+// is closed.
+func (q *eventQueue) next(timeout time.Duration, done <-chan struct{}) (transferEvent, bool) {
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		if e, ok := q.pop(); ok {
+			return e, true
+		}
+
+		select {
+		case <-q.ready:
+		case <-expired:
+			return q.pop()
+		case <-done:
+			return q.pop()
+		}
+	}
+}
@@ -6,6 +6,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"sync"
 	"unsafe"
 )
 
@@ -15,6 +16,10 @@ import "C"
 
 const MAX_READ_BUFFER_LEN = 1024 * 64
 
+// MAX_BUFFER_LEN is the largest caller provided buffer accepted by
+// ClientSendBuffer and ClientRecvBuffer.
+const MAX_BUFFER_LEN = 1 << 30
+
 // TODO this is added in lieu of io.ReadSeekCloser
 // which isn't available on older Go versions of the io package
 type ReadSeekCloser interface {
@@ -22,11 +27,16 @@ type ReadSeekCloser interface {
 	Close() error
 }
 
+// native_reader reads through the context's read and seek callbacks.
+// It may be closed while another goroutine is reading from it, so mu
+// keeps Close from freeing the buffer under a read in progress.
 type native_reader struct {
 	context      PendingTransfer
 	buffer       *C.uint8_t
 	bufferLength int
-	closed       bool
+
+	mu     sync.Mutex
+	closed bool
 }
 
 func NewNativeReader(ctx PendingTransfer) (ReadSeekCloser, error) {
@@ -34,21 +44,29 @@ func NewNativeReader(ctx PendingTransfer) (ReadSeekCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	return native_reader{
+	return &native_reader{
 		context:      ctx,
 		buffer:       (*C.uint8_t)(buffer),
 		bufferLength: MAX_READ_BUFFER_LEN,
-		closed:       false,
 	}, nil
 }
 
-func (r native_reader) Close() error {
+func (r *native_reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
 	C.free((unsafe.Pointer)(r.buffer))
 	r.closed = true
 	return nil
 }
 
-func (r native_reader) Read(buffer []byte) (int, error) {
+func (r *native_reader) Read(buffer []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.closed {
 		return 0, fmt.Errorf("Reading from a closed reader")
 	}
@@ -72,7 +90,10 @@ func (r native_reader) Read(buffer []byte) (int, error) {
 
 }
 
-func (r native_reader) Seek(offset int64, whence int) (int64, error) {
+func (r *native_reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.closed {
 		return 0, fmt.Errorf("Seeking from a closed reader")
 	}
@@ -0,0 +1,251 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+type Command int
+
+const (
+	DOWNLOAD Command = 0
+	REJECT   Command = 1
+)
+
+type transferContext struct {
+	Commands   chan Command
+	CancelFunc context.CancelFunc
+	// LastError is the full text of the most recent error reported
+	// for the transfer, see LastErrorMessage.
+	LastError string
+	// Code is the wormhole code allocated for a send, once the
+	// mailbox has been created.
+	Code string
+	// ReceivedText is the text received by ClientRecvText, see
+	// ReceivedText.
+	ReceivedText string
+	// Result is the result_type_t (or codegen_result_type_t) the
+	// transfer finished with. It is only meaningful once Finished is set.
+	Result   int32
+	Finished bool
+
+	// Events queues the transfer's events for WormholeNextEvent.
+	Events *eventQueue
+
+	// done is closed when the transfer is finalized so that senders
+	// on Commands don't block forever.
+	done chan struct{}
+	// goroutines counts the goroutines using the transfer's wrapped
+	// context, which is only freed once they have all exited.
+	goroutines sync.WaitGroup
+
+	// callbackMu is held while one of the caller's callbacks runs for
+	// the transfer, and by remove, so that no callback is made once
+	// the transfer has been finalized.
+	callbackMu sync.Mutex
+	removed    bool
+}
+
+// transferRegistry maps the opaque handles given out to C callers to
+// their transfers. Handles are never reused and all methods are safe
+// to call from multiple threads.
+type transferRegistry struct {
+	mu        sync.Mutex
+	lastID    int32
+	transfers map[int32]*transferContext
+}
+
+var pendingTransfers = &transferRegistry{
+	transfers: make(map[int32]*transferContext),
+}
+
+func (r *transferRegistry) add(cancel context.CancelFunc) int32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID++
+	r.transfers[r.lastID] = &transferContext{
+		Commands:   make(chan Command),
+		CancelFunc: cancel,
+		Events:     newEventQueue(),
+		done:       make(chan struct{}),
+	}
+	return r.lastID
+}
+
+func (r *transferRegistry) get(id int32) (*transferContext, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.transfers[id]
+	return t, ok
+}
+
+// spawn runs f in a new goroutine counted in the transfer's goroutines.
+// It returns false without running f if the transfer has already been
+// finalized.
+func (r *transferRegistry) spawn(id int32, f func()) bool {
+	r.mu.Lock()
+	t, ok := r.transfers[id]
+	if ok {
+		t.goroutines.Add(1)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	go func() {
+		defer t.goroutines.Done()
+		f()
+	}()
+	return true
+}
+
+// remove unregisters the transfer with the given handle. It waits for
+// a callback in progress for the transfer to return, and no callbacks
+// are made for it afterwards.
+func (r *transferRegistry) remove(id int32) (*transferContext, bool) {
+	r.mu.Lock()
+	t, ok := r.transfers[id]
+	if ok {
+		delete(r.transfers, id)
+		close(t.done)
+	}
+	r.mu.Unlock()
+
+	if ok {
+		t.callbackMu.Lock()
+		t.removed = true
+		t.callbackMu.Unlock()
+	}
+	return t, ok
+}
+
+// callback runs f, which calls into the caller's callbacks for the
+// transfer with the given handle, unless the transfer has been
+// finalized. It reports whether f was run.
+func (r *transferRegistry) callback(id int32, f func()) bool {
+	t, ok := r.get(id)
+	if !ok {
+		return false
+	}
+
+	t.callbackMu.Lock()
+	defer t.callbackMu.Unlock()
+	if t.removed {
+		return false
+	}
+	f()
+	return true
+}
+
+func (r *transferRegistry) setLastError(id int32, errorMessage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		t.LastError = errorMessage
+	}
+}
+
+func (r *transferRegistry) lastError(id int32) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		return t.LastError
+	}
+	return ""
+}
+
+func (r *transferRegistry) setCode(id int32, code string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		t.Code = code
+		t.Events.push(transferEvent{Type: EVENT_CODE_READY, Text: code})
+	}
+}
+
+func (r *transferRegistry) code(id int32) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		return t.Code
+	}
+	return ""
+}
+
+func (r *transferRegistry) setReceivedText(id int32, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		t.ReceivedText = text
+	}
+}
+
+func (r *transferRegistry) receivedText(id int32) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		return t.ReceivedText
+	}
+	return ""
+}
+
+// setResult records the final result of a transfer. text is the error
+// message or received text passed along with the completion event.
+func (r *transferRegistry) setResult(id int32, result int32, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.transfers[id]; ok {
+		t.Result = result
+		t.Finished = true
+		t.Events.push(transferEvent{Type: EVENT_COMPLETED, Text: text, Result: result})
+	}
+}
+
+// pushEvent queues e for the transfer with the given handle, if it
+// still exists.
+func (r *transferRegistry) pushEvent(id int32, e transferEvent) {
+	if t, ok := r.get(id); ok {
+		t.Events.push(e)
+	}
+}
+
+func (r *transferRegistry) result(id int32) (result int32, finished bool, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.transfers[id]
+	if !ok {
+		return 0, false, false
+	}
+	return t.Result, t.Finished, true
+}
+
+// sendCommand delivers cmd to the transfer with the given handle. It
+// returns false if there is no such transfer or it was finalized
+// before the command was picked up.
+func (r *transferRegistry) sendCommand(id int32, cmd Command) bool {
+	t, ok := r.get(id)
+	if !ok {
+		return false
+	}
+
+	select {
+	case t.Commands <- cmd:
+		return true
+	case <-t.done:
+		return false
+	}
+}
@@ -4,10 +4,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strings"
+	"sync"
 	"unsafe"
 
+	"github.com/psanford/wormhole-william/c/codes"
 	"github.com/psanford/wormhole-william/wormhole"
 )
 
@@ -15,33 +17,6 @@ import (
 // #include "client.h"
 import "C"
 
-const (
-	// use cases: (1) sender cancels from frontend, Sender gets error
-	ERR_CONTEXT_CANCELLED = "context canceled"
-	// use cases: (1) receiver terminates transfer, Sender gets error; (2) network iterruption?
-	ERR_BROKEN_PIPE = "write: broken pipe"
-	// use cases: (1) sender terminates transfer, Receiver gets error; (2) network iterruption?
-	ERR_UNEXPECTED_EOF = "unexpected EOF"
-	// use cases: (1) receiver (desktop) terminates transfer, sender (mobile) gets error
-	ERR_EOF = "EOF"
-	// use cases: (1) receiver (desktop) terminates transfer quickly after starting, sender (mobile) gets error
-	ERR_RESET_BY_PEER = "connection reset by peer"
-	// use cases: (1) receiver rejects offer, Sender and Receiver get error; (2) receiver fails to overwrite file, sender get error
-	ERR_TRANSFER_REJECTED    = "transfer rejected"
-	ERR_FAILED_TO_GET_READER = "failed to get reader"
-	// use cases: (1) receiver enter wrong code, Sender and Receiver get error
-	ERR_WRONG_CODE = "decrypt message failed"
-	// use cases: (1) cannot connect to mailbox/relay
-	ERR_CONNECTION_REFUSED  = "connect: connection refused"
-	ERR_NETWORK_UNREACHABLE = "connect: network is unreachable"
-	ERR_FAILED_HANDSHAKE    = "failed to send handshake request"
-	ERR_NO_ADDRESS          = "No address associated with hostname"
-	// use cases: (1) receiver enters an incorrect nameplate
-	ERR_INVALID_NAMEPLATE = "Nameplate is unclaimed"
-	// use cases: (1) sender/receiver terminates network (air plane mode)
-	ERR_CONNECTION_ABORT = "connection abort"
-)
-
 const (
 	DEFAULT_APP_ID                      = "lothar.com/wormhole/text-or-file-xfer"
 	DEFAULT_RENDEZVOUS_URL              = "ws://relay.magic-wormhole.io:4000/v1"
@@ -52,74 +27,86 @@ const (
 type PendingTransfer interface {
 	Log(message string, args ...interface{})
 	UpdateProgress(done int64, total int64)
-	NotifyError(result C.result_type_t, errorMessage string)
+	NotifyError(result C.result_type_t, err error)
 	UpdateMetadata(fileName string, length int64)
 	Write(bytes unsafe.Pointer, length int) error
 	Read(buffer *C.uint8_t, length int) (int, error)
 	Seek(offset int64, whence int) (int64, error)
 	NotifySuccess()
 	TextReceived(text string)
+	BufferReceived(length int)
 	Finalize()
-	NotifyCodeGenerationFailure(errorCode C.codegen_result_type_t, errorMessage string)
+	NotifyCodeGenerationFailure(errorCode C.codegen_result_type_t, err error)
 	NotifyCodeGenerated(code string)
 	NewClient() *wormhole.Client
-	Reference() unsafe.Pointer
+	RelayOnly() bool
+	TransferID() int32
+	SetTransferID(id int32)
 	Malloc(size int) (unsafe.Pointer, error)
 }
 
-// TODO when the original error type contains more information than
-// the error message, refactor this
-func extractErrorCode(fallback C.result_type_t, errorMessage string) C.result_type_t {
-	if fallback == C.SendFileError {
-		if strings.Contains(errorMessage, ERR_CONTEXT_CANCELLED) ||
-			strings.Contains(errorMessage, ERR_CONNECTION_ABORT) {
-			return C.TransferCancelled
-		} else if strings.Contains(errorMessage, ERR_BROKEN_PIPE) ||
-			strings.Contains(errorMessage, ERR_EOF) ||
-			strings.Contains(errorMessage, ERR_RESET_BY_PEER) {
+// resultType maps err onto the result_type_t reported to C callers,
+// with the classification codes.FromError also uses for the wasm
+// bindings. Errors that fit none of the specific result types are
+// reported as fallback, which says what kind of transfer failed.
+func resultType(fallback C.result_type_t, err error) C.result_type_t {
+	switch codes.FromError(err, codes.ERR_UNKNOWN) {
+	case codes.ERR_CANCELLED:
+		return C.TransferCancelled
+	case codes.ERR_TIMEOUT:
+		return C.Timeout
+	case codes.ERR_WRONG_CODE:
+		return C.WrongCode
+	case codes.ERR_REJECTED:
+		return C.TransferRejected
+	case codes.ERR_TRANSIT:
+		return C.TransitFailed
+	case codes.ERR_RENDEZVOUS_CONNECT:
+		return C.ConnectionRefused
+	case codes.ERR_PEER_CANCELLED:
+		switch fallback {
+		case C.SendFileError, C.SendDirectoryError:
 			return C.TransferCancelledByReceiver
-		} else if strings.Contains(errorMessage, ERR_WRONG_CODE) {
-			return C.WrongCode
-		} else if strings.Contains(errorMessage, ERR_CONNECTION_REFUSED) ||
-			strings.Contains(errorMessage, ERR_NETWORK_UNREACHABLE) {
-			return C.ConnectionRefused
-		}
-	} else if fallback == C.ReceiveFileError {
-		if strings.Contains(errorMessage, ERR_CONTEXT_CANCELLED) ||
-			strings.Contains(errorMessage, ERR_FAILED_TO_GET_READER) ||
-			strings.Contains(errorMessage, ERR_CONNECTION_ABORT) {
-			return C.TransferCancelled
-		} else if strings.Contains(errorMessage, ERR_UNEXPECTED_EOF) {
+		case C.ReceiveFileError:
 			return C.TransferCancelledBySender
-		} else if strings.Contains(errorMessage, ERR_INVALID_NAMEPLATE) {
-			return C.WrongCode
 		}
 	}
+	return fallback
+}
 
-	// Common errors
-	if strings.Contains(errorMessage, ERR_TRANSFER_REJECTED) {
-		return C.TransferRejected
-	} else if strings.Contains(errorMessage, ERR_WRONG_CODE) {
-		return C.WrongCode
-	} else if strings.Contains(errorMessage, ERR_CONNECTION_REFUSED) ||
-		strings.Contains(errorMessage, ERR_NETWORK_UNREACHABLE) ||
-		strings.Contains(errorMessage, ERR_FAILED_HANDSHAKE) ||
-		strings.Contains(errorMessage, ERR_NO_ADDRESS) {
-		return C.ConnectionRefused
+// codegenResultType is like resultType for failures to allocate a code.
+func codegenResultType(fallback C.codegen_result_type_t, err error) C.codegen_result_type_t {
+	switch codes.FromError(err, codes.ERR_UNKNOWN) {
+	case codes.ERR_RENDEZVOUS_CONNECT:
+		return C.CodeGenConnectionRefused
+	case codes.ERR_CANCELLED:
+		return C.CodeGenTransferCancelled
+	case codes.ERR_TIMEOUT:
+		return C.CodeGenTimeout
 	}
-
 	return fallback
 }
 
-func extractErrorCodeCodeGen(errorCode C.codegen_result_type_t, errorMessage string) C.codegen_result_type_t {
-	if strings.Contains(errorMessage, ERR_CONNECTION_REFUSED) ||
-		strings.Contains(errorMessage, ERR_NETWORK_UNREACHABLE) ||
-		strings.Contains(errorMessage, ERR_FAILED_HANDSHAKE) ||
-		strings.Contains(errorMessage, ERR_NO_ADDRESS) {
-		return C.ConnectionRefused
+// replaceCString stores a C copy of s in *dst, freeing the string that
+// was there before. Strings stored this way are owned by the context and
+// freed by free_wrapped_context.
+func replaceCString(dst **C.char, s string) {
+	if *dst != nil {
+		C.free(unsafe.Pointer(*dst))
 	}
+	*dst = C.CString(s)
+}
+
+// errTransferFinalized is returned by the read, write and seek
+// callbacks of a transfer that has been finalized.
+var errTransferFinalized = errors.New("transfer finalized")
 
-	return errorCode
+// callback runs f, which calls into the context's client_impl_t, unless
+// the transfer has been finalized: the caller no longer expects any
+// callbacks for it and may have freed its client_context_t. It reports
+// whether f was run.
+func (wctx *C.wrapped_context_t) callback(f func()) bool {
+	return pendingTransfers.callback(wctx.TransferID(), f)
 }
 
 func (wctx *C.wrapped_context_t) Log(message string, args ...interface{}) {
@@ -129,27 +116,42 @@ func (wctx *C.wrapped_context_t) Log(message string, args ...interface{}) {
 }
 
 func (wctx *C.wrapped_context_t) UpdateProgress(done int64, total int64) {
-	wctx.progress.transferred_bytes = C.int64_t(done)
-	wctx.progress.total_bytes = C.int64_t(total)
-	C.call_update_progress(wctx)
+	wctx.callback(func() {
+		wctx.progress.transferred_bytes = C.int64_t(done)
+		wctx.progress.total_bytes = C.int64_t(total)
+		pendingTransfers.pushEvent(wctx.TransferID(), transferEvent{Type: EVENT_PROGRESS, Done: done, Total: total})
+		C.call_update_progress(wctx)
+	})
 }
 
-func (wctx *C.wrapped_context_t) NotifyError(result C.result_type_t, errorMessage string) {
-	wctx.Log("Error: ErrorCode:%d %s", int(result), errorMessage)
-	wctx.result.result_type = extractErrorCode(result, errorMessage)
-	wctx.result.err_string = C.CString(errorMessage)
-	C.call_notify(wctx)
+func (wctx *C.wrapped_context_t) NotifyError(result C.result_type_t, err error) {
+	wctx.callback(func() {
+		errorMessage := err.Error()
+		wctx.Log("Error: ErrorCode:%d %s", int(result), errorMessage)
+		setLastError(wctx.TransferID(), errorMessage)
+		wctx.result.result_type = resultType(result, err)
+		replaceCString(&wctx.result.err_string, errorMessage)
+		setResult(wctx.TransferID(), int32(wctx.result.result_type), errorMessage)
+		C.call_notify(wctx)
+	})
 }
 
 func (wctx *C.wrapped_context_t) UpdateMetadata(fileName string, length int64) {
-	wctx.Log("Updating metadata. Filename:%s, length:%d", fileName, length)
-	wctx.metadata.length = C.int64_t(length)
-	wctx.metadata.file_name = C.CString(fileName)
-	C.call_update_metadata(wctx)
+	wctx.callback(func() {
+		wctx.Log("Updating metadata. Filename:%s, length:%d", fileName, length)
+		wctx.metadata.length = C.int64_t(length)
+		replaceCString(&wctx.metadata.file_name, fileName)
+		C.call_update_metadata(wctx)
+	})
 }
 
 func (wctx *C.wrapped_context_t) Write(bytes unsafe.Pointer, length int) error {
-	errorMsg := C.call_write(wctx, (*C.uint8_t)(bytes), C.int32_t(length))
+	var errorMsg *C.char
+	if !wctx.callback(func() {
+		errorMsg = C.call_write(wctx, (*C.uint8_t)(bytes), C.int32_t(length))
+	}) {
+		return errTransferFinalized
+	}
 
 	if unsafe.Pointer(errorMsg) != nil {
 		defer C.free(unsafe.Pointer(errorMsg))
@@ -160,50 +162,86 @@ func (wctx *C.wrapped_context_t) Write(bytes unsafe.Pointer, length int) error {
 }
 
 func (wctx *C.wrapped_context_t) NotifySuccess() {
-	wctx.result.result_type = C.Success
-	C.call_notify(wctx)
+	wctx.callback(func() {
+		wctx.result.result_type = C.Success
+		setResult(wctx.TransferID(), int32(C.Success), "")
+		C.call_notify(wctx)
+	})
 }
 
 func (wctx *C.wrapped_context_t) TextReceived(text string) {
-	wctx.result.result_type = C.Success
-	wctx.result.received_text = C.CString(text)
-	C.call_notify(wctx)
+	wctx.callback(func() {
+		wctx.result.result_type = C.Success
+		replaceCString(&wctx.result.received_text, text)
+		wctx.result.received_text_length = C.int64_t(len(text))
+		setReceivedText(wctx.TransferID(), text)
+		setResult(wctx.TransferID(), int32(C.Success), text)
+		C.call_notify(wctx)
+	})
+}
+
+func (wctx *C.wrapped_context_t) BufferReceived(length int) {
+	wctx.callback(func() {
+		wctx.result.result_type = C.Success
+		wctx.result.buffer_length = C.int64_t(length)
+		setResult(wctx.TransferID(), int32(C.Success), "")
+		C.call_notify(wctx)
+	})
 }
 
 func (wctx *C.wrapped_context_t) Read(buffer *C.uint8_t, length int) (int, error) {
-	result := C.call_read(wctx, buffer, C.int(length))
+	var result C.read_result_t
+	if !wctx.callback(func() {
+		result = C.call_read(wctx, buffer, C.int(length))
+	}) {
+		return -1, errTransferFinalized
+	}
 	if result.error_msg != nil {
 		defer C.free(unsafe.Pointer(result.error_msg))
-		return -1, fmt.Errorf(C.GoString(result.error_msg))
+		return -1, errors.New(C.GoString(result.error_msg))
 	} else {
 		return int(result.bytes_read), nil
 	}
 }
 
 func (wctx *C.wrapped_context_t) Seek(offset int64, whence int) (int64, error) {
-	result := C.call_seek(wctx, C.int64_t(offset), C.int32_t(whence))
+	var result C.seek_result_t
+	if !wctx.callback(func() {
+		result = C.call_seek(wctx, C.int64_t(offset), C.int32_t(whence))
+	}) {
+		return -1, errTransferFinalized
+	}
 
 	if result.error_msg != nil {
 		defer C.free(unsafe.Pointer(result.error_msg))
-		return -1, fmt.Errorf(C.GoString(result.error_msg))
+		return -1, errors.New(C.GoString(result.error_msg))
 	} else {
 		return int64(result.current_offset), nil
 	}
 }
 
 func (wctx *C.wrapped_context_t) NotifyCodeGenerated(code string) {
-	wctx.Log("Code generated: %s", code)
-	wctx.codegen_result.result_type = C.CodeGenSuccessful
-	wctx.codegen_result.generated.code = C.CString(code)
-	C.call_notify_codegen(wctx)
+	wctx.callback(func() {
+		wctx.Log("Code generated: %s", code)
+		wctx.codegen_result.result_type = C.CodeGenSuccessful
+		replaceCString(&wctx.codegen_result.generated.code, code)
+		wctx.codegen_result.generated.transfer_id = wctx.transfer_id
+		setCode(wctx.TransferID(), code)
+		C.call_notify_codegen(wctx)
+	})
 }
 
-func (wctx *C.wrapped_context_t) NotifyCodeGenerationFailure(errorCode C.codegen_result_type_t, errorMessage string) {
-	wctx.Log("Code generation failed. error code:%d, error message:%s", errorCode, errorMessage)
-	wctx.codegen_result.result_type = extractErrorCodeCodeGen(errorCode, errorMessage)
-	wctx.codegen_result.error.error_string = C.CString(errorMessage)
-
-	C.call_notify_codegen(wctx)
+func (wctx *C.wrapped_context_t) NotifyCodeGenerationFailure(errorCode C.codegen_result_type_t, err error) {
+	wctx.callback(func() {
+		errorMessage := err.Error()
+		wctx.Log("Code generation failed. error code:%d, error message:%s", errorCode, errorMessage)
+		setLastError(wctx.TransferID(), errorMessage)
+		wctx.codegen_result.result_type = codegenResultType(errorCode, err)
+		replaceCString(&wctx.codegen_result.error.error_string, errorMessage)
+		setResult(wctx.TransferID(), int32(wctx.codegen_result.result_type), errorMessage)
+
+		C.call_notify_codegen(wctx)
+	})
 }
 
 func (wctx *C.wrapped_context_t) Finalize() {
@@ -212,6 +250,45 @@ func (wctx *C.wrapped_context_t) Finalize() {
 }
 
 func (wctx *C.wrapped_context_t) NewClient() *wormhole.Client {
+	client := newClientWithConfig(&wctx.config)
+	transferID := wctx.TransferID()
+	client.VerifierOk = func(verifier string) bool {
+		pendingTransfers.pushEvent(transferID, transferEvent{Type: EVENT_VERIFIER, Text: verifier})
+		return true
+	}
+	client.Logger = wormhole.LogFuncLogger(wctx.Log)
+	client.CodeHistory = codeHistoryFor(client.AppID, client.RendezvousURL)
+	return client
+}
+
+func (wctx *C.wrapped_context_t) RelayOnly() bool {
+	return bool(wctx.config.relay_only)
+}
+
+// codeHistories holds the wormhole.CodeHistory shared by the clients
+// for each app ID and rendezvous server. Every transfer gets a new
+// client, so the clients could not detect reused codes otherwise.
+var codeHistories = struct {
+	sync.Mutex
+	m map[[2]string]*wormhole.CodeHistory
+}{m: make(map[[2]string]*wormhole.CodeHistory)}
+
+func codeHistoryFor(appID, rendezvousURL string) *wormhole.CodeHistory {
+	codeHistories.Lock()
+	defer codeHistories.Unlock()
+
+	key := [2]string{appID, rendezvousURL}
+	h, ok := codeHistories.m[key]
+	if !ok {
+		h = wormhole.NewCodeHistory()
+		codeHistories.m[key] = h
+	}
+	return h
+}
+
+// newClientWithConfig builds a wormhole client from config, falling back
+// to the DEFAULT_* values for any field that is unset.
+func newClientWithConfig(config *C.client_config_t) *wormhole.Client {
 	client := &wormhole.Client{
 		AppID:                     DEFAULT_APP_ID,
 		RendezvousURL:             DEFAULT_RENDEZVOUS_URL,
@@ -219,26 +296,34 @@ func (wctx *C.wrapped_context_t) NewClient() *wormhole.Client {
 		PassPhraseComponentLength: DEFAULT_PASSPHRASE_COMPONENT_LENGTH,
 	}
 
-	if wctx.config.app_id != nil {
-		client.AppID = C.GoString(wctx.config.app_id)
+	if config == nil {
+		return client
 	}
 
-	if wctx.config.rendezvous_url != nil {
-		client.RendezvousURL = C.GoString(wctx.config.rendezvous_url)
+	if config.app_id != nil {
+		client.AppID = C.GoString(config.app_id)
 	}
 
-	if wctx.config.transit_relay_url != nil {
-		client.TransitRelayURL = C.GoString(wctx.config.transit_relay_url)
+	if config.rendezvous_url != nil {
+		client.RendezvousURL = C.GoString(config.rendezvous_url)
 	}
 
-	if wctx.config.passphrase_length == 0 {
-		client.PassPhraseComponentLength = int(wctx.config.passphrase_length)
+	if config.transit_relay_url != nil {
+		client.TransitRelayURL = C.GoString(config.transit_relay_url)
+	}
+
+	if config.passphrase_length > 0 {
+		client.PassPhraseComponentLength = int(config.passphrase_length)
 	}
 	return client
 }
 
-func (wctx *C.wrapped_context_t) Reference() unsafe.Pointer {
-	return unsafe.Pointer(wctx)
+func (wctx *C.wrapped_context_t) TransferID() int32 {
+	return int32(wctx.transfer_id)
+}
+
+func (wctx *C.wrapped_context_t) SetTransferID(id int32) {
+	wctx.transfer_id = C.int32_t(id)
 }
 
 func (wctx *C.wrapped_context_t) Malloc(size int) (unsafe.Pointer, error) {
@@ -0,0 +1,24 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import "testing"
+
+func TestCodeHistoryFor(t *testing.T) {
+	// each C transfer gets a new client, so reuse is only detected if
+	// they all share one history
+	h := codeHistoryFor("app", "ws://rendezvous")
+	if h == nil {
+		t.Fatal("got nil CodeHistory")
+	}
+	if got := codeHistoryFor("app", "ws://rendezvous"); got != h {
+		t.Fatal("clients with the same config do not share a CodeHistory")
+	}
+	if codeHistoryFor("other-app", "ws://rendezvous") == h {
+		t.Fatal("clients for different app IDs share a CodeHistory")
+	}
+	if codeHistoryFor("app", "ws://other-rendezvous") == h {
+		t.Fatal("clients for different servers share a CodeHistory")
+	}
+}
@@ -0,0 +1,79 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchRelay    bool
+	benchDuration time.Duration
+)
+
+func benchCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "bench",
+		Short: "Measure transfer throughput and recommend send settings",
+		Long: `Measure transfer throughput and recommend send settings.
+
+  By default bench measures how fast this machine can encrypt and decrypt
+  transit records over a loopback connection, which is what limits
+  transfers on fast links. With --relay it instead sends data to itself
+  through the rendezvous server and transit relay.
+
+  The recommended settings can be passed to send as --buffer-size and
+  --encryption-workers.`,
+		Args: cobra.NoArgs,
+		Run:  benchAction,
+	}
+
+	cmd.Flags().BoolVar(&benchRelay, "relay", false, "measure transfers through the transit relay instead of a loopback connection")
+	cmd.Flags().DurationVar(&benchDuration, "duration", time.Second, "how long to measure each setting for")
+
+	return &cmd
+}
+
+func benchAction(cmd *cobra.Command, args []string) {
+	if benchDuration <= 0 {
+		bail("--duration must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	var (
+		result *wormhole.BenchResult
+		err    error
+	)
+	if benchRelay {
+		c := newClient()
+		result, err = c.BenchRelay(ctx, benchDuration)
+	} else {
+		result, err = wormhole.Bench(ctx, benchDuration)
+	}
+	if err != nil {
+		bail("Bench failed: %s", err)
+	}
+
+	fmt.Printf("%12s  %7s  %12s\n", "buffer size", "workers", "throughput")
+	for _, s := range result.Samples {
+		fmt.Printf("%12s  %7d  %10s/s\n", formatBytes(int64(s.BufferSize)), s.EncryptionWorkers, formatBytes(int64(s.BytesPerSecond)))
+	}
+	fmt.Printf("\nRecommended: send --buffer-size %d --encryption-workers %d\n", result.BufferSize, result.EncryptionWorkers)
+}
@@ -29,6 +29,9 @@ var (
 	verify          bool
 	hideProgressBar bool
 	disableListener bool
+	relayOnlyFlag   bool
+	directOnlyFlag  bool
+	traceFile       string
 )
 
 func Execute() error {
@@ -43,11 +46,34 @@ func Execute() error {
 	}
 
 	rootCmd.PersistentFlags().BoolVar(&disableListener, "no-listen", false, "(debug) don't open a listening socket for transit")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "protocol-trace", "", "(debug) append a redacted protocol trace to this file, for bug reports")
 
 	rootCmd.PersistentFlags().StringVar(&appID, "appid", wormhole.WormholeCLIAppID, "AppID to use")
 
 	rootCmd.AddCommand(recvCommand())
 	rootCmd.AddCommand(sendCommand())
 	rootCmd.AddCommand(completionCommand())
+	rootCmd.AddCommand(serveRelayCommand())
+	rootCmd.AddCommand(daemonCommand())
+	rootCmd.AddCommand(benchCommand())
 	return rootCmd.Execute()
 }
+
+// addTransitPolicyFlags registers the flags that restrict how the
+// transit connection for a file or directory transfer is made.
+func addTransitPolicyFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&relayOnlyFlag, "relay-only", false, "only use the transit relay; never reveal local addresses to the peer")
+	cmd.Flags().BoolVar(&directOnlyFlag, "direct-only", false, "never use the transit relay")
+}
+
+func transitPolicyOptions() []wormhole.TransferOption {
+	switch {
+	case relayOnlyFlag && directOnlyFlag:
+		bail("--relay-only and --direct-only cannot be combined")
+	case relayOnlyFlag:
+		return []wormhole.TransferOption{wormhole.WithTransitPolicy(wormhole.TransitRelayOnly)}
+	case directOnlyFlag:
+		return []wormhole.TransferOption{wormhole.WithTransitPolicy(wormhole.TransitDirectOnly)}
+	}
+	return nil
+}
@@ -1,8 +1,12 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
 package cmd
 
 import (
 	"context"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -56,6 +60,11 @@ PowerShell:
   # To load completions for every new session, run:
   PS> wormhole-william shell-completion powershell > wormhole-william.ps1
   # and source this file from your PowerShell profile.
+
+The receive code is completed word by word from the wordlist. Completing
+the nameplate (the leading number) lists the nameplates currently open on
+the rendezvous server; set WORMHOLE_NO_NAMEPLATE_COMPLETION=1 to skip that
+network lookup.
 `,
 		DisableFlagsInUseLine: true,
 		ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
@@ -79,14 +88,40 @@ PowerShell:
 
 func recvCodeCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 	flags := cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveNoSpace
+	if len(args) > 0 {
+		// receive only takes a single code
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	lookup := activeNameplates
+	if os.Getenv("WORMHOLE_NO_NAMEPLATE_COMPLETION") != "" {
+		lookup = nil
+	}
+
+	return codeCompletions(toComplete, lookup), flags
+}
+
+// sendCodeCompletion completes the words of a --code passed to send.
+// The nameplate is the sender's choice, so it is never looked up.
+func sendCodeCompletion(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	flags := cobra.ShellCompDirectiveNoFileComp | cobra.ShellCompDirectiveNoSpace
+	return codeCompletions(toComplete, nil), flags
+}
+
+// codeCompletions returns the candidate completions for a partially
+// typed code. The nameplate is completed from lookup, if non-nil, and
+// the remaining words from the PGP wordlist for their position, as
+// given by wordlist.WordsAt.
+func codeCompletions(toComplete string, lookup func() ([]string, error)) []string {
 	parts := strings.Split(toComplete, "-")
 	if len(parts) < 2 {
-		nameplates, err := activeNameplates()
-		if err != nil {
-			return nil, flags
+		if lookup == nil {
+			return nil
 		}
-		if len(parts) == 0 {
-			return nameplates, flags
+
+		nameplates, err := lookup()
+		if err != nil {
+			return nil
 		}
 
 		var candidates []string
@@ -95,38 +130,36 @@ func recvCodeCompletion(cmd *cobra.Command, args []string, toComplete string) ([
 				candidates = append(candidates, nameplate+"-")
 			}
 		}
+		sort.Strings(candidates)
 
-		return candidates, flags
+		return candidates
 	}
 
-	currentCompletion := parts[len(parts)-1]
+	currentCompletion := strings.ToLower(parts[len(parts)-1])
 	prefix := parts[:len(parts)-1]
 
-	// even odd is based on just the number of words so slice off the mailbox
-	parts = parts[1:]
-	even := len(parts)%2 == 0
+	// the word's position is counted from the first word after the
+	// nameplate
+	position := len(parts) - 2
 
 	var candidates []string
-	for _, pair := range wordlist.RawWords {
-		var candidateWord string
-		if even {
-			candidateWord = pair.Even
-		} else {
-			candidateWord = pair.Odd
-		}
+	for _, candidateWord := range wordlist.WordsAt(position) {
 		if strings.HasPrefix(candidateWord, currentCompletion) {
-			guessParts := append(prefix, candidateWord)
+			guessParts := append(prefix[:len(prefix):len(prefix)], candidateWord)
 			candidates = append(candidates, strings.Join(guessParts, "-"))
 		}
 	}
+	sort.Strings(candidates)
 
-	return candidates, flags
+	return candidates
 }
 
 func activeNameplates() ([]string, error) {
-	url := wormhole.DefaultRendezvousURL
+	url := relayURL
+	if url == "" {
+		url = wormhole.DefaultRendezvousURL
+	}
 	sideID := crypto.RandSideID()
-	appID := wormhole.WormholeCLIAppID
 
 	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
 	defer cancel()
@@ -0,0 +1,201 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+	"github.com/spf13/cobra"
+)
+
+var (
+	daemonDir   string
+	daemonCode  string
+	daemonRetry time.Duration
+	daemonMax   int64
+)
+
+func daemonCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "receive-daemon --dir DIR [--code CODE]",
+		Short: "Keep receiving files and directories into a directory",
+		Long: `Keep receiving files and directories into a directory.
+
+  Without --code, receive-daemon reads one code per line from stdin and
+  receives a transfer for each. With --code it waits for senders to use
+  that code (e.g. "wormhole-william send --code 7-drop-box FILE") and
+  accepts any number of transfers with it, one after the other.
+
+  All file and directory offers are accepted. Names that already exist
+  in the directory get a numeric suffix. Text messages are logged.
+
+  A reusable code lets anyone who learns it send you files, and gives
+  an attacker an online guess at the code for every attempt, so use a
+  long one.`,
+		Args: cobra.NoArgs,
+		Run:  daemonAction,
+	}
+
+	cmd.Flags().StringVar(&daemonDir, "dir", "", "directory to write received files into")
+	cmd.Flags().StringVar(&daemonCode, "code", "", "reusable code to receive with, instead of reading codes from stdin")
+	cmd.Flags().DurationVar(&daemonRetry, "retry-interval", 5*time.Second, "how long to wait before trying --code again")
+	cmd.Flags().Int64Var(&daemonMax, "max-size", 0, "reject offers larger than this many bytes (0 for no limit)")
+	addTransitPolicyFlags(&cmd)
+
+	return &cmd
+}
+
+func daemonAction(cmd *cobra.Command, args []string) {
+	if daemonDir == "" {
+		bail("--dir is required")
+	}
+
+	dir, err := filepath.Abs(daemonDir)
+	if err != nil {
+		bail("Failed to get abs directory: %s", err)
+	}
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		bail("%s is not a directory", daemonDir)
+	}
+
+	c := newClient()
+	ctx := context.Background()
+
+	if daemonCode != "" {
+		// the code is meant to be used by one sender after another
+		c.CodeReuseHook = func(string) bool { return true }
+		for {
+			err := daemonReceive(ctx, &c, daemonCode, dir)
+			if err != nil {
+				if !strings.Contains(err.Error(), "Nameplate is unclaimed") {
+					log.Printf("receive failed: %s", err)
+				}
+				time.Sleep(daemonRetry)
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		code := strings.TrimSpace(scanner.Text())
+		if code == "" {
+			continue
+		}
+
+		err := daemonReceive(ctx, &c, code, dir)
+		if err != nil {
+			log.Printf("receive with code %s failed: %s", code, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		bail("Error reading codes from stdin: %s", err)
+	}
+}
+
+// daemonReceive receives a single transfer into dir without asking
+// the user anything.
+func daemonReceive(ctx context.Context, c *wormhole.Client, code, dir string) error {
+	var dest string
+	accept := func(offer wormhole.Offer) bool {
+		name := filepath.Base(offer.Name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			log.Printf("rejecting offer with bad name %q", offer.Name)
+			return false
+		}
+		dest = uniquePath(dir, name)
+		return true
+	}
+
+	opts := []wormhole.TransferOption{wormhole.WithOfferCallback(accept)}
+	if daemonMax > 0 {
+		opts = append(opts, wormhole.WithMaxOfferSize(daemonMax))
+	}
+	opts = append(opts, transitPolicyOptions()...)
+
+	msg, err := c.Receive(ctx, code, disableListener, opts...)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case wormhole.TransferText:
+		text, err := ioutil.ReadAll(msg)
+		if err != nil {
+			return err
+		}
+		log.Printf("received text message: %s", text)
+		return nil
+	case wormhole.TransferFile:
+		err = receiveInto(msg, dir, func(tmpName string, n int64) error {
+			return os.Rename(tmpName, dest)
+		})
+	case wormhole.TransferDirectory:
+		err = receiveInto(msg, dir, func(tmpName string, n int64) error {
+			f, err := os.Open(tmpName)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			if err := os.Mkdir(dest, 0700); err != nil {
+				return err
+			}
+			return extractZip(f, n, msg, dest)
+		})
+	default:
+		return fmt.Errorf("unexpected transfer type %s", msg.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("received %s", dest)
+	return nil
+}
+
+// receiveInto reads msg into a temporary file in dir and then calls
+// finish with its name and size. The temporary file is removed
+// afterwards unless finish has moved it.
+func receiveInto(msg *wormhole.IncomingMessage, dir string, finish func(tmpName string, n int64) error) error {
+	f, err := ioutil.TempFile(dir, ".wormhole-recv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, msg)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return finish(f.Name(), n)
+}
+
+// uniquePath returns a path for name in dir that does not exist yet,
+// adding a numeric suffix before the extension if needed.
+func uniquePath(dir, name string) string {
+	p := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = filepath.Join(dir, base+"."+strconv.Itoa(i)+ext)
+	}
+}
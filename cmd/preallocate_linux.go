@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE from linux/falloc.h.
+const fallocKeepSize = 0x1
+
+// preallocate reserves disk space for size bytes of f without changing
+// its size, so a partial download still only holds the bytes received.
+// It fails if the disk doesn't have room. Filesystems that can't
+// preallocate are not an error.
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return nil
+	}
+	return err
+}
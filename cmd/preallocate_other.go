@@ -0,0 +1,14 @@
+//go:build !linux && !js && !wasm
+// +build !linux,!js,!wasm
+
+package cmd
+
+import "os"
+
+// preallocate is a no-op outside of Linux. Growing the file with
+// Truncate would make it sparse on most systems without reserving any
+// space, and would break resuming, which relies on the size of the
+// partial download.
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,109 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// progressBarTemplate is pb.Full with the speed and ETA taken from the
+// library's TransferStats instead of pb's own sampling, plus an
+// indicator of whether the transfer is direct or relayed.
+const progressBarTemplate pb.ProgressBarTemplate = `{{string . "route"}} {{counters . }} {{bar . }} {{percent . }} {{string . "speed"}} {{string . "eta"}}`
+
+// transferProgress draws a progress bar for a file or directory
+// transfer. A nil *transferProgress draws nothing, which is what
+// --hide-progress gets.
+type transferProgress struct {
+	bar  *pb.ProgressBar
+	done bool
+	// total overrides TransferStats.Total when set. The receive side
+	// reports progress against the uncompressed size, which does not
+	// match the number of bytes read for directories.
+	total int64
+}
+
+func newTransferProgress() *transferProgress {
+	if hideProgressBar {
+		return nil
+	}
+	return &transferProgress{}
+}
+
+// options returns the TransferOptions needed to feed the progress bar.
+func (p *transferProgress) options() []wormhole.TransferOption {
+	if p == nil {
+		return nil
+	}
+	return []wormhole.TransferOption{wormhole.WithProgressStats(p.update)}
+}
+
+func (p *transferProgress) update(s wormhole.TransferStats) {
+	if p.done {
+		return
+	}
+
+	total := s.Total
+	if p.total > 0 {
+		total = p.total
+	}
+
+	if p.bar == nil {
+		p.bar = progressBarTemplate.Start64(total)
+		p.bar.Set(pb.Bytes, true)
+		p.bar.Set(pb.SIBytesPrefix, true)
+		if s.Relayed {
+			p.bar.Set("route", "[relay]")
+		} else {
+			p.bar.Set("route", "[direct]")
+		}
+	}
+
+	p.bar.Set("speed", formatBytes(int64(s.BytesPerSecond))+"/s")
+
+	s.Total = total
+	if eta := s.ETA(); eta > 0 {
+		p.bar.Set("eta", fmt.Sprintf("ETA %s", eta.Round(time.Second)))
+	} else {
+		p.bar.Set("eta", "")
+	}
+
+	p.bar.SetCurrent(s.Bytes)
+
+	// streamed sends have no total; their bar is finished on close
+	if total > 0 && s.Bytes >= total {
+		p.finish()
+	}
+}
+
+// track wraps a received message so that closing it finishes the
+// progress bar. The bar itself is driven by TransferStats callbacks.
+func (p *transferProgress) track(msg *wormhole.IncomingMessage) io.ReadCloser {
+	if p != nil {
+		p.total = msg.TransferBytes64
+	}
+	return &progressReadCloser{Reader: msg, progress: p}
+}
+
+func (p *transferProgress) finish() {
+	if p != nil && p.bar != nil && !p.done {
+		p.bar.Finish()
+		p.done = true
+	}
+}
+
+type progressReadCloser struct {
+	io.Reader
+	progress *transferProgress
+}
+
+func (r *progressReadCloser) Close() error {
+	r.progress.finish()
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"io"
+
+	qrterminal "github.com/mdp/qrterminal/v3"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// transferURI encodes code as a wormhole-transfer URI. The rendezvous
+// URL is only included when it differs from the default, which keeps
+// the QR code small for the common case.
+func transferURI(code string) string {
+	u := wormhole.TransferURI{Code: code}
+	if relayURL != "" && relayURL != wormhole.DefaultRendezvousURL {
+		u.RendezvousURL = relayURL
+	}
+	return u.String()
+}
+
+func printQRCode(w io.Writer, code string) {
+	qrterminal.GenerateHalfBlock(transferURI(code), qrterminal.L, w)
+}
@@ -6,6 +6,7 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,12 +15,17 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/cheggaaa/pb/v3"
 	"github.com/klauspost/compress/zip"
+	"github.com/psanford/wormhole-william/wordlist"
 	"github.com/psanford/wormhole-william/wormhole"
 	"github.com/spf13/cobra"
 )
 
+var (
+	resumeRecv bool
+	acceptYes  bool
+)
+
 func recvCommand() *cobra.Command {
 	cmd := cobra.Command{
 		Use:     "receive [OPTIONS] [CODE]...",
@@ -30,6 +36,9 @@ func recvCommand() *cobra.Command {
 
 	cmd.Flags().BoolVarP(&verify, "verify", "v", false, "display verification string (and wait for approval)")
 	cmd.Flags().BoolVar(&hideProgressBar, "hide-progress", false, "suppress progress-bar display")
+	cmd.Flags().BoolVar(&resumeRecv, "resume", false, "continue an interrupted download of the same file")
+	cmd.Flags().BoolVarP(&acceptYes, "yes", "y", false, "accept file and directory offers without asking")
+	addTransitPolicyFlags(&cmd)
 
 	cmd.ValidArgsFunction = recvCodeCompletion
 
@@ -58,15 +67,34 @@ func recvAction(cmd *cobra.Command, args []string) {
 		code = strings.TrimSpace(line)
 	}
 
-	if verify {
-		c.VerifierOk = func(code string) bool {
-			fmt.Printf("Verifier %s.\n", code)
-			return true
+	// accept the URI from a scanned send --qr code, or a link, as well
+	// as a bare code
+	if uri, err := wormhole.ParseTransferURI(code); err == nil {
+		code = uri.Code
+		if uri.RendezvousURL != "" {
+			c.RendezvousURL = uri.RendezvousURL
 		}
+	} else if !errors.Is(err, wormhole.ErrNotTransferURI) {
+		bail("%s", err)
 	}
 
-	msg, err := c.Receive(ctx, code, disableListener)
-	if err != nil {
+	// custom codes are allowed, so this only warns about likely typos
+	if words := strings.Split(code, "-"); len(words) > 1 {
+		if err := wordlist.CheckWords(words[1:]); err != nil {
+			errf("Warning: %s; if the code was generated, check it for typos", err)
+		}
+	}
+
+	progress := newTransferProgress()
+
+	opts := []wormhole.TransferOption{wormhole.WithOfferCallback(acceptOffer)}
+	opts = append(opts, progress.options()...)
+	opts = append(opts, transitPolicyOptions()...)
+
+	msg, err := c.Receive(ctx, code, disableListener, opts...)
+	if errors.Is(err, wormhole.ErrOfferDeclined) {
+		bail("transfer rejected")
+	} else if err != nil {
 		log.Fatal(err)
 	}
 
@@ -82,62 +110,47 @@ func recvAction(cmd *cobra.Command, args []string) {
 			log.Fatal(err)
 		}
 	case wormhole.TransferFile:
-		var acceptFile bool
-		if _, err := os.Stat(msg.Name); err == nil {
-			msg.Reject()
-			errf("Error refusing to overwrite existing '%s'", msg.Name)
-		} else if !os.IsNotExist(err) {
-			msg.Reject()
-			errf("Error stat'ing existing '%s'\n", msg.Name)
+		if resumeRecv {
+			recvFileResumable(msg, progress)
 		} else {
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Printf("Receiving file (%s) into: %s\n", formatBytes(msg.TransferBytes64), msg.Name)
-			fmt.Print("ok? (y/N):")
-
-			line, err := reader.ReadString('\n')
+			wd, err := os.Getwd()
 			if err != nil {
-				errf("Error reading from stdin: %s\n", err)
+				bail("Failed to get working directory: %s", err)
 			}
-			line = strings.TrimSpace(line)
-			if line == "y" {
-				acceptFile = true
+			f, err := ioutil.TempFile(wd, fmt.Sprintf("%s.tmp", msg.Name))
+			if err != nil {
+				bail("Failed to create tempfile: %s", err)
 			}
 
-			if !acceptFile {
-				msg.Reject()
-				bail("transfer rejected")
-			} else {
-				wd, err := os.Getwd()
-				if err != nil {
-					bail("Failed to get working directory: %s", err)
-				}
-				f, err := ioutil.TempFile(wd, fmt.Sprintf("%s.tmp", msg.Name))
-				if err != nil {
-					bail("Failed to create tempfile: %s", err)
-				}
-
-				proxyReader := pbProxyReader(msg, msg.TransferBytes64)
-
-				_, err = io.Copy(f, proxyReader)
-				if err != nil {
-					os.Remove(f.Name())
-					bail("Receive file error: %s", err)
-				}
-
-				proxyReader.Close()
-
-				tmpName := f.Name()
+			// reserve the space before accepting the offer, so a full
+			// disk fails the transfer before any data is sent.
+			err = preallocate(f, msg.TransferBytes64)
+			if err != nil {
 				f.Close()
+				os.Remove(f.Name())
+				msg.Reject()
+				bail("Failed to preallocate %s: %s", formatBytes(msg.TransferBytes64), err)
+			}
+
+			proxyReader := progress.track(msg)
+
+			_, err = io.Copy(f, proxyReader)
+			if err != nil {
+				os.Remove(f.Name())
+				bail("Receive file error: %s", err)
+			}
 
-				err = os.Rename(tmpName, msg.Name)
-				if err != nil {
-					bail("Rename %s to %s failed: %s", tmpName, msg.Name, err)
-				}
+			proxyReader.Close()
+
+			tmpName := f.Name()
+			f.Close()
+
+			err = os.Rename(tmpName, msg.Name)
+			if err != nil {
+				bail("Rename %s to %s failed: %s", tmpName, msg.Name, err)
 			}
 		}
 	case wormhole.TransferDirectory:
-		var acceptDir bool
-
 		wd, err := os.Getwd()
 		if err != nil {
 			bail("Failed to get working directory: %s", err)
@@ -153,115 +166,120 @@ func recvAction(cmd *cobra.Command, args []string) {
 			bail("Bad Directory name %s", msg.Name)
 		}
 
-		if _, err := os.Stat(dirName); err == nil {
-			errf("Error refusing to overwrite existing '%s'", msg.Name)
-		} else if !os.IsNotExist(err) {
-			errf("Error stat'ing existing '%s'\n", msg.Name)
-		} else {
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Printf("Receiving directory (%s) into: %s\n", formatBytes(msg.TransferBytes64), msg.Name)
-			fmt.Printf("%d files, %s (uncompressed)\n", msg.FileCount, formatBytes(msg.UncompressedBytes64))
-			fmt.Print("ok? (y/N):")
+		err = os.Mkdir(msg.Name, 0700)
+		if err != nil {
+			bail("Mkdir error for %s: %s\n", msg.Name, err)
+		}
 
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				errf("Error reading from stdin: %s\n", err)
-			}
-			line = strings.TrimSpace(line)
-			if line == "y" {
-				acceptDir = true
-			}
+		tmpFile, err := ioutil.TempFile(wd, msg.Name+".zip.tmp")
+		if err != nil {
+			bail("Failed to create tempfile: %s", err)
+		}
 
-			if !acceptDir {
-				msg.Reject()
-				bail("transfer rejected")
-			} else {
-				err = os.Mkdir(msg.Name, 0700)
-				if err != nil {
-					bail("Mkdir error for %s: %s\n", msg.Name, err)
-				}
-
-				tmpFile, err := ioutil.TempFile(wd, msg.Name+".zip.tmp")
-				if err != nil {
-					bail("Failed to create tempfile: %s", err)
-				}
-
-				defer tmpFile.Close()
-				defer os.Remove(tmpFile.Name())
-
-				proxyReader := pbProxyReader(msg, msg.TransferBytes64)
-
-				n, err := io.Copy(tmpFile, proxyReader)
-				if err != nil {
-					os.Remove(tmpFile.Name())
-					bail("Receive file error: %s", err)
-				}
-
-				zr, err := zip.NewReader(tmpFile, n)
-				if err != nil {
-					bail("Read zip error: %s", err)
-				}
-
-				// calculate the uncompressed size of the contents of the zip
-				var actualUncompressedSize uint64
-				var fileCount int
-				for _, f := range zr.File {
-					actualUncompressedSize += f.FileHeader.UncompressedSize64
-					fileCount++
-				}
-				if msg.UncompressedBytes64 != int64(actualUncompressedSize) ||
-					msg.FileCount != fileCount {
-					bail("zip error: corrupted zip file")
-				}
-
-				for _, zf := range zr.File {
-					p, err := filepath.Abs(filepath.Join(dirName, zf.Name))
-					if err != nil {
-						bail("Failes to calculate file path ABS: %s", err)
-					}
-
-					if !strings.HasPrefix(p, dirName) {
-						bail("Dangerous filename detected: %s", zf.Name)
-					}
-
-					rc, err := zf.Open()
-					if err != nil {
-						bail("Failed to open file in zip: %s %s", zf.Name, err)
-					}
-
-					dir := filepath.Dir(p)
-					err = os.MkdirAll(dir, 0700)
-					if err != nil {
-						bail("Failed to mkdirall %s: %s", dir, err)
-					}
-
-					f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, zf.Mode())
-					if err != nil {
-						bail("Failed to open %s: %s", p, err)
-					}
-					mode := zf.Mode()
-					err = os.Chmod(p, mode)
-					if err != nil {
-						bail("error setting mode for %s: %s", p, err)
-					}
-
-					_, err = io.Copy(f, rc)
-					if err != nil {
-						bail("Failed to write to %s: %s", p, err)
-					}
-
-					err = f.Close()
-					if err != nil {
-						bail("Error closing %s: %s", p, err)
-					}
-
-					rc.Close()
-				}
-
-				proxyReader.Close()
-			}
+		err = preallocate(tmpFile, msg.TransferBytes64)
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			msg.Reject()
+			bail("Failed to preallocate %s: %s", formatBytes(msg.TransferBytes64), err)
 		}
+
+		defer tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+
+		proxyReader := progress.track(msg)
+
+		n, err := io.Copy(tmpFile, proxyReader)
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			bail("Receive file error: %s", err)
+		}
+
+		err = extractZip(tmpFile, n, msg, dirName)
+		if err != nil {
+			bail("%s", err)
+		}
+
+		proxyReader.Close()
+	}
+}
+
+// extractZip checks the received zip in r against msg's offer and
+// extracts it into dirName, which must already exist.
+func extractZip(r io.ReaderAt, size int64, msg *wormhole.IncomingMessage, dirName string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("Read zip error: %s", err)
+	}
+
+	// calculate the uncompressed size of the contents of the zip
+	var actualUncompressedSize uint64
+	var fileCount int
+	for _, f := range zr.File {
+		actualUncompressedSize += f.FileHeader.UncompressedSize64
+		fileCount++
+	}
+	if msg.UncompressedBytes64 != int64(actualUncompressedSize) ||
+		msg.FileCount != fileCount {
+		return errors.New("zip error: corrupted zip file")
 	}
+
+	return wormhole.ExtractZip(r, size, dirName)
+}
+
+// acceptOffer shows the details of a file or directory offer and asks
+// the user whether to accept it. It runs before this side has sent
+// anything about its network location to the sender.
+func acceptOffer(offer wormhole.Offer) bool {
+	existing := offer.Name
+	if offer.Type == wormhole.TransferDirectory {
+		wd, err := os.Getwd()
+		if err != nil {
+			errf("Failed to get working directory: %s", err)
+			return false
+		}
+		dirName, err := filepath.Abs(offer.Name)
+		if err != nil || filepath.Dir(dirName) != wd {
+			errf("Bad Directory name %s", offer.Name)
+			return false
+		}
+		existing = dirName
+	}
+
+	if _, err := os.Stat(existing); err == nil {
+		errf("Error refusing to overwrite existing '%s'", offer.Name)
+		return false
+	} else if !os.IsNotExist(err) {
+		errf("Error stat'ing existing '%s'\n", offer.Name)
+		return false
+	}
+
+	switch {
+	case offer.Type == wormhole.TransferDirectory:
+		fmt.Printf("Receiving directory (%s) into: %s\n", formatBytes(offer.TransferBytes64), offer.Name)
+		fmt.Printf("%d files, %s (uncompressed)\n", offer.FileCount, formatBytes(offer.UncompressedBytes64))
+	case offer.UnknownLength:
+		fmt.Printf("Receiving file (size unknown) into: %s\n", offer.Name)
+	default:
+		fmt.Printf("Receiving file (%s) into: %s\n", formatBytes(offer.TransferBytes64), offer.Name)
+	}
+	if offer.Message != "" {
+		fmt.Printf("Message: %s\n", offer.Message)
+	}
+
+	if acceptYes {
+		return true
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("ok? (y/N):")
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		errf("Error reading from stdin: %s\n", err)
+	}
+	line = strings.TrimSpace(line)
+	return line == "y"
 }
 
 func errf(msg string, args ...interface{}) {
@@ -288,28 +306,3 @@ func formatBytes(b int64) string {
 	}
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "kMGTPE"[exp])
 }
-
-type proxyReadCloser struct {
-	*pb.Reader
-	bar *pb.ProgressBar
-}
-
-func (p *proxyReadCloser) Close() error {
-	p.bar.Finish()
-	return nil
-}
-
-func pbProxyReader(r io.Reader, size int64) io.ReadCloser {
-	if hideProgressBar {
-		return ioutil.NopCloser(r)
-	} else {
-		progressBar := pb.Full.Start64(size)
-		progressBar.Set(pb.Bytes, true)
-		progressBar.Set(pb.SIBytesPrefix, true)
-		proxyReader := progressBar.NewProxyReader(r)
-		return &proxyReadCloser{
-			Reader: proxyReader,
-			bar:    progressBar,
-		}
-	}
-}
@@ -0,0 +1,174 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// checkpointInterval is how many bytes of a resumable download are
+// received between syncing the partial download and checkpointing it.
+const checkpointInterval = 64 << 20
+
+func partialDownloadName(name string) string {
+	return name + ".part"
+}
+
+// resumeStateName is the name of the wormhole.Checkpoint stored next to
+// a partial download, so that `receive --resume` can tell whether the
+// partial file belongs to the offer it is about to accept and how much
+// of it was safely written.
+func resumeStateName(name string) string {
+	return partialDownloadName(name) + ".json"
+}
+
+// openPartialDownload opens the partial download for msg, creating it
+// if there isn't one yet (or the existing one is for a different
+// offer), and resumes msg from the part of it that can be reused. It
+// returns the file, positioned for the rest of the download, and the
+// number of bytes reused.
+func openPartialDownload(msg *wormhole.IncomingMessage) (*os.File, int64, error) {
+	partName := partialDownloadName(msg.Name)
+	stateName := resumeStateName(msg.Name)
+
+	var (
+		offset int64
+		cp     *wormhole.Checkpoint
+	)
+	if state, err := wormhole.ReadCheckpoint(stateName); err == nil && state.Matches(msg) {
+		if stat, err := os.Stat(partName); err == nil && stat.Size() <= msg.TransferBytes64 {
+			if state.Version == 0 {
+				// written before checkpoints: just the name and
+				// size, with all of the partial file usable
+				offset = stat.Size()
+			} else if state.Offset > 0 && stat.Size() >= state.Offset {
+				offset = state.Offset
+				cp = state
+			}
+		}
+	}
+
+	if offset > 0 && !msg.PeerCanResume() {
+		fmt.Println("Sender doesn't support resuming, starting over")
+		offset = 0
+		cp = nil
+	}
+
+	f, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if cp != nil {
+		// anything after the checkpoint may not have been synced
+		err = f.Truncate(offset)
+		if err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err == nil {
+			err = msg.ResumeFromCheckpoint(cp)
+		}
+	} else if offset > 0 {
+		// ResumeFrom reads the partial file up to offset, leaving f
+		// positioned to append the rest.
+		err = msg.ResumeFrom(offset, f)
+	} else {
+		err = f.Truncate(0)
+		if err == nil {
+			cp, err = msg.Checkpoint(msg.Name)
+		}
+		if err == nil {
+			err = wormhole.WriteCheckpoint(stateName, cp)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, offset, nil
+}
+
+// checkpointWriter writes a download to a partial download, syncing
+// it and checkpointing msg every checkpointInterval bytes. All the data
+// read from msg must be written to it before the next read.
+type checkpointWriter struct {
+	f         *os.File
+	msg       *wormhole.IncomingMessage
+	stateName string
+	unsynced  int64
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	w.unsynced += int64(n)
+	if w.unsynced < checkpointInterval {
+		return n, nil
+	}
+	w.unsynced = 0
+
+	err = w.f.Sync()
+	if err != nil {
+		return n, err
+	}
+	cp, err := w.msg.Checkpoint(w.msg.Name)
+	if err != nil {
+		return n, err
+	}
+	return n, wormhole.WriteCheckpoint(w.stateName, cp)
+}
+
+// recvFileResumable receives msg into a partial download, continuing an
+// earlier one if possible, and renames it into place once the transfer
+// has completed. On failure the partial download is kept for the next
+// `receive --resume`.
+func recvFileResumable(msg *wormhole.IncomingMessage, progress *transferProgress) {
+	f, offset, err := openPartialDownload(msg)
+	if err != nil {
+		msg.Reject()
+		bail("Failed to open partial download: %s", err)
+	}
+
+	err = preallocate(f, msg.TransferBytes64)
+	if err != nil {
+		f.Close()
+		msg.Reject()
+		bail("Failed to preallocate %s: %s", formatBytes(msg.TransferBytes64), err)
+	}
+
+	if offset > 0 {
+		fmt.Printf("Resuming from %s\n", formatBytes(offset))
+	}
+
+	proxyReader := progress.track(msg)
+
+	w := &checkpointWriter{f: f, msg: msg, stateName: resumeStateName(msg.Name)}
+	_, err = io.Copy(w, proxyReader)
+	if err != nil {
+		f.Close()
+		bail("Receive file error: %s\nRun receive --resume with a new code to continue", err)
+	}
+
+	proxyReader.Close()
+
+	partName := f.Name()
+	err = f.Close()
+	if err != nil {
+		bail("Error closing %s: %s", partName, err)
+	}
+
+	err = os.Rename(partName, msg.Name)
+	if err != nil {
+		bail("Rename %s to %s failed: %s", partName, msg.Name, err)
+	}
+	os.Remove(resumeStateName(msg.Name))
+}
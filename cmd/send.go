@@ -14,8 +14,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/cheggaaa/pb/v3"
-	qrterminal "github.com/mdp/qrterminal/v3"
 	"github.com/psanford/wormhole-william/wormhole"
 	"github.com/spf13/cobra"
 )
@@ -25,6 +23,17 @@ var (
 	codeFlag     string
 	sendTextFlag string
 	showQRCode   bool
+
+	sendStdinFlag   bool
+	sendNameFlag    string
+	sendMessageFlag string
+	noCompressFlag  bool
+	ignoreFlag      []string
+	ignoreFileFlag  string
+	ignoreVCSFlag   bool
+
+	bufferSizeFlag        int
+	encryptionWorkersFlag int
 )
 
 func sendCommand() *cobra.Command {
@@ -32,7 +41,22 @@ func sendCommand() *cobra.Command {
 		Use:   "send [WHAT]",
 		Short: "Send a text message, file, or directory...",
 		Run: func(cmd *cobra.Command, args []string) {
+			if sendStdinFlag {
+				if len(args) > 0 || sendTextFlag != "" {
+					bail("--stdin cannot be combined with a file argument or --text")
+				}
+				if verify {
+					// the verifier prompt would read from the data being sent
+					bail("--stdin cannot be combined with --verify")
+				}
+				sendStdin()
+				return
+			}
+
 			if len(args) == 0 {
+				if sendMessageFlag != "" {
+					bail("--message is for files and directories, use --text to send only a message")
+				}
 				sendText()
 				return
 			} else if len(args) > 1 {
@@ -58,8 +82,20 @@ func sendCommand() *cobra.Command {
 	cmd.Flags().IntVarP(&codeLen, "code-length", "c", 0, "length of code (in bytes/words)")
 	cmd.Flags().StringVar(&codeFlag, "code", "", "human-generated code phrase")
 	cmd.Flags().StringVar(&sendTextFlag, "text", "", "text message to send, instead of a file.\nUse '-' to read from stdin")
+	cmd.Flags().BoolVar(&sendStdinFlag, "stdin", false, "send data read from stdin as a file")
+	cmd.Flags().StringVar(&sendNameFlag, "name", "stdin", "file name to offer with --stdin")
+	cmd.Flags().StringVar(&sendMessageFlag, "message", "", "text message to send along with the file or directory\n(the receiver must also be wormhole-william)")
+	cmd.Flags().BoolVar(&noCompressFlag, "no-compress", false, "send directories without compressing the files in them\n(older receivers may refuse them)")
+	cmd.Flags().StringArrayVar(&ignoreFlag, "ignore", nil, "leave out files of a directory matching this .gitignore style pattern\n(may be repeated)")
+	cmd.Flags().StringVar(&ignoreFileFlag, "ignore-file", "", "leave out files of a directory matching the patterns in this file,\nsuch as a .gitignore")
+	cmd.Flags().BoolVar(&ignoreVCSFlag, "ignore-vcs", false, "leave out version control directories such as .git")
 	cmd.Flags().BoolVar(&hideProgressBar, "hide-progress", false, "suppress progress-bar display")
-	cmd.Flags().BoolVar(&showQRCode, "qr", false, "display code as QR code (experimental)")
+	cmd.Flags().BoolVar(&showQRCode, "qr", false, "also display the code as a QR code for mobile receivers")
+	cmd.Flags().IntVar(&bufferSizeFlag, "buffer-size", 0, "bytes of data per transit record (see bench)")
+	cmd.Flags().IntVar(&encryptionWorkersFlag, "encryption-workers", 0, "encrypt transit records on this many goroutines (see bench)")
+	addTransitPolicyFlags(&cmd)
+
+	cmd.RegisterFlagCompletionFunc("code", sendCodeCompletion)
 
 	return &cmd
 }
@@ -77,20 +113,45 @@ func newClient() wormhole.Client {
 	}
 
 	if verify {
-		c.VerifierOk = func(code string) bool {
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Printf("Verifier %s. ok? (yes/no): ", code)
-
-			yn, _ := reader.ReadString('\n')
-			yn = strings.TrimSpace(yn)
+		c.VerifierOk = confirmVerifier
+	}
 
-			return yn == "yes"
+	if traceFile != "" {
+		f, err := os.OpenFile(traceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			bail("Failed to open protocol trace file: %s", err)
 		}
+		c.ProtocolTrace = f
 	}
 
 	return c
 }
 
+// confirmVerifier shows the verifier as hex, words and emoji and waits
+// for the user to confirm that it matches the one shown on the other
+// side. Nothing is transferred until they do.
+func confirmVerifier(verifier string) bool {
+	fmt.Printf("Verifier %s.\n", verifier)
+	if words, err := wormhole.VerifierWords(verifier); err == nil {
+		fmt.Printf("Verifier words: %s\n", strings.Join(words, "-"))
+	}
+	if emoji, err := wormhole.VerifierEmoji(verifier); err == nil {
+		names := make([]string, len(emoji))
+		for i, e := range emoji {
+			names[i] = e.String()
+		}
+		fmt.Printf("Verifier emoji: %s\n", strings.Join(names, ", "))
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("ok? (yes/no): ")
+
+	yn, _ := reader.ReadString('\n')
+	yn = strings.TrimSpace(yn)
+
+	return yn == "yes"
+}
+
 func printInstructions(code string) {
 	mwCmd := "wormhole receive"
 	wwCmd := "wormhole-william recv"
@@ -104,15 +165,31 @@ func printInstructions(code string) {
 	fmt.Printf("Wormhole code is: %s\n", code)
 
 	if showQRCode {
-		url := relayURL
-		if url == "" {
-			url = wormhole.DefaultRendezvousURL
-		}
-		content := fmt.Sprintf("wormhole:%s?code=%s", url, code)
-		qrterminal.Generate(content, qrterminal.L, os.Stdout)
+		printQRCode(os.Stdout, code)
 	}
 }
 
+// tuningOptions returns the TransferOptions for the --buffer-size and
+// --encryption-workers flags.
+func tuningOptions() []wormhole.TransferOption {
+	var opts []wormhole.TransferOption
+	if bufferSizeFlag != 0 {
+		opts = append(opts, wormhole.WithBufferSize(bufferSizeFlag))
+	}
+	if encryptionWorkersFlag != 0 {
+		opts = append(opts, wormhole.WithEncryptionWorkers(encryptionWorkersFlag))
+	}
+	return opts
+}
+
+// messageOptions returns the TransferOptions for the --message flag.
+func messageOptions() []wormhole.TransferOption {
+	if sendMessageFlag == "" {
+		return nil
+	}
+	return []wormhole.TransferOption{wormhole.WithMessage(sendMessageFlag)}
+}
+
 func sendFile(filename string) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -123,28 +200,51 @@ func sendFile(filename string) {
 
 	ctx := context.Background()
 
-	var bar *pb.ProgressBar
-
 	args := []wormhole.TransferOption{
 		wormhole.WithCode(codeFlag),
 	}
+	args = append(args, newTransferProgress().options()...)
+	args = append(args, transitPolicyOptions()...)
+	args = append(args, tuningOptions()...)
+	args = append(args, messageOptions()...)
 
-	if !hideProgressBar {
-		args = append(args, wormhole.WithProgress(func(sentBytes int64, totalBytes int64) {
-			if bar == nil {
-				bar = pb.Full.Start64(totalBytes)
-				bar.Set(pb.Bytes, true)
-				bar.Set(pb.SIBytesPrefix, true)
-			}
-			bar.SetCurrent(sentBytes)
+	code, status, err := c.SendFile(ctx, filepath.Base(filename), f, disableListener, args...)
+	if err != nil {
+		bail("Error sending message: %s", err)
+	}
 
-			if sentBytes == totalBytes {
-				bar.Finish()
-			}
-		}))
+	printInstructions(code)
+
+	s := <-status
+
+	if s.OK {
+		fmt.Println("file sent")
+	} else {
+		bail("Send error: %s", s.Error)
 	}
+}
 
-	code, status, err := c.SendFile(ctx, filepath.Base(filename), f, disableListener, args...)
+// sendStdin streams stdin to the receiver without knowing its length
+// up front, so it can be used at the end of a pipeline.
+func sendStdin() {
+	name := filepath.Base(sendNameFlag)
+	if name == "." || name == string(filepath.Separator) {
+		bail("Invalid --name %q", sendNameFlag)
+	}
+
+	c := newClient()
+
+	ctx := context.Background()
+
+	args := []wormhole.TransferOption{
+		wormhole.WithCode(codeFlag),
+	}
+	args = append(args, newTransferProgress().options()...)
+	args = append(args, transitPolicyOptions()...)
+	args = append(args, tuningOptions()...)
+	args = append(args, messageOptions()...)
+
+	code, status, err := c.SendStream(ctx, name, os.Stdin, disableListener, args...)
 	if err != nil {
 		bail("Error sending message: %s", err)
 	}
@@ -161,7 +261,9 @@ func sendFile(filename string) {
 }
 
 func sendDir(dirpath string) {
-	dirpath = strings.TrimSuffix(dirpath, "/")
+	// drop a trailing separator, which would leave the directory name
+	// empty; on Windows it may be a backslash
+	dirpath = filepath.Clean(dirpath)
 
 	stat, err := os.Stat(dirpath)
 	if err != nil {
@@ -174,9 +276,18 @@ func sendDir(dirpath string) {
 
 	prefix, dirname := filepath.Split(dirpath)
 
+	ignore := ignoreList()
+
 	var entries []wormhole.DirectoryEntry
 
 	filepath.Walk(dirpath, func(path string, info os.FileInfo, err error) error {
+		if rel, err := filepath.Rel(dirpath, path); err == nil && rel != "." && ignore.Ignored(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		if info.IsDir() {
 			return nil
 		}
@@ -201,7 +312,18 @@ func sendDir(dirpath string) {
 	c := newClient()
 
 	ctx := context.Background()
-	code, status, err := c.SendDirectory(ctx, dirname, entries, disableListener, wormhole.WithCode(codeFlag))
+	args := []wormhole.TransferOption{
+		wormhole.WithCode(codeFlag),
+	}
+	args = append(args, newTransferProgress().options()...)
+	args = append(args, transitPolicyOptions()...)
+	args = append(args, tuningOptions()...)
+	args = append(args, messageOptions()...)
+	if noCompressFlag {
+		args = append(args, wormhole.WithDirectoryMode(wormhole.DirectoryModeStored))
+	}
+
+	code, status, err := c.SendDirectory(ctx, dirname, entries, disableListener, args...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -217,6 +339,40 @@ func sendDir(dirpath string) {
 	}
 }
 
+// ignoreList returns the IgnoreList for the --ignore, --ignore-file
+// and --ignore-vcs flags, or nil if none are set.
+func ignoreList() *wormhole.IgnoreList {
+	patterns := ignoreFlag
+	if ignoreVCSFlag {
+		patterns = append(append([]string(nil), wormhole.VCSIgnorePatterns...), patterns...)
+	}
+	if len(patterns) == 0 && ignoreFileFlag == "" {
+		return nil
+	}
+
+	var lines []string
+	if ignoreFileFlag != "" {
+		f, err := os.Open(ignoreFileFlag)
+		if err != nil {
+			bail("Failed to read ignore file: %s", err)
+		}
+		fromFile, err := wormhole.ReadIgnoreList(f)
+		f.Close()
+		if err != nil {
+			bail("%s: %s", ignoreFileFlag, err)
+		}
+		lines = fromFile.Patterns()
+	}
+
+	// patterns on the command line come last so that they override
+	// the file
+	ignore, err := wormhole.NewIgnoreList(append(lines, patterns...)...)
+	if err != nil {
+		bail("%s", err)
+	}
+	return ignore
+}
+
 func sendText() {
 	c := newClient()
 
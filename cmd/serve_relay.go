@@ -0,0 +1,111 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/psanford/wormhole-william/transitrelay"
+	"github.com/spf13/cobra"
+)
+
+var (
+	relayTCPListen       string
+	relayWSListen        string
+	relayIdleTimeout     time.Duration
+	relayUnpairedTimeout time.Duration
+	relayUsageLog        string
+)
+
+func serveRelayCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "serve-relay",
+		Short: "Run a transit relay server",
+		Long: `Run a transit relay server.
+
+  The transit relay connects senders and receivers that cannot reach
+  each other directly. Clients select it with --transit-helper, using a
+  tcp:// URL for the TCP listener or a ws:// URL for the WebSocket one.`,
+		Args: cobra.NoArgs,
+		Run:  serveRelayAction,
+	}
+
+	cmd.Flags().StringVar(&relayTCPListen, "tcp-listen", ":4001", "address for raw TCP transit connections (empty to disable)")
+	cmd.Flags().StringVar(&relayWSListen, "ws-listen", "", "address for WebSocket transit connections (empty to disable)")
+	cmd.Flags().DurationVar(&relayIdleTimeout, "idle-timeout", 10*time.Minute, "close sessions with no traffic for this long (0 to disable)")
+	cmd.Flags().DurationVar(&relayUnpairedTimeout, "unpaired-timeout", 5*time.Minute, "close connections still waiting for a peer after this long (0 to disable)")
+	cmd.Flags().StringVar(&relayUsageLog, "usage-log", "", "append per-session usage records to this file ('-' for stderr)")
+
+	return &cmd
+}
+
+func serveRelayAction(cmd *cobra.Command, args []string) {
+	if relayTCPListen == "" && relayWSListen == "" {
+		bail("At least one of --tcp-listen or --ws-listen is required")
+	}
+
+	srv := &transitrelay.Server{
+		IdleTimeout:     relayIdleTimeout,
+		UnpairedTimeout: relayUnpairedTimeout,
+	}
+
+	switch relayUsageLog {
+	case "":
+	case "-":
+		srv.UsageLog = log.New(os.Stderr, "usage: ", log.LstdFlags)
+	default:
+		f, err := os.OpenFile(relayUsageLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			bail("Failed to open usage log: %s", err)
+		}
+		defer f.Close()
+		srv.UsageLog = log.New(f, "", log.LstdFlags)
+	}
+
+	errc := make(chan error, 2)
+
+	if relayTCPListen != "" {
+		l, err := net.Listen("tcp", relayTCPListen)
+		if err != nil {
+			bail("Failed to listen on %s: %s", relayTCPListen, err)
+		}
+		log.Printf("transit relay listening for tcp on %s", l.Addr())
+		go func() {
+			errc <- srv.Serve(l)
+		}()
+	}
+
+	var httpServer *http.Server
+	if relayWSListen != "" {
+		l, err := net.Listen("tcp", relayWSListen)
+		if err != nil {
+			bail("Failed to listen on %s: %s", relayWSListen, err)
+		}
+		log.Printf("transit relay listening for websockets on %s", l.Addr())
+		httpServer = &http.Server{Handler: srv}
+		go func() {
+			errc <- httpServer.Serve(l)
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+
+	select {
+	case err := <-errc:
+		log.Printf("transit relay stopped: %s", err)
+	case <-sigs:
+		log.Printf("shutting down")
+	}
+
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	srv.Close()
+}
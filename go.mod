@@ -8,6 +8,8 @@ require (
 	github.com/klauspost/compress v1.15.0
 	github.com/mdp/qrterminal/v3 v3.0.0
 	github.com/spf13/cobra v1.5.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	nhooyr.io/websocket v1.8.7
 	salsa.debian.org/vasudev/gospake2 v0.0.0-20210510093858-d91629950ad1
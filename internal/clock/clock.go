@@ -0,0 +1,188 @@
+// Package clock lets the timeout, keepalive and expiry logic of the
+// wormhole and transitrelay packages run against a fake clock in
+// tests, so that tests can advance time instead of sleeping.
+//
+// Only timers and the current time go through a Clock. Read and write
+// deadlines on connections are enforced by the operating system and
+// always use real time.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a time.Timer made by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Real is the system clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+func (t realTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(d)
+}
+
+// Since returns the time elapsed on c since t.
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// OrReal returns c, or Real if c is nil, so that the zero values of
+// structs with a Clock field use the system clock.
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
+
+// Fake is a Clock whose time only moves when Advance is called. Its
+// zero value is not usable; use NewFake.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// added is signaled whenever a timer is started, for
+	// WaitForTimers.
+	added *sync.Cond
+}
+
+// NewFake returns a fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.added = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		f: f,
+		c: make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers that expire
+// on the way in order.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		sort.Slice(f.timers, func(i, j int) bool {
+			return f.timers[i].when.Before(f.timers[j].when)
+		})
+		if len(f.timers) == 0 || f.timers[0].when.After(end) {
+			break
+		}
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		f.now = t.when
+		select {
+		case t.c <- f.now:
+		default:
+		}
+	}
+	f.now = end
+}
+
+// Timers returns the number of timers waiting to fire.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// WaitForTimers blocks until at least n timers are waiting to fire, so
+// that a test can be sure the code it is testing has started its
+// timer before calling Advance.
+func (f *Fake) WaitForTimers(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.added.Wait()
+	}
+}
+
+type fakeTimer struct {
+	f    *Fake
+	c    chan time.Time
+	when time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// stop removes t from the pending timers. f.mu must be held.
+func (t *fakeTimer) stop() bool {
+	for i, other := range t.f.timers {
+		if other == t {
+			t.f.timers = append(t.f.timers[:i], t.f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	return t.stop()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	active := t.stop()
+	t.when = t.f.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.c <- t.f.now:
+		default:
+		}
+		return active
+	}
+	t.f.timers = append(t.f.timers, t)
+	t.f.added.Broadcast()
+	return active
+}
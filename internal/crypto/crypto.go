@@ -11,25 +11,55 @@ const NonceSize = 24
 // RandSideID returns a string appropate for use
 // as the Side ID for a client.
 func RandSideID() string {
-	return RandHex(5)
+	id, err := RandSideIDFrom(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// RandSideIDFrom is like RandSideID but reads from r instead of
+// crypto/rand, and returns the error of r instead of panicking.
+func RandSideIDFrom(r io.Reader) (string, error) {
+	return RandHexFrom(r, 5)
 }
 
 // RandHex generates secure random bytes of byteCount long
 // and returns that in hex encoded string format
 func RandHex(byteCount int) string {
-	buf := make([]byte, byteCount)
-	_, err := io.ReadFull(rand.Reader, buf)
+	s, err := RandHexFrom(rand.Reader, byteCount)
 	if err != nil {
 		panic(err)
 	}
+	return s
+}
 
-	return hex.EncodeToString(buf)
+// RandHexFrom is like RandHex but reads from r instead of crypto/rand,
+// and returns the error of r instead of panicking.
+func RandHexFrom(r io.Reader, byteCount int) (string, error) {
+	buf := make([]byte, byteCount)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
 }
 
 func RandNonce() [NonceSize]byte {
-	var nonce [NonceSize]byte
-	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+	nonce, err := RandNonceFrom(rand.Reader)
+	if err != nil {
 		panic(err)
 	}
 	return nonce
 }
+
+// RandNonceFrom is like RandNonce but reads from r instead of
+// crypto/rand, and returns the error of r instead of panicking.
+func RandNonceFrom(r io.Reader) ([NonceSize]byte, error) {
+	var nonce [NonceSize]byte
+	if _, err := io.ReadFull(r, nonce[:]); err != nil {
+		return nonce, err
+	}
+	return nonce, nil
+}
@@ -0,0 +1,208 @@
+// Package prototrace writes sanitized traces of the rendezvous and
+// transit protocol messages exchanged by a client.
+//
+// A trace is a sequence of JSON encoded Entry values, one per line.
+// Encrypted mailbox bodies, transit keys and transferred data are
+// never written, so traces can be attached to bug reports.
+package prototrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/redact"
+)
+
+// Directions of a traced message.
+const (
+	Send = "send"
+	Recv = "recv"
+)
+
+// Protocol layers of a traced message.
+const (
+	LayerRendezvous = "rendezvous"
+	LayerTransit    = "transit"
+)
+
+// Entry is a single traced protocol message.
+type Entry struct {
+	Time  time.Time `json:"time"`
+	Layer string    `json:"layer"`
+	Dir   string    `json:"dir"`
+	// Peer is the remote address of a transit connection.
+	Peer string `json:"peer,omitempty"`
+	// Msg is a rendezvous message with its body redacted.
+	Msg json.RawMessage `json:"msg,omitempty"`
+	// Line is a transit handshake line with its keys redacted.
+	Line string `json:"line,omitempty"`
+	// Len is the size of transit data that was not a handshake line.
+	Len int `json:"len,omitempty"`
+}
+
+// writeMu serializes all trace writes. The rendezvous and transit
+// layers of a transfer trace from different goroutines, usually to a
+// writer such as a bytes.Buffer or os.File that the caller expects to
+// be written to one entry at a time.
+var writeMu sync.Mutex
+
+// A Writer writes trace entries to an underlying io.Writer. It is
+// safe for concurrent use.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a Writer for w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) write(e Entry) {
+	e.Time = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	w.w.Write(append(line, '\n'))
+}
+
+// Rendezvous traces a raw rendezvous message sent or received in
+// direction dir.
+func (w *Writer) Rendezvous(dir string, raw []byte) {
+	w.write(Entry{
+		Layer: LayerRendezvous,
+		Dir:   dir,
+		Msg:   sanitizeRendezvous(raw),
+	})
+}
+
+// Transit traces data sent to or received from a transit peer.
+func (w *Writer) Transit(dir, peer string, data []byte) {
+	e := Entry{
+		Layer: LayerTransit,
+		Dir:   dir,
+		Peer:  peer,
+	}
+	if isHandshakeLine(data) {
+		e.Line = redact.String(string(data))
+	} else {
+		e.Len = len(data)
+	}
+	w.write(e)
+}
+
+// sanitizeRendezvous replaces the body of mailbox messages, which is
+// the encrypted application data, with its length.
+func sanitizeRendezvous(raw []byte) json.RawMessage {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return json.RawMessage(fmt.Sprintf("%q", fmt.Sprintf("[unparsable %d bytes]", len(raw))))
+	}
+
+	if body, ok := msg["body"].(string); ok {
+		msg["body"] = fmt.Sprintf("[redacted %d bytes]", len(body)/2)
+	}
+
+	out, err := json.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(redact.String(string(out)))
+}
+
+// isHandshakeLine reports whether data looks like one of the short
+// ASCII lines of the transit handshake rather than record data.
+func isHandshakeLine(data []byte) bool {
+	if len(data) == 0 || len(data) > maxLine || data[len(data)-1] != '\n' {
+		return false
+	}
+	return isPrintable(data)
+}
+
+// maxLine is the longest transit handshake line.
+const maxLine = 256
+
+func isPrintable(data []byte) bool {
+	for _, b := range data {
+		if b != '\n' && (b < 0x20 || b > 0x7e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Conn wraps a transit connection so that everything written to or
+// read from it is traced to w.
+func Conn(conn net.Conn, w *Writer) net.Conn {
+	return &tracedConn{Conn: conn, w: w, peer: conn.RemoteAddr().String()}
+}
+
+type tracedConn struct {
+	net.Conn
+	w    *Writer
+	peer string
+
+	// partial holds the start of a handshake line that is being read
+	// in pieces, so it is traced as one line.
+	partial []byte
+}
+
+func (c *tracedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.traceRecv(p[:n])
+	}
+	return n, err
+}
+
+func (c *tracedConn) traceRecv(data []byte) {
+	if c.partial == nil && isHandshakeLine(data) {
+		c.w.Transit(Recv, c.peer, data)
+		return
+	}
+
+	line := append(c.partial, data...)
+	if len(line) <= maxLine && isPrintable(line) {
+		if line[len(line)-1] == '\n' {
+			c.w.Transit(Recv, c.peer, line)
+			c.partial = nil
+		} else {
+			c.partial = line
+		}
+		return
+	}
+
+	c.partial = nil
+	c.w.Transit(Recv, c.peer, line)
+}
+
+func (c *tracedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.w.Transit(Send, c.peer, p[:n])
+	}
+	return n, err
+}
+
+// ReadEntries reads a trace written by a Writer.
+func ReadEntries(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
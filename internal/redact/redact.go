@@ -0,0 +1,28 @@
+// Package redact removes secrets from text before it is logged or
+// traced.
+//
+// Keys, PAKE messages and verifiers are all written as long runs of
+// hex digits, and the secret part of a wormhole code is the words
+// after its nameplate, so both can be recognized without knowing the
+// values of a particular transfer.
+package redact
+
+import "regexp"
+
+// Redacted replaces every secret that is removed.
+const Redacted = "[redacted]"
+
+var (
+	// side IDs, at 16 hex digits, are not secret and stay readable
+	hexSecret = regexp.MustCompile(`[0-9a-fA-F]{32,}`)
+
+	code = regexp.MustCompile(`\b([0-9]+)-[A-Za-z]+(?:-[A-Za-z]+)*\b`)
+)
+
+// String returns s with hex encoded key material replaced by
+// Redacted, and the words of any wormhole code in it replaced so that
+// only the nameplate is left, e.g. "7-[redacted]".
+func String(s string) string {
+	s = hexSecret.ReplaceAllString(s, Redacted)
+	return code.ReplaceAllString(s, "${1}-"+Redacted)
+}
@@ -0,0 +1,34 @@
+//go:build !js
+// +build !js
+
+package tlspin
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// DialOptions returns the options to dial a websocket with pins and,
+// if dial is non-nil, over connections opened by dial. It returns nil
+// if there are no pins and no dial function.
+func DialOptions(pins []string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*websocket.DialOptions, error) {
+	if len(pins) == 0 && dial == nil {
+		return nil, nil
+	}
+	transport := &http.Transport{DialContext: dial}
+	if len(pins) > 0 {
+		cfg, err := Config(pins)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = cfg
+	}
+	return &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: transport,
+		},
+	}, nil
+}
@@ -0,0 +1,26 @@
+//go:build js
+// +build js
+
+package tlspin
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"nhooyr.io/websocket"
+)
+
+// DialOptions returns the options to dial a websocket with pins, or nil
+// if there are no pins. Browsers do their own certificate checks, so
+// pins are not supported, and open their own connections, so neither
+// is dial.
+func DialOptions(pins []string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*websocket.DialOptions, error) {
+	if len(pins) > 0 {
+		return nil, errors.New("TLS pins are not supported in the browser")
+	}
+	if dial != nil {
+		return nil, errors.New("custom dialers are not supported in the browser")
+	}
+	return nil, nil
+}
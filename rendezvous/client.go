@@ -3,15 +3,21 @@ package rendezvous
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/LeastAuthority/hashcash"
 	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/internal/prototrace"
+	"github.com/psanford/wormhole-william/internal/tlspin"
 	"github.com/psanford/wormhole-william/rendezvous/internal/msgs"
 	"github.com/psanford/wormhole-william/version"
 	"nhooyr.io/websocket"
@@ -35,6 +41,9 @@ func NewClient(url, sideID, appID string, opts ...ClientOption) *Client {
 		pendingMailboxWaiters: make(map[uint32]chan int),
 
 		pendingMsgWaiters: make(map[uint32]chan uint32),
+
+		logger: nopLogger{},
+		rand:   rand.Reader,
 	}
 
 	for _, opt := range opts {
@@ -64,6 +73,18 @@ type Client struct {
 	agentString  string
 	agentVersion string
 
+	logger         Logger
+	trace          *prototrace.Writer
+	connStateHook  func(ConnState, error)
+	tlsPins        []string
+	requestTimeout time.Duration
+	rand           io.Reader
+	dial           func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// connUp is 1 while the websocket connection is up and 2 once
+	// it has gone down.
+	connUp int32
+
 	wsClient *websocket.Conn
 
 	mailboxMsgs           []MailboxEvent
@@ -80,6 +101,10 @@ type Client struct {
 
 	clientState clientState
 	err         error
+
+	// peerMood is the mood the other side closed the mailbox with,
+	// guarded by pendingMsgMu.
+	peerMood Mood
 }
 
 type MailboxEvent struct {
@@ -118,6 +143,26 @@ func (c clientState) String() string {
 func (c *Client) closeWithError(err error) {
 	atomic.StoreInt32((*int32)(&c.clientState), int32(stateError))
 	c.err = err
+	c.logger.Debug("rendezvous connection closed", "err", err)
+	c.disconnected(err)
+}
+
+func (c *Client) connected() {
+	atomic.StoreInt32(&c.connUp, 1)
+	if c.connStateHook != nil {
+		c.connStateHook(ConnConnected, nil)
+	}
+}
+
+// disconnected reports the loss of the connection, the first time it
+// is called after the connection came up.
+func (c *Client) disconnected(reason error) {
+	if !atomic.CompareAndSwapInt32(&c.connUp, 1, 2) {
+		return
+	}
+	if c.connStateHook != nil {
+		c.connStateHook(ConnDisconnected, reason)
+	}
 }
 
 const (
@@ -140,15 +185,25 @@ func (c *Client) Connect(ctx context.Context) (*ConnectInfo, error) {
 		return nil, fmt.Errorf("current client state %s != pending, cannot connect", c.clientState)
 	}
 
-	var err error
-	c.wsClient, _, err = websocket.Dial(ctx, c.url, nil)
+	dialOpts, err := tlspin.DialOptions(c.tlsPins, c.dial)
+	if err != nil {
+		c.closeWithError(err)
+		return nil, err
+	}
+
+	dialCtx, cancel := c.withRequestTimeout(ctx)
+	c.wsClient, _, err = websocket.Dial(dialCtx, c.url, dialOpts)
+	cancel()
 	if err != nil {
 		wrappedErr := fmt.Errorf("dial %s: %s", c.url, err)
 		c.closeWithError(wrappedErr)
 		return nil, wrappedErr
 	}
 
-	go c.readMessages(ctx)
+	c.logger.Debug("rendezvous connected", "url", c.url, "side", c.sideID)
+	c.connected()
+
+	go c.readMessages(ctx, c.wsClient)
 
 	var permType int
 	var welcome msgs.Welcome
@@ -159,6 +214,7 @@ func (c *Client) Connect(ctx context.Context) (*ConnectInfo, error) {
 	}
 
 	if welcome.Welcome.Error != "" {
+		c.logger.Error("rendezvous server error", "error", welcome.Welcome.Error)
 		err := fmt.Errorf("server error: %s", err)
 		c.closeWithError(err)
 		return nil, err
@@ -209,6 +265,7 @@ func (c *Client) Connect(ctx context.Context) (*ConnectInfo, error) {
 		}
 	} else {
 		// unsupported permission method
+		c.logger.Warn("rendezvous server requires unsupported permission method")
 		c.closeWithError(fmt.Errorf("unsupported permission method"))
 	}
 
@@ -259,9 +316,21 @@ func (c *Client) deregisterWaiter(id uint32) {
 	delete(c.pendingMsgWaiters, id)
 }
 
+// withRequestTimeout returns ctx bounded by the client's request
+// timeout, if it has one.
+func (c *Client) withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.requestTimeout)
+}
+
 func (c *Client) readMsg(ctx context.Context, m interface{}) error {
 	expectMsgType := msgType(m)
 
+	ctx, cancel := c.withRequestTimeout(ctx)
+	defer cancel()
+
 	waiterID, ch := c.registerWaiter()
 	defer c.deregisterWaiter(waiterID)
 
@@ -348,6 +417,22 @@ func (c *Client) AttachMailbox(ctx context.Context, nameplate string) error {
 	return nil
 }
 
+// ReleaseNameplate releases the nameplate claimed by CreateMailbox or
+// AttachMailbox, if it has not been released already. The nameplate is
+// otherwise released once the other side has sent a message, so
+// ReleaseNameplate must not be called after MsgChan.
+func (c *Client) ReleaseNameplate(ctx context.Context) error {
+	if c.nameplate == "" {
+		return nil
+	}
+	err := c.releaseNameplate(ctx, c.nameplate)
+	if err != nil {
+		return err
+	}
+	c.nameplate = ""
+	return nil
+}
+
 // ListNameplates returns a list of active nameplates on the
 // rendezvous server.
 func (c *Client) ListNameplates(ctx context.Context) ([]string, error) {
@@ -469,6 +554,16 @@ const (
 	Errory Mood = "errory"
 )
 
+// PeerMood returns the mood the other side closed the mailbox with,
+// or "" if it has not closed it yet. The mood is only known when the
+// server relays closes with a peer-closed message; the reference
+// mailbox server does not, so callers must treat "" as unknown.
+func (c *Client) PeerMood() Mood {
+	c.pendingMsgMu.Lock()
+	defer c.pendingMsgMu.Unlock()
+	return c.peerMood
+}
+
 // Close sends mood to server and then tears down the connection.
 func (c *Client) Close(ctx context.Context, mood Mood) error {
 	if mood == "" {
@@ -480,12 +575,15 @@ func (c *Client) Close(ctx context.Context, mood Mood) error {
 	}
 
 	defer func() {
+		c.disconnected(nil)
 		if c.wsClient != nil {
 			c.wsClient.Close(websocket.StatusNormalClosure, "")
 			c.wsClient = nil
 		}
 	}()
 
+	c.logger.Debug("rendezvous close", "mailbox", c.mailboxID, "mood", mood)
+
 	var closedResp msgs.ClosedResp
 
 	closeReq := msgs.Close{
@@ -510,12 +608,20 @@ func (c *Client) sendAndWait(ctx context.Context, msg interface{}) (*msgs.Ack, e
 		return nil, err
 	}
 
+	ctx, cancel := c.withRequestTimeout(ctx)
+	defer cancel()
+
 	c.sendCmdMu.Lock()
 	err = wsjson.Write(ctx, c.wsClient, msg)
 	if err != nil {
 		c.sendCmdMu.Unlock()
 		return nil, err
 	}
+	if c.trace != nil {
+		if raw, err := json.Marshal(msg); err == nil {
+			c.trace.Rendezvous(prototrace.Send, raw)
+		}
+	}
 
 	var ack msgs.Ack
 	err = c.readMsg(ctx, &ack)
@@ -535,7 +641,10 @@ func (c *Client) sendAndWait(ctx context.Context, msg interface{}) (*msgs.Ack, e
 // prepareMsg populates the ID and Type fields for a message.
 // It returns the ID string or an error.
 func (c *Client) prepareMsg(msg interface{}) (string, error) {
-	id := crypto.RandHex(2)
+	id, err := crypto.RandHexFrom(c.rand, 2)
+	if err != nil {
+		return "", err
+	}
 
 	ptr := reflect.TypeOf(msg)
 
@@ -646,6 +755,8 @@ func (c *Client) claimNameplate(ctx context.Context, nameplate string) (*msgs.Cl
 		return nil, err
 	}
 
+	c.logger.Debug("rendezvous nameplate claimed", "nameplate", nameplate, "mailbox", claimResp.Mailbox)
+
 	return &claimResp, nil
 }
 
@@ -679,24 +790,31 @@ func (c *Client) openMailbox(ctx context.Context, mailbox string) error {
 	}
 
 	_, err := c.sendAndWait(ctx, &open)
+	if err == nil {
+		c.logger.Debug("rendezvous mailbox opened", "mailbox", mailbox)
+	}
 	return err
 }
 
 // readMessages reads off the websocket and dispatches messages
-// to either pendingMsg or pendingMailboxMsg.
-func (c *Client) readMessages(ctx context.Context) {
+// to either pendingMsg or pendingMailboxMsg. It is passed the
+// websocket because Close clears c.wsClient while it may be reading.
+func (c *Client) readMessages(ctx context.Context, ws *websocket.Conn) {
 	for {
 		if err := ctx.Err(); err != nil {
 			c.closeWithError(err)
 			break
 		}
 
-		_, msg, err := c.wsClient.Read(ctx)
+		_, msg, err := ws.Read(ctx)
 		if err != nil {
 			wrappedErr := fmt.Errorf("WS Read: %s", err)
 			c.closeWithError(wrappedErr)
 			break
 		}
+		if c.trace != nil {
+			c.trace.Rendezvous(prototrace.Recv, msg)
+		}
 
 		var genericMsg msgs.GenericServerMsg
 		err = json.Unmarshal(msg, &genericMsg)
@@ -732,6 +850,21 @@ func (c *Client) readMessages(ctx context.Context) {
 				}
 			}
 			c.pendingMsgMu.Unlock()
+		} else if genericMsg.Type == "peer-closed" {
+			var pc msgs.PeerClosed
+			err := json.Unmarshal(msg, &pc)
+			if err != nil {
+				wrappedErr := fmt.Errorf("JSON unmarshal: %s", err)
+				c.closeWithError(wrappedErr)
+				break
+			}
+
+			if pc.Side != c.sideID {
+				c.logger.Debug("rendezvous peer closed", "mood", pc.Mood)
+				c.pendingMsgMu.Lock()
+				c.peerMood = Mood(pc.Mood)
+				c.pendingMsgMu.Unlock()
+			}
 		} else {
 			nextID := atomic.AddUint32(&c.pendingMsgIDCntr, 1)
 
@@ -2,12 +2,23 @@ package rendezvous
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/internal/tlspin"
 	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
 	"github.com/psanford/wormhole-william/version"
+	"nhooyr.io/websocket"
 )
 
 func TestBasicClient(t *testing.T) {
@@ -111,6 +122,138 @@ func TestBasicClient(t *testing.T) {
 	}
 }
 
+func TestConnStateHook(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	type stateChange struct {
+		state  ConnState
+		reason error
+	}
+
+	var (
+		mu      sync.Mutex
+		changes []stateChange
+	)
+	hook := WithConnStateHook(func(state ConnState, reason error) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, stateChange{state, reason})
+	})
+
+	ctx := context.Background()
+
+	c0 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), "superlatively-abbeys", hook)
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c0.Close(ctx, Happy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	expect := []stateChange{{ConnConnected, nil}, {ConnDisconnected, nil}}
+	if !reflect.DeepEqual(changes, expect) {
+		t.Fatalf("got state changes %v expected %v", changes, expect)
+	}
+	changes = nil
+	mu.Unlock()
+
+	connCtx, cancel := context.WithCancel(ctx)
+	c1 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), "superlatively-abbeys", hook)
+	_, err = c1.Connect(connCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	for i := 0; ; i++ {
+		mu.Lock()
+		n := len(changes)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("timed out waiting for disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(changes) != 2 || changes[0].state != ConnConnected || changes[1].state != ConnDisconnected {
+		t.Fatalf("got state changes %v", changes)
+	}
+	if changes[1].reason == nil {
+		t.Fatal("Expected a reason for the lost connection")
+	}
+}
+
+func TestPeerMood(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	side0 := crypto.RandSideID()
+	side1 := crypto.RandSideID()
+	appID := "unsavory-cantilevers"
+
+	ctx := context.Background()
+
+	c0 := NewClient(ts.WebSocketURL(), side0, appID)
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nameplate, err := c0.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := NewClient(ts.WebSocketURL(), side1, appID)
+	_, err = c1.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c1.AttachMailbox(ctx, nameplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mood := c0.PeerMood(); mood != "" {
+		t.Fatalf("got peer mood %q before peer closed", mood)
+	}
+
+	err = c1.Close(ctx, Scary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; c0.PeerMood() == ""; i++ {
+		if i > 100 {
+			t.Fatal("timed out waiting for peer mood")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if mood := c0.PeerMood(); mood != Scary {
+		t.Fatalf("got peer mood %q expected %q", mood, Scary)
+	}
+
+	err = c0.Close(ctx, Errory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mood := c0.PeerMood(); mood != Scary {
+		t.Fatalf("own close changed peer mood to %q", mood)
+	}
+}
+
 func TestCustomUserAgent(t *testing.T) {
 	ts := rendezvousservertest.NewServerLegacy()
 	defer ts.Close()
@@ -222,3 +365,104 @@ func TestConnectWithPermissionsHashcash(t *testing.T) {
 		t.Fatalf("Server expects permissions, but client connected without permissions")
 	}
 }
+
+func TestTLSPins(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	tlsSrv := httptest.NewTLSServer(ts.Config.Handler)
+	defer tlsSrv.Close()
+
+	u, err := url.Parse(tlsSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL := "wss://" + u.Host + "/ws"
+
+	goodPin := tlspin.Pin(tlsSrv.Certificate())
+	wrongPin := "sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	appID := "unpinned-overgrowth"
+	ctx := context.Background()
+
+	c0 := NewClient(wsURL, crypto.RandSideID(), appID, WithTLSPins(wrongPin, goodPin))
+	if _, err := c0.Connect(ctx); err != nil {
+		t.Fatalf("connect with matching pin failed: %s", err)
+	}
+	c0.Close(ctx, "")
+
+	for _, tc := range []struct {
+		name string
+		opts []ClientOption
+	}{
+		{"wrong pin", []ClientOption{WithTLSPins(wrongPin)}},
+		{"bad pin", []ClientOption{WithTLSPins("sha256/not-base64")}},
+		// the test certificate is not in the system roots
+		{"no pins", nil},
+	} {
+		c := NewClient(wsURL, crypto.RandSideID(), appID, tc.opts...)
+		if _, err := c.Connect(ctx); err == nil {
+			t.Errorf("%s: connect should have failed", tc.name)
+			c.Close(ctx, "")
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// a server that accepts the connection but never says anything
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		for {
+			if _, _, err := conn.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	defer silent.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(silent.URL, "http")
+
+	c0 := NewClient(wsURL, crypto.RandSideID(), "taciturn-switchboards", WithRequestTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	_, err := c0.Connect(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, expected context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("connect took %s to time out", elapsed)
+	}
+}
+
+func TestClientDialer(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	// the dialer is handed the server's address whatever the URL says
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+
+	c0 := NewClient("ws://rendezvous.invalid:4000/ws", crypto.RandSideID(), "unclassifiable-harpsichords", WithDialer(dial))
+
+	ctx := context.Background()
+	if _, err := c0.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c0.Close(ctx, Happy)
+
+	if _, err := c0.CreateMailbox(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dialed) != 1 || dialed[0] != "rendezvous.invalid:4000" {
+		t.Fatalf("got dials %q, expected one to rendezvous.invalid:4000", dialed)
+	}
+}
@@ -161,6 +161,17 @@ type GenericServerMsg struct {
 	Error    string  `json:"error"`
 }
 
+// Server sent to the sides still attached to a mailbox when another
+// side closes it. The reference mailbox server does not send this; it
+// is for servers that relay moods so a side can learn how its peer
+// finished.
+type PeerClosed struct {
+	Type     string  `json:"type" rendezvous_value:"peer-closed"`
+	Side     string  `json:"side"`
+	Mood     string  `json:"mood"`
+	ServerTX float64 `json:"server_tx"`
+}
+
 var MsgMap = map[string]interface{}{
 	"welcome":            Welcome{},
 	"submit-permissions": SubmitPermissions{},
@@ -180,4 +191,5 @@ var MsgMap = map[string]interface{}{
 	"error":              Error{},
 	"close":              Close{},
 	"closed":             ClosedResp{},
+	"peer-closed":        PeerClosed{},
 }
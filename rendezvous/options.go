@@ -1,5 +1,15 @@
 package rendezvous
 
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/prototrace"
+)
+
 type ClientOption interface {
 	setValue(*Client)
 }
@@ -22,3 +32,162 @@ func WithVersion(agentID string, version string) ClientOption {
 		agentVersion: version,
 	}
 }
+
+// Logger receives diagnostic messages from a Client as a short
+// message followed by alternating key/value pairs.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+type loggerOption struct {
+	logger Logger
+}
+
+func (o *loggerOption) setValue(c *Client) {
+	if o.logger != nil {
+		c.logger = o.logger
+	}
+}
+
+// WithLogger returns a ClientOption that sends the client's
+// diagnostic messages to l. By default nothing is logged.
+func WithLogger(l Logger) ClientOption {
+	return &loggerOption{logger: l}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+type protocolTraceOption struct {
+	w io.Writer
+}
+
+func (o *protocolTraceOption) setValue(c *Client) {
+	if o.w != nil {
+		c.trace = prototrace.NewWriter(o.w)
+	}
+}
+
+// WithProtocolTrace returns a ClientOption that writes every message
+// sent to or received from the rendezvous server to w, one JSON object
+// per line, with the encrypted message bodies redacted.
+func WithProtocolTrace(w io.Writer) ClientOption {
+	return &protocolTraceOption{w: w}
+}
+
+// ConnState is the state of a Client's connection to the rendezvous
+// server, as passed to the hook registered with WithConnStateHook.
+type ConnState int
+
+const (
+	// ConnConnected is reported once the websocket connection to the
+	// server is up.
+	ConnConnected ConnState = iota + 1
+	// ConnDisconnected is reported once when a connection that was up
+	// goes down, either because Close was called or because of an
+	// error.
+	ConnDisconnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnected:
+		return "Connected"
+	case ConnDisconnected:
+		return "Disconnected"
+	default:
+		return fmt.Sprintf("ConnStateUnknown<%d>", s)
+	}
+}
+
+type connStateHookOption struct {
+	f func(ConnState, error)
+}
+
+func (o *connStateHookOption) setValue(c *Client) {
+	c.connStateHook = o.f
+}
+
+// WithConnStateHook returns a ClientOption that calls f whenever the
+// client's connection to the rendezvous server changes state. For
+// ConnDisconnected, reason is the error that brought the connection
+// down, or nil if it was closed with Close. f is called synchronously
+// from the client's goroutines and must not block.
+func WithConnStateHook(f func(state ConnState, reason error)) ClientOption {
+	return &connStateHookOption{f: f}
+}
+
+type tlsPinsOption struct {
+	pins []string
+}
+
+func (o *tlsPinsOption) setValue(c *Client) {
+	c.tlsPins = o.pins
+}
+
+// WithTLSPins returns a ClientOption that only accepts a wss://
+// rendezvous server if the public key of its certificate matches one
+// of pins, instead of checking the certificate against the system
+// roots. Each pin is "sha256/" followed by the base64 encoded sha256
+// of the certificate's SubjectPublicKeyInfo. Invalid pins make Connect
+// fail. Pins are not supported in browsers.
+func WithTLSPins(pins ...string) ClientOption {
+	return &tlsPinsOption{pins: pins}
+}
+
+type requestTimeoutOption struct {
+	timeout time.Duration
+}
+
+func (o *requestTimeoutOption) setValue(c *Client) {
+	c.requestTimeout = o.timeout
+}
+
+// WithRequestTimeout returns a ClientOption that bounds each request
+// to the rendezvous server, from connecting or sending the request to
+// reading the server's reply, so that a server that stops answering
+// fails the call with context.DeadlineExceeded. Waiting for mailbox
+// messages from the other side is not bounded. By default only the
+// context passed to each call bounds it.
+func WithRequestTimeout(timeout time.Duration) ClientOption {
+	return &requestTimeoutOption{timeout: timeout}
+}
+
+type randOption struct {
+	r io.Reader
+}
+
+func (o *randOption) setValue(c *Client) {
+	c.rand = o.r
+}
+
+// WithRand returns a ClientOption that reads the IDs of the client's
+// requests from r instead of crypto/rand, so that tests can produce
+// the same protocol trace each time. r must be safe for concurrent
+// use.
+func WithRand(r io.Reader) ClientOption {
+	return &randOption{r: r}
+}
+
+type dialOption struct {
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (o *dialOption) setValue(c *Client) {
+	c.dial = o.dial
+}
+
+// WithDialer returns a ClientOption that opens the connection to the
+// rendezvous server with dial instead of the system's network stack,
+// for example to connect to a server running in memory. It is not
+// supported in browsers.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return &dialOption{dial: dial}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -29,6 +30,8 @@ type TestServer struct {
 	mailboxes  map[string]*mailbox
 	nameplates map[int16]string
 	agents     [][]string
+	replay     map[string]bool
+	thirdSide  map[string]bool
 }
 
 var TestMotd = "ordure-posts"
@@ -36,6 +39,26 @@ var TestMotd = "ordure-posts"
 // this creates a rendezvous server that does not talk any
 // permission messages (as in the pre-permissions mailbox server).
 func NewServerLegacy() *TestServer {
+	ts, h := newServerLegacy()
+	ts.Server = httptest.NewServer(h)
+	return ts
+}
+
+// NewServerLegacyOn is like NewServerLegacy but serves connections
+// accepted from l instead of listening on a local port, for example
+// to run the server on an in-memory network. The server closes l when
+// it is closed.
+func NewServerLegacyOn(l net.Listener) *TestServer {
+	ts, h := newServerLegacy()
+	ts.Server = &httptest.Server{
+		Listener: l,
+		Config:   &http.Server{Handler: h},
+	}
+	ts.Start()
+	return ts
+}
+
+func newServerLegacy() (*TestServer, http.Handler) {
 	ts := &TestServer{
 		mailboxes:  make(map[string]*mailbox),
 		nameplates: make(map[int16]string),
@@ -49,8 +72,7 @@ func NewServerLegacy() *TestServer {
 		ServerTX: 0,
 	}))
 
-	ts.Server = httptest.NewServer(smux)
-	return ts
+	return ts, smux
 }
 
 func NewServerWithPermNone() *TestServer {
@@ -138,16 +160,40 @@ func (ts *TestServer) CloseMoods() map[string]string {
 	closeMoods := make(map[string]string)
 
 	for _, mbox := range ts.mailboxes {
+		mbox.Lock()
 		for _, msg := range mbox.msgs {
 			if msg.msgType == "close" {
 				closeMoods[msg.side] = msg.body
 			}
 		}
+		mbox.Unlock()
 	}
 
 	return closeMoods
 }
 
+// ReplayPhase makes the server deliver every mailbox message added
+// with phase twice, as a malicious server replaying it would.
+func (ts *TestServer) ReplayPhase(phase string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.replay == nil {
+		ts.replay = make(map[string]bool)
+	}
+	ts.replay[phase] = true
+}
+
+// ThirdSidePhase makes the server deliver a copy of every mailbox
+// message added with phase as if a third side had sent it.
+func (ts *TestServer) ThirdSidePhase(phase string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.thirdSide == nil {
+		ts.thirdSide = make(map[string]bool)
+	}
+	ts.thirdSide[phase] = true
+}
+
 func (ts *TestServer) WebSocketURL() string {
 	u, err := url.Parse(ts.URL)
 	if err != nil {
@@ -225,6 +271,23 @@ type mboxMsg struct {
 	body    string
 }
 
+// serverMsg returns the message sent to the sides attached to the
+// mailbox for m. Closes are relayed as peer-closed so that clients
+// can learn their peer's mood.
+func (m mboxMsg) serverMsg() interface{} {
+	if m.msgType == "close" {
+		return &msgs.PeerClosed{
+			Side: m.side,
+			Mood: m.body,
+		}
+	}
+	return &msgs.Message{
+		Side:  m.side,
+		Phase: m.phase,
+		Body:  m.body,
+	}
+}
+
 func prepareServerMsg(msg interface{}) {
 	ptr := reflect.TypeOf(msg)
 
@@ -316,7 +379,10 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 			}
 		}
 
-		sendMsg(welcomeMsg)
+		// prepareServerMsg writes to the message, so each
+		// connection sends its own copy of the welcome.
+		welcome := *welcomeMsg
+		sendMsg(&welcome)
 
 		ackMsg := func(id string) {
 			ack := &msgs.Ack{
@@ -526,24 +592,12 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 				mbox.Unlock()
 
 				for _, mboxMsg := range pendingMsgs {
-					msg := &msgs.Message{
-						Side:  mboxMsg.side,
-						Type:  mboxMsg.msgType,
-						Phase: mboxMsg.phase,
-						Body:  mboxMsg.body,
-					}
-					sendMsg(msg)
+					sendMsg(mboxMsg.serverMsg())
 				}
 
 				go func() {
 					for mboxMsg := range msgChan {
-						msg := &msgs.Message{
-							Side:  mboxMsg.side,
-							Type:  mboxMsg.msgType,
-							Phase: mboxMsg.phase,
-							Body:  mboxMsg.body,
-						}
-						sendMsg(msg)
+						sendMsg(mboxMsg.serverMsg())
 					}
 				}()
 
@@ -567,6 +621,17 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 
 				openMailbox.Add(sideID, m)
 
+				ts.mu.Lock()
+				replay := ts.replay[m.Phase]
+				thirdSide := ts.thirdSide[m.Phase]
+				ts.mu.Unlock()
+				if replay {
+					openMailbox.Add(sideID, m)
+				}
+				if thirdSide {
+					openMailbox.Add(crypto.RandSideID(), m)
+				}
+
 			case *msgs.Close:
 				ackMsg(m.ID)
 				if openMailbox != nil {
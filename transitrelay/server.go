@@ -0,0 +1,400 @@
+// Package transitrelay implements a magic wormhole transit relay.
+//
+// A transit relay pairs up two clients that present the same channel
+// token in their handshake and then copies bytes between them. It is
+// used when the two sides of a file transfer cannot connect to each
+// other directly. The relay never sees plaintext: transit records are
+// encrypted end to end by the clients.
+package transitrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/clock"
+	"nhooyr.io/websocket"
+)
+
+// Server is a transit relay that accepts both raw TCP connections
+// (via Serve) and WebSocket connections (via ServeHTTP).
+type Server struct {
+	// IdleTimeout closes a relayed session when no data has been
+	// transferred in either direction for this long. Zero means
+	// sessions never time out.
+	IdleTimeout time.Duration
+
+	// UnpairedTimeout closes a connection that is still waiting for
+	// its peer after this long. Zero means wait forever.
+	UnpairedTimeout time.Duration
+
+	// UsageLog, if set, receives one line per connection attempt
+	// describing its outcome, duration and the number of bytes relayed.
+	UsageLog *log.Logger
+
+	// clock, if set, replaces the system clock for the timeouts, so
+	// that tests can advance time instead of sleeping.
+	clock clock.Clock
+
+	mu        sync.Mutex
+	pending   map[string]*waitingConn
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type waitingConn struct {
+	conn   net.Conn
+	start  time.Time
+	paired chan struct{}
+}
+
+// Outcomes reported in usage log lines. These follow the mood names
+// used by the Python transit relay.
+const (
+	moodHappy  = "happy"
+	moodLonely = "lonely"
+	moodErrory = "errory"
+)
+
+var (
+	headerPrefix = []byte("please relay ")
+	headerSide   = []byte(" for side ")
+)
+
+// Serve accepts raw TCP transit connections on l until l is closed
+// or the Server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return errServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and relays binary
+// messages on it as a transit stream.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	conn := websocket.NetConn(context.Background(), c, websocket.MessageBinary)
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+	s.handleConn(conn)
+}
+
+// Close stops all listeners passed to Serve, closes every open
+// connection and waits for their handlers to return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.doneChan())
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// doneChan must be called with s.mu held.
+func (s *Server) doneChan() chan struct{} {
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.closed {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	if add {
+		if s.closed {
+			return false
+		}
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+	return true
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	start := s.now()
+
+	if !s.trackConn(c, true) {
+		c.Close()
+		return
+	}
+	defer s.trackConn(c, false)
+	defer c.Close()
+
+	if s.UnpairedTimeout > 0 {
+		// deadlines are enforced in real time, whatever the clock
+		c.SetReadDeadline(time.Now().Add(s.UnpairedTimeout))
+	}
+
+	chanID, err := readHandshake(c)
+	if err != nil {
+		if err == errBadHandshake {
+			c.Write([]byte("bad handshake\n"))
+		}
+		s.logUsage(start, moodErrory, 0)
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string]*waitingConn)
+	}
+	peer, found := s.pending[chanID]
+	if found {
+		delete(s.pending, chanID)
+	} else {
+		peer = &waitingConn{
+			conn:   c,
+			start:  start,
+			paired: make(chan struct{}),
+		}
+		s.pending[chanID] = peer
+	}
+	done := s.doneChan()
+	s.mu.Unlock()
+
+	if !found {
+		// The second side of the session runs the copy loop; the
+		// first side just waits here so its connection stays tracked.
+		s.waitForPeer(chanID, peer, done)
+		return
+	}
+
+	defer close(peer.paired)
+
+	if _, err := peer.conn.Write([]byte("ok\n")); err != nil {
+		s.logUsage(peer.start, moodErrory, 0)
+		return
+	}
+	if _, err := c.Write([]byte("ok\n")); err != nil {
+		s.logUsage(peer.start, moodErrory, 0)
+		return
+	}
+
+	total := s.relay(peer.conn, c)
+	s.logUsage(peer.start, moodHappy, total)
+}
+
+func (s *Server) waitForPeer(chanID string, w *waitingConn, done <-chan struct{}) {
+	var timeout <-chan time.Time
+	if s.UnpairedTimeout > 0 {
+		t := clock.OrReal(s.clock).NewTimer(s.UnpairedTimeout)
+		defer t.Stop()
+		timeout = t.C()
+	}
+
+	select {
+	case <-w.paired:
+		return
+	case <-timeout:
+	case <-done:
+	}
+
+	s.mu.Lock()
+	stillWaiting := s.pending[chanID] == w
+	if stillWaiting {
+		delete(s.pending, chanID)
+	}
+	s.mu.Unlock()
+
+	if !stillWaiting {
+		// we were paired just as the timer fired
+		<-w.paired
+		return
+	}
+
+	s.logUsage(w.start, moodLonely, 0)
+}
+
+// relay copies data in both directions between a and b until either
+// side closes or the session goes idle. It returns the total number
+// of bytes relayed.
+func (s *Server) relay(a, b net.Conn) int64 {
+	var (
+		total    int64
+		lastSeen = s.now().UnixNano()
+		wg       sync.WaitGroup
+		done     = make(chan struct{})
+	)
+
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.AddInt64(&total, int64(n))
+				atomic.StoreInt64(&lastSeen, s.now().UnixNano())
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		a.Close()
+		b.Close()
+	}
+
+	if s.IdleTimeout > 0 {
+		// Transit traffic is mostly one-directional, so idleness is
+		// tracked across both directions rather than with per-conn
+		// read deadlines.
+		go func() {
+			t := clock.OrReal(s.clock).NewTimer(s.IdleTimeout)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C():
+				}
+				idle := s.now().Sub(time.Unix(0, atomic.LoadInt64(&lastSeen)))
+				if idle >= s.IdleTimeout {
+					a.Close()
+					b.Close()
+					return
+				}
+				t.Reset(s.IdleTimeout - idle)
+			}
+		}()
+	}
+
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	close(done)
+
+	return atomic.LoadInt64(&total)
+}
+
+func (s *Server) now() time.Time {
+	return clock.OrReal(s.clock).Now()
+}
+
+func (s *Server) logUsage(start time.Time, mood string, total int64) {
+	if s.UsageLog == nil {
+		return
+	}
+	s.UsageLog.Printf("mood=%s duration=%s bytes=%d", mood, s.now().Sub(start).Round(time.Millisecond), total)
+}
+
+var (
+	errBadHandshake = errors.New("bad handshake")
+	errServerClosed = errors.New("transitrelay: server closed")
+)
+
+// readHandshake reads a request of the form:
+// "please relay 10bf5ab71e48a3ca74b0a0d4d54f66f38704a76d15885442a8df141680fd for side 4a74cb8a377c970a\n"
+// and returns the channel token.
+func readHandshake(c net.Conn) (string, error) {
+	headerBuf := make([]byte, 64)
+
+	matchExpect := func(expect []byte) error {
+		got := headerBuf[:len(expect)]
+		if _, err := io.ReadFull(c, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, expect) {
+			return errBadHandshake
+		}
+		return nil
+	}
+
+	readHex := func(buf []byte) (string, error) {
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return "", err
+		}
+		if _, err := hex.DecodeString(string(buf)); err != nil {
+			return "", errBadHandshake
+		}
+		return string(buf), nil
+	}
+
+	if err := matchExpect(headerPrefix); err != nil {
+		return "", err
+	}
+
+	chanID, err := readHex(headerBuf)
+	if err != nil {
+		return "", err
+	}
+
+	if err := matchExpect(headerSide); err != nil {
+		return "", err
+	}
+
+	if _, err := readHex(headerBuf[:16]); err != nil {
+		return "", err
+	}
+
+	if err := matchExpect([]byte("\n")); err != nil {
+		return "", err
+	}
+
+	return chanID, nil
+}
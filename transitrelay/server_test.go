@@ -0,0 +1,186 @@
+package transitrelay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/clock"
+)
+
+const (
+	testToken = "10bf5ab71e48a3ca74b0a0d4d54f66f38704a76d15885442a8df141680fd0123"
+)
+
+func startServer(t *testing.T, srv *Server) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	return l.Addr().String()
+}
+
+func dialRelay(t *testing.T, addr, side string) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.WriteString(c, "please relay "+testToken+" for side "+side+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, bufio.NewReader(c)
+}
+
+func TestRelayPairsConnections(t *testing.T) {
+	var usage bytes.Buffer
+	srv := &Server{
+		UsageLog: log.New(&usage, "", 0),
+	}
+	addr := startServer(t, srv)
+
+	a, aReader := dialRelay(t, addr, "4a74cb8a377c970a")
+	b, bReader := dialRelay(t, addr, "0a74cb8a377c970b")
+
+	for _, r := range []*bufio.Reader{aReader, bReader} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "ok\n" {
+			t.Fatalf("expected ok, got %q", line)
+		}
+	}
+
+	msg := []byte("hello from a")
+	if _, err := a.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(bReader, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, expected %q", got, msg)
+	}
+
+	a.Close()
+	if _, err := bReader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF after peer close, got %v", err)
+	}
+	b.Close()
+
+	srv.Close()
+
+	if !strings.Contains(usage.String(), "mood=happy") || !strings.Contains(usage.String(), "bytes=12") {
+		t.Fatalf("unexpected usage log: %q", usage.String())
+	}
+}
+
+func TestRelayBadHandshake(t *testing.T) {
+	srv := &Server{}
+	defer srv.Close()
+	addr := startServer(t, srv)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "please relay nothexnothexnothexnothexnothexnothexnothexnothexnothex for side 4a74cb8a377c970a\n")
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "bad handshake\n" {
+		t.Fatalf("expected bad handshake, got %q", line)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	srv := &Server{
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	defer srv.Close()
+	addr := startServer(t, srv)
+
+	a, aReader := dialRelay(t, addr, "4a74cb8a377c970a")
+	defer a.Close()
+	b, _ := dialRelay(t, addr, "0a74cb8a377c970b")
+	defer b.Close()
+
+	if _, err := aReader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := aReader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected idle session to be closed, got %v", err)
+	}
+}
+
+func TestRelayIdleTimeoutFakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	srv := &Server{
+		IdleTimeout: time.Hour,
+		clock:       clk,
+	}
+	defer srv.Close()
+	addr := startServer(t, srv)
+
+	a, aReader := dialRelay(t, addr, "4a74cb8a377c970a")
+	defer a.Close()
+	b, bReader := dialRelay(t, addr, "0a74cb8a377c970b")
+	defer b.Close()
+
+	for _, r := range []*bufio.Reader{aReader, bReader} {
+		if _, err := r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// traffic just before the timeout keeps the session open
+	clk.WaitForTimers(1)
+	clk.Advance(59 * time.Minute)
+	if _, err := a.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bReader.ReadByte(); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(time.Minute)
+	clk.WaitForTimers(1)
+
+	// and an hour after it the session is closed
+	clk.Advance(59 * time.Minute)
+
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := aReader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected idle session to be closed, got %v", err)
+	}
+}
+
+func TestRelayUnpairedTimeout(t *testing.T) {
+	srv := &Server{
+		UnpairedTimeout: 100 * time.Millisecond,
+	}
+	defer srv.Close()
+	addr := startServer(t, srv)
+
+	a, aReader := dialRelay(t, addr, "4a74cb8a377c970a")
+	defer a.Close()
+
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := aReader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected lonely connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+//go:build js && wasm
+// +build js,wasm
+
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"syscall/js"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// The functions in this file make up the high level API set on the
+// Wormhole global. Unlike the Wormhole.Client functions they don't
+// need a client handle: each call takes an optional config object (see
+// NewClient) and every result is a Promise. A `signal` AbortSignal in
+// the config cancels the transfer, and progress, verifier and state
+// changes are reported as described for transferEvents.
+
+// sendResultPromise returns a Promise that settles with the final
+// result of a send, releasing the send's context afterwards.
+func sendResultPromise(ctx context.Context, cancel context.CancelFunc, resultChan chan wormhole.SendResult, events *transferEvents) js.Value {
+	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
+		defer cancel()
+
+		select {
+		case result := <-resultChan:
+			events.finished(result.Error)
+			switch {
+			case result.Error != nil:
+				reject(result.Error)
+			case result.OK:
+				resolve(nil)
+			default:
+				reject(errors.New("unknown send result"))
+			}
+		case <-ctx.Done():
+			events.finished(ctx.Err())
+			reject(ctx.Err())
+		}
+	})
+}
+
+// API_SendText implements `Wormhole.sendText(msg, [config])`. It
+// resolves to `{code, done}` once the code has been allocated; `done`
+// is a Promise that resolves when the receiver has got the message.
+func API_SendText(_ js.Value, args []js.Value) interface{} {
+	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
+		if len(args) != 1 && len(args) != 2 {
+			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d or %d", len(args), 1, 2))
+			return
+		}
+
+		config := optionsArg(args, 1)
+		client := newClientFromConfig(config)
+
+		events := newTransferEvents(config)
+		events.setState(STATE_CONNECTING)
+
+		ctx, cancel := withAbortSignal(context.Background(), config)
+		code, resultChan, err := withEvents(client, events).SendText(ctx, args[0].String(), collectTransferOptions(config, events)...)
+		if err != nil {
+			cancel()
+			events.finished(err)
+			reject(err)
+			return
+		}
+		events.setState(STATE_WAITING_FOR_PEER)
+
+		returnObj := js.Global().Get("Object").New()
+		returnObj.Set("code", code)
+		returnObj.Set("done", sendResultPromise(ctx, cancel, resultChan, events))
+		resolve(returnObj)
+	})
+}
+
+// API_SendFile implements `Wormhole.sendFile(name, file, [config])`
+// for Files, Blobs and ReadableStreams (which need a `size` in config).
+// It resolves to `{code, done, cancel}`.
+func API_SendFile(_ js.Value, args []js.Value) interface{} {
+	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
+		if len(args) != 2 && len(args) != 3 {
+			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d or %d", len(args), 2, 3))
+			return
+		}
+
+		config := optionsArg(args, 2)
+		client := newClientFromConfig(config)
+
+		fileReader, err := newJSReadSeeker(args[1], config)
+		if err != nil {
+			reject(err)
+			return
+		}
+
+		events := newTransferEvents(config)
+		events.setState(STATE_CONNECTING)
+
+		ctx, cancel := withAbortSignal(context.Background(), config)
+		code, resultChan, err := withEvents(client, events).SendFile(ctx, args[0].String(), fileReader, NO_LISTEN, collectTransferOptions(config, events)...)
+		if err != nil {
+			cancel()
+			events.finished(err)
+			reject(err)
+			return
+		}
+		events.setState(STATE_WAITING_FOR_PEER)
+
+		returnObj := js.Global().Get("Object").New()
+		returnObj.Set("code", code)
+		returnObj.Set("done", sendResultPromise(ctx, cancel, resultChan, events))
+		returnObj.Set("cancel", js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+			cancel()
+			return nil
+		}))
+		resolve(returnObj)
+	})
+}
+
+// API_Receive implements `Wormhole.receive(code, [config])`. Text
+// messages resolve to `{type: "text", text}`; files and directories to
+// `{type, name, size, stream, reject}` where stream is a ReadableStream
+// of the (for directories, zipped) contents. The `chunkSize` and
+// `highWaterMark` options bound how much of it is buffered.
+func API_Receive(_ js.Value, args []js.Value) interface{} {
+	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
+		if len(args) != 1 && len(args) != 2 {
+			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d or %d", len(args), 1, 2))
+			return
+		}
+
+		config := optionsArg(args, 1)
+		client := newClientFromConfig(config)
+
+		events := newTransferEvents(config)
+		events.setState(STATE_CONNECTING)
+
+		ctx, cancel := withAbortSignal(context.Background(), config)
+		msg, err := withEvents(client, events).Receive(ctx, args[0].String(), NO_LISTEN, collectTransferOptions(config, events)...)
+		if err != nil {
+			cancel()
+			events.finished(err)
+			reject(err)
+			return
+		}
+
+		returnObj := js.Global().Get("Object").New()
+		switch msg.Type {
+		case wormhole.TransferText:
+			defer cancel()
+			text, err := ioutil.ReadAll(msg)
+			events.finished(err)
+			if err != nil {
+				reject(err)
+				return
+			}
+			returnObj.Set("type", "text")
+			returnObj.Set("text", string(text))
+		default:
+			if msg.Type == wormhole.TransferDirectory {
+				returnObj.Set("type", "directory")
+			} else {
+				returnObj.Set("type", "file")
+			}
+			events.setState(STATE_OFFER_RECEIVED)
+			returnObj.Set("name", msg.Name)
+			returnObj.Set("size", msg.UncompressedBytes64)
+			returnObj.Set("stream", NewIncomingStream(ctx, msg, newStreamOptions(config), cancel, events))
+			returnObj.Set("reject", js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+				return NewPromise(func(resolve ResolveFn, reject RejectFn) {
+					err := msg.Reject()
+					cancel()
+					if err != nil {
+						reject(err)
+						return
+					}
+					resolve(nil)
+				})
+			}))
+		}
+		resolve(returnObj)
+	})
+}
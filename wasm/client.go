@@ -37,13 +37,24 @@ func init() {
 }
 
 func NewClient(_ js.Value, args []js.Value) interface{} {
-	var (
-		config js.Value
-		object = js.Global().Get("Object")
-	)
-	if len(args) > 0 && args[0].InstanceOf(object) {
+	config := js.Undefined()
+	if len(args) > 0 {
 		config = args[0]
-	} else {
+	}
+
+	client := newClientFromConfig(config)
+	clientPtr := uintptr(unsafe.Pointer(client))
+	clientMap[clientPtr] = client
+
+	return clientPtr
+}
+
+// newClientFromConfig builds a client from a JS config object, using
+// the defaults for any falsy property. The defaults are written back to
+// config.
+func newClientFromConfig(config js.Value) *wormhole.Client {
+	object := js.Global().Get("Object")
+	if !config.InstanceOf(object) {
 		config = object.New()
 	}
 
@@ -80,19 +91,21 @@ func NewClient(_ js.Value, args []js.Value) interface{} {
 		RendezvousURL:             rendezvousURL.String(),
 		TransitRelayURL:           transitRelayURL.String(),
 		PassPhraseComponentLength: passPhraseComponentLength.Int(),
+		// every transfer runs on a copy of client (see withEvents),
+		// so the history must exist before the first one
+		CodeHistory: wormhole.NewCodeHistory(),
 	}
-	clientPtr := uintptr(unsafe.Pointer(client))
-	clientMap[clientPtr] = client
-
-	return clientPtr
+	return client
 }
 
+// Client_SendText sends a text message, resolving to the code. An
+// AbortSignal passed as the `signal` option cancels the send.
 func Client_SendText(_ js.Value, args []js.Value) interface{} {
-	ctx := context.Background()
+	ctx, cancel := withAbortSignal(context.Background(), optionsArg(args, 2))
 
 	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
-		if len(args) != 2 {
-			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d", len(args), 2))
+		if len(args) != 2 && len(args) != 3 {
+			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d or %d", len(args), 2, 3))
 			return
 		}
 
@@ -104,11 +117,22 @@ func Client_SendText(_ js.Value, args []js.Value) interface{} {
 			return
 		}
 
-		code, _, err := client.SendText(ctx, msg)
+		events := newTransferEvents(optionsArg(args, 2))
+		events.setState(STATE_CONNECTING)
+
+		code, resultChan, err := withEvents(client, events).SendText(ctx, msg, collectTransferOptions(optionsArg(args, 2), events)...)
 		if err != nil {
+			cancel()
+			events.finished(err)
 			reject(err)
 			return
 		}
+		events.setState(STATE_WAITING_FOR_PEER)
+		go func() {
+			result := <-resultChan
+			cancel()
+			events.finished(result.Error)
+		}()
 		resolve(code)
 	})
 }
@@ -205,8 +229,13 @@ func (fileWrapper *FileWrapper) Seek(offset int64, whence int) (int64, error) {
 	return abs, nil
 }
 
+// Client_SendFile sends a File, Blob or ReadableStream, reading it in
+// chunks as the transfer progresses rather than copying it into wasm
+// memory. ReadableStreams must have their length passed as the `size`
+// option. The send is cancelled by the returned `cancel` function or an
+// AbortSignal passed as the `signal` option.
 func Client_SendFile(_ js.Value, args []js.Value) interface{} {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := withAbortSignal(context.Background(), optionsArg(args, 3))
 
 	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
 		if len(args) != 3 && len(args) != 4 {
@@ -224,8 +253,10 @@ func Client_SendFile(_ js.Value, args []js.Value) interface{} {
 		clientPtr := uintptr(args[0].Int())
 		fileName := args[1].String()
 
+		jsOpts := optionsArg(args, 3)
+
 		fileJSVal := args[2]
-		fileWrapper, err := NewFileWrapper(fileJSVal)
+		fileReader, err := newJSReadSeeker(fileJSVal, jsOpts)
 		if err != nil {
 			reject(err)
 			return
@@ -237,16 +268,18 @@ func Client_SendFile(_ js.Value, args []js.Value) interface{} {
 			return
 		}
 
-		var opts []wormhole.TransferOption
-		if len(args) == 4 {
-			opts = collectTransferOptions(args[3])
-		}
+		events := newTransferEvents(jsOpts)
+		events.setState(STATE_CONNECTING)
 
-		code, resultChan, err := client.SendFile(ctx, fileName, fileWrapper, NO_LISTEN, opts...)
+		opts := collectTransferOptions(jsOpts, events)
+
+		code, resultChan, err := withEvents(client, events).SendFile(ctx, fileName, fileReader, NO_LISTEN, opts...)
 		if err != nil {
+			events.finished(err)
 			reject(err)
 			return
 		}
+		events.setState(STATE_WAITING_FOR_PEER)
 
 		returnObj := js.Global().Get("Object").New()
 		returnObj.Set("code", code)
@@ -258,6 +291,7 @@ func Client_SendFile(_ js.Value, args []js.Value) interface{} {
 			func(resolve ResolveFn, reject RejectFn) {
 				select {
 				case result := <-resultChan:
+					events.finished(result.Error)
 					switch {
 					case result.Error != nil:
 						reject(result.Error)
@@ -274,12 +308,16 @@ func Client_SendFile(_ js.Value, args []js.Value) interface{} {
 	})
 }
 
+// Client_RecvText receives a text message. An AbortSignal passed as
+// the `signal` option cancels the receive.
 func Client_RecvText(_ js.Value, args []js.Value) interface{} {
-	ctx := context.Background()
+	ctx, cancel := withAbortSignal(context.Background(), optionsArg(args, 2))
 
 	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
-		if len(args) != 2 {
-			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d", len(args), 2))
+		defer cancel()
+
+		if len(args) != 2 && len(args) != 3 {
+			reject(fmt.Errorf("invalid number of arguments: %d. expected: %d or %d", len(args), 2, 3))
 			return
 		}
 
@@ -291,13 +329,18 @@ func Client_RecvText(_ js.Value, args []js.Value) interface{} {
 			return
 		}
 
-		msg, err := client.Receive(ctx, code, NO_LISTEN)
+		events := newTransferEvents(optionsArg(args, 2))
+		events.setState(STATE_CONNECTING)
+
+		msg, err := withEvents(client, events).Receive(ctx, code, NO_LISTEN, collectTransferOptions(optionsArg(args, 2), events)...)
 		if err != nil {
+			events.finished(err)
 			reject(err)
 			return
 		}
 
 		msgBytes, err := ioutil.ReadAll(msg)
+		events.finished(err)
 		if err != nil {
 			reject(err)
 			return
@@ -306,8 +349,14 @@ func Client_RecvText(_ js.Value, args []js.Value) interface{} {
 	})
 }
 
+// Client_RecvFile resolves to a reader object for the incoming file.
+// Its contents can either be pulled with `read(buf)` or piped from the
+// ReadableStream returned by `stream()`; progress is reported through
+// the `progressFunc` option either way. An AbortSignal passed as the
+// `signal` option cancels the receive. The `chunkSize` and
+// `highWaterMark` options bound how much of the file is buffered.
 func Client_RecvFile(_ js.Value, args []js.Value) interface{} {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := withAbortSignal(context.Background(), optionsArg(args, 2))
 
 	return NewPromise(func(resolve ResolveFn, reject RejectFn) {
 		// TODO: improve
@@ -331,18 +380,24 @@ func Client_RecvFile(_ js.Value, args []js.Value) interface{} {
 			return
 		}
 
-		var opts []wormhole.TransferOption
-		if len(args) == 3 {
-			opts = collectTransferOptions(args[2])
-		}
+		events := newTransferEvents(optionsArg(args, 2))
+		events.setState(STATE_CONNECTING)
+
+		opts := collectTransferOptions(optionsArg(args, 2), events)
 
-		msg, err := client.Receive(ctx, code, true, opts...)
+		msg, err := withEvents(client, events).Receive(ctx, code, true, opts...)
 		if err != nil {
+			events.finished(err)
 			reject(err)
 			return
 		}
+		events.setState(STATE_OFFER_RECEIVED)
 
-		readerObj := NewFileStreamReader(ctx, msg)
+		streamOpts := newStreamOptions(optionsArg(args, 2))
+		readerObj := NewFileStreamReader(ctx, msg, streamOpts)
+		readerObj.Set("stream", js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+			return NewIncomingStream(ctx, msg, streamOpts, cancel, events)
+		}))
 		readerObj.Set("reject", js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
 			return NewPromise(func(resolve ResolveFn, reject RejectFn) {
 				go func() {
@@ -357,9 +412,8 @@ func Client_RecvFile(_ js.Value, args []js.Value) interface{} {
 	})
 }
 
-func NewFileStreamReader(ctx context.Context, msg *wormhole.IncomingMessage) js.Value {
-	// TODO: parameterize
-	bufSize := 1024 * 4 // 4KiB
+func NewFileStreamReader(ctx context.Context, msg *wormhole.IncomingMessage, opts streamOptions) js.Value {
+	bufSize := opts.chunkSize
 
 	total := 0
 	readFunc := func(_ js.Value, args []js.Value) interface{} {
@@ -419,6 +473,15 @@ func Client_free(_ js.Value, args []js.Value) interface{} {
 	return js.Undefined()
 }
 
+// optionsArg returns the optional options object at args[i], or
+// undefined if it wasn't passed.
+func optionsArg(args []js.Value, i int) js.Value {
+	if len(args) > i {
+		return args[i]
+	}
+	return js.Undefined()
+}
+
 func getClient(clientPtr uintptr) (error, *wormhole.Client) {
 	client, ok := clientMap[clientPtr]
 	if !ok {
@@ -429,27 +492,30 @@ func getClient(clientPtr uintptr) (error, *wormhole.Client) {
 	return nil, client
 }
 
-func collectTransferOptions(jsOpts js.Value) []wormhole.TransferOption {
+func collectTransferOptions(jsOpts js.Value, events *transferEvents) []wormhole.TransferOption {
 	var opts []wormhole.TransferOption
 	if !jsOpts.IsUndefined() {
 		progressFunc := jsOpts.Get("progressFunc")
-		if !progressFunc.IsUndefined() {
-			progressOpt := withProgress(progressFunc)
+		if !progressFunc.IsUndefined() || events != nil {
+			progressOpt := withProgress(progressFunc, events)
 			opts = append(opts, progressOpt)
 		}
 
 		jsCode := jsOpts.Get("code")
 		if !jsCode.IsUndefined() {
-			codeOpt := withCode(jsOpts)
+			codeOpt := withCode(jsCode)
 			opts = append(opts, codeOpt)
 		}
 	}
 	return opts
 }
 
-func withProgress(progressFn js.Value) wormhole.TransferOption {
+func withProgress(progressFn js.Value, events *transferEvents) wormhole.TransferOption {
 	return wormhole.WithProgress(func(sentBytes, totalBytes int64) {
-		progressFn.Invoke(sentBytes, totalBytes)
+		if progressFn.Type() == js.TypeFunction {
+			progressFn.Invoke(sentBytes, totalBytes)
+		}
+		events.progress(sentBytes, totalBytes)
 	})
 }
 
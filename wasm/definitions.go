@@ -18,5 +18,9 @@ func init() {
 	clientObj.Set("recvFile", js.FuncOf(Client_RecvFile))
 
 	wormholeObj.Set("Client", clientObj)
+	wormholeObj.Set("sendText", js.FuncOf(API_SendText))
+	wormholeObj.Set("sendFile", js.FuncOf(API_SendFile))
+	wormholeObj.Set("receive", js.FuncOf(API_Receive))
+	wormholeObj.Set("ErrorCodes", errorCodesObject())
 	js.Global().Set("Wormhole", wormholeObj)
 }
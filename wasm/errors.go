@@ -0,0 +1,72 @@
+//go:build js && wasm
+// +build js,wasm
+
+package wasm
+
+import (
+	"syscall/js"
+
+	"github.com/psanford/wormhole-william/c/codes"
+)
+
+// Error codes set as the `code` property of errors passed to JS.
+const (
+	ERR_CODE_UNKNOWN           = "UNKNOWN"
+	ERR_CODE_WRONG_CODE        = "WRONG_CODE"
+	ERR_CODE_REJECTED          = "REJECTED"
+	ERR_CODE_RELAY_UNREACHABLE = "RELAY_UNREACHABLE"
+	ERR_CODE_TRANSIT_FAILED    = "TRANSIT_FAILED"
+	ERR_CODE_CANCELLED         = "CANCELLED"
+	ERR_CODE_TIMEOUT           = "TIMEOUT"
+)
+
+// errorNames maps each error code to the `name` of the JS Error, so
+// callers can branch on either.
+var errorNames = map[string]string{
+	ERR_CODE_UNKNOWN:           "WormholeError",
+	ERR_CODE_WRONG_CODE:        "WrongCodeError",
+	ERR_CODE_REJECTED:          "TransferRejectedError",
+	ERR_CODE_RELAY_UNREACHABLE: "RelayUnreachableError",
+	ERR_CODE_TRANSIT_FAILED:    "TransitError",
+	ERR_CODE_CANCELLED:         "AbortError",
+	ERR_CODE_TIMEOUT:           "TimeoutError",
+}
+
+func errorCode(err error) string {
+	switch codes.FromError(err, codes.ERR_UNKNOWN) {
+	case codes.ERR_WRONG_CODE:
+		return ERR_CODE_WRONG_CODE
+	case codes.ERR_REJECTED:
+		return ERR_CODE_REJECTED
+	case codes.ERR_RENDEZVOUS_CONNECT:
+		return ERR_CODE_RELAY_UNREACHABLE
+	case codes.ERR_TRANSIT:
+		return ERR_CODE_TRANSIT_FAILED
+	case codes.ERR_CANCELLED:
+		return ERR_CODE_CANCELLED
+	case codes.ERR_TIMEOUT:
+		return ERR_CODE_TIMEOUT
+	}
+	return ERR_CODE_UNKNOWN
+}
+
+// newJSError converts err to a JS Error whose `name` and `code`
+// identify the kind of failure.
+func newJSError(err error) js.Value {
+	code := errorCode(err)
+
+	jsErr := js.Global().Get("Error").New(err.Error())
+	jsErr.Set("name", errorNames[code])
+	jsErr.Set("code", code)
+	return jsErr
+}
+
+// errorCodesObject returns the error codes as a JS object, exposed as
+// Wormhole.ErrorCodes.
+func errorCodesObject() js.Value {
+	obj := js.Global().Get("Object").New()
+	for code := range errorNames {
+		obj.Set(code, code)
+	}
+	return obj
+}
@@ -0,0 +1,146 @@
+//go:build js && wasm
+// +build js,wasm
+
+package wasm
+
+import (
+	"sync"
+	"syscall/js"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// Transfer states reported to JS.
+const (
+	STATE_CONNECTING       = "connecting"
+	STATE_WAITING_FOR_PEER = "waiting-for-peer"
+	STATE_OFFER_RECEIVED   = "offer-received"
+	STATE_TRANSFERRING     = "transferring"
+	STATE_COMPLETED        = "completed"
+	STATE_FAILED           = "failed"
+)
+
+// transferEvents forwards the progress, verifier and state changes of
+// a transfer to JS. They are delivered to the `onStateChange`,
+// `onProgress` and `onVerifier` callbacks of the transfer options, and
+// dispatched as "statechange", "progress" and "verifier" CustomEvents
+// on the `events` EventTarget, whichever are set. A nil
+// *transferEvents ignores all events.
+//
+// The `verifierOk` option mirrors wormhole.Client.VerifierOk: it is
+// called with the verifier and may return a boolean or a Promise of one,
+// so the page can ask the user to compare the verifier with their peer
+// before any data is sent. The transfer is aborted if it returns (or
+// resolves to) false, or rejects.
+type transferEvents struct {
+	target     js.Value
+	onState    js.Value
+	onProgress js.Value
+	onVerifier js.Value
+	verifierOk js.Value
+
+	mu    sync.Mutex
+	state string
+}
+
+func newTransferEvents(jsOpts js.Value) *transferEvents {
+	if jsOpts.Type() != js.TypeObject {
+		return nil
+	}
+
+	return &transferEvents{
+		target:     jsOpts.Get("events"),
+		onState:    jsOpts.Get("onStateChange"),
+		onProgress: jsOpts.Get("onProgress"),
+		onVerifier: jsOpts.Get("onVerifier"),
+		verifierOk: jsOpts.Get("verifierOk"),
+	}
+}
+
+func (e *transferEvents) dispatch(callback js.Value, name string, detail interface{}) {
+	if callback.Type() == js.TypeFunction {
+		callback.Invoke(detail)
+	}
+
+	if e.target.Type() == js.TypeObject && e.target.Get("dispatchEvent").Type() == js.TypeFunction {
+		init := js.Global().Get("Object").New()
+		init.Set("detail", detail)
+		e.target.Call("dispatchEvent", js.Global().Get("CustomEvent").New(name, init))
+	}
+}
+
+// setState reports a state change. Repeated reports of the same state
+// are dropped.
+func (e *transferEvents) setState(state string) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	changed := e.state != state
+	e.state = state
+	e.mu.Unlock()
+
+	if changed {
+		e.dispatch(e.onState, "statechange", state)
+	}
+}
+
+func (e *transferEvents) progress(doneBytes, totalBytes int64) {
+	if e == nil {
+		return
+	}
+
+	e.setState(STATE_TRANSFERRING)
+
+	detail := js.Global().Get("Object").New()
+	detail.Set("transferredBytes", doneBytes)
+	detail.Set("totalBytes", totalBytes)
+	e.dispatch(e.onProgress, "progress", detail)
+}
+
+// verifier reports the verifier and returns whether the transfer may
+// proceed.
+func (e *transferEvents) verifier(verifier string) bool {
+	if e == nil {
+		return true
+	}
+
+	e.dispatch(e.onVerifier, "verifier", verifier)
+
+	if e.verifierOk.Type() != js.TypeFunction {
+		return true
+	}
+
+	ok := e.verifierOk.Invoke(verifier)
+	if ok.Type() == js.TypeObject && ok.Get("then").Type() == js.TypeFunction {
+		var err error
+		ok, err = await(ok)
+		if err != nil {
+			return false
+		}
+	}
+	return ok.Truthy()
+}
+
+// finished reports the final state of a transfer.
+func (e *transferEvents) finished(err error) {
+	if err != nil {
+		e.setState(STATE_FAILED)
+	} else {
+		e.setState(STATE_COMPLETED)
+	}
+}
+
+// withEvents returns a copy of client that reports its verifier to
+// events and lets the verifierOk option abort the transfer, leaving the
+// (possibly shared) client untouched.
+func withEvents(client *wormhole.Client, events *transferEvents) *wormhole.Client {
+	if events == nil {
+		return client
+	}
+
+	c := *client
+	c.VerifierOk = events.verifier
+	return &c
+}
@@ -4,6 +4,7 @@
 package wasm
 
 import (
+	"errors"
 	"syscall/js"
 )
 
@@ -18,7 +19,7 @@ func NewPromise(fn PromiseFn) js.Value {
 			args[0].Invoke(val)
 		}
 		reject := func(err error) {
-			args[1].Invoke(err.Error())
+			args[1].Invoke(newJSError(err))
 		}
 
 		go func() {
@@ -30,3 +31,41 @@ func NewPromise(fn PromiseFn) js.Value {
 	constructor.Release()
 	return jsPromise
 }
+
+// await blocks until the JS promise settles, returning the value it
+// resolved with or an error built from the rejection reason. It must
+// not be called from the JS event loop goroutine.
+func await(promise js.Value) (js.Value, error) {
+	var (
+		valCh = make(chan js.Value, 1)
+		errCh = make(chan error, 1)
+	)
+
+	success := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		valCh <- args[0]
+		return nil
+	})
+	defer success.Release()
+
+	failure := js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		errCh <- jsErrorMessage(args[0])
+		return nil
+	})
+	defer failure.Release()
+
+	promise.Call("then", success, failure)
+
+	select {
+	case val := <-valCh:
+		return val, nil
+	case err := <-errCh:
+		return js.Undefined(), err
+	}
+}
+
+func jsErrorMessage(reason js.Value) error {
+	if reason.Type() == js.TypeObject && reason.Get("message").Type() == js.TypeString {
+		return errors.New(reason.Get("message").String())
+	}
+	return errors.New(reason.String())
+}
@@ -0,0 +1,43 @@
+//go:build js && wasm
+// +build js,wasm
+
+package wasm
+
+import (
+	"context"
+	"syscall/js"
+)
+
+// withAbortSignal returns a context that is cancelled when the
+// AbortSignal in the `signal` property of jsOpts fires. Without a
+// signal it behaves like context.WithCancel.
+func withAbortSignal(parent context.Context, jsOpts js.Value) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if jsOpts.Type() != js.TypeObject {
+		return ctx, cancel
+	}
+
+	signal := jsOpts.Get("signal")
+	if signal.Type() != js.TypeObject {
+		return ctx, cancel
+	}
+
+	if signal.Get("aborted").Truthy() {
+		cancel()
+		return ctx, cancel
+	}
+
+	onAbort := js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+		cancel()
+		return nil
+	})
+	signal.Call("addEventListener", "abort", onAbort)
+
+	go func() {
+		<-ctx.Done()
+		signal.Call("removeEventListener", "abort", onAbort)
+		onAbort.Release()
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,219 @@
+//go:build js && wasm
+// +build js,wasm
+
+package wasm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall/js"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// StreamWrapper adapts a JS ReadableStream of Uint8Array chunks to the
+// io.ReadSeeker SendFile expects. SendFile only seeks to find the size
+// of the file before reading it front to back, so the stream's size
+// must be known up front and seeking is limited to moving the logical
+// offset; reads must happen at the current stream position.
+type StreamWrapper struct {
+	reader js.Value
+	Size   int64
+
+	// index is the number of bytes consumed from the stream, offset
+	// the position set by Seek.
+	index  int64
+	offset int64
+	chunk  []byte
+}
+
+func NewStreamWrapper(stream js.Value, size int64) (*StreamWrapper, error) {
+	if stream.IsUndefined() || stream.IsNull() {
+		return nil, errors.New("NewStreamWrapper: cannot construct from an undefined stream")
+	}
+	if size < 0 {
+		return nil, errors.New("NewStreamWrapper: size must be set for ReadableStreams")
+	}
+
+	return &StreamWrapper{reader: stream.Call("getReader"), Size: size}, nil
+}
+
+func (s *StreamWrapper) Read(p []byte) (int, error) {
+	if s.offset != s.index {
+		return 0, errors.New("StreamWrapper: cannot read from a position other than the current stream position")
+	}
+
+	if len(s.chunk) == 0 {
+		if s.index >= s.Size {
+			return 0, io.EOF
+		}
+
+		result, err := await(s.reader.Call("read"))
+		if err != nil {
+			return 0, err
+		}
+		if result.Get("done").Bool() {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		value := result.Get("value")
+		s.chunk = make([]byte, value.Get("byteLength").Int())
+		js.CopyBytesToGo(s.chunk, value)
+	}
+
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+	s.index += int64(n)
+	s.offset = s.index
+	return n, nil
+}
+
+func (s *StreamWrapper) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = s.offset + offset
+	case io.SeekEnd:
+		abs = s.Size + offset
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("Seek: negative position")
+	}
+
+	s.offset = abs
+	return abs, nil
+}
+
+// Close cancels the underlying stream.
+func (s *StreamWrapper) Close() error {
+	s.reader.Call("cancel")
+	return nil
+}
+
+// newJSReadSeeker wraps a File, Blob or ReadableStream for SendFile.
+// The size of a ReadableStream is taken from the `size` property of
+// jsOpts.
+func newJSReadSeeker(value js.Value, jsOpts js.Value) (io.ReadSeeker, error) {
+	readableStream := js.Global().Get("ReadableStream")
+	if !readableStream.IsUndefined() && value.InstanceOf(readableStream) {
+		size := int64(-1)
+		if !jsOpts.IsUndefined() && jsOpts.Get("size").Type() == js.TypeNumber {
+			size = int64(jsOpts.Get("size").Float())
+		}
+		return NewStreamWrapper(value, size)
+	}
+
+	return NewFileWrapper(value)
+}
+
+// Defaults for streamOptions.
+const (
+	DEFAULT_CHUNK_SIZE      = 1024 * 4  // 4KiB
+	DEFAULT_HIGH_WATER_MARK = 1024 * 64 // 64KiB
+)
+
+// streamOptions bound the memory used while receiving into JS.
+type streamOptions struct {
+	// chunkSize is the largest chunk read from the transfer at a time.
+	chunkSize int
+	// highWaterMark is the number of bytes the ReadableStream queues
+	// before it stops pulling from the transfer. Since the transit
+	// connection is only read when the stream pulls, this caps the
+	// memory used by a receive no matter how slowly it is consumed.
+	highWaterMark int
+}
+
+// newStreamOptions reads the `chunkSize` and `highWaterMark` options
+// from jsOpts, falling back to the defaults. The chunk size never
+// exceeds the high watermark.
+func newStreamOptions(jsOpts js.Value) streamOptions {
+	opts := streamOptions{
+		chunkSize:     DEFAULT_CHUNK_SIZE,
+		highWaterMark: DEFAULT_HIGH_WATER_MARK,
+	}
+
+	if jsOpts.Type() == js.TypeObject {
+		if v := jsOpts.Get("chunkSize"); v.Type() == js.TypeNumber && v.Int() > 0 {
+			opts.chunkSize = v.Int()
+		}
+		if v := jsOpts.Get("highWaterMark"); v.Type() == js.TypeNumber && v.Int() > 0 {
+			opts.highWaterMark = v.Int()
+		}
+	}
+
+	if opts.chunkSize > opts.highWaterMark {
+		opts.chunkSize = opts.highWaterMark
+	}
+	return opts
+}
+
+// NewIncomingStream exposes msg as a JS ReadableStream of Uint8Array
+// chunks, so it can be piped to the File System Access API (or any
+// other WritableStream) without holding the whole payload in wasm
+// memory. Chunks are only read from the transit connection when the
+// stream is pulled, which applies backpressure to the sender once
+// opts.highWaterMark bytes are queued. Cancelling the stream calls
+// cancel. The end of the transfer is reported to events.
+func NewIncomingStream(ctx context.Context, msg *wormhole.IncomingMessage, opts streamOptions, cancel context.CancelFunc, events *transferEvents) js.Value {
+	var pull, cancelFn js.Func
+	release := func() {
+		pull.Release()
+		cancelFn.Release()
+	}
+
+	pull = js.FuncOf(func(_ js.Value, args []js.Value) interface{} {
+		controller := args[0]
+		return NewPromise(func(resolve ResolveFn, reject RejectFn) {
+			if err := ctx.Err(); err != nil {
+				controller.Call("error", newJSError(err))
+				events.finished(err)
+				release()
+				resolve(nil)
+				return
+			}
+
+			buf := make([]byte, opts.chunkSize)
+			n, err := msg.Read(buf)
+			if n > 0 {
+				chunk := js.Global().Get("Uint8Array").New(n)
+				js.CopyBytesToJS(chunk, buf[:n])
+				controller.Call("enqueue", chunk)
+			}
+
+			switch {
+			case err == io.EOF || (err == nil && msg.ReadDone()):
+				controller.Call("close")
+				events.finished(nil)
+				release()
+			case err != nil:
+				controller.Call("error", newJSError(err))
+				events.finished(err)
+				release()
+			}
+			resolve(nil)
+		})
+	})
+
+	cancelFn = js.FuncOf(func(_ js.Value, _ []js.Value) interface{} {
+		cancel()
+		release()
+		return nil
+	})
+
+	source := js.Global().Get("Object").New()
+	source.Set("pull", pull)
+	source.Set("cancel", cancelFn)
+
+	strategyInit := js.Global().Get("Object").New()
+	strategyInit.Set("highWaterMark", opts.highWaterMark)
+	strategy := js.Global().Get("ByteLengthQueuingStrategy").New(strategyInit)
+
+	return js.Global().Get("ReadableStream").New(source, strategy)
+}
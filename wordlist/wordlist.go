@@ -2,6 +2,9 @@ package wordlist
 
 import (
 	"crypto/rand"
+	"fmt"
+	"io"
+	"sort"
 	"strings"
 )
 
@@ -269,20 +272,100 @@ var RawWords = map[byte]WordPair{
 	0xFF: {"zulu", "yucatan"},
 }
 
+// WordAt returns the word for b at position i of a code, counting
+// from the first word after the nameplate. As in the reference
+// implementation, a code starts with a word from the odd list and then
+// alternates between the even and odd lists, so that swapped or
+// dropped words stand out when the code is read aloud.
+func WordAt(i int, b byte) string {
+	if i%2 == 0 {
+		return RawWords[b].Odd
+	}
+	return RawWords[b].Even
+}
+
+// WordsAt returns all the words that may appear at position i of a
+// code, sorted.
+func WordsAt(i int) []string {
+	words := make([]string, 0, len(RawWords))
+	for w := range wordIndex[i%2] {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// CheckWords returns an error naming the first of words, the words of
+// a code after the nameplate, that isn't from the list for its
+// position. Codes chosen by the sender need not pass; it is meant to
+// catch typos in generated ones.
+func CheckWords(words []string) error {
+	for i, w := range words {
+		if _, ok := wordIndex[i%2][strings.ToLower(w)]; !ok {
+			list := "odd"
+			if i%2 == 1 {
+				list = "even"
+			}
+			return fmt.Errorf("word %d, %q, is not in the %s wordlist", i+1, w, list)
+		}
+	}
+	return nil
+}
+
+// wordIndex maps the words of the odd list, at index 0, and of the
+// even list, at index 1, to the bytes they encode.
+var wordIndex = func() [2]map[string]byte {
+	index := [2]map[string]byte{
+		make(map[string]byte, len(RawWords)),
+		make(map[string]byte, len(RawWords)),
+	}
+	for b, pair := range RawWords {
+		index[0][pair.Odd] = b
+		index[1][pair.Even] = b
+	}
+	return index
+}()
+
 func ChooseWords(count int) string {
+	words, err := ChooseWordsFrom(rand.Reader, count)
+	if err != nil {
+		panic(err)
+	}
+	return words
+}
+
+// ChooseWordsFrom is like ChooseWords but reads the random bytes for
+// the words from r instead of crypto/rand, so that tests can generate
+// the same words each time. It returns the error of r instead of
+// panicking.
+func ChooseWordsFrom(r io.Reader, count int) (string, error) {
 	words := make([]string, count)
 	b := make([]byte, 1)
 	for i := 0; i < count; i++ {
-		_, err := rand.Read(b)
+		_, err := io.ReadFull(r, b)
 		if err != nil {
-			panic(err)
-		}
-		if i%2 == 0 {
-			words[i] = RawWords[b[0]].Odd
-		} else {
-			words[i] = RawWords[b[0]].Even
+			return "", err
 		}
+		words[i] = WordAt(i, b[0])
+	}
+
+	return strings.Join(words, "-"), nil
+}
+
+// EncodeBytes returns b encoded as words from the wordlist, one word
+// per byte, alternating between the odd and even lists the same way
+// ChooseWords does. It is used to show short authentication strings
+// that are easier to compare aloud than hex.
+func EncodeBytes(b []byte) string {
+	return strings.Join(EncodeWords(b), "-")
+}
+
+// EncodeWords is like EncodeBytes but returns the words unjoined.
+func EncodeWords(b []byte) []string {
+	words := make([]string, len(b))
+	for i, c := range b {
+		words[i] = WordAt(i, c)
 	}
 
-	return strings.Join(words, "-")
+	return words
 }
@@ -0,0 +1,138 @@
+package wormhole
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/redact"
+)
+
+// AuditRecord is the summary of one transfer written to
+// Client.AuditLog. It never contains the code's secret words or any
+// of the transferred data.
+type AuditRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// TransferID matches the ID in the transfer's logs, events and
+	// results.
+	TransferID string `json:"transfer_id"`
+	// Side is "send" or "receive".
+	Side      string `json:"side"`
+	Nameplate string `json:"nameplate,omitempty"`
+	// Verifier is the hex encoded session verifier, which both sides
+	// of a transfer share.
+	Verifier string `json:"verifier,omitempty"`
+	// Type is "text", "file" or "directory".
+	Type      string `json:"type,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	FileCount int    `json:"file_count,omitempty"`
+	// Transit is "direct" or "relay" for file and directory transfers
+	// that got as far as connecting.
+	Transit string `json:"transit,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	// Result is "ok", "declined" or "error".
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// auditTrail collects the AuditRecord for a single transfer. A nil
+// *auditTrail records nothing.
+type auditTrail struct {
+	w    io.Writer
+	rec  AuditRecord
+	done bool
+}
+
+func (c *Client) newAuditTrail(options *transferOptions) *auditTrail {
+	if c.AuditLog == nil {
+		return nil
+	}
+	return &auditTrail{
+		w: c.AuditLog,
+		rec: AuditRecord{
+			Start:      time.Now(),
+			TransferID: options.transferID,
+			Side:       options.side,
+		},
+	}
+}
+
+func (a *auditTrail) setNameplate(nameplate string) {
+	if a != nil {
+		a.rec.Nameplate = nameplate
+	}
+}
+
+func (a *auditTrail) setOffer(offer Offer) {
+	if a == nil {
+		return
+	}
+	switch offer.Type {
+	case TransferText:
+		a.rec.Type = "text"
+	case TransferFile:
+		a.rec.Type = "file"
+	case TransferDirectory:
+		a.rec.Type = "directory"
+	}
+	a.rec.Name = offer.Name
+	a.rec.Size = offer.TransferBytes64
+	a.rec.FileCount = offer.FileCount
+}
+
+// observe updates the record from a lifecycle event, writing it out
+// once the transfer is over.
+func (a *auditTrail) observe(e Event) {
+	if a == nil {
+		return
+	}
+	switch e.Type {
+	case EventCodeAllocated:
+		if nameplate, err := nameplateFromCode(e.Code); err == nil {
+			a.rec.Nameplate = nameplate
+		}
+	case EventVerifier:
+		a.rec.Verifier = e.Verifier
+	case EventTransitConnected:
+		a.rec.Transit = "direct"
+		if e.Relayed {
+			a.rec.Transit = "relay"
+		}
+	case EventProgress:
+		a.rec.Bytes = e.Bytes
+	case EventCompleted:
+		a.rec.Bytes = e.Bytes
+		a.finish(nil)
+	case EventFailed:
+		a.finish(e.Err)
+	}
+}
+
+// finish writes the record as a single JSON line. Only the first call
+// has any effect.
+func (a *auditTrail) finish(err error) {
+	if a == nil || a.done {
+		return
+	}
+	a.done = true
+
+	a.rec.End = time.Now()
+	switch {
+	case err == nil:
+		a.rec.Result = "ok"
+	case errors.Is(err, ErrOfferDeclined):
+		a.rec.Result = "declined"
+	default:
+		a.rec.Result = "error"
+		a.rec.Error = redact.String(err.Error())
+	}
+
+	line, jsonErr := json.Marshal(a.rec)
+	if jsonErr != nil {
+		return
+	}
+	a.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,290 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// BenchSample is the throughput measured by Bench or BenchRelay for
+// one combination of settings.
+type BenchSample struct {
+	BufferSize        int
+	EncryptionWorkers int
+	// BytesPerSecond counts file data only, not record framing.
+	BytesPerSecond float64
+}
+
+// BenchResult holds the measurements made by Bench or BenchRelay and
+// the settings they recommend.
+type BenchResult struct {
+	Samples []BenchSample
+
+	// BufferSize and EncryptionWorkers are the recommended values for
+	// WithBufferSize and WithEncryptionWorkers.
+	BufferSize        int
+	EncryptionWorkers int
+}
+
+// Options returns the recommended settings as TransferOptions for
+// SendFile, SendStream and SendDirectory.
+func (r *BenchResult) Options() []TransferOption {
+	return []TransferOption{
+		WithBufferSize(r.BufferSize),
+		WithEncryptionWorkers(r.EncryptionWorkers),
+	}
+}
+
+// benchBufferSizes are the buffer sizes Bench tries, chosen so that
+// each record is a power of two in size.
+var benchBufferSizes = []int{
+	defaultBufferSize,
+	1<<16 - secretbox.Overhead,
+	1<<18 - secretbox.Overhead,
+	1<<20 - secretbox.Overhead,
+}
+
+// benchMinGain is how much faster a larger setting has to be than a
+// smaller one to be recommended over it, since larger settings cost
+// more memory.
+const benchMinGain = 1.05
+
+// Bench measures how fast this machine can encrypt, send and decrypt
+// transit records over a loopback TCP connection, and recommends the
+// buffer size and number of encryption workers to send with. This is
+// the upper bound on the throughput of a transfer; it matters on fast
+// links, where the network is not the bottleneck.
+//
+// Bench first tries each buffer size with a single encryption worker,
+// then more workers with the best buffer size. Each measurement takes
+// about d.
+func Bench(ctx context.Context, d time.Duration) (*BenchResult, error) {
+	return runBench(ctx, func(bufferSize, workers int) (float64, error) {
+		return benchLoopback(ctx, bufferSize, workers, d)
+	})
+}
+
+// BenchRelay measures transfers through c's transit relay, in the same
+// way as Bench, by sending streams from c to itself. This includes the
+// network path to the relay and the relay's own limits, so it reflects
+// what relayed transfers from this machine can achieve. Each
+// measurement is a separate transfer through c's rendezvous server
+// whose data takes about d.
+func (c *Client) BenchRelay(ctx context.Context, d time.Duration) (*BenchResult, error) {
+	return runBench(ctx, func(bufferSize, workers int) (float64, error) {
+		return c.benchRelay(ctx, bufferSize, workers, d)
+	})
+}
+
+func runBench(ctx context.Context, measure func(bufferSize, workers int) (float64, error)) (*BenchResult, error) {
+	var result BenchResult
+
+	sample := func(bufferSize, workers int) (float64, error) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		bps, err := measure(bufferSize, workers)
+		if err != nil {
+			return 0, err
+		}
+		result.Samples = append(result.Samples, BenchSample{
+			BufferSize:        bufferSize,
+			EncryptionWorkers: workers,
+			BytesPerSecond:    bps,
+		})
+		return bps, nil
+	}
+
+	var best float64
+	for _, size := range benchBufferSizes {
+		bps, err := sample(size, 1)
+		if err != nil {
+			return nil, err
+		}
+		if result.BufferSize == 0 || bps > best*benchMinGain {
+			best = bps
+			result.BufferSize = size
+		}
+	}
+
+	result.EncryptionWorkers = 1
+	for _, workers := range benchWorkerCounts() {
+		bps, err := sample(result.BufferSize, workers)
+		if err != nil {
+			return nil, err
+		}
+		if bps > best*benchMinGain {
+			best = bps
+			result.EncryptionWorkers = workers
+		}
+	}
+
+	return &result, nil
+}
+
+// benchWorkerCounts returns the numbers of encryption workers, other
+// than 1, that are worth trying on this machine.
+func benchWorkerCounts() []int {
+	var counts []int
+	for n := 2; n <= runtime.GOMAXPROCS(0) && n <= 16; n *= 2 {
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+// benchLoopback sends records of bufferSize bytes over a loopback TCP
+// connection for about d and returns the throughput.
+func benchLoopback(ctx context.Context, bufferSize, workers int, d time.Duration) (float64, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	type acceptResult struct {
+		conn net.Conn
+		err  error
+	}
+	acceptc := make(chan acceptResult, 1)
+	go func() {
+		conn, err := l.Accept()
+		acceptc <- acceptResult{conn, err}
+	}()
+
+	sendConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return 0, err
+	}
+	defer sendConn.Close()
+
+	accepted := <-acceptc
+	if accepted.err != nil {
+		return 0, accepted.err
+	}
+	recvConn := accepted.conn
+	defer recvConn.Close()
+
+	key := make([]byte, 32)
+	sender := newTransportCryptor(sendConn, key, "transit_record_receiver_key", "transit_record_sender_key")
+	receiver := newTransportCryptor(recvConn, key, "transit_record_sender_key", "transit_record_receiver_key")
+	receiver.setReadBufferSize(bufferSize)
+
+	var records recordWriter = sender
+	if workers > 1 {
+		pw := newParallelRecordWriter(sender, workers, bufferSize)
+		defer pw.close()
+		records = pw
+	}
+
+	type readResult struct {
+		n   int64
+		err error
+	}
+	readc := make(chan readResult, 1)
+	go func() {
+		var n int64
+		for {
+			rec, err := receiver.readRecord()
+			if err != nil {
+				readc <- readResult{n, err}
+				return
+			}
+			if len(rec) == 0 {
+				readc <- readResult{n, nil}
+				return
+			}
+			n += int64(len(rec))
+		}
+	}()
+
+	chunk := make([]byte, bufferSize)
+	start := time.Now()
+	for time.Since(start) < d && ctx.Err() == nil {
+		err = records.writeRecord(chunk)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// an empty record marks the end of the data, as for SendStream
+	err = records.writeRecord(nil)
+	if err == nil {
+		err = records.flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	read := <-readc
+	if read.err != nil {
+		return 0, read.err
+	}
+	return float64(read.n) / time.Since(start).Seconds(), nil
+}
+
+// benchRelay sends a stream from c to itself through c's transit relay
+// for about d and returns the throughput seen by the receiver.
+func (c *Client) benchRelay(ctx context.Context, bufferSize, workers int, d time.Duration) (float64, error) {
+	relayOnly := WithTransitPolicy(TransitRelayOnly)
+
+	code, resultCh, err := c.SendStream(ctx, "wormhole-william-bench", &benchReader{duration: d}, true,
+		relayOnly, WithBufferSize(bufferSize), WithEncryptionWorkers(workers))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := c.Receive(ctx, code, true, relayOnly)
+	if err != nil {
+		return 0, err
+	}
+
+	// start the clock at the first byte so that the rendezvous and the
+	// transit connection setup are not counted.
+	var buf [1]byte
+	_, err = io.ReadFull(msg, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, msg)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+
+	result := <-resultCh
+	if !result.OK {
+		if result.Error == nil {
+			return 0, errors.New("bench transfer failed")
+		}
+		return 0, result.Error
+	}
+
+	return float64(n) / elapsed.Seconds(), nil
+}
+
+// benchReader returns zeros for duration from its first Read, then
+// io.EOF.
+type benchReader struct {
+	duration time.Duration
+	deadline time.Time
+}
+
+func (r *benchReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	if r.deadline.IsZero() {
+		r.deadline = now.Add(r.duration)
+	} else if now.After(r.deadline) {
+		return 0, io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,150 @@
+package wormhole
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checkpointVersion is the version of the Checkpoint format written by
+// this package.
+const checkpointVersion = 1
+
+// A Checkpoint records how much of a file transfer the receiver has
+// stored, so that a receiver that crashes or restarts can resume the
+// transfer where it left off with ResumeFromCheckpoint, without
+// reading back what it already has.
+//
+// Checkpoints are made with IncomingMessage.Checkpoint and saved with
+// WriteCheckpoint, typically every so many bytes, once the data read
+// so far has been synced to the destination file. The sender of the
+// resumed transfer must offer a file with the same name and size.
+type Checkpoint struct {
+	Version int `json:"version"`
+	// Path is where the receiver is storing the file.
+	Path string `json:"path"`
+	// Name and Size identify the offer being received.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Code is the code the transfer was received with. Resuming needs
+	// a new code, since codes can only be used once; it is kept to
+	// help users tell checkpoints apart.
+	Code string `json:"code,omitempty"`
+	// Offset is the number of bytes of the file the receiver has
+	// stored, and HashState the state of the SHA-256 of those bytes.
+	Offset    int64  `json:"offset"`
+	HashState []byte `json:"hash_state,omitempty"`
+}
+
+// Checkpoint returns a checkpoint of a file transfer for a receiver
+// storing the file at path, covering the data returned by Read so far.
+func (f *IncomingMessage) Checkpoint(path string) (*Checkpoint, error) {
+	if f.Type != TransferFile || f.streaming {
+		return nil, errors.New("checkpoints are only supported for file transfers of known size")
+	}
+
+	hasher := f.sha256
+	if hasher == nil {
+		hasher = sha256.New()
+	}
+	state, err := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{
+		Version:   checkpointVersion,
+		Path:      path,
+		Name:      f.Name,
+		Size:      f.TransferBytes64,
+		Code:      f.code,
+		Offset:    f.readCount,
+		HashState: state,
+	}, nil
+}
+
+// Matches reports whether cp is a checkpoint of a transfer of the same
+// file as f offers.
+func (cp *Checkpoint) Matches(f *IncomingMessage) bool {
+	return f.Type == TransferFile && !f.streaming && cp.Name == f.Name && cp.Size == f.TransferBytes64
+}
+
+// ResumeFromCheckpoint is like ResumeFrom, but takes the offset and the
+// hash of the bytes the caller already has from cp instead of reading
+// them, so the caller must make sure its copy of the file still holds
+// the cp.Offset bytes it did when cp was made. cp must match the offer.
+func (f *IncomingMessage) ResumeFromCheckpoint(cp *Checkpoint) error {
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d", cp.Version)
+	}
+	if !cp.Matches(f) {
+		return errors.New("checkpoint is for a different offer")
+	}
+	if err := f.checkResume(cp.Offset); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.HashState)
+	if err != nil {
+		return fmt.Errorf("checkpoint hash state: %w", err)
+	}
+
+	f.resume(cp.Offset, hasher)
+	return nil
+}
+
+// WriteCheckpoint saves cp to the file name. It replaces the file
+// atomically, so a crash leaves either the old checkpoint or the new
+// one.
+func WriteCheckpoint(name string, cp *Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data)
+}
+
+// writeFileAtomic replaces the file name with one holding data, which
+// is synced to disk before the rename. The file is only readable by
+// its owner.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// ReadCheckpoint reads a checkpoint saved with WriteCheckpoint.
+func ReadCheckpoint(name string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp Checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, fmt.Errorf("read checkpoint %s: %w", name, err)
+	}
+	return &cp, nil
+}
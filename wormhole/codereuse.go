@@ -0,0 +1,98 @@
+package wormhole
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// maxRecentCodes is the number of codes a Client remembers for
+// detecting reuse. Older codes are forgotten first.
+const maxRecentCodes = 1024
+
+// CodeReusedError is the error a transfer is refused with when it
+// would use a code that the same Client already used for another
+// transfer, unless CodeReuseHook allows it.
+//
+// Reusing a code gives anyone who saw or guessed it the first time
+// another chance to join a transfer, so codes should only be used once.
+type CodeReusedError struct {
+	// Nameplate is the nameplate of the reused code. The rest of the
+	// code is left out so that it does not end up in logs.
+	Nameplate string
+}
+
+func (e *CodeReusedError) Error() string {
+	return fmt.Sprintf("code with nameplate %s was already used by this client", e.Nameplate)
+}
+
+// A CodeHistory remembers the hashes of the last 1024 codes used for
+// transfers, for detecting reuse; see Client.CodeReuseHook. Sending and
+// receiving with a code are tracked separately, so that a Client can
+// receive a transfer it sent itself. A CodeHistory is safe for
+// concurrent use.
+type CodeHistory struct {
+	mu    sync.Mutex
+	seen  map[[sha256.Size]byte]bool
+	order [][sha256.Size]byte
+}
+
+// NewCodeHistory returns an empty CodeHistory.
+func NewCodeHistory() *CodeHistory {
+	return &CodeHistory{
+		seen: make(map[[sha256.Size]byte]bool),
+	}
+}
+
+// usedCodes returns c.CodeHistory, setting it to a new CodeHistory
+// first if it is nil. Concurrent transfers may be the first to use c,
+// so it is set atomically.
+func (c *Client) usedCodes() *CodeHistory {
+	p := (*unsafe.Pointer)(unsafe.Pointer(&c.CodeHistory))
+	if h := atomic.LoadPointer(p); h != nil {
+		return (*CodeHistory)(h)
+	}
+	atomic.CompareAndSwapPointer(p, nil, unsafe.Pointer(NewCodeHistory()))
+	return (*CodeHistory)(atomic.LoadPointer(p))
+}
+
+func codeHash(side, code string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(side + "\x00" + code))
+}
+
+// checkCodeReuse returns a CodeReusedError if c already used code on
+// side for a transfer and CodeReuseHook does not allow it.
+func (c *Client) checkCodeReuse(side, code string) error {
+	h := c.usedCodes()
+	h.mu.Lock()
+	used := h.seen[codeHash(side, code)]
+	h.mu.Unlock()
+
+	if !used || (c.CodeReuseHook != nil && c.CodeReuseHook(code)) {
+		return nil
+	}
+
+	nameplate, _ := nameplateFromCode(code)
+	return &CodeReusedError{Nameplate: nameplate}
+}
+
+// rememberCode records that c used code on side for a transfer.
+func (c *Client) rememberCode(side, code string) {
+	sum := codeHash(side, code)
+
+	h := c.usedCodes()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.seen[sum] {
+		return
+	}
+	if len(h.order) >= maxRecentCodes {
+		delete(h.seen, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.seen[sum] = true
+	h.order = append(h.order, sum)
+}
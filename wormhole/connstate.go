@@ -0,0 +1,96 @@
+package wormhole
+
+import (
+	"fmt"
+
+	"github.com/psanford/wormhole-william/rendezvous"
+)
+
+// ConnLayer identifies the connection of a transfer that a
+// ConnStateChange is about.
+type ConnLayer int
+
+const (
+	// ConnRendezvous is the connection to the rendezvous server.
+	ConnRendezvous ConnLayer = iota + 1
+	// ConnTransit is the transit connection of a file or directory
+	// transfer, either directly to the peer or through a transit relay.
+	ConnTransit
+)
+
+func (l ConnLayer) String() string {
+	switch l {
+	case ConnRendezvous:
+		return "Rendezvous"
+	case ConnTransit:
+		return "Transit"
+	default:
+		return fmt.Sprintf("ConnLayerUnknown<%d>", l)
+	}
+}
+
+// ConnState is the state of one of the connections of a transfer.
+type ConnState int
+
+const (
+	// ConnConnected is reported once the connection is up.
+	ConnConnected ConnState = iota + 1
+	// ConnDisconnected is reported once when a connection that was up
+	// goes down.
+	ConnDisconnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnected:
+		return "Connected"
+	case ConnDisconnected:
+		return "Disconnected"
+	default:
+		return fmt.Sprintf("ConnStateUnknown<%d>", s)
+	}
+}
+
+// ConnStateChange is passed to Client.ConnStateHook when one of the
+// connections of a transfer changes state.
+type ConnStateChange struct {
+	TransferID string
+	Layer      ConnLayer
+	State      ConnState
+	// Relayed is set for transit connections that go through a
+	// transit relay.
+	Relayed bool
+	// Reason is set for ConnDisconnected if the connection was lost
+	// because of an error. It is nil if the connection was closed
+	// because the transfer no longer needed it.
+	Reason error
+}
+
+func (o *transferOptions) connStateChanged(change ConnStateChange) {
+	if o.connStateHook == nil {
+		return
+	}
+	change.TransferID = o.transferID
+	o.connStateHook(change)
+}
+
+// rendezvousConnStateHook returns a rendezvous.ClientOption that
+// reports the rendezvous connection's state changes to the transfer's
+// hook, or nil if there is no hook.
+func (o *transferOptions) rendezvousConnStateHook() rendezvous.ClientOption {
+	if o.connStateHook == nil {
+		return nil
+	}
+	return rendezvous.WithConnStateHook(func(state rendezvous.ConnState, reason error) {
+		change := ConnStateChange{Layer: ConnRendezvous, Reason: reason}
+		switch state {
+		case rendezvous.ConnConnected:
+			change.State = ConnConnected
+		case rendezvous.ConnDisconnected:
+			change.State = ConnDisconnected
+		default:
+			return
+		}
+		o.connStateChanged(change)
+	})
+}
@@ -0,0 +1,435 @@
+package wormhole
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Delta sync lets a receiver that has an older copy of a file, the
+// basis, receive only the parts of the new file that changed, in the
+// manner of rsync. The receiver asks for it in its answer, with the
+// size of the basis and the block size it split the basis into, and
+// after the transit connection is made sends the signature of the
+// basis: a rolling checksum and a strong hash of each block. The
+// sender then looks for those blocks at any offset of its file, and
+// sends the file as a sequence of records that either hold literal
+// data or refer to a run of blocks of the basis. The checksums of the
+// whole file are computed and compared as usual.
+const (
+	deltaMinBlockSize = 2 << 10
+	deltaMaxBlockSize = 1 << 20
+	// deltaMaxBlocks bounds the size of a signature, which the sender
+	// holds in memory.
+	deltaMaxBlocks = 1 << 20
+
+	// deltaStrongSize is the size of the strong hash of a block, a
+	// truncated SHA-256. A collision only costs a failed transfer,
+	// since the checksum of the whole file is still checked.
+	deltaStrongSize = 16
+	deltaSigSize    = 4 + deltaStrongSize
+	// deltaSigRecordBlocks is the number of block signatures sent in
+	// each record of the signature.
+	deltaSigRecordBlocks = 4096
+
+	// deltaMaxLiteral is the most data a literal record holds, and
+	// deltaMaxCopy the most data a copy record refers to, unless the
+	// block size is larger.
+	deltaMaxLiteral = 64 << 10
+	deltaMaxCopy    = 1 << 20
+)
+
+// The records of a delta transfer start with the type of operation.
+const (
+	// deltaOpLiteral is followed by data to append to the file.
+	deltaOpLiteral byte = iota
+	// deltaOpCopy is followed by the uvarint index of the first block
+	// of the basis to append, and the uvarint number of blocks.
+	deltaOpCopy
+)
+
+// deltaAnswer is the receiver's request for a delta transfer. It is
+// only sent to peers advertising abilityDeltaV1.
+type deltaAnswer struct {
+	// BlockSize is the size of the blocks of the basis, of which the
+	// last may be shorter.
+	BlockSize int `json:"block_size"`
+	// Size is the size of the basis.
+	Size int64 `json:"size"`
+}
+
+// blocks returns the number of blocks of the basis.
+func (a *deltaAnswer) blocks() int64 {
+	return (a.Size + int64(a.BlockSize) - 1) / int64(a.BlockSize)
+}
+
+// deltaBlockSize returns the block size to split a basis of size bytes
+// into: about the square root of the size, as rsync uses, and large
+// enough that the signature is no more than deltaMaxBlocks blocks.
+func deltaBlockSize(size int64) (int, error) {
+	bs := deltaMinBlockSize
+	for bs < deltaMaxBlockSize && (int64(bs)*int64(bs) < size || int64(bs)*deltaMaxBlocks < size) {
+		bs *= 2
+	}
+	if int64(bs)*deltaMaxBlocks < size {
+		return 0, fmt.Errorf("basis of %d bytes is too large for delta transfers", size)
+	}
+	return bs, nil
+}
+
+// rollingSum is the weak checksum of rsync, which can be moved along
+// the data a byte at a time.
+type rollingSum struct {
+	a, b, n uint32
+}
+
+func (s *rollingSum) init(p []byte) {
+	s.a, s.b, s.n = 0, 0, uint32(len(p))
+	for i, c := range p {
+		s.a += uint32(c)
+		s.b += (s.n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll moves the window one byte on, dropping out and adding in.
+func (s *rollingSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s *rollingSum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+func deltaStrongHash(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:deltaStrongSize]
+}
+
+// deltaBasis is the receiver's side of a delta transfer.
+type deltaBasis struct {
+	r       io.ReaderAt
+	answer  deltaAnswer
+	sig     []byte
+	scratch []byte
+}
+
+// newDeltaBasis computes the signature of basis, of size bytes.
+func newDeltaBasis(basis io.ReaderAt, size int64) (*deltaBasis, error) {
+	bs, err := deltaBlockSize(size)
+	if err != nil {
+		return nil, err
+	}
+	b := &deltaBasis{
+		r:      basis,
+		answer: deltaAnswer{BlockSize: bs, Size: size},
+	}
+
+	blocks := b.answer.blocks()
+	b.sig = make([]byte, 0, blocks*deltaSigSize)
+	block := make([]byte, bs)
+	var sum rollingSum
+	for i := int64(0); i < blocks; i++ {
+		n, err := b.read(block, i*int64(bs))
+		if err != nil {
+			return nil, fmt.Errorf("read basis: %w", err)
+		}
+		sum.init(block[:n])
+		var weak [4]byte
+		binary.BigEndian.PutUint32(weak[:], sum.sum())
+		b.sig = append(b.sig, weak[:]...)
+		b.sig = append(b.sig, deltaStrongHash(block[:n])...)
+	}
+	return b, nil
+}
+
+// read reads the part of the basis at off into p, or as much of it as
+// there is.
+func (b *deltaBasis) read(p []byte, off int64) (int, error) {
+	if rest := b.answer.Size - off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := b.r.ReadAt(p, off)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// writeSignature sends the signature of the basis to the sender.
+func (b *deltaBasis) writeSignature(w recordWriter) error {
+	sig := b.sig
+	for len(sig) > 0 {
+		n := len(sig)
+		if n > deltaSigRecordBlocks*deltaSigSize {
+			n = deltaSigRecordBlocks * deltaSigSize
+		}
+		if err := w.writeRecord(sig[:n]); err != nil {
+			return err
+		}
+		sig = sig[n:]
+	}
+	return w.flush()
+}
+
+// expand returns the file data that rec, a record of the delta
+// transfer, stands for. The data is only valid until the next call.
+func (b *deltaBasis) expand(rec []byte) ([]byte, error) {
+	if len(rec) < 2 {
+		return nil, newTransferError(CodeProtocol, PhaseData, errors.New("short delta record"))
+	}
+	switch rec[0] {
+	case deltaOpLiteral:
+		return rec[1:], nil
+	case deltaOpCopy:
+		r := bytes.NewReader(rec[1:])
+		first, err1 := binary.ReadUvarint(r)
+		count, err2 := binary.ReadUvarint(r)
+		bs := uint64(b.answer.BlockSize)
+		maxCount := uint64(deltaMaxCopy) / bs
+		if maxCount < 1 {
+			maxCount = 1
+		}
+		if err1 != nil || err2 != nil || r.Len() != 0 || count < 1 || count > maxCount ||
+			first >= uint64(b.answer.blocks()) || count > uint64(b.answer.blocks())-first {
+			return nil, newTransferError(CodeProtocol, PhaseData, errors.New("invalid delta copy record"))
+		}
+		if need := int(count * bs); cap(b.scratch) < need {
+			b.scratch = make([]byte, need)
+		}
+		n, err := b.read(b.scratch[:count*bs], int64(first*bs))
+		if err != nil {
+			return nil, fmt.Errorf("read basis: %w", err)
+		}
+		return b.scratch[:n], nil
+	default:
+		return nil, newTransferError(CodeProtocol, PhaseData, fmt.Errorf("unknown delta record type %d", rec[0]))
+	}
+}
+
+// recordReader reads the records of a transfer.
+type recordReader interface {
+	readRecord() ([]byte, error)
+}
+
+// deltaSignature is the sender's copy of the signature of the
+// receiver's basis.
+type deltaSignature struct {
+	blockSize int
+	blocks    int
+	// lastLen is the length of the last block.
+	lastLen int
+	weak    map[uint32][]int32
+	strong  []byte
+}
+
+// readDeltaSignature reads the signature the receiver sends for the
+// basis described by a.
+func readDeltaSignature(r recordReader, a *deltaAnswer) (*deltaSignature, error) {
+	if a.BlockSize < deltaMinBlockSize || a.BlockSize > deltaMaxBlockSize ||
+		a.Size < 0 || a.Size > int64(a.BlockSize)*deltaMaxBlocks {
+		return nil, newTransferError(CodeProtocol, PhaseData,
+			fmt.Errorf("invalid delta request for %d bytes in blocks of %d", a.Size, a.BlockSize))
+	}
+
+	sig := &deltaSignature{
+		blockSize: a.BlockSize,
+		blocks:    int(a.blocks()),
+		weak:      make(map[uint32][]int32),
+	}
+	sig.lastLen = int(a.Size - int64(sig.blocks-1)*int64(a.BlockSize))
+	sig.strong = make([]byte, 0, sig.blocks*deltaStrongSize)
+
+	for i := 0; i < sig.blocks; {
+		rec, err := r.readRecord()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) == 0 || len(rec)%deltaSigSize != 0 || len(rec)/deltaSigSize > sig.blocks-i {
+			return nil, newTransferError(CodeProtocol, PhaseData, errors.New("invalid delta signature"))
+		}
+		for ; len(rec) > 0; rec = rec[deltaSigSize:] {
+			weak := binary.BigEndian.Uint32(rec)
+			sig.weak[weak] = append(sig.weak[weak], int32(i))
+			sig.strong = append(sig.strong, rec[4:deltaSigSize]...)
+			i++
+		}
+	}
+	return sig, nil
+}
+
+func (s *deltaSignature) blockLen(i int) int {
+	if i == s.blocks-1 {
+		return s.lastLen
+	}
+	return s.blockSize
+}
+
+// match returns the index of a block of the basis that holds data,
+// whose rolling checksum is weak.
+func (s *deltaSignature) match(weak uint32, data []byte) (int, bool) {
+	candidates := s.weak[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	strong := deltaStrongHash(data)
+	for _, i := range candidates {
+		if s.blockLen(int(i)) == len(data) &&
+			bytes.Equal(s.strong[int(i)*deltaStrongSize:int(i+1)*deltaStrongSize], strong) {
+			return int(i), true
+		}
+	}
+	return 0, false
+}
+
+// deltaEncoder writes the records of a delta transfer.
+type deltaEncoder struct {
+	sig      *deltaSignature
+	w        recordWriter
+	progress func(n int64)
+	rec      []byte
+
+	// copyFirst and copyCount are the run of blocks of the basis
+	// that is yet to be written.
+	copyFirst, copyCount int
+	maxCount             int
+}
+
+func (e *deltaEncoder) literal(data []byte) error {
+	if err := e.flushCopy(); err != nil || len(data) == 0 {
+		return err
+	}
+	e.rec = append(append(e.rec[:0], deltaOpLiteral), data...)
+	if err := e.w.writeRecord(e.rec); err != nil {
+		return err
+	}
+	e.progress(int64(len(data)))
+	return nil
+}
+
+func (e *deltaEncoder) copyBlock(i int) error {
+	if e.copyCount > 0 && i == e.copyFirst+e.copyCount && e.copyCount < e.maxCount {
+		e.copyCount++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyFirst, e.copyCount = i, 1
+	return nil
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	var first, count [binary.MaxVarintLen64]byte
+	e.rec = append(e.rec[:0], deltaOpCopy)
+	e.rec = append(e.rec, first[:binary.PutUvarint(first[:], uint64(e.copyFirst))]...)
+	e.rec = append(e.rec, count[:binary.PutUvarint(count[:], uint64(e.copyCount))]...)
+	if err := e.w.writeRecord(e.rec); err != nil {
+		return err
+	}
+
+	n := int64(e.copyCount-1)*int64(e.sig.blockSize) + int64(e.sig.blockLen(e.copyFirst+e.copyCount-1))
+	e.copyCount = 0
+	e.progress(n)
+	return nil
+}
+
+// encode sends the data read from r as a delta against the basis
+// described by s. Everything read from r is passed to hash, in order,
+// and progress is called with the number of bytes of the file each
+// record covers.
+func (s *deltaSignature) encode(r io.Reader, w recordWriter, hash func([]byte), progress func(n int64)) error {
+	bs := s.blockSize
+	e := &deltaEncoder{sig: s, w: w, progress: progress, maxCount: deltaMaxCopy / bs}
+	if e.maxCount < 1 {
+		e.maxCount = 1
+	}
+
+	// buf[lit:p] is data not found in the basis and yet to be sent,
+	// and buf[p:p+bs] the window being looked up.
+	var (
+		buf    = make([]byte, deltaMaxLiteral+2*bs)
+		n      int
+		lit, p int
+		eof    bool
+		sum    rollingSum
+		summed bool
+	)
+	for {
+		if !eof && n-p < bs {
+			copy(buf, buf[lit:n])
+			n, p, lit = n-lit, p-lit, 0
+			for !eof && n-p < bs {
+				m, err := r.Read(buf[n:])
+				hash(buf[n : n+m])
+				n += m
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if n-p < bs {
+			break
+		}
+
+		if !summed {
+			sum.init(buf[p : p+bs])
+			summed = true
+		}
+		if i, ok := s.match(sum.sum(), buf[p:p+bs]); ok {
+			if err := e.literal(buf[lit:p]); err != nil {
+				return err
+			}
+			if err := e.copyBlock(i); err != nil {
+				return err
+			}
+			p += bs
+			lit = p
+			summed = false
+			continue
+		}
+
+		if p+bs < n {
+			sum.roll(buf[p], buf[p+bs])
+		} else {
+			summed = false
+		}
+		p++
+		if p-lit >= deltaMaxLiteral {
+			if err := e.literal(buf[lit:p]); err != nil {
+				return err
+			}
+			lit = p
+		}
+	}
+
+	// the rest is shorter than a block, but may still be the short
+	// last block of the basis
+	if tail := buf[p:n]; len(tail) > 0 && len(tail) == s.lastLen {
+		sum.init(tail)
+		if i, ok := s.match(sum.sum(), tail); ok {
+			if err := e.literal(buf[lit:p]); err != nil {
+				return err
+			}
+			if err := e.copyBlock(i); err != nil {
+				return err
+			}
+			lit = n
+		}
+	}
+	if err := e.literal(buf[lit:n]); err != nil {
+		return err
+	}
+	return e.flushCopy()
+}
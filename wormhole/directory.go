@@ -0,0 +1,474 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// ReceivedFile describes a file in a directory read with a
+// DirectoryReader.
+type ReceivedFile struct {
+	// Path is the slash separated path of the file relative to the
+	// received directory. It never starts with a slash or contains ".."
+	// elements.
+	Path string
+	// Mode holds the type bits sent by the peer and the permissions
+	// that Extract gives the file; see ExtractZip.
+	Mode os.FileMode
+	// Size is the size of the file as recorded by the peer.
+	Size int64
+}
+
+// A DirectoryReader provides sequential access to the files of a
+// received directory, in the manner of archive/tar.Reader: Next
+// advances to the next file and Read reads its contents.
+type DirectoryReader struct {
+	spool *os.File
+	files []*zip.File
+	next  int
+	cur   io.ReadCloser
+}
+
+// Directory receives a TransferDirectory offer and returns a
+// DirectoryReader for its files, so that callers do not have to deal
+// with the zip file the directory is sent as.
+//
+// The zip file is spooled to an unlinked temporary file in tmpDir, or
+// the default directory for temporary files if tmpDir is empty, because
+// it cannot be read until all of it has arrived. Its contents are
+// checked against the offer and the ZipLimits set with WithZipLimits,
+// or DefaultZipLimits, before Directory returns. Directory must be
+// called instead of Read, and the DirectoryReader must be closed to
+// release the temporary file.
+func (f *IncomingMessage) Directory(tmpDir string) (*DirectoryReader, error) {
+	if f.Type != TransferDirectory {
+		return nil, errors.New("Directory is only supported for TransferDirectory")
+	}
+	if f.transferInitialized {
+		return nil, errors.New("cannot call Directory after calls to Read")
+	}
+
+	spool, err := ioutil.TempFile(tmpDir, "wormhole-william-dir")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(spool.Name())
+
+	size, err := io.Copy(spool, f)
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		spool.Close()
+		return nil, fmt.Errorf("read zip: %w", err)
+	}
+
+	limits := DefaultZipLimits
+	if f.options.zipLimits != nil {
+		limits = *f.options.zipLimits
+	}
+	err = limits.check(zr.File, size)
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	var uncompressed uint64
+	for _, zf := range zr.File {
+		if !safeZipPath(zf.Name) {
+			spool.Close()
+			return nil, fmt.Errorf("dangerous file name in zip: %q", zf.Name)
+		}
+		uncompressed += zf.UncompressedSize64
+	}
+	if int64(uncompressed) != f.UncompressedBytes64 || len(zr.File) != f.FileCount {
+		spool.Close()
+		return nil, errors.New("zip contents do not match the offer")
+	}
+
+	return &DirectoryReader{spool: spool, files: zr.File}, nil
+}
+
+// EachFile receives a TransferDirectory offer like Directory and calls
+// fn for each of its files in turn, with a reader for the file's
+// contents that is only valid until fn returns. fn may read as much or
+// as little of each file as it wants, so it can filter files, rename
+// them or copy them to its own storage. If fn returns an error,
+// EachFile stops and returns it.
+//
+// Directory entries are passed to fn like files, with an empty reader
+// and a Mode for which IsDir is true.
+func (f *IncomingMessage) EachFile(tmpDir string, fn func(file *ReceivedFile, r io.Reader) error) error {
+	d, err := f.Directory(tmpDir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	for {
+		file, err := d.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// hide Next from fn
+		err = fn(file, struct{ io.Reader }{d})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// safeZipPath reports whether name stays inside the directory it is
+// extracted to, and on Windows whether it is a name Windows can create.
+func safeZipPath(name string) bool {
+	return safeZipPathOn(name, runtime.GOOS == "windows")
+}
+
+// safeZipPathOn is safeZipPath for Windows, if windows is set, or for
+// other systems.
+func safeZipPathOn(name string, windows bool) bool {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return false
+	}
+	// zip paths always use slashes; a backslash or drive letter would
+	// be a separator or volume on Windows.
+	if strings.ContainsRune(name, '\\') || filepath.VolumeName(filepath.FromSlash(name)) != "" {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
+		}
+		if windows && elem != "" && elem != "." && !windowsSafeName(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// windowsReservedNames are the device names Windows reserves in every
+// directory, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// windowsSafeName reports whether elem can be used as a file name on
+// Windows. Reserved device names would open the device, a colon would
+// write to an alternate data stream of another file, and trailing dots
+// and spaces are silently dropped, so that two names can refer to the
+// same file.
+func windowsSafeName(elem string) bool {
+	if strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+		return false
+	}
+	for _, r := range elem {
+		if r < 0x20 || strings.ContainsRune(`<>:"|?*`, r) {
+			return false
+		}
+	}
+	base := strings.TrimRight(strings.SplitN(elem, ".", 2)[0], " ")
+	return !windowsReservedNames[strings.ToUpper(base)]
+}
+
+// extractMode returns mode, the mode of a file or directory in a zip,
+// with the permissions it is extracted with. Setuid, setgid and sticky
+// bits are dropped, and so is write permission for the group and
+// others, which zips made on Windows grant to everyone. Zips that
+// record no permissions, as some Windows tools make, get 0644 for files
+// and 0755 for directories.
+func extractMode(mode os.FileMode) os.FileMode {
+	perm := mode.Perm() &^ 0022
+	if mode.Perm() == 0 {
+		perm = 0644
+		if mode.IsDir() {
+			perm = 0755
+		}
+	}
+	return mode&os.ModeType | perm
+}
+
+// Next advances to the next file in the directory. It returns io.EOF
+// once there are no more files.
+func (d *DirectoryReader) Next() (*ReceivedFile, error) {
+	d.closeCurrent()
+
+	if d.next >= len(d.files) {
+		return nil, io.EOF
+	}
+	zf := d.files[d.next]
+	d.next++
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open %s in zip: %w", zf.Name, err)
+	}
+	d.cur = rc
+
+	return &ReceivedFile{
+		Path: zf.Name,
+		Mode: extractMode(zf.Mode()),
+		Size: int64(zf.UncompressedSize64),
+	}, nil
+}
+
+// Read reads from the current file. It returns io.EOF at the end of
+// the file, or before the first call to Next.
+func (d *DirectoryReader) Read(p []byte) (int, error) {
+	if d.cur == nil {
+		return 0, io.EOF
+	}
+	return d.cur.Read(p)
+}
+
+// Extract writes the remaining files of the directory under dir, which
+// must already exist, as ExtractZip does. The limits were already
+// checked by Directory.
+func (d *DirectoryReader) Extract(dir string) error {
+	d.closeCurrent()
+
+	files := d.files[d.next:]
+	d.next = len(d.files)
+	return extractFiles(files, dir)
+}
+
+// Close releases the temporary file holding the directory.
+func (d *DirectoryReader) Close() error {
+	d.closeCurrent()
+	return d.spool.Close()
+}
+
+func (d *DirectoryReader) closeCurrent() {
+	if d.cur != nil {
+		d.cur.Close()
+		d.cur = nil
+	}
+}
+
+// ExtractZip extracts the received directory zip file in r, of size
+// bytes, into dir, which must already exist, within DefaultZipLimits. It refuses, before writing
+// the offending file, entries that would end up outside dir: absolute
+// paths, ".." elements, symlinks, and paths through symlinks that
+// already exist in dir. It never overwrites existing files.
+//
+// Only the permission bits of each file's mode are kept, without write
+// permission for the group and others. Files whose mode records no
+// permissions get 0644. On Windows, where only the owner's write bit
+// has an effect, as the read-only attribute, ExtractZip also refuses
+// names that Windows reserves for devices or would alter, such as
+// "CON", "a:b" or "a.". ExtractZip does not check the zip against the
+// offer; Directory does.
+func ExtractZip(r io.ReaderAt, size int64, dir string) error {
+	return DefaultZipLimits.ExtractZip(r, size, dir)
+}
+
+// ExtractZip is like the ExtractZip function but checks the zip against
+// l instead of DefaultZipLimits.
+func (l ZipLimits) ExtractZip(r io.ReaderAt, size int64, dir string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("read zip: %w", err)
+	}
+	err = l.check(zr.File, size)
+	if err != nil {
+		return err
+	}
+	return extractFiles(zr.File, dir)
+}
+
+func extractFiles(files []*zip.File, dir string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	// dir itself may be a symlink; only links below it are refused.
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range files {
+		err := extractFile(zf, root)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(zf *zip.File, root string) error {
+	if !safeZipPath(zf.Name) {
+		return fmt.Errorf("dangerous file name in zip: %q", zf.Name)
+	}
+
+	mode := zf.Mode()
+	isDir := mode.IsDir() || strings.HasSuffix(zf.Name, "/")
+	if !isDir && !mode.IsRegular() {
+		return fmt.Errorf("unsupported file type %s in zip: %q", mode&os.ModeType, zf.Name)
+	}
+
+	if isDir {
+		_, err := mkdirInside(root, zf.Name)
+		return err
+	}
+
+	parent, err := mkdirInside(root, path.Dir(zf.Name))
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(parent, path.Base(zf.Name))
+
+	rc, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("open %s in zip: %w", zf.Name, err)
+	}
+	defer rc.Close()
+
+	// O_EXCL also refuses to follow a symlink at p
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, rc)
+	if err == nil {
+		err = f.Chmod(extractMode(mode).Perm())
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", p, err)
+	}
+	return nil
+}
+
+// mkdirInside creates the directory rel, a slash separated path, and
+// any missing parents below root and returns its path. It refuses to
+// go through symlinks, so the directory is always inside root.
+func mkdirInside(root, rel string) (string, error) {
+	p := root
+	for _, elem := range strings.Split(rel, "/") {
+		if elem == "" || elem == "." {
+			continue
+		}
+		p = filepath.Join(p, elem)
+
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(p, 0700)
+			if err != nil && !os.IsExist(err) {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract through symlink %s", p)
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("%s is not a directory", p)
+		}
+	}
+	return p, nil
+}
+
+// ZipLimits bounds what a received directory zip may expand to, as
+// protection against zip bombs: small zips that extract to enough data
+// or files to exhaust the receiver's disk or memory. A zero field means
+// no limit.
+type ZipLimits struct {
+	// MaxEntries is the maximum number of files and directories.
+	MaxEntries int
+	// MaxUncompressedBytes is the maximum total size of the files.
+	MaxUncompressedBytes int64
+	// MaxCompressionRatio is the maximum ratio of the total size of the
+	// files to the size of the zip.
+	MaxCompressionRatio float64
+}
+
+// DefaultZipLimits are the limits used by ExtractZip, and by Directory
+// unless WithZipLimits is used. Deflate cannot compress by much more
+// than 1000:1, so only zips that reuse compressed data between entries,
+// or use other tricks, exceed the default ratio.
+var DefaultZipLimits = ZipLimits{
+	MaxEntries:           1 << 20,
+	MaxUncompressedBytes: 1 << 40,
+	MaxCompressionRatio:  1100,
+}
+
+// ZipLimitError is the error a directory zip is refused with when it
+// exceeds its ZipLimits or has entries that share compressed data.
+type ZipLimitError struct {
+	Reason string
+}
+
+func (e *ZipLimitError) Error() string {
+	return "zip refused: " + e.Reason
+}
+
+// check checks the entries of a zip of size bytes against l. Entries
+// whose data overlaps are always refused: no zip writer produces them,
+// and they let a zip bomb expand the same compressed data many times.
+func (l ZipLimits) check(files []*zip.File, size int64) error {
+	if l.MaxEntries > 0 && len(files) > l.MaxEntries {
+		return &ZipLimitError{Reason: fmt.Sprintf("%d entries exceeds limit of %d", len(files), l.MaxEntries)}
+	}
+
+	var total uint64
+	for _, zf := range files {
+		total += zf.UncompressedSize64
+		if total < zf.UncompressedSize64 {
+			return &ZipLimitError{Reason: "total size overflows"}
+		}
+	}
+	if l.MaxUncompressedBytes > 0 && total > uint64(l.MaxUncompressedBytes) {
+		return &ZipLimitError{Reason: fmt.Sprintf("%d bytes exceeds limit of %d", total, l.MaxUncompressedBytes)}
+	}
+	if l.MaxCompressionRatio > 0 && size > 0 && float64(total)/float64(size) > l.MaxCompressionRatio {
+		return &ZipLimitError{Reason: fmt.Sprintf("compression ratio %.0f exceeds limit of %.0f", float64(total)/float64(size), l.MaxCompressionRatio)}
+	}
+
+	type span struct{ start, end int64 }
+	spans := make([]span, 0, len(files))
+	for _, zf := range files {
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return fmt.Errorf("read zip entry %q: %w", zf.Name, err)
+		}
+		end := offset + int64(zf.CompressedSize64)
+		if end < offset || end > size {
+			return &ZipLimitError{Reason: fmt.Sprintf("entry %q extends past the end of the zip", zf.Name)}
+		}
+		spans = append(spans, span{offset, end})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for i := 1; i < len(spans); i++ {
+		if spans[i].start < spans[i-1].end {
+			return &ZipLimitError{Reason: "entries overlap"}
+		}
+	}
+
+	return nil
+}
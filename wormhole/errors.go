@@ -0,0 +1,272 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// TransferPhase is the stage of a transfer, as reported in a
+// TransferError.
+type TransferPhase int
+
+const (
+	// PhaseRendezvous covers connecting to the rendezvous server and
+	// claiming or attaching to the mailbox for the code.
+	PhaseRendezvous TransferPhase = iota + 1
+	// PhasePake covers the key exchange with the peer, the version
+	// exchange and verification.
+	PhasePake
+	// PhaseTransit covers the offer and answer and, for files and
+	// directories, establishing the transit connection.
+	PhaseTransit
+	// PhaseData covers sending or receiving the data of a file or
+	// directory and the final acknowledgment.
+	PhaseData
+)
+
+func (p TransferPhase) String() string {
+	switch p {
+	case PhaseRendezvous:
+		return "Rendezvous"
+	case PhasePake:
+		return "Pake"
+	case PhaseTransit:
+		return "Transit"
+	case PhaseData:
+		return "Data"
+	default:
+		return fmt.Sprintf("TransferPhaseUnknown<%d>", p)
+	}
+}
+
+// ErrorCode classifies why a transfer failed, as reported in a
+// TransferError.
+type ErrorCode int
+
+const (
+	// CodeUnknown is used for errors that fit none of the other codes,
+	// such as errors from the caller's reader.
+	CodeUnknown ErrorCode = iota
+	// CodeCanceled means the transfer's context was canceled.
+	CodeCanceled
+	// CodeTimeout means the transfer's context deadline passed or a
+	// network operation timed out.
+	CodeTimeout
+	// CodeNetwork means a connection to the rendezvous server, transit
+	// relay or peer failed or was lost.
+	CodeNetwork
+	// CodeNameplateUnclaimed means no sender is using the nameplate of
+	// the code passed to Receive.
+	CodeNameplateUnclaimed
+	// CodeWrongCode means the code is malformed or the two sides used
+	// different codes, so the key exchange did not produce a shared key.
+	CodeWrongCode
+	// CodeVerifierRejected means the VerifierOk callback on either side
+	// rejected the verifier, or WithStrictVerification was used and the
+	// peer did not check it.
+	CodeVerifierRejected
+	// CodeRejected means the peer rejected the offer.
+	CodeRejected
+	// CodeDeclined means this side declined the offer, with
+	// WithOfferCallback or IncomingMessage.Reject, or one of its
+	// TransferHooks stopped the transfer.
+	CodeDeclined
+	// CodePeerError means the peer reported an error.
+	CodePeerError
+	// CodeProtocol means the peer sent an unexpected message.
+	CodeProtocol
+	// CodeTransitFailed means no transit connection could be made.
+	CodeTransitFailed
+	// CodeIntegrity means the transferred data failed to decrypt or did
+	// not match the sender's checksum.
+	CodeIntegrity
+	// CodeStalled means the transfer was aborted by the callback
+	// registered with WithStallTimeout.
+	CodeStalled
+	// CodeRecordTooLarge means the sender exceeded the limit set with
+	// WithReceiveMemoryLimit.
+	CodeRecordTooLarge
+	// CodeTampering means the mailbox showed signs of tampering: a
+	// replayed message (ErrReplayedMessage) or messages from a third
+	// side (*ThirdSideError). The mailbox was closed with the scary
+	// mood.
+	CodeTampering
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "Unknown"
+	case CodeCanceled:
+		return "Canceled"
+	case CodeTimeout:
+		return "Timeout"
+	case CodeNetwork:
+		return "Network"
+	case CodeNameplateUnclaimed:
+		return "NameplateUnclaimed"
+	case CodeWrongCode:
+		return "WrongCode"
+	case CodeVerifierRejected:
+		return "VerifierRejected"
+	case CodeRejected:
+		return "Rejected"
+	case CodeDeclined:
+		return "Declined"
+	case CodePeerError:
+		return "PeerError"
+	case CodeProtocol:
+		return "Protocol"
+	case CodeTransitFailed:
+		return "TransitFailed"
+	case CodeIntegrity:
+		return "Integrity"
+	case CodeStalled:
+		return "Stalled"
+	case CodeRecordTooLarge:
+		return "RecordTooLarge"
+	case CodeTampering:
+		return "Tampering"
+	default:
+		return fmt.Sprintf("ErrorCodeUnknown<%d>", c)
+	}
+}
+
+// TransferError is the type of the errors that transfers fail with:
+// SendResult.Error, errors from Receive once the transfer has started,
+// and errors from reading an IncomingMessage. Use errors.As to get at
+// it. The underlying error is still available to errors.Is, so checks
+// such as errors.Is(err, ErrOfferDeclined) keep working.
+type TransferError struct {
+	Code  ErrorCode
+	Phase TransferPhase
+	Err   error
+}
+
+// Error returns the message of the underlying error, so that wrapping
+// does not change the text of existing errors.
+func (e *TransferError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+func newTransferError(code ErrorCode, phase TransferPhase, err error) *TransferError {
+	return &TransferError{Code: code, Phase: phase, Err: err}
+}
+
+// transferError wraps err in a TransferError for phase, classifying it
+// by its underlying error. Errors that already are TransferErrors are
+// returned unchanged.
+func transferError(phase TransferPhase, err error) error {
+	if err == nil {
+		return nil
+	}
+	var te *TransferError
+	if errors.As(err, &te) {
+		return err
+	}
+	return newTransferError(classifyError(phase, err), phase, err)
+}
+
+func classifyError(phase TransferPhase, err error) ErrorCode {
+	var (
+		pe   *peerError
+		tse  *ThirdSideError
+		nerr net.Error
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrPeerTimeout):
+		return CodeTimeout
+	case errors.Is(err, ErrOfferDeclined):
+		return CodeDeclined
+	case errors.Is(err, ErrTransferStalled):
+		return CodeStalled
+	case errors.Is(err, ErrRecordTooLarge):
+		return CodeRecordTooLarge
+	case errors.Is(err, ErrReplayedMessage), errors.As(err, &tse):
+		return CodeTampering
+	case errors.Is(err, errDecryptFailed):
+		if phase == PhasePake {
+			return CodeWrongCode
+		}
+		return CodeIntegrity
+	case errors.As(err, &pe):
+		switch pe.msg {
+		case rejectedMsg:
+			return CodeRejected
+		case verifierRejectedMsg, verificationRequiredMsg:
+			return CodeVerifierRejected
+		}
+		return CodePeerError
+	case errors.As(err, &nerr):
+		if nerr.Timeout() {
+			return CodeTimeout
+		}
+		return CodeNetwork
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CodeNetwork
+	}
+	return CodeUnknown
+}
+
+// isScary reports whether err means the transfer may have been
+// tampered with, in which case the mailbox is closed with the scary
+// mood.
+func isScary(err error) bool {
+	var tse *ThirdSideError
+	return errors.Is(err, errDecryptFailed) || errors.Is(err, ErrReplayedMessage) || errors.As(err, &tse)
+}
+
+// transitFailed wraps an error from establishing the transit
+// connection, unless the transfer was canceled or timed out waiting
+// for the peer.
+func transitFailed(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrPeerTimeout) {
+		return transferError(PhaseTransit, err)
+	}
+	return newTransferError(CodeTransitFailed, PhaseTransit, err)
+}
+
+// The error messages this package sends to the peer.
+const (
+	rejectedMsg             = "transfer rejected"
+	verifierRejectedMsg     = "sender rejected verification check, abandoned transfer"
+	verificationRequiredMsg = "peer requires verification, abandoned transfer"
+	versionMismatchMsg      = "peer versions do not match policy, abandoned transfer"
+	abandonedMsg            = "transfer abandoned by policy"
+)
+
+// peerError is an error message sent by the peer.
+type peerError struct {
+	msg string
+}
+
+func (e *peerError) Error() string {
+	return "TransferError: " + e.msg
+}
+
+// IsTransient reports whether err is a TransferError that may not
+// happen again if the transfer is retried: a timeout, a lost or failed
+// connection, a stall, or a code whose sender has not arrived yet.
+// Cancellation, rejections and signs of a wrong code or tampering are
+// not transient.
+func IsTransient(err error) bool {
+	var te *TransferError
+	if !errors.As(err, &te) {
+		return false
+	}
+	switch te.Code {
+	case CodeTimeout, CodeNetwork, CodeNameplateUnclaimed, CodeTransitFailed, CodeStalled:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package wormhole
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// EventType identifies a step in the lifecycle of a transfer.
+type EventType int
+
+const (
+	// EventCodeAllocated is sent by the sending side once the code for
+	// the transfer is known. Event.Code holds the code.
+	EventCodeAllocated EventType = iota + 1
+	// EventPakeComplete is sent once the PAKE exchange with the peer has
+	// finished and both sides share a key.
+	EventPakeComplete
+	// EventVerifier is sent once the verifier for the session is known.
+	// Event.Verifier holds it hex encoded, as passed to VerifierOk.
+	EventVerifier
+	// EventTransitConnecting is sent when a file or directory transfer
+	// starts establishing its transit connection.
+	EventTransitConnecting
+	// EventTransitConnected is sent once the transit connection is up.
+	// Event.Relayed reports whether it goes through a transit relay.
+	EventTransitConnected
+	// EventProgress is sent as the transfer passes each tenth of the
+	// total size. Streams of unknown length get one every
+	// unknownLengthMilestone bytes instead.
+	EventProgress
+	// EventCompleted is sent once the transfer has finished
+	// successfully.
+	EventCompleted
+	// EventFailed is sent if the transfer fails after the call that
+	// started it has returned. Event.Err holds the error.
+	EventFailed
+	// EventStalled is sent when a transfer using WithStallTimeout has
+	// not moved any bytes for the stall timeout. Event.Idle holds the
+	// time since bytes last moved.
+	EventStalled
+	// EventTampering is sent when the mailbox shows signs of tampering,
+	// such as a replayed message or a third side. Event.Err describes
+	// what was seen.
+	// The transfer then fails with CodeTampering.
+	EventTampering
+)
+
+func (et EventType) String() string {
+	switch et {
+	case EventCodeAllocated:
+		return "EventCodeAllocated"
+	case EventPakeComplete:
+		return "EventPakeComplete"
+	case EventVerifier:
+		return "EventVerifier"
+	case EventTransitConnecting:
+		return "EventTransitConnecting"
+	case EventTransitConnected:
+		return "EventTransitConnected"
+	case EventProgress:
+		return "EventProgress"
+	case EventCompleted:
+		return "EventCompleted"
+	case EventFailed:
+		return "EventFailed"
+	case EventStalled:
+		return "EventStalled"
+	case EventTampering:
+		return "EventTampering"
+	default:
+		return fmt.Sprintf("EventTypeUnknown<%d>", et)
+	}
+}
+
+// unknownLengthMilestone is the EventProgress interval for transfers
+// whose size is not known up front.
+const unknownLengthMilestone = 1 << 20
+
+// Event is a lifecycle event of a transfer, delivered to the channel
+// registered with WithEvents. Only the fields relevant to Type are set.
+type Event struct {
+	Type EventType
+	// TransferID identifies the transfer the event belongs to.
+	TransferID string
+	Code       string
+	Verifier   string
+	Relayed    bool
+	// Bytes and Total are set for EventProgress and EventCompleted.
+	Bytes int64
+	Total int64
+	Idle  time.Duration
+	Err   error
+}
+
+type eventsTransferOption struct {
+	ch chan<- Event
+}
+
+func (o eventsTransferOption) setOption(opts *transferOptions) error {
+	opts.events = o.ch
+	return nil
+}
+
+// WithEvents returns a TransferOption that sends the lifecycle events
+// of the transfer to ch.
+//
+// Like signal.Notify, events are sent without blocking: if ch is not
+// ready to receive an event it is dropped. Use a buffered channel and
+// keep reading from it. ch is never closed; EventCompleted or
+// EventFailed is the last event of a transfer. Errors returned directly
+// by SendText, SendFile, SendDirectory, SendStream or Receive are not
+// repeated as EventFailed.
+func WithEvents(ch chan<- Event) TransferOption {
+	return eventsTransferOption{ch}
+}
+
+func (o *transferOptions) emit(e Event) {
+	e.TransferID = o.transferID
+	o.audit.observe(e)
+	switch e.Type {
+	case EventCompleted:
+		o.counter.end(nil)
+		o.removePending()
+		o.afterComplete(nil)
+	case EventFailed:
+		o.counter.end(e.Err)
+		o.removePending()
+		o.afterComplete(e.Err)
+	}
+
+	if o.events == nil {
+		return
+	}
+	select {
+	case o.events <- e:
+	default:
+	}
+}
+
+// end records the end of a transfer that is over without an
+// EventCompleted or EventFailed, because it failed before the call
+// that started it returned or because the offer was declined.
+func (o *transferOptions) end(err error) {
+	o.audit.finish(err)
+	o.counter.end(err)
+	o.afterComplete(err)
+}
+
+// tampering reports signs of tampering with the mailbox.
+func (o *transferOptions) tampering(err error) {
+	o.logger.Warn("mailbox tampering detected", "err", err)
+	o.emit(Event{Type: EventTampering, Err: err})
+}
+
+// observed reports whether anything consumes the transfer's events.
+func (o *transferOptions) observed() bool {
+	return o.events != nil || o.audit != nil
+}
+
+// emitVerifier sends an EventVerifier for the session if anything
+// consumes events.
+func (o *transferOptions) emitVerifier(cp *clientProtocol) {
+	if !o.observed() {
+		return
+	}
+	verifier, err := cp.Verifier()
+	if err != nil {
+		return
+	}
+	o.emit(Event{Type: EventVerifier, Verifier: hex.EncodeToString(verifier)})
+}
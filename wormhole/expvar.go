@@ -0,0 +1,66 @@
+package wormhole
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters for all transfers made by the package, published by
+// PublishExpvar.
+var (
+	activeTransfers = new(expvar.Int)
+	totalTransfers  = new(expvar.Int)
+	failedTransfers = new(expvar.Int)
+	totalBytes      = new(expvar.Int)
+
+	publishExpvarOnce sync.Once
+)
+
+// PublishExpvar publishes counters for the transfers made by every
+// Client in the process as the expvar map "wormhole", so that they are
+// served at /debug/vars along with the other expvar variables. The map
+// has these keys:
+//
+//	active_transfers  transfers currently in progress
+//	transfers         transfers started
+//	failed_transfers  transfers that ended with an error
+//	bytes             file and directory bytes sent and received
+//
+// Declined offers are not counted as failures. PublishExpvar may be
+// called more than once.
+func PublishExpvar() {
+	publishExpvarOnce.Do(func() {
+		m := new(expvar.Map).Init()
+		m.Set("active_transfers", activeTransfers)
+		m.Set("transfers", totalTransfers)
+		m.Set("failed_transfers", failedTransfers)
+		m.Set("bytes", totalBytes)
+		expvar.Publish("wormhole", m)
+	})
+}
+
+// transferCounter keeps the package counters for a single transfer.
+// A nil *transferCounter counts nothing.
+type transferCounter struct {
+	ended int32
+}
+
+func startTransferCounter() *transferCounter {
+	activeTransfers.Add(1)
+	totalTransfers.Add(1)
+	return &transferCounter{}
+}
+
+// end counts the transfer as finished. Only the first call has any
+// effect.
+func (t *transferCounter) end(err error) {
+	if t == nil || !atomic.CompareAndSwapInt32(&t.ended, 0, 1) {
+		return
+	}
+	activeTransfers.Add(-1)
+	if err != nil && !errors.Is(err, ErrOfferDeclined) {
+		failedTransfers.Add(1)
+	}
+}
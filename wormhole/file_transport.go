@@ -3,20 +3,23 @@ package wormhole
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
-	"math/big"
 	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"time"
 
+	"github.com/psanford/wormhole-william/internal/clock"
 	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/internal/prototrace"
+	"github.com/psanford/wormhole-william/internal/tlspin"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
 	"nhooyr.io/websocket"
@@ -27,6 +30,16 @@ type fileTransportAck struct {
 	SHA256 string `json:"sha256"`
 }
 
+// ackRejected is the fileTransportAck.Ack a receiver sends instead of
+// "ok" when the data fails its checksum confirmation.
+const ackRejected = "rejected"
+
+// fileTransportChecksum is the record a sender sends after the data to
+// peers advertising abilityChecksumV1.
+type fileTransportChecksum struct {
+	SHA256 string `json:"sha256"`
+}
+
 type TransferType int
 
 // we want to know to which url we succeeded
@@ -47,6 +60,10 @@ const websocketReadSize int64 = 65536
 // TCP direct connection timeout in sec.
 const tcpDirectTimeout = 10
 
+// relayFallbackDelay is the head start relay endpoints get over those
+// of lower priority before they are dialed too.
+const relayFallbackDelay = 2 * time.Second
+
 // UnsupportedProtocolErr is used in the default case of protocol switch
 // statements to account for unexpected protocols.
 var UnsupportedProtocolErr = errors.New("unsupported protocol")
@@ -65,13 +82,30 @@ func (tt TransferType) String() string {
 }
 
 type transportCryptor struct {
-	conn           net.Conn
-	prefixBuf      []byte
-	nextReadNonce  *big.Int
-	nextWriteNonce uint64
-	err            error
-	readKey        [32]byte
-	writeKey       [32]byte
+	conn      net.Conn
+	prefixBuf []byte
+	err       error
+	readKey   [32]byte
+	writeKey  [32]byte
+
+	// readNonce and writeNonce are the big-endian nonces of the next
+	// record to be read and written. They are incremented in place.
+	readNonce  [crypto.NonceSize]byte
+	writeNonce [crypto.NonceSize]byte
+	// nonceBuf holds the nonce returned by takeWriteNonce.
+	nonceBuf [crypto.NonceSize]byte
+
+	// writeBuf is reused by writeRecord to build each record.
+	writeBuf []byte
+	// sealedBuf and openBuf are reused by readRecord to read and
+	// decrypt each record.
+	sealedBuf []byte
+	openBuf   []byte
+	// maxRecordSize, if non-zero, is the largest record readRecord
+	// will accept, not counting its nonce and authenticator.
+	maxRecordSize int
+	// readTimeout, if non-zero, bounds each call to readRecord.
+	readTimeout time.Duration
 }
 
 func newTransportCryptor(c net.Conn, transitKey []byte, readPurpose, writePurpose string) *transportCryptor {
@@ -90,21 +124,42 @@ func newTransportCryptor(c net.Conn, transitKey []byte, readPurpose, writePurpos
 	}
 
 	return &transportCryptor{
-		conn:          c,
-		prefixBuf:     make([]byte, 4+crypto.NonceSize),
-		nextReadNonce: big.NewInt(0),
-		readKey:       readKey,
-		writeKey:      writeKey,
+		conn:      c,
+		prefixBuf: make([]byte, 4+crypto.NonceSize),
+		readKey:   readKey,
+		writeKey:  writeKey,
 	}
 }
 func (d *transportCryptor) Close() error {
 	return d.conn.Close()
 }
 
+// wipeKeys zeroes the record keys. It must not be called while records
+// are still being read or written.
+func (d *transportCryptor) wipeKeys() {
+	wipe(d.readKey[:])
+	wipe(d.writeKey[:])
+}
+
+// setReadBufferSize preallocates readRecord's buffers for records of
+// up to size bytes of data. Larger records grow the buffers.
+func (d *transportCryptor) setReadBufferSize(size int) {
+	d.sealedBuf = make([]byte, 0, size+secretbox.Overhead)
+	d.openBuf = make([]byte, 0, size)
+}
+
+// readRecord reads and decrypts the next record. The returned slice is
+// only valid until the next call to readRecord.
 func (d *transportCryptor) readRecord() ([]byte, error) {
 	if d.err != nil {
 		return nil, d.err
 	}
+	if d.readTimeout > 0 {
+		if err := d.conn.SetReadDeadline(time.Now().Add(d.readTimeout)); err != nil {
+			d.err = err
+			return nil, d.err
+		}
+	}
 	_, err := io.ReadFull(d.conn, d.prefixBuf)
 	if err != nil {
 		d.err = err
@@ -112,156 +167,320 @@ func (d *transportCryptor) readRecord() ([]byte, error) {
 	}
 
 	l := binary.BigEndian.Uint32(d.prefixBuf[:4])
-	var nonce [24]byte
-	copy(nonce[:], d.prefixBuf[4:])
-
-	var bigNonce big.Int
-	bigNonce.SetBytes(nonce[:])
 
-	if bigNonce.Cmp(d.nextReadNonce) != 0 {
+	if !bytes.Equal(d.prefixBuf[4:], d.readNonce[:]) {
 		d.err = errors.New("received out-of-order record")
 		return nil, d.err
 	}
 
-	d.nextReadNonce.Add(d.nextReadNonce, big.NewInt(1))
-
-	sealedMsg := make([]byte, l-crypto.NonceSize)
+	if l < crypto.NonceSize+secretbox.Overhead {
+		d.err = errors.New("received truncated record")
+		return nil, d.err
+	}
+	sealedLen := int(l - crypto.NonceSize)
+	if d.maxRecordSize > 0 && sealedLen-secretbox.Overhead > d.maxRecordSize {
+		d.err = ErrRecordTooLarge
+		return nil, d.err
+	}
+	if cap(d.sealedBuf) < sealedLen {
+		d.sealedBuf = make([]byte, sealedLen)
+	}
+	sealedMsg := d.sealedBuf[:sealedLen]
 	_, err = io.ReadFull(d.conn, sealedMsg)
 	if err != nil {
 		d.err = err
 		return nil, d.err
 	}
 
-	out, ok := secretbox.Open(nil, sealedMsg, &nonce, &d.readKey)
+	out, ok := secretbox.Open(d.openBuf[:0], sealedMsg, &d.readNonce, &d.readKey)
 	if !ok {
 		d.err = errDecryptFailed
 		return nil, d.err
 	}
+	d.openBuf = out
+	incrementNonce(&d.readNonce)
 
 	return out, nil
 }
 
 func (d *transportCryptor) writeRecord(msg []byte) error {
-	var nonce [crypto.NonceSize]byte
+	nonce := d.takeWriteNonce()
 
-	if d.nextWriteNonce == math.MaxUint64 {
-		panic("Nonce exhaustion")
-	}
+	// build the length prefix, nonce and sealed message in a single
+	// buffer so the record is sent with one write.
+	d.writeBuf = d.sealRecord(d.writeBuf[:0], msg, nonce)
 
-	binary.BigEndian.PutUint64(nonce[crypto.NonceSize-8:], d.nextWriteNonce)
-	d.nextWriteNonce++
+	_, err := d.conn.Write(d.writeBuf)
+	return err
+}
 
-	sealedMsg := secretbox.Seal(nil, msg, &nonce, &d.writeKey)
+// flush is a no-op; it makes transportCryptor a recordWriter.
+func (d *transportCryptor) flush() error {
+	return nil
+}
 
-	nonceAndSealedMsg := append(nonce[:], sealedMsg...)
+// takeWriteNonce returns the nonce for the next record to be written
+// and advances writeNonce past it. The returned pointer is only valid
+// until the next call.
+func (d *transportCryptor) takeWriteNonce() *[crypto.NonceSize]byte {
+	if binary.BigEndian.Uint64(d.writeNonce[crypto.NonceSize-8:]) == math.MaxUint64 {
+		panic("Nonce exhaustion")
+	}
+	d.nonceBuf = d.writeNonce
+	incrementNonce(&d.writeNonce)
+	return &d.nonceBuf
+}
+
+// sealRecord appends the record for msg, sealed with nonce, to dst. It
+// only reads the cryptor's write key, so it is safe to call from
+// several goroutines at once.
+func (d *transportCryptor) sealRecord(dst, msg []byte, nonce *[crypto.NonceSize]byte) []byte {
+	start := len(dst)
+	record := append(dst, 0, 0, 0, 0)
+	record = append(record, nonce[:]...)
+	record = secretbox.Seal(record, msg, nonce, &d.writeKey)
 
 	// we do an explit cast to int64 to avoid compilation failures
 	// for 32bit systems.
-	nonceAndSealedMsgSize := int64(len(nonceAndSealedMsg))
+	nonceAndSealedMsgSize := int64(len(record) - start - 4)
 
 	if nonceAndSealedMsgSize >= math.MaxUint32 {
-		panic(fmt.Sprintf("writeRecord too large: %d", len(nonceAndSealedMsg)))
+		panic(fmt.Sprintf("writeRecord too large: %d", nonceAndSealedMsgSize))
 	}
 
-	l := make([]byte, 4)
-	binary.BigEndian.PutUint32(l, uint32(len(nonceAndSealedMsg)))
-
-	lenNonceAndSealedMsg := append(l, nonceAndSealedMsg...)
+	binary.BigEndian.PutUint32(record[start:start+4], uint32(nonceAndSealedMsgSize))
+	return record
+}
 
-	_, err := d.conn.Write(lenNonceAndSealedMsg)
-	return err
+// incrementNonce adds one to the big-endian nonce n.
+func incrementNonce(n *[crypto.NonceSize]byte) {
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return
+		}
+	}
 }
 
-func newFileTransport(transitKey []byte, appID string, relayURL *url.URL, disableListener bool) *fileTransport {
+// newFileTransport returns a fileTransport for a transfer with
+// transitKey. It derives the handshake tokens up front and does not
+// keep transitKey, so the caller can wipe it while connection attempts
+// that lost the race are still winding down.
+func newFileTransport(transitKey []byte, appID string, relayURL *url.URL, disableListener bool, logger Logger) *fileTransport {
 	return &fileTransport{
-		transitKey:      transitKey,
+		senderToken:     deriveHandshakeToken(transitKey, "transit_sender"),
+		receiverToken:   deriveHandshakeToken(transitKey, "transit_receiver"),
+		relayToken:      deriveHandshakeToken(transitKey, "transit_relay_token"),
 		appID:           appID,
 		relayURL:        relayURL,
 		disableListener: disableListener,
+		logger:          logger,
+		timeouts:        Timeouts{}.resolve(),
+		rand:            rand.Reader,
+		clock:           clock.Real{},
 	}
 }
 
 type fileTransport struct {
 	disableListener bool
+	policy          TransitPolicy
+	relayHandshake  RelayHandshake
+	rand            io.Reader
+	clock           clock.Clock
 	listener        net.Listener
 	relayConn       net.Conn
 	relayURL        *url.URL
-	transitKey      []byte
+	senderToken     []byte
+	receiverToken   []byte
+	relayToken      []byte
 	appID           string
+	logger          Logger
+	trace           *prototrace.Writer
+	tlsPins         []string
+	// dial, if set, opens connections to relays and peers instead of
+	// the system's network stack.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// timeouts are resolved; see Timeouts.resolve.
+	timeouts Timeouts
+	// relayEndpoints are other addresses of the relay at relayURL,
+	// offered in the same relay-v1 hint.
+	relayEndpoints []*url.URL
 }
 
-// removes duplicates and returns set to minimize connections
+// filterHints returns the endpoints of the hints of hintType, highest
+// priority first. A relay-v1 hint may list several endpoints of the
+// same relay, and the same endpoint may be offered by both sides, so
+// duplicates are removed, keeping the highest priority given. Endpoints
+// of equal priority stay in the order they were offered. Websocket
+// endpoints are returned as "websocket-v1", whichever of the two
+// websocket hint types they were offered as.
 func filterHints(mergedHints []transitHintsV1, hintType string) []transitHintsRelay {
-	filteredHints := make(map[transitHintsRelay]struct{})
+	index := make(map[transitHintsRelay]int)
+	keys := []transitHintsRelay{}
 	for _, hints := range mergedHints {
-		if hints.Type == hintType {
-			for _, hint := range hints.Hints {
-				filteredHints[hint] = struct{}{}
+		if hints.Type != hintType {
+			continue
+		}
+		for _, hint := range hints.Hints {
+			if hint.Type == "websocket" {
+				hint.Type = "websocket-v1"
 			}
+			endpoint := hint
+			endpoint.Priority = 0
+			if i, ok := index[endpoint]; ok {
+				if hint.Priority > keys[i].Priority {
+					keys[i].Priority = hint.Priority
+				}
+				continue
+			}
+			index[endpoint] = len(keys)
+			keys = append(keys, hint)
 		}
 	}
 
-	keys := []transitHintsRelay{}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Priority > keys[j].Priority
+	})
+	return keys
+}
 
-	for k := range filteredHints {
-		keys = append(keys, k)
+// relayEndpointURL returns the URL to dial for a relay endpoint, or nil
+// if it is of a type this build can't use.
+func relayEndpointURL(endpoint transitHintsRelay) *url.URL {
+	switch endpoint.Type {
+	case "direct-tcp-v1":
+		if relayOnly {
+			return nil
+		}
+		return &url.URL{
+			Scheme: "tcp",
+			Host:   net.JoinHostPort(endpoint.Hostname, strconv.Itoa(endpoint.Port)),
+		}
+	case "websocket-v1", "websocket":
+		u, err := url.Parse(endpoint.Url)
+		if err != nil {
+			return nil
+		}
+		return u
 	}
-	return keys
+	return nil
 }
 
-func (t *fileTransport) connectViaRelay(filteredHints []transitHintsRelay) (net.Conn, error) {
+// connect establishes the receiving side's transit connection, trying
+// the peer's direct hints before the relay hints from both sides. It
+// reports whether the connection goes through a relay.
+func (t *fileTransport) connect(ours, theirs *transitMsg) (net.Conn, bool, error) {
+	conn, err := t.connectDirect(theirs)
+	if err != nil {
+		return nil, false, err
+	}
+	if conn != nil {
+		return conn, false, nil
+	}
 
-	successChan := make(chan successType, 1)
-	failChan := make(chan string)
+	// filter relay hints and remove duplicates
+	filteredHints := filterHints(append(ours.HintsV1, theirs.HintsV1...), "relay-v1")
+	conn, err = t.connectViaRelay(filteredHints)
+	if err != nil {
+		return nil, false, err
+	}
+	if conn == nil {
+		return nil, false, errors.New("failed to establish connection")
+	}
+	return conn, true, nil
+}
 
-	var count int
+// traced returns conn wrapped to write to the protocol trace, if one
+// is enabled.
+func (t *fileTransport) traced(conn net.Conn) net.Conn {
+	if t.trace == nil {
+		return conn
+	}
+	return prototrace.Conn(conn, t.trace)
+}
 
-	cancelMap := make(map[string]context.CancelFunc)
+// connectViaRelay dials the relay endpoints in hints, which are sorted
+// by filterHints, and returns the first connection to complete the
+// handshake. Endpoints are dialed together with those of the same
+// priority; lower priority ones are only dialed once the better ones
+// have failed or had relayFallbackDelay to connect.
+func (t *fileTransport) connectViaRelay(hints []transitHintsRelay) (net.Conn, error) {
+	if t.policy == TransitDirectOnly {
+		return nil, nil
+	}
+
+	// buffered so that attempts still running when we return don't
+	// block on reporting their result
+	successChan := make(chan successType, len(hints))
+	failChan := make(chan string, len(hints))
 
-	for _, endpoint := range filteredHints {
-		var relayUrl *url.URL
-		var err error
+	cancelMap := make(map[string]context.CancelFunc)
 
-		switch endpoint.Type {
-		case "direct-tcp-v1":
-			relayUrl = &url.URL{
-				Scheme: "tcp",
-				Host:   net.JoinHostPort(endpoint.Hostname, strconv.Itoa(endpoint.Port)),
+	var (
+		pending  int
+		won      *successType
+		priority float64
+	)
+
+	// await waits for the pending attempts until one succeeds, all of
+	// them fail or fallback fires.
+	await := func(fallback <-chan time.Time) {
+		for pending > 0 {
+			select {
+			case <-failChan:
+				pending--
+			case s := <-successChan:
+				pending--
+				won = &s
+				return
+			case <-fallback:
+				return
 			}
-		case "websocket-v1":
-			relayUrl, err = url.Parse(endpoint.Url)
 		}
+	}
 
-		if err == nil && relayUrl != nil {
-			ctx, cancel := context.WithCancel(context.Background())
-			cancelMap[relayUrl.String()] = cancel
-
-			count++
-			go t.connectToRelay(ctx, relayUrl, successChan, failChan)
-
-		} else {
+	for _, endpoint := range hints {
+		relayUrl := relayEndpointURL(endpoint)
+		if relayUrl == nil {
+			continue
+		}
+		if _, dup := cancelMap[relayUrl.String()]; dup {
 			continue
 		}
+
+		if pending > 0 && endpoint.Priority < priority {
+			// give the better endpoints a head start
+			timer := t.clock.NewTimer(relayFallbackDelay)
+			await(timer.C())
+			timer.Stop()
+			if won != nil {
+				break
+			}
+		}
+		priority = endpoint.Priority
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelMap[relayUrl.String()] = cancel
+
+		pending++
+		go t.connectToRelay(ctx, relayUrl, successChan, failChan)
 	}
 
-	var s successType
+	if won == nil {
+		await(nil)
+	}
 
-	for i := 0; i < count; i++ {
-		select {
-		case <-failChan:
-		case s = <-successChan:
-			// cancel all other connections context
-			for cancelUrl, cancel := range cancelMap {
-				if s.relayUrl != cancelUrl {
-					cancel()
-				}
-			}
-			// return function straight away after first success
-			return s.conn, nil
+	// cancel all other connections context
+	for cancelUrl, cancel := range cancelMap {
+		if won == nil || won.relayUrl != cancelUrl {
+			cancel()
 		}
 	}
 
-	return nil, nil
+	if won == nil {
+		return nil, nil
+	}
+	return won.conn, nil
 }
 
 func (t *fileTransport) connectDirect(otherTransit *transitMsg) (net.Conn, error) {
@@ -272,6 +491,10 @@ func (t *fileTransport) connectDirect(otherTransit *transitMsg) (net.Conn, error
 
 	var count int
 
+	if relayOnly || t.policy == TransitRelayOnly {
+		return nil, nil
+	}
+
 	for _, hint := range otherTransit.HintsV1 {
 		if hint.Type == "direct-tcp-v1" {
 			count++
@@ -298,82 +521,105 @@ func (t *fileTransport) connectDirect(otherTransit *transitMsg) (net.Conn, error
 }
 
 func (t *fileTransport) connectToRelay(ctx context.Context, relayUrl *url.URL, successChan chan successType, failChan chan string) {
-	var d net.Dialer
-	var conn net.Conn
-	var err error
+	legacy := t.relayHandshake == RelayHandshakeLegacy
+	conn, err := t.requestRelay(ctx, relayUrl, legacy)
+	if errors.Is(err, errRelayRefused) && t.relayHandshake == RelayHandshakeAuto {
+		t.logger.Info("transit relay refused handshake, retrying with legacy handshake", "relay", relayUrl.String())
+		conn, err = t.requestRelay(ctx, relayUrl, true)
+	}
+	if err != nil {
+		if errors.Is(err, errBadHandshake) {
+			t.logger.Warn("transit relay refused handshake", "relay", relayUrl.String(), "err", err)
+		}
+		failChan <- relayUrl.String()
+		return
+	}
+	t.directRecvHandshake(relayUrl.String(), ctx, conn, successChan, failChan)
+}
+
+// requestRelay connects to the relay at relayUrl and waits for it to
+// pair the connection with the sender's, which is already waiting.
+func (t *fileTransport) requestRelay(ctx context.Context, relayUrl *url.URL, legacy bool) (net.Conn, error) {
+	conn, err := t.dialRelay(ctx, relayUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	t.logger.Debug("transit relay connected", "relay", relayUrl.String())
 
+	err = t.writeRelayHandshake(conn, legacy)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = withHandshakeDeadline(conn, t.timeouts.Handshake, func() error {
+		return expectHandshakeLine(conn, "ok")
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialRelay opens a connection to the relay at relayUrl.
+func (t *fileTransport) dialRelay(ctx context.Context, relayUrl *url.URL) (net.Conn, error) {
+	var conn net.Conn
 	switch relayUrl.Scheme {
 	case "tcp":
-		conn, err = d.DialContext(ctx, relayUrl.Scheme, relayUrl.Host)
+		c, err := t.dialTCP(ctx, relayUrl.Host)
 		if err != nil {
-			failChan <- relayUrl.String()
-			return
+			return nil, err
 		}
-		fmt.Println("Downloading... via TCP relay " + relayUrl.String())
+		conn = c
 	case "ws", "wss":
-		var wsconn *websocket.Conn
-		wsconn, _, err = websocket.Dial(ctx, relayUrl.String(), nil)
+		dialOpts, err := tlspin.DialOptions(t.tlsPins, t.dial)
 		if err != nil {
-			failChan <- relayUrl.String()
-			return
+			return nil, err
 		}
-		wsconn.SetReadLimit(websocketReadSize)
-		fmt.Println("Downloading... via WebSocket relay " + relayUrl.String())
-		conn = websocket.NetConn(ctx, wsconn, websocket.MessageBinary)
-	}
-
-	_, err = conn.Write(t.relayHandshakeHeader())
-	if err != nil {
-		failChan <- relayUrl.String()
-		return
-	}
-	gotOk := make([]byte, 3)
-	_, err = io.ReadFull(conn, gotOk)
-	if err != nil {
-		conn.Close()
-		failChan <- relayUrl.String()
-		return
+		c, _, err := websocket.Dial(ctx, relayUrl.String(), dialOpts)
+		if err != nil {
+			return nil, fmt.Errorf("websocket.Dial failed")
+		}
+		c.SetReadLimit(websocketReadSize)
+		conn = websocket.NetConn(ctx, c, websocket.MessageBinary)
+	default:
+		return nil, fmt.Errorf("%w: '%s'", UnsupportedProtocolErr, relayUrl.Scheme)
 	}
+	return t.traced(conn), nil
+}
 
-	if !bytes.Equal(gotOk, []byte("ok\n")) {
-		conn.Close()
-		failChan <- relayUrl.String()
-		return
+// dialTCP opens a TCP connection to addr, with t.dial if it is set.
+func (t *fileTransport) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	if t.dial != nil {
+		return t.dial(ctx, "tcp", addr)
 	}
-	t.directRecvHandshake(relayUrl.String(), ctx, conn, successChan, failChan)
+	return dialTCP(ctx, addr)
 }
 
 func (t *fileTransport) connectToSingleHost(ctx context.Context, addr string, successChan chan successType, failChan chan string) {
-	var d net.Dialer
-	fmt.Println("Downloading... directly")
-	conn, err := d.DialContext(ctx, "tcp", addr)
+	t.logger.Debug("transit dialing peer", "addr", addr)
+	conn, err := t.dialTCP(ctx, addr)
 
 	if err != nil {
 		failChan <- addr
 		return
 	}
+	conn = t.traced(conn)
 
 	t.directRecvHandshake(addr, ctx, conn, successChan, failChan)
 }
 
 func (t *fileTransport) directRecvHandshake(addr string, ctx context.Context, conn net.Conn, successChan chan successType, failChan chan string) {
-	expectHeader := t.senderHandshakeHeader()
-
-	gotHeader := make([]byte, len(expectHeader))
-
-	_, err := io.ReadFull(conn, gotHeader)
+	err := withHandshakeDeadline(conn, t.timeouts.Handshake, func() error {
+		return expectHandshakeHeader(conn, t.senderHandshakeHeader())
+	})
 	if err != nil {
 		conn.Close()
 		failChan <- addr
 		return
 	}
 
-	if subtle.ConstantTimeCompare(gotHeader, expectHeader) != 1 {
-		conn.Close()
-		failChan <- addr
-		return
-	}
-
 	_, err = conn.Write(t.receiverHandshakeHeader())
 	if err != nil {
 		conn.Close()
@@ -381,20 +627,15 @@ func (t *fileTransport) directRecvHandshake(addr string, ctx context.Context, co
 		return
 	}
 
-	gotGo := make([]byte, 3)
-	_, err = io.ReadFull(conn, gotGo)
+	err = withHandshakeDeadline(conn, t.timeouts.Handshake, func() error {
+		return expectHandshakeLine(conn, "go")
+	})
 	if err != nil {
 		conn.Close()
 		failChan <- addr
 		return
 	}
 
-	if !bytes.Equal(gotGo, []byte("go\n")) {
-		conn.Close()
-		failChan <- addr
-		return
-	}
-
 	successChan <- successType{addr, conn}
 }
 
@@ -411,6 +652,11 @@ func (t *fileTransport) makeTransitMsg() (*transitMsg, error) {
 		// make a slice so this jsons to [] and not null
 		HintsV1: make([]transitHintsV1, 0),
 	}
+	if relayOnly {
+		// we can neither listen nor dial direct-tcp-v1 hints, so don't
+		// let the peer wait for a direct connection
+		msg.AbilitiesV1 = msg.AbilitiesV1[1:]
+	}
 
 	if t.listener != nil {
 		_, portStr, err := net.SplitHostPort(t.listener.Addr().String())
@@ -435,64 +681,61 @@ func (t *fileTransport) makeTransitMsg() (*transitMsg, error) {
 		}
 	}
 
-	var relayType string
-	switch t.relayURL.Scheme {
-	case "tcp":
-		relayType = "direct-tcp-v1"
-	case "ws":
-		relayType = "websocket-v1"
-	case "wss":
-		relayType = "websocket-v1"
-	default:
-		return nil, fmt.Errorf("%w: '%s'", UnsupportedProtocolErr, t.relayURL.Scheme)
+	if t.policy == TransitDirectOnly {
+		return &msg, nil
 	}
-	if relayType == "direct-tcp-v1" {
-		var port, err = strconv.Atoi(t.relayURL.Port())
-		if err == nil {
-			msg.HintsV1 = append(msg.HintsV1, transitHintsV1{
-				Type: "relay-v1",
-				Hints: []transitHintsRelay{
-					{
-						Type:     relayType,
-						Hostname: t.relayURL.Hostname(),
-						Port:     port,
-					},
-				},
-			})
+
+	var relayHints []transitHintsRelay
+	for _, u := range append([]*url.URL{t.relayURL}, t.relayEndpoints...) {
+		hints, err := relayEndpointHints(u)
+		if err != nil {
+			return nil, err
 		}
-	} else {
+		relayHints = append(relayHints, hints...)
+	}
+	if len(relayHints) > 0 {
 		msg.HintsV1 = append(msg.HintsV1, transitHintsV1{
-			Type: "relay-v1",
-			Hints: []transitHintsRelay{
-				{
-					Type: relayType,
-					Url:  t.relayURL.String(),
-				},
-			},
+			Type:  "relay-v1",
+			Hints: relayHints,
 		})
 	}
 
 	return &msg, nil
 }
 
-func (t *fileTransport) senderHandshakeHeader() []byte {
-	purpose := "transit_sender"
-
-	r := hkdf.New(sha256.New, t.transitKey, nil, []byte(purpose))
-	out := make([]byte, 32)
-
-	_, err := io.ReadFull(r, out)
-	if err != nil {
-		panic(err)
+// relayEndpointHints returns the relay-v1 endpoints to offer for the
+// relay at u. A tcp URL without a port, such as the "tcp://" used to
+// disable the relay, is not offered.
+//
+// A websocket endpoint is offered twice: as "websocket-v1", which
+// earlier versions of this client read, and as "websocket", which is
+// what the rust client reads. The python client ignores both and uses
+// the direct-tcp-v1 endpoints, so a relay that listens on both
+// protocols should be configured with both (see
+// Client.TransitRelayEndpoints) for a websocket-only peer to reach it.
+func relayEndpointHints(u *url.URL) ([]transitHintsRelay, error) {
+	switch u.Scheme {
+	case "tcp":
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			return nil, nil
+		}
+		return []transitHintsRelay{{
+			Type:     "direct-tcp-v1",
+			Hostname: u.Hostname(),
+			Port:     port,
+		}}, nil
+	case "ws", "wss":
+		return []transitHintsRelay{
+			{Type: "websocket-v1", Url: u.String()},
+			{Type: "websocket", Url: u.String()},
+		}, nil
 	}
-
-	return []byte(fmt.Sprintf("transit sender %x ready\n\n", out))
+	return nil, fmt.Errorf("%w: '%s'", UnsupportedProtocolErr, u.Scheme)
 }
 
-func (t *fileTransport) receiverHandshakeHeader() []byte {
-	purpose := "transit_receiver"
-
-	r := hkdf.New(sha256.New, t.transitKey, nil, []byte(purpose))
+func deriveHandshakeToken(transitKey []byte, purpose string) []byte {
+	r := hkdf.New(sha256.New, transitKey, nil, []byte(purpose))
 	out := make([]byte, 32)
 
 	_, err := io.ReadFull(r, out)
@@ -500,31 +743,41 @@ func (t *fileTransport) receiverHandshakeHeader() []byte {
 		panic(err)
 	}
 
-	return []byte(fmt.Sprintf("transit receiver %x ready\n\n", out))
+	return out
 }
 
-func (t *fileTransport) relayHandshakeHeader() []byte {
-	purpose := "transit_relay_token"
+func (t *fileTransport) senderHandshakeHeader() []byte {
+	return []byte(fmt.Sprintf("transit sender %x ready\n\n", t.senderToken))
+}
 
-	r := hkdf.New(sha256.New, t.transitKey, nil, []byte(purpose))
-	out := make([]byte, 32)
+func (t *fileTransport) receiverHandshakeHeader() []byte {
+	return []byte(fmt.Sprintf("transit receiver %x ready\n\n", t.receiverToken))
+}
 
-	_, err := io.ReadFull(r, out)
-	if err != nil {
-		panic(err)
+// writeRelayHandshake writes the request for the relay to pair us with
+// the peer to conn. The legacy request, from before relays told the
+// sides of a session apart, has no side.
+func (t *fileTransport) writeRelayHandshake(conn net.Conn, legacy bool) error {
+	if legacy {
+		_, err := fmt.Fprintf(conn, "please relay %x\n", t.relayToken)
+		return err
 	}
 
-	sideID := crypto.RandHex(8)
+	sideID, err := crypto.RandHexFrom(t.rand, 8)
+	if err != nil {
+		return err
+	}
 
-	return []byte(fmt.Sprintf("please relay %x for side %s\n", out, sideID))
+	_, err = fmt.Fprintf(conn, "please relay %x for side %s\n", t.relayToken, sideID)
+	return err
 }
 
 func (t *fileTransport) listen() error {
-	if t.disableListener {
+	if t.disableListener || relayOnly || t.policy == TransitRelayOnly {
 		return nil
 	}
 	// always have tcp listener, otherwise app should run with --no-listen
-	l, err := net.Listen("tcp", ":0")
+	l, err := listenTCP()
 	if err != nil {
 		return err
 	}
@@ -534,34 +787,22 @@ func (t *fileTransport) listen() error {
 }
 
 func (t *fileTransport) listenRelay() (err error) {
-	ctx := context.Background()
+	if t.policy == TransitDirectOnly {
+		return nil
+	}
 
-	var conn net.Conn
-	switch t.relayURL.Scheme {
-	case "tcp":
-		// NB: don't dial the relay if we don't have an address.
-		// NB2: Host already contains the port here, if present
-		addr := t.relayURL.Host
-		if addr == "" {
-			return nil
-		}
+	// NB: don't dial the relay if we don't have an address.
+	// NB2: Host already contains the port here, if present
+	if t.relayURL.Scheme == "tcp" && t.relayURL.Host == "" {
+		return nil
+	}
 
-		conn, err = net.Dial("tcp", addr)
-		if err != nil {
-			return err
-		}
-	case "ws", "wss":
-		c, _, err := websocket.Dial(ctx, t.relayURL.String(), nil)
-		if err != nil {
-			return fmt.Errorf("websocket.Dial failed")
-		}
-		c.SetReadLimit(websocketReadSize)
-		conn = websocket.NetConn(ctx, c, websocket.MessageBinary)
-	default:
-		return fmt.Errorf("%w: '%s'", UnsupportedProtocolErr, t.relayURL.Scheme)
+	conn, err := t.dialRelay(context.Background(), t.relayURL)
+	if err != nil {
+		return err
 	}
 
-	_, err = conn.Write(t.relayHandshakeHeader())
+	err = t.writeRelayHandshake(conn, t.relayHandshake == RelayHandshakeLegacy)
 	if err != nil {
 		conn.Close()
 		return err
@@ -571,7 +812,31 @@ func (t *fileTransport) listenRelay() (err error) {
 	return nil
 }
 
-func (t *fileTransport) waitForRelayPeer(conn net.Conn, cancelCh chan struct{}) error {
+// waitForRelayPeer waits for the relay to pair conn, the connection
+// made by listenRelay, with the receiver's, and returns the paired
+// connection. That is a new one if the relay only knows the legacy
+// handshake.
+func (t *fileTransport) waitForRelayPeer(conn net.Conn, cancelCh chan struct{}) (net.Conn, error) {
+	err := t.awaitRelayPairing(conn, cancelCh)
+	if errors.Is(err, errRelayRefused) && t.relayHandshake == RelayHandshakeAuto {
+		t.logger.Info("transit relay refused handshake, retrying with legacy handshake", "relay", t.relayURL.String())
+		conn, err = t.dialRelay(context.Background(), t.relayURL)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.writeRelayHandshake(conn, true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		err = t.awaitRelayPairing(conn, cancelCh)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *fileTransport) awaitRelayPairing(conn net.Conn, cancelCh chan struct{}) error {
 	okCh := make(chan struct{})
 	go func() {
 		select {
@@ -583,33 +848,33 @@ func (t *fileTransport) waitForRelayPeer(conn net.Conn, cancelCh chan struct{})
 
 	defer close(okCh)
 
-	gotOk := make([]byte, 3)
-	_, err := io.ReadFull(conn, gotOk)
+	// the relay only answers once the peer has connected
+	err := withHandshakeDeadline(conn, t.timeouts.Peer, func() error {
+		return expectHandshakeLine(conn, "ok")
+	})
 	if err != nil {
 		conn.Close()
 		return err
 	}
 
-	if !bytes.Equal(gotOk, []byte("ok\n")) {
-		conn.Close()
-		return errors.New("got non ok status from relay server")
-	}
-
 	return nil
 }
 
-func (t *fileTransport) acceptConnection(ctx context.Context) (net.Conn, error) {
+// acceptConnection waits for the receiver to connect, directly or
+// through the relay, and reports which of the two it did.
+func (t *fileTransport) acceptConnection(ctx context.Context) (net.Conn, bool, error) {
 	readyCh := make(chan net.Conn)
+	relayReadyCh := make(chan net.Conn)
 	cancelCh := make(chan struct{})
 	acceptErrCh := make(chan error, 1)
 
 	if t.relayConn != nil {
 		go func() {
-			waitErr := t.waitForRelayPeer(t.relayConn, cancelCh)
+			conn, waitErr := t.waitForRelayPeer(t.relayConn, cancelCh)
 			if waitErr != nil {
 				return
 			}
-			t.handleIncomingConnection(t.relayConn, readyCh, cancelCh)
+			t.handleIncomingConnection(conn, relayReadyCh, cancelCh)
 		}()
 	}
 
@@ -626,27 +891,40 @@ func (t *fileTransport) acceptConnection(ctx context.Context) (net.Conn, error)
 					break
 				}
 
-				go t.handleIncomingConnection(conn, readyCh, cancelCh)
+				go t.handleIncomingConnection(t.traced(conn), readyCh, cancelCh)
 			}
 		}()
 	}
 
+	timeout, stop := peerTimer(t.clock, t.timeouts.Peer)
+	defer stop()
+
+	var (
+		conn    net.Conn
+		relayed bool
+	)
 	select {
 	case <-ctx.Done():
 		close(cancelCh)
-		return nil, ctx.Err()
-	case acceptErr := <-acceptErrCh:
+		return nil, false, ctx.Err()
+	case <-timeout:
 		close(cancelCh)
-		return nil, acceptErr
-	case conn := <-readyCh:
+		return nil, false, fmt.Errorf("%w to connect", ErrPeerTimeout)
+	case acceptErr := <-acceptErrCh:
 		close(cancelCh)
-		_, err := conn.Write([]byte("go\n"))
-		if err != nil {
-			return nil, err
-		}
+		return nil, false, acceptErr
+	case conn = <-readyCh:
+	case conn = <-relayReadyCh:
+		relayed = true
+	}
 
-		return conn, nil
+	close(cancelCh)
+	_, err := conn.Write([]byte("go\n"))
+	if err != nil {
+		return nil, false, err
 	}
+
+	return conn, relayed, nil
 }
 
 func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- net.Conn, cancelCh chan struct{}) {
@@ -667,22 +945,14 @@ func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- n
 		return
 	}
 
-	expectHeader := t.receiverHandshakeHeader()
-
-	gotHeader := make([]byte, len(expectHeader))
-
-	_, err = io.ReadFull(conn, gotHeader)
+	err = withHandshakeDeadline(conn, t.timeouts.Handshake, func() error {
+		return expectHandshakeHeader(conn, t.receiverHandshakeHeader())
+	})
 	if err != nil {
 		conn.Close()
 		close(okCh)
 		return
 	}
-
-	if subtle.ConstantTimeCompare(gotHeader, expectHeader) != 1 {
-		conn.Close()
-		close(okCh)
-		return
-	}
 	select {
 	case okCh <- struct{}{}:
 	case <-cancelCh:
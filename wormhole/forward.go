@@ -0,0 +1,625 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Forwarding frame types. A frame is its type, the ID of the stream it
+// is for and the length of its payload, then the payload. Each side
+// numbers the streams it opens itself; the top bit of the ID is set on
+// frames for streams the receiver of the frame opened.
+const (
+	// fwdOpen opens a stream to the target in the payload.
+	fwdOpen byte = iota + 1
+	// fwdOpenOK and fwdOpenFail answer fwdOpen. The payload of
+	// fwdOpenFail is the reason.
+	fwdOpenOK
+	fwdOpenFail
+	// fwdData carries data, within the receiver's window.
+	fwdData
+	// fwdEOF ends the data in one direction.
+	fwdEOF
+	// fwdClose ends the stream in both directions.
+	fwdClose
+	// fwdCredit lets the receiver send as many more bytes of data as
+	// the 4 byte big-endian payload says.
+	fwdCredit
+)
+
+const (
+	fwdHeaderSize = 9
+	// fwdMaxPayload is the largest payload of a frame.
+	fwdMaxPayload = 16 << 10
+	// fwdWindow is how much data each side of a stream may send before
+	// the other grants it more, and so how much it may have to buffer.
+	fwdWindow = 256 << 10
+	// fwdPeerOpened marks the IDs of streams opened by the other side.
+	fwdPeerOpened uint32 = 1 << 31
+	// fwdDialTimeout bounds connecting to a target.
+	fwdDialTimeout = 30 * time.Second
+)
+
+// ErrForwardRefused is returned by Forwarder.Dial when the peer does
+// not open a connection to the target, because the target is not in
+// its allow list or cannot be reached.
+var ErrForwardRefused = errors.New("forward refused by peer")
+
+// ErrForwarderClosed is returned for a Forwarder, and its connections,
+// after Close.
+var ErrForwarderClosed = errors.New("forwarder closed")
+
+// ForwardOptions configures a Forwarder.
+type ForwardOptions struct {
+	// Allow lists the targets, as "host:port", that the peer may open
+	// connections to through this side. If it is empty the peer can
+	// open none.
+	Allow []string
+	// Dial, if set, connects to targets instead of the system's
+	// network stack, like Client.Dial.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// A Forwarder forwards TCP connections to a peer over a single
+// connection to it, such as one made with Session.Connect, so that two
+// consenting peers can share services without opening ports.
+//
+// Both peers run a Forwarder on their end of the connection. A
+// connection opened with Dial, or accepted by Listen, on one side is
+// made to its target by the other side, which only connects to the
+// targets in its Allow list. Any number of connections share the
+// underlying connection, each with its own flow control.
+type Forwarder struct {
+	conn    net.Conn
+	options ForwardOptions
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*forwardStream
+	nextID  uint32
+	err     error
+	done    chan struct{}
+}
+
+// NewForwarder starts forwarding over conn. The Forwarder owns conn
+// from then on.
+func NewForwarder(conn net.Conn, options ForwardOptions) *Forwarder {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Forwarder{
+		conn:    conn,
+		options: options,
+		ctx:     ctx,
+		cancel:  cancel,
+		streams: make(map[uint32]*forwardStream),
+		done:    make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// Dial opens a connection to target, as "host:port", from the peer's
+// side. It fails with ErrForwardRefused if the peer does not connect to
+// target. Deadlines are not supported on the returned connection.
+func (f *Forwarder) Dial(ctx context.Context, target string) (net.Conn, error) {
+	if len(target) > fwdMaxPayload {
+		return nil, errors.New("forward target too long")
+	}
+
+	f.mu.Lock()
+	if f.err != nil {
+		f.mu.Unlock()
+		return nil, f.err
+	}
+	f.nextID++
+	if f.nextID&fwdPeerOpened != 0 {
+		f.mu.Unlock()
+		return nil, errors.New("forwarder out of stream IDs")
+	}
+	s := newForwardStream(f, f.nextID)
+	f.streams[s.id] = s
+	f.mu.Unlock()
+
+	err := f.writeFrame(fwdOpen, s.id, []byte(target))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case err = <-s.opened:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-f.done:
+		err = f.Err()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Listen forwards each connection accepted from l to target, as
+// "host:port", from the peer's side, until accepting fails or the
+// Forwarder is closed. It closes l before returning.
+func (f *Forwarder) Listen(l net.Listener, target string) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-f.done:
+		case <-stop:
+		}
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ferr := f.Err(); ferr != nil {
+				return ferr
+			}
+			return err
+		}
+
+		go func() {
+			s, err := f.Dial(f.ctx, target)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			proxyConns(conn, s)
+		}()
+	}
+}
+
+// Done returns a channel that is closed once the Forwarder stops,
+// because it was closed or its connection failed.
+func (f *Forwarder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns why the Forwarder stopped, or nil if it has not.
+func (f *Forwarder) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close closes the Forwarder's connection and every forwarded
+// connection.
+func (f *Forwarder) Close() error {
+	f.fail(ErrForwarderClosed)
+	return nil
+}
+
+// fail stops the Forwarder after err, failing its streams.
+func (f *Forwarder) fail(err error) {
+	f.mu.Lock()
+	if f.err != nil {
+		f.mu.Unlock()
+		return
+	}
+	f.err = err
+	streams := f.streams
+	f.streams = nil
+	close(f.done)
+	f.mu.Unlock()
+
+	f.cancel()
+	f.conn.Close()
+
+	streamErr := err
+	if err != ErrForwarderClosed {
+		streamErr = fmt.Errorf("forwarder connection lost: %w", err)
+	}
+	for _, s := range streams {
+		s.fail(streamErr)
+	}
+}
+
+func (f *Forwarder) stream(id uint32) *forwardStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams[id]
+}
+
+func (f *Forwarder) removeStream(id uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.streams, id)
+}
+
+// writeFrame sends a frame for the stream with the local ID id.
+func (f *Forwarder) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, fwdHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[fwdHeaderSize:], payload)
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	_, err := f.conn.Write(frame)
+	if err != nil {
+		f.fail(err)
+		return f.Err()
+	}
+	return nil
+}
+
+// run reads frames until the connection fails. It never writes, so it
+// never waits for the peer to read.
+func (f *Forwarder) run() {
+	header := make([]byte, fwdHeaderSize)
+	payload := make([]byte, fwdMaxPayload)
+	for {
+		_, err := io.ReadFull(f.conn, header)
+		if err != nil {
+			f.fail(err)
+			return
+		}
+		typ := header[0]
+		// flip the peer's view of the ID to ours
+		id := binary.BigEndian.Uint32(header[1:5]) ^ fwdPeerOpened
+		n := binary.BigEndian.Uint32(header[5:9])
+		if n > fwdMaxPayload {
+			f.fail(fmt.Errorf("forward frame of %d bytes too large", n))
+			return
+		}
+		_, err = io.ReadFull(f.conn, payload[:n])
+		if err != nil {
+			f.fail(err)
+			return
+		}
+
+		err = f.handleFrame(typ, id, payload[:n])
+		if err != nil {
+			f.fail(err)
+			return
+		}
+	}
+}
+
+func (f *Forwarder) handleFrame(typ byte, id uint32, payload []byte) error {
+	if typ == fwdOpen {
+		if id&fwdPeerOpened == 0 {
+			return fmt.Errorf("peer opened forward stream with our ID %d", id)
+		}
+		f.mu.Lock()
+		if f.streams == nil {
+			f.mu.Unlock()
+			return nil
+		}
+		if _, ok := f.streams[id]; ok {
+			f.mu.Unlock()
+			return fmt.Errorf("peer reopened forward stream %d", id)
+		}
+		s := newForwardStream(f, id)
+		f.streams[id] = s
+		f.mu.Unlock()
+
+		go f.serve(s, string(payload))
+		return nil
+	}
+
+	s := f.stream(id)
+	if s == nil {
+		// a late frame for a stream we closed
+		return nil
+	}
+
+	switch typ {
+	case fwdOpenOK:
+		s.answer(nil)
+	case fwdOpenFail:
+		f.removeStream(id)
+		s.answer(fmt.Errorf("%w: %s", ErrForwardRefused, payload))
+	case fwdData:
+		return s.deliver(payload)
+	case fwdEOF:
+		s.peerEOF()
+	case fwdClose:
+		f.removeStream(id)
+		s.peerClose()
+	case fwdCredit:
+		if len(payload) != 4 {
+			return errors.New("bad forward credit frame")
+		}
+		s.addCredit(int(binary.BigEndian.Uint32(payload)))
+	default:
+		return fmt.Errorf("unknown forward frame type %d", typ)
+	}
+	return nil
+}
+
+// serve connects the stream the peer opened to target, if it is
+// allowed.
+func (f *Forwarder) serve(s *forwardStream, target string) {
+	if !f.allowed(target) {
+		f.removeStream(s.id)
+		f.writeFrame(fwdOpenFail, s.id, []byte("target not allowed"))
+		return
+	}
+
+	dial := f.options.Dial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	ctx, cancel := context.WithTimeout(f.ctx, fwdDialTimeout)
+	conn, err := dial(ctx, "tcp", target)
+	cancel()
+	if err != nil {
+		f.removeStream(s.id)
+		f.writeFrame(fwdOpenFail, s.id, []byte("connect failed"))
+		return
+	}
+
+	err = f.writeFrame(fwdOpenOK, s.id, nil)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	proxyConns(conn, s)
+}
+
+func (f *Forwarder) allowed(target string) bool {
+	for _, allowed := range f.options.Allow {
+		if target == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConns copies between a and b until both directions end, passing
+// on half closes, then closes both.
+func proxyConns(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		cw, ok := dst.(interface{ CloseWrite() error })
+		if err != nil || !ok {
+			// there is no way to pass on the end of just this
+			// direction, so end both
+			a.Close()
+			b.Close()
+			return
+		}
+		cw.CloseWrite()
+	}
+
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// forwardStream is a connection forwarded through a Forwarder.
+type forwardStream struct {
+	f  *Forwarder
+	id uint32
+	// opened receives the peer's answer to opening the stream.
+	opened chan error
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// consumed is how much data has been read since the peer was last
+	// granted credit for it.
+	consumed int
+	// credit is how much more data may be sent.
+	credit int
+	// eof is set once the peer sends no more data.
+	eof bool
+	// wroteEOF is set once we send no more data.
+	wroteEOF bool
+	// err is set once the stream is closed, or the peer closed it.
+	err error
+}
+
+func newForwardStream(f *Forwarder, id uint32) *forwardStream {
+	s := &forwardStream{
+		f:      f,
+		id:     id,
+		opened: make(chan error, 1),
+		credit: fwdWindow,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *forwardStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.buf) == 0 && !s.eof && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.buf) == 0 {
+		err := s.err
+		if s.eof {
+			err = io.EOF
+		}
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	s.consumed += n
+	credit := 0
+	if s.consumed >= fwdWindow/2 {
+		credit, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+
+	if credit > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(credit))
+		s.f.writeFrame(fwdCredit, s.id, payload[:])
+	}
+	return n, nil
+}
+
+func (s *forwardStream) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		s.mu.Lock()
+		for s.credit == 0 && s.err == nil && !s.wroteEOF {
+			s.cond.Wait()
+		}
+		if s.err != nil || s.wroteEOF {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := len(p)
+		if n > s.credit {
+			n = s.credit
+		}
+		if n > fwdMaxPayload {
+			n = fwdMaxPayload
+		}
+		s.credit -= n
+		s.mu.Unlock()
+
+		err := s.f.writeFrame(fwdData, s.id, p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer that no more data will be written, like
+// net.TCPConn's.
+func (s *forwardStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.err != nil || s.wroteEOF {
+		s.mu.Unlock()
+		return nil
+	}
+	s.wroteEOF = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return s.f.writeFrame(fwdEOF, s.id, nil)
+}
+
+func (s *forwardStream) Close() error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.err = io.ErrClosedPipe
+	s.buf = nil
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.f.removeStream(s.id)
+	if s.f.Err() != nil {
+		return nil
+	}
+	return s.f.writeFrame(fwdClose, s.id, nil)
+}
+
+// deliver buffers data from the peer.
+func (s *forwardStream) deliver(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil
+	}
+	if s.eof {
+		return fmt.Errorf("forward stream %d data after EOF", s.id)
+	}
+	if len(s.buf)+s.consumed+len(data) > fwdWindow {
+		return fmt.Errorf("forward stream %d window exceeded", s.id)
+	}
+	s.buf = append(s.buf, data...)
+	s.cond.Broadcast()
+	return nil
+}
+
+func (s *forwardStream) peerEOF() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eof = true
+	s.cond.Broadcast()
+}
+
+// peerClose ends the stream after the peer closed it. Data already
+// received can still be read.
+func (s *forwardStream) peerClose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eof = true
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+	}
+	s.cond.Broadcast()
+}
+
+func (s *forwardStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.answer(err)
+	s.cond.Broadcast()
+}
+
+// answer passes the answer to opening the stream to Dial. Only the
+// first answer counts.
+func (s *forwardStream) answer(err error) {
+	select {
+	case s.opened <- err:
+	default:
+	}
+}
+
+func (s *forwardStream) addCredit(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credit += n
+	s.cond.Broadcast()
+}
+
+func (s *forwardStream) LocalAddr() net.Addr {
+	return s.f.conn.LocalAddr()
+}
+
+func (s *forwardStream) RemoteAddr() net.Addr {
+	return s.f.conn.RemoteAddr()
+}
+
+var errForwardDeadline = errors.New("deadlines are not supported on forwarded connections")
+
+func (s *forwardStream) SetDeadline(t time.Time) error {
+	return errForwardDeadline
+}
+
+func (s *forwardStream) SetReadDeadline(t time.Time) error {
+	return errForwardDeadline
+}
+
+func (s *forwardStream) SetWriteDeadline(t time.Time) error {
+	return errForwardDeadline
+}
@@ -0,0 +1,95 @@
+package wormhole
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Every message of the transit handshake is short and of known length,
+// so a relay or peer that sends more, or takes too long once it has
+// started answering, fails that connection instead of tying it up.
+const (
+	// handshakeTimeout is the default for Timeouts.Handshake.
+	handshakeTimeout = 30 * time.Second
+
+	// maxHandshakeLine is the longest status line, such as "ok" from
+	// a relay or "go" from the sender, read before giving up.
+	maxHandshakeLine = 64
+)
+
+var errBadHandshake = errors.New("bad transit handshake")
+
+// errRelayRefused is returned when a relay answers "bad handshake",
+// which is also how relays that only know the legacy handshake answer
+// the current one.
+var errRelayRefused = fmt.Errorf("%w: relay answered \"bad handshake\"", errBadHandshake)
+
+// readHandshakeLine reads a "\n" terminated line from r and returns it
+// without the line ending. It reads one byte at a time so that nothing
+// after the line is consumed.
+func readHandshakeLine(r io.Reader) (string, error) {
+	line := make([]byte, 0, 16)
+	b := make([]byte, 1)
+	for len(line) <= maxHandshakeLine {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("%w: line longer than %d bytes", errBadHandshake, maxHandshakeLine)
+}
+
+// expectHandshakeLine reads a status line from r and fails unless it
+// is want. Relays answer "bad handshake" and losing connections get
+// "nevermind", which end up in the error.
+func expectHandshakeLine(r io.Reader, want string) error {
+	line, err := readHandshakeLine(r)
+	if err != nil {
+		return err
+	}
+	if line == "bad handshake" && want != line {
+		return errRelayRefused
+	}
+	if line != want {
+		return fmt.Errorf("%w: got %q, expected %q", errBadHandshake, line, want)
+	}
+	return nil
+}
+
+// expectHandshakeHeader reads len(expect) bytes from r and compares
+// them to expect in constant time, since the header is derived from
+// the transit key.
+func expectHandshakeHeader(r io.Reader, expect []byte) error {
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(r, got); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, expect) != 1 {
+		return errBadHandshake
+	}
+	return nil
+}
+
+// withHandshakeDeadline runs read with a read deadline d from now set
+// on conn, and clears it again afterwards. A zero d sets no deadline.
+func withHandshakeDeadline(conn net.Conn, d time.Duration, read func() error) error {
+	if d <= 0 {
+		return read()
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return err
+	}
+	err := read()
+	if clearErr := conn.SetReadDeadline(time.Time{}); err == nil {
+		err = clearErr
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package wormhole
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func FuzzReadHandshakeLine(f *testing.F) {
+	for _, seed := range []string{"ok\n", "go\n", "nevermind\n", "bad handshake\n", "ok\r\n", "ok", ""} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		line, err := readHandshakeLine(r)
+		if err != nil {
+			return
+		}
+		if len(line) > maxHandshakeLine {
+			t.Fatalf("accepted a %d byte line", len(line))
+		}
+		if strings.Contains(line, "\n") {
+			t.Fatalf("line %q contains a newline", line)
+		}
+		consumed := len(data) - r.Len()
+		if data[consumed-1] != '\n' {
+			t.Fatalf("read past the end of line %q", line)
+		}
+	})
+}
+
+func FuzzExpectHandshakeHeader(f *testing.F) {
+	expect := []byte("transit receiver 3b9c9a5d4f3b1f2e ready\n\n")
+	f.Add(expect)
+	f.Add([]byte("transit sender 3b9c9a5d4f3b1f2e ready\n\n"))
+	f.Add([]byte("bad handshake\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := expectHandshakeHeader(bytes.NewReader(data), expect)
+		match := bytes.HasPrefix(data, expect)
+		if match != (err == nil) {
+			t.Fatalf("data %q: got err=%v", data, err)
+		}
+		if len(data) >= len(expect) && !match && !errors.Is(err, errBadHandshake) {
+			t.Fatalf("data %q: got %v, expected errBadHandshake", data, err)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package wormhole
+
+import (
+	"context"
+)
+
+// TransferInfo describes the transfer a TransferHooks hook is called
+// for.
+type TransferInfo struct {
+	// TransferID matches the ID in the transfer's logs, events and
+	// results.
+	TransferID string
+	// Side is "send" or "receive".
+	Side string
+	// Offer is the offer of the transfer. It is the zero Offer for
+	// transfers that failed before the offer was made or received.
+	Offer Offer
+}
+
+// TransferHooks are called at the points of a transfer where an
+// application may want to apply its own policy, such as scanning
+// received files, enforcing quotas or auditing. Any of the hooks may
+// be nil. Hooks are called from the transfer's goroutines, so they
+// must be safe for concurrent use if the Client makes concurrent
+// transfers.
+//
+// A hook that returns an error stops the transfer, which fails with
+// CodeDeclined and the hook's error; the peer is told the transfer was
+// abandoned. The hooks in Client.Hooks are called first, in order,
+// followed by the ones set with WithHooks, and the first error stops
+// the rest from being called.
+type TransferHooks struct {
+	// BeforeOffer is called by the sender once the key exchange and
+	// verification are done, before the offer is sent.
+	BeforeOffer func(ctx context.Context, info TransferInfo) error
+	// AfterAnswer is called by the sender of a file or directory once
+	// the receiver has accepted the offer and the transit connection
+	// is up, before any data is sent.
+	AfterAnswer func(ctx context.Context, info TransferInfo) error
+	// BeforeAck is called by the receiver of a file or directory once
+	// all the data has been read and its checksums checked, before the
+	// final acknowledgment is sent, as with WithChecksumCallback. An
+	// error withholds the acknowledgment, so the sender's transfer
+	// fails with CodeIntegrity.
+	BeforeAck func(ctx context.Context, info TransferInfo, sum Checksum) error
+	// AfterComplete is called on both sides once the transfer is over,
+	// with err set if it failed, including when it was declined.
+	AfterComplete func(info TransferInfo, err error)
+}
+
+type hooksTransferOption struct {
+	hooks TransferHooks
+}
+
+func (o hooksTransferOption) setOption(opts *transferOptions) error {
+	opts.hooks = append(opts.hooks, o.hooks)
+	return nil
+}
+
+// WithHooks returns a TransferOption that adds hooks to the transfer,
+// to be called after those in Client.Hooks.
+func WithHooks(hooks TransferHooks) TransferOption {
+	return hooksTransferOption{hooks}
+}
+
+func (o *transferOptions) transferInfo() TransferInfo {
+	return TransferInfo{
+		TransferID: o.transferID,
+		Side:       o.side,
+		Offer:      o.offer,
+	}
+}
+
+// setOffer records the offer of the transfer for hooks and the audit
+// log.
+func (o *transferOptions) setOffer(offer Offer) {
+	o.offer = offer
+	o.audit.setOffer(offer)
+}
+
+// runHooks calls f for each of the transfer's hooks until one returns
+// an error, which is returned as a CodeDeclined TransferError.
+func (o *transferOptions) runHooks(phase TransferPhase, f func(h *TransferHooks) error) error {
+	for i := range o.hooks {
+		if err := f(&o.hooks[i]); err != nil {
+			return newTransferError(CodeDeclined, phase, err)
+		}
+	}
+	return nil
+}
+
+func (o *transferOptions) beforeOffer(ctx context.Context) error {
+	return o.runHooks(PhaseTransit, func(h *TransferHooks) error {
+		if h.BeforeOffer == nil {
+			return nil
+		}
+		return h.BeforeOffer(ctx, o.transferInfo())
+	})
+}
+
+func (o *transferOptions) afterAnswer(ctx context.Context) error {
+	return o.runHooks(PhaseTransit, func(h *TransferHooks) error {
+		if h.AfterAnswer == nil {
+			return nil
+		}
+		return h.AfterAnswer(ctx, o.transferInfo())
+	})
+}
+
+func (o *transferOptions) beforeAck(ctx context.Context, sum Checksum) error {
+	return o.runHooks(PhaseData, func(h *TransferHooks) error {
+		if h.BeforeAck == nil {
+			return nil
+		}
+		return h.BeforeAck(ctx, o.transferInfo(), sum)
+	})
+}
+
+// afterComplete calls the AfterComplete hooks, once per transfer.
+func (o *transferOptions) afterComplete(err error) {
+	if o.hooksDone {
+		return
+	}
+	o.hooksDone = true
+	for _, h := range o.hooks {
+		if h.AfterComplete != nil {
+			h.AfterComplete(o.transferInfo(), err)
+		}
+	}
+}
+
+// abandonTransfer tells the peer that a hook stopped the transfer.
+func abandonTransfer(ctx context.Context, cp *clientProtocol) {
+	errMsg := abandonedMsg
+	cp.WriteAppData(ctx, &genericMessage{
+		Error: &errMsg,
+	})
+}
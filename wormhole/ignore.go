@@ -0,0 +1,217 @@
+package wormhole
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// VCSIgnorePatterns are ignore patterns for the metadata directories of
+// common version control systems.
+var VCSIgnorePatterns = []string{".git/", ".hg/", ".svn/", ".bzr/", "_darcs/", "CVS/"}
+
+// An IgnoreList decides which files of a directory are left out of a
+// directory send, with patterns in the syntax of .gitignore files:
+//
+//   - A pattern without a slash, such as "*.log" or "node_modules",
+//     matches a file or directory with that name at any depth.
+//   - A pattern with a slash at the start or in the middle, such as
+//     "/build" or "docs/*.pdf", matches paths relative to the top of
+//     the directory.
+//   - A pattern ending in a slash, such as "dist/", only matches
+//     directories.
+//   - "*", "?" and "[...]" match as in path.Match, within one path
+//     element. "**" matches any number of elements, as in "**/tmp",
+//     "logs/**" or "a/**/b".
+//   - A pattern starting with "!" includes again what an earlier
+//     pattern excluded, except for files in an excluded directory.
+//   - Blank lines and lines starting with "#" are ignored.
+//
+// The last pattern that matches a path decides whether it is ignored.
+// A file in an ignored directory is always ignored.
+type IgnoreList struct {
+	patterns []string
+	rules    []ignoreRule
+}
+
+type ignoreRule struct {
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	elems    []string
+}
+
+// NewIgnoreList returns an IgnoreList with patterns, one per element
+// as they would appear on a line of a .gitignore file.
+func NewIgnoreList(patterns ...string) (*IgnoreList, error) {
+	l := &IgnoreList{}
+	for _, p := range patterns {
+		if err := l.add(p); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ReadIgnoreList returns an IgnoreList with the patterns read from r,
+// in the format of a .gitignore file.
+func ReadIgnoreList(r io.Reader) (*IgnoreList, error) {
+	l := &IgnoreList{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := l.add(scanner.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Patterns returns the patterns of l that have an effect, in order.
+func (l *IgnoreList) Patterns() []string {
+	return append([]string(nil), l.patterns...)
+}
+
+func (l *IgnoreList) add(line string) error {
+	p := strings.TrimRight(strings.TrimSuffix(line, "\r"), " ")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil
+	}
+
+	var r ignoreRule
+	pattern := p
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	r.anchored = strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return fmt.Errorf("invalid ignore pattern %q", line)
+	}
+
+	r.elems = strings.Split(pattern, "/")
+	for _, elem := range r.elems {
+		if _, err := path.Match(elem, ""); err != nil || elem == "" {
+			return fmt.Errorf("invalid ignore pattern %q", line)
+		}
+	}
+
+	l.patterns = append(l.patterns, p)
+	l.rules = append(l.rules, r)
+	return nil
+}
+
+// Ignored reports whether the file or directory at name, a slash
+// separated path relative to the top of the directory being sent, is
+// left out. isDir says whether name is a directory.
+func (l *IgnoreList) Ignored(name string, isDir bool) bool {
+	if l == nil || len(l.rules) == 0 {
+		return false
+	}
+	elems := strings.Split(strings.Trim(name, "/"), "/")
+	for i := range elems {
+		last := i == len(elems)-1
+		if l.match(elems[:i+1], isDir || !last) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the last rule that matches the path elems
+// excludes it.
+func (l *IgnoreList) match(elems []string, isDir bool) bool {
+	ignored := false
+	for _, r := range l.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.matches(elems) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func (r *ignoreRule) matches(elems []string) bool {
+	if !r.anchored {
+		ok, _ := path.Match(r.elems[0], elems[len(elems)-1])
+		return ok
+	}
+	return matchElems(r.elems, elems)
+}
+
+// matchElems reports whether the path elements name match the pattern
+// elements, where a "**" element matches any number of elements, or at
+// least one at the end of the pattern.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				// a trailing "**" matches what is inside, not the
+				// directory itself
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+type ignoreTransferOption struct {
+	list *IgnoreList
+}
+
+func (o ignoreTransferOption) setOption(opts *transferOptions) error {
+	opts.ignore = o.list
+	return nil
+}
+
+// WithIgnore returns a TransferOption for SendDirectory that leaves
+// out the entries l ignores. Entry paths are matched relative to the
+// directory being sent.
+func WithIgnore(l *IgnoreList) TransferOption {
+	return ignoreTransferOption{l}
+}
+
+// filterEntries returns the entries of the directory directoryName
+// that l does not ignore.
+func filterEntries(entries []DirectoryEntry, directoryName string, l *IgnoreList) []DirectoryEntry {
+	if l == nil {
+		return entries
+	}
+	prefix := path.Clean(filepath.ToSlash(directoryName)) + "/"
+	var kept []DirectoryEntry
+	for _, e := range entries {
+		p := filepath.ToSlash(e.Path)
+		if strings.HasPrefix(p, prefix) && l.Ignored(strings.TrimPrefix(p, prefix), false) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
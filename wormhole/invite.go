@@ -0,0 +1,82 @@
+package wormhole
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/psanford/wormhole-william/wordlist"
+)
+
+// inviteWordCount is the minimum number of words in an invite code.
+// An invite is used for many transfers, each of which gives anyone
+// trying to join one guess at it, so it gets more words than a code
+// used once.
+const inviteWordCount = 4
+
+// Invite nameplates are drawn from a range above the small numbers the
+// rendezvous server allocates, so that they rarely collide with
+// nameplates in use by ordinary transfers.
+const (
+	minInviteNameplate = 100000
+	maxInviteNameplate = 999999
+)
+
+var errInviteWithoutCode = errors.New("WithInvite requires WithCode when sending")
+
+// NewInviteCode returns a new random code for use with WithInvite. It
+// is made up of a six-digit nameplate and at least four words, or
+// PassPhraseComponentLength words if that is more.
+//
+// Unlike the codes the rendezvous server allocates, an invite code does
+// not depend on any state on the server, so it can be shared ahead of
+// time and stays valid for as long as its owner wants to use it.
+func (c *Client) NewInviteCode() (string, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(c.random(), buf[:]); err != nil {
+		return "", err
+	}
+	n := binary.BigEndian.Uint32(buf[:]) % (maxInviteNameplate - minInviteNameplate + 1)
+	nameplate := strconv.Itoa(int(n) + minInviteNameplate)
+
+	words := c.wordCount()
+	if words < inviteWordCount {
+		words = inviteWordCount
+	}
+	code, err := wordlist.ChooseWordsFrom(c.random(), words)
+	if err != nil {
+		return "", err
+	}
+	return nameplate + "-" + code, nil
+}
+
+type inviteTransferOption struct{}
+
+func (o inviteTransferOption) setOption(opts *transferOptions) error {
+	opts.invite = true
+	return nil
+}
+
+// WithInvite returns a TransferOption that marks the transfer's code as
+// a long-lived invite, such as one made with NewInviteCode, so that the
+// same code can be used for one transfer after another. This suits a
+// drop box, where a host keeps receiving with its invite and guests
+// send to it with WithCode and WithInvite whenever they like.
+//
+// For a transfer with an invite, the Client skips its check for reused
+// codes, and Receive and JoinSession claim the nameplate themselves if
+// the peer has not claimed it yet and wait for the peer to arrive, so
+// either side can come first. Each transfer claims the nameplate again
+// once the last one has released it, so an invite can only carry one
+// transfer at a time; a third client arriving during a transfer is
+// turned away by the rendezvous server.
+//
+// Every transfer made with an invite gives anyone trying to join it one
+// guess at the code, while an ordinary code gives one guess in total.
+// Invites should only be used with long codes, should be shared with
+// the same care as a password, and should be replaced when they may
+// have leaked. Sending with WithInvite requires WithCode.
+func WithInvite() TransferOption {
+	return inviteTransferOption{}
+}
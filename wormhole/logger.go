@@ -0,0 +1,170 @@
+package wormhole
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/psanford/wormhole-william/internal/redact"
+)
+
+// Logger receives diagnostic messages from a Client. Each message is
+// a short constant string followed by alternating key/value pairs,
+// e.g.
+//
+//	logger.Debug("transit connected", "addr", addr, "relayed", true)
+//
+// Implementations must be safe for concurrent use. Logger has the same
+// method set as rendezvous.Logger, so one value can be used for both.
+//
+// A Client scrubs what it logs before passing it to its Logger: codes
+// are shortened to their nameplate, and keys, PAKE messages and
+// verifiers are replaced by "[redacted]", at every level.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// LogFunc is a printf style logging function.
+//
+// Deprecated: set Client.Logger instead, using LogFuncLogger to adapt
+// an existing LogFunc.
+type LogFunc func(string, ...interface{})
+
+// LogFuncLogger returns a Logger that formats every message, at every
+// level, as "level msg key=value ..." and passes it to f.
+func LogFuncLogger(f LogFunc) Logger {
+	return logFuncLogger(f)
+}
+
+type logFuncLogger LogFunc
+
+func (f logFuncLogger) log(level, msg string, keyvals []interface{}) {
+	format := level + " " + msg
+	args := make([]interface{}, 0, len(keyvals))
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			format += " %v=%v"
+			args = append(args, keyvals[i], keyvals[i+1])
+		} else {
+			format += " %v=(missing)"
+			args = append(args, keyvals[i])
+		}
+	}
+	f(format, args...)
+}
+
+func (f logFuncLogger) Debug(msg string, keyvals ...interface{}) { f.log("debug", msg, keyvals) }
+func (f logFuncLogger) Info(msg string, keyvals ...interface{})  { f.log("info", msg, keyvals) }
+func (f logFuncLogger) Warn(msg string, keyvals ...interface{})  { f.log("warn", msg, keyvals) }
+func (f logFuncLogger) Error(msg string, keyvals ...interface{}) { f.log("error", msg, keyvals) }
+
+// withKeyvals returns a Logger that appends keyvals to every message
+// logged through l.
+func withKeyvals(l Logger, keyvals ...interface{}) Logger {
+	if _, ok := l.(nopLogger); ok {
+		return l
+	}
+	return &keyvalsLogger{l: l, keyvals: keyvals}
+}
+
+type keyvalsLogger struct {
+	l       Logger
+	keyvals []interface{}
+}
+
+func (k *keyvalsLogger) with(keyvals []interface{}) []interface{} {
+	return append(append([]interface{}{}, keyvals...), k.keyvals...)
+}
+
+func (k *keyvalsLogger) Debug(msg string, keyvals ...interface{}) { k.l.Debug(msg, k.with(keyvals)...) }
+func (k *keyvalsLogger) Info(msg string, keyvals ...interface{})  { k.l.Info(msg, k.with(keyvals)...) }
+func (k *keyvalsLogger) Warn(msg string, keyvals ...interface{})  { k.l.Warn(msg, k.with(keyvals)...) }
+func (k *keyvalsLogger) Error(msg string, keyvals ...interface{}) { k.l.Error(msg, k.with(keyvals)...) }
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+func (c *Client) logger() Logger {
+	if c.Logger != nil {
+		return redactingLogger{c.Logger}
+	}
+	return nopLogger{}
+}
+
+// secretKeys are log keys whose values are always redacted.
+var secretKeys = map[string]bool{
+	"code":     true,
+	"key":      true,
+	"password": true,
+	"pake":     true,
+	"secret":   true,
+	"verifier": true,
+}
+
+// redactingLogger removes secrets from everything logged through it
+// before passing it on, so that no code path has to remember to. The
+// values of secretKeys are dropped, and key material and code words
+// are scrubbed from any text.
+type redactingLogger struct {
+	l Logger
+}
+
+func redactKeyvals(keyvals []interface{}) []interface{} {
+	out := make([]interface{}, len(keyvals))
+	for i, v := range keyvals {
+		if i%2 == 0 {
+			out[i] = v
+			continue
+		}
+		if k, ok := keyvals[i-1].(string); ok && secretKeys[strings.ToLower(k)] {
+			out[i] = redact.Redacted
+			continue
+		}
+		out[i] = redactValue(v)
+	}
+	return out
+}
+
+// redactValue returns v, or a scrubbed string if any text of v had
+// to be redacted.
+func redactValue(v interface{}) interface{} {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		return v
+	}
+	if r := redact.String(s); r != s {
+		return r
+	}
+	return v
+}
+
+func (r redactingLogger) Debug(msg string, keyvals ...interface{}) {
+	r.l.Debug(msg, redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) Info(msg string, keyvals ...interface{}) {
+	r.l.Info(msg, redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) Warn(msg string, keyvals ...interface{}) {
+	r.l.Warn(msg, redactKeyvals(keyvals)...)
+}
+
+func (r redactingLogger) Error(msg string, keyvals ...interface{}) {
+	r.l.Error(msg, redactKeyvals(keyvals)...)
+}
@@ -1,8 +1,65 @@
 package wormhole
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/clock"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
 type transferOptions struct {
-	code         string
-	progressFunc progressFunc
+	code           string
+	progressFunc   progressFunc
+	statsFunc      func(TransferStats)
+	offerFunc      func(Offer) bool
+	checksumFunc   func(Checksum) error
+	maxOfferSize   int64
+	zipLimits      *ZipLimits
+	versionPolicy  *VersionPolicy
+	transitPolicy  TransitPolicy
+	relayHandshake RelayHandshake
+	directoryMode  DirectoryMode
+	events         chan<- Event
+	stallTimeout   time.Duration
+	stallFunc      func(idle time.Duration) bool
+	bufferSize     int
+	memoryLimit    int
+
+	encryptionWorkers  int
+	strictVerification bool
+	message            *string
+	invite             bool
+	pairing            bool
+	pendingPath        string
+	resumed            bool
+	hooks              []TransferHooks
+	collisionPolicy    CollisionPolicy
+	collisionFunc      func(path string, offer Offer) CollisionPolicy
+	ignore             *IgnoreList
+
+	// The rest are set by the Client when a transfer starts rather
+	// than by a TransferOption.
+	transferID string
+	side       string
+	logger     Logger
+	audit      *auditTrail
+	counter    *transferCounter
+	// pendingStore is set once the send is recorded in the Client's
+	// PendingStore.
+	pendingStore PendingStore
+	// offer is the offer of the transfer once it is known.
+	offer Offer
+	// hooksDone is set once the AfterComplete hooks have been called.
+	hooksDone bool
+
+	connStateHook func(ConnStateChange)
+	// timeouts are resolved; see Timeouts.resolve.
+	timeouts Timeouts
+	// clock runs the timers of timeouts and stall detection.
+	clock clock.Clock
 }
 
 type TransferOption interface {
@@ -50,3 +107,532 @@ func (o progressTransferOption) setOption(opts *transferOptions) error {
 func WithProgress(f func(sentBytes int64, totalBytes int64)) TransferOption {
 	return progressTransferOption{f}
 }
+
+type progressStatsTransferOption struct {
+	statsFunc func(TransferStats)
+}
+
+func (o progressStatsTransferOption) setOption(opts *transferOptions) error {
+	opts.statsFunc = o.statsFunc
+	return nil
+}
+
+// WithProgressStats returns a TransferOption to track the progress of
+// a file or directory transfer along with its throughput and whether
+// it is going through a transit relay. The callback is called for each
+// chunk of data successfully written, in addition to any callback
+// registered with WithProgress.
+//
+// Like WithProgress, WithProgressStats is only minimally supported in
+// SendText.
+func WithProgressStats(f func(TransferStats)) TransferOption {
+	return progressStatsTransferOption{f}
+}
+
+// Offer describes a file or directory offered by the sender, as passed
+// to the callback registered with WithOfferCallback. Like the matching
+// IncomingMessage fields, the sizes come from the peer and a malicious
+// peer could lie about them.
+type Offer struct {
+	Type                TransferType
+	Name                string
+	TransferBytes64     int64
+	UncompressedBytes64 int64
+	FileCount           int
+	// UnknownLength is set for offers made with SendStream; the sizes
+	// are 0 in that case.
+	UnknownLength bool
+	// Message is the text sent along with a file or directory offer,
+	// as with WithMessage. It is empty for text offers.
+	Message string
+	// DirectoryMode is how a directory offer is archived.
+	DirectoryMode DirectoryMode
+}
+
+type offerTransferOption struct {
+	offerFunc func(Offer) bool
+}
+
+func (o offerTransferOption) setOption(opts *transferOptions) error {
+	opts.offerFunc = o.offerFunc
+	return nil
+}
+
+// WithOfferCallback returns a TransferOption for Receive that lets the
+// caller inspect a file or directory offer before anything else is
+// sent to the sender, including this side's transit hints. If f returns
+// false the offer is rejected and Receive returns ErrOfferDeclined.
+//
+// Text messages are always accepted: by the time a text offer arrives
+// the message has already been transferred.
+func WithOfferCallback(f func(Offer) bool) TransferOption {
+	return offerTransferOption{f}
+}
+
+// ErrOfferTooLarge is the error Receive fails with when an offer is
+// larger than the limit set with WithMaxOfferSize. It wraps
+// ErrOfferDeclined.
+var ErrOfferTooLarge = fmt.Errorf("%w: offer exceeds size limit", ErrOfferDeclined)
+
+// ErrUnsupportedDirectoryMode is the error Receive fails with when a
+// directory offer is archived in a mode other than the DirectoryMode
+// constants. It wraps ErrOfferDeclined.
+var ErrUnsupportedDirectoryMode = fmt.Errorf("%w: unsupported directory mode", ErrOfferDeclined)
+
+// DirectoryMode is the archive format of a directory transfer, as
+// declared in the offer.
+type DirectoryMode string
+
+const (
+	// DirectoryModeDeflated sends directories as a zip file with
+	// compressed entries. This is the default, and the only mode most
+	// clients send.
+	DirectoryModeDeflated DirectoryMode = "zipfile/deflated"
+	// DirectoryModeStored sends directories as a zip file with the
+	// entries stored uncompressed, which saves the cost of compressing
+	// data that doesn't compress, such as media or archives.
+	DirectoryModeStored DirectoryMode = "zipfile/stored"
+)
+
+type directoryModeTransferOption struct {
+	mode DirectoryMode
+}
+
+func (o directoryModeTransferOption) setOption(opts *transferOptions) error {
+	switch o.mode {
+	case DirectoryModeDeflated, DirectoryModeStored:
+	default:
+		return fmt.Errorf("unknown directory mode %q", o.mode)
+	}
+	opts.directoryMode = o.mode
+	return nil
+}
+
+// WithDirectoryMode returns a TransferOption for SendDirectory that
+// selects how the directory is archived. Receivers read either mode,
+// but clients that don't know DirectoryModeStored may refuse it.
+func WithDirectoryMode(m DirectoryMode) TransferOption {
+	return directoryModeTransferOption{m}
+}
+
+type maxOfferSizeTransferOption struct {
+	size int64
+}
+
+func (o maxOfferSizeTransferOption) setOption(opts *transferOptions) error {
+	if o.size < 1 {
+		return fmt.Errorf("invalid max offer size %d", o.size)
+	}
+	opts.maxOfferSize = o.size
+	return nil
+}
+
+// WithMaxOfferSize returns a TransferOption for Receive that rejects
+// file and directory offers larger than size bytes, before any transit
+// connection is made. Both the size sent over the network and, for
+// directories, the uncompressed size are checked. Receive then fails
+// with ErrOfferTooLarge.
+//
+// Offers made with SendStream have no size up front, so they are
+// accepted, but reading one fails with ErrOfferTooLarge once more than
+// size bytes have arrived.
+func WithMaxOfferSize(size int64) TransferOption {
+	return maxOfferSizeTransferOption{size}
+}
+
+// TransitPolicy controls which kinds of transit connection a file or
+// directory transfer may use.
+type TransitPolicy int
+
+const (
+	// TransitAny tries to connect directly to the peer and falls back to
+	// the transit relay. This is the default.
+	TransitAny TransitPolicy = iota
+	// TransitRelayOnly only uses the transit relay. No listening socket is
+	// opened and no local addresses are sent to the peer.
+	TransitRelayOnly
+	// TransitDirectOnly never uses the transit relay. The sender must be
+	// able to listen for connections and be reachable by the receiver.
+	TransitDirectOnly
+)
+
+type transitPolicyTransferOption struct {
+	policy TransitPolicy
+}
+
+func (o transitPolicyTransferOption) setOption(opts *transferOptions) error {
+	switch o.policy {
+	case TransitAny, TransitRelayOnly, TransitDirectOnly:
+	default:
+		return fmt.Errorf("unknown transit policy %d", o.policy)
+	}
+	opts.transitPolicy = o.policy
+	return nil
+}
+
+// WithTransitPolicy returns a TransferOption that restricts how the
+// transit connection for a file or directory transfer is made.
+func WithTransitPolicy(p TransitPolicy) TransferOption {
+	return transitPolicyTransferOption{p}
+}
+
+// RelayHandshake selects the form of the request sent to the transit
+// relay to be paired with the peer.
+type RelayHandshake int
+
+const (
+	// RelayHandshakeAuto sends the current request and, if the relay
+	// answers "bad handshake", retries once with the legacy request.
+	// This is the default.
+	RelayHandshakeAuto RelayHandshake = iota
+	// RelayHandshakeCurrent only sends the current request,
+	// "please relay <token> for side <side>".
+	RelayHandshakeCurrent
+	// RelayHandshakeLegacy only sends the legacy request,
+	// "please relay <token>", which relays from before sides were added
+	// to the handshake expect.
+	RelayHandshakeLegacy
+)
+
+type relayHandshakeTransferOption struct {
+	handshake RelayHandshake
+}
+
+func (o relayHandshakeTransferOption) setOption(opts *transferOptions) error {
+	switch o.handshake {
+	case RelayHandshakeAuto, RelayHandshakeCurrent, RelayHandshakeLegacy:
+	default:
+		return fmt.Errorf("unknown relay handshake %d", o.handshake)
+	}
+	opts.relayHandshake = o.handshake
+	return nil
+}
+
+// WithRelayHandshake returns a TransferOption that selects the
+// handshake used with the transit relay. It is only needed to skip the
+// retry with relays known to be old, or to rule out the legacy
+// handshake.
+func WithRelayHandshake(h RelayHandshake) TransferOption {
+	return relayHandshakeTransferOption{h}
+}
+
+// ErrTransferStalled is the error a transfer fails with when the
+// callback registered with WithStallTimeout aborts it.
+var ErrTransferStalled = errors.New("transfer stalled")
+
+type stallTransferOption struct {
+	timeout time.Duration
+	f       func(idle time.Duration) bool
+}
+
+func (o stallTransferOption) setOption(opts *transferOptions) error {
+	if o.timeout <= 0 {
+		return fmt.Errorf("invalid stall timeout %s", o.timeout)
+	}
+	opts.stallTimeout = o.timeout
+	opts.stallFunc = o.f
+	return nil
+}
+
+// WithStallTimeout returns a TransferOption that watches the data
+// transfer of a file or directory for stalls, where no bytes have moved
+// for at least timeout. On each stall an EventStalled is sent and f,
+// if non-nil, is called from another goroutine with the time since
+// bytes last moved. If f returns true the transit connection is closed
+// and the transfer fails with ErrTransferStalled; otherwise f is called
+// again only after the transfer has made progress and stalled again.
+//
+// On the receiving side bytes only move while the caller is reading
+// from the IncomingMessage, so time spent not calling Read counts
+// towards a stall.
+func WithStallTimeout(timeout time.Duration, f func(idle time.Duration) bool) TransferOption {
+	return stallTransferOption{timeout: timeout, f: f}
+}
+
+// Limits for WithBufferSize.
+const (
+	minBufferSize = 1 << 10
+	maxBufferSize = 1 << 24
+)
+
+// defaultBufferSize makes each transit record exactly 16 KiB.
+const defaultBufferSize = 1<<14 - secretbox.Overhead
+
+type bufferSizeTransferOption struct {
+	size int
+}
+
+func (o bufferSizeTransferOption) setOption(opts *transferOptions) error {
+	if o.size < minBufferSize || o.size > maxBufferSize {
+		return fmt.Errorf("buffer size %d out of range [%d, %d]", o.size, minBufferSize, maxBufferSize)
+	}
+	opts.bufferSize = o.size
+	return nil
+}
+
+// WithBufferSize returns a TransferOption that sets the size of the
+// buffers used for the data of a file or directory transfer, in place
+// of the default of just under 16 KiB.
+//
+// When sending, size is the amount of data read from the source and
+// sent in each encrypted record. Larger records cost more memory but
+// less CPU and framing overhead per byte, which helps on fast links.
+// When receiving, size is the record size the decryption buffers are
+// allocated for up front; since the sender chooses the record size,
+// the buffers still grow to hold larger records.
+func WithBufferSize(size int) TransferOption {
+	return bufferSizeTransferOption{size}
+}
+
+func (o *transferOptions) bufferSizeOrDefault() int {
+	if o.bufferSize > 0 {
+		return o.bufferSize
+	}
+	return defaultBufferSize
+}
+
+// ErrRecordTooLarge is the error a receive fails with when the sender
+// sends a record larger than the limit set with WithReceiveMemoryLimit.
+var ErrRecordTooLarge = errors.New("transit record exceeds receive memory limit")
+
+type memoryLimitTransferOption struct {
+	limit int
+}
+
+func (o memoryLimitTransferOption) setOption(opts *transferOptions) error {
+	if o.limit < minBufferSize {
+		return fmt.Errorf("receive memory limit %d below minimum of %d", o.limit, minBufferSize)
+	}
+	opts.memoryLimit = o.limit
+	return nil
+}
+
+// WithReceiveMemoryLimit returns a TransferOption for Receive that
+// bounds how much decrypted data a file or directory transfer buffers
+// for the caller.
+//
+// An IncomingMessage only reads from the transit connection when the
+// caller calls Read, so a slow consumer already pushes back on the
+// sender through the connection. What is buffered is the record
+// currently being read, and the sender chooses how large records are.
+// With a limit set, a record with more than limit bytes of data fails
+// the transfer with ErrRecordTooLarge before it is read into memory.
+// Other clients send records of 16 KiB or less by default, so limits
+// of 64 KiB and up are safe.
+func WithReceiveMemoryLimit(limit int) TransferOption {
+	return memoryLimitTransferOption{limit}
+}
+
+type encryptionWorkersTransferOption struct {
+	workers int
+}
+
+func (o encryptionWorkersTransferOption) setOption(opts *transferOptions) error {
+	if o.workers < 1 {
+		return fmt.Errorf("invalid number of encryption workers %d", o.workers)
+	}
+	opts.encryptionWorkers = o.workers
+	return nil
+}
+
+// WithEncryptionWorkers returns a TransferOption for SendFile,
+// SendStream and SendDirectory that encrypts the records of the
+// transfer on n goroutines instead of on the goroutine that sends
+// them. Records are still sent in order, so the receiver needs no
+// support for this.
+//
+// Encryption only limits a transfer on fast links with fast storage,
+// such as multi-gigabyte transfers over a LAN from a machine with many
+// cores. Elsewhere the workers only add memory use, about 4n buffers
+// of the size set with WithBufferSize. The default of 1 encrypts on
+// the sending goroutine.
+func WithEncryptionWorkers(n int) TransferOption {
+	return encryptionWorkersTransferOption{n}
+}
+
+type strictVerificationTransferOption struct{}
+
+func (o strictVerificationTransferOption) setOption(opts *transferOptions) error {
+	opts.strictVerification = true
+	return nil
+}
+
+// ErrVerificationUnsupported is the error a transfer made with
+// WithStrictVerification fails with when the peer cannot confirm that
+// it checked the verifier.
+var ErrVerificationUnsupported = errors.New("peer does not support strict verification")
+
+// ErrPeerUnverified is the error a transfer made with
+// WithStrictVerification fails with when the peer has no VerifierOk
+// callback, so its user never checked the verifier.
+var ErrPeerUnverified = errors.New("peer did not check the verifier")
+
+// WithStrictVerification returns a TransferOption that holds back the
+// transfer until the VerifierOk callbacks on both sides have approved
+// the verifier. The sender does not send its offer, and the receiver
+// does not accept one, until the peer has confirmed its approval.
+//
+// Without it each side only waits for its own VerifierOk, so a sender
+// can send a text message before the receiver's user has compared the
+// verifiers. The Client must have a VerifierOk callback, and the peer
+// must be a client that confirms its approval, such as this one; other
+// peers make the transfer fail with ErrVerificationUnsupported.
+func WithStrictVerification() TransferOption {
+	return strictVerificationTransferOption{}
+}
+
+type messageTransferOption struct {
+	msg string
+}
+
+func (o messageTransferOption) setOption(opts *transferOptions) error {
+	opts.message = &o.msg
+	return nil
+}
+
+// ErrMessageUnsupported is the error a transfer made with WithMessage
+// fails with when the peer cannot take a message along with a file or
+// directory offer.
+var ErrMessageUnsupported = errors.New("peer does not support a message with a file offer")
+
+var errMessageWithText = errors.New("WithMessage is only for file and directory transfers")
+
+// WithMessage returns a TransferOption for SendFile, SendStream and
+// SendDirectory that sends msg along with the offer, for the receiver
+// to show next to it. This client makes it available as
+// IncomingMessage.Message and Offer.Message.
+//
+// Clients that don't support this, such as the python client, would
+// take the offer for a text message, so the transfer fails with
+// ErrMessageUnsupported before the offer is sent to them.
+func WithMessage(msg string) TransferOption {
+	return messageTransferOption{msg}
+}
+
+// Checksum is passed to the callback registered with
+// WithChecksumCallback once all the data of a file or directory has
+// been received.
+type Checksum struct {
+	// SHA256 is the sha256 of the data, computed by the receiver. For
+	// directories it covers the zip file.
+	SHA256 []byte
+	// SenderSHA256 is the sha256 the sender computed of the data it
+	// sent, or nil if the sender is a client that does not send it.
+	// The transfer fails with CodeIntegrity before the callback is
+	// called if it differs from SHA256.
+	SenderSHA256 []byte
+}
+
+type checksumTransferOption struct {
+	checksumFunc func(Checksum) error
+}
+
+func (o checksumTransferOption) setOption(opts *transferOptions) error {
+	opts.checksumFunc = o.checksumFunc
+	return nil
+}
+
+// WithChecksumCallback returns a TransferOption for Receive that calls
+// f with the checksums of a file or directory once all its data has
+// been read, before the final acknowledgment is sent to the sender.
+//
+// If f returns an error, for instance because the data failed the
+// application's own validation, the acknowledgment is withheld: the
+// sender's transfer fails with CodeIntegrity, and the Read that reached
+// the end of the data returns f's error in a TransferError.
+func WithChecksumCallback(f func(Checksum) error) TransferOption {
+	return checksumTransferOption{f}
+}
+
+type zipLimitsTransferOption struct {
+	limits ZipLimits
+}
+
+func (o zipLimitsTransferOption) setOption(opts *transferOptions) error {
+	if o.limits.MaxEntries < 0 || o.limits.MaxUncompressedBytes < 0 || o.limits.MaxCompressionRatio < 0 {
+		return fmt.Errorf("invalid zip limits %+v", o.limits)
+	}
+	opts.zipLimits = &o.limits
+	return nil
+}
+
+// WithZipLimits returns a TransferOption for Receive that sets the
+// limits IncomingMessage.Directory checks a directory's zip against,
+// in place of DefaultZipLimits.
+func WithZipLimits(limits ZipLimits) TransferOption {
+	return zipLimitsTransferOption{limits}
+}
+
+// VersionPolicy lists the abilities a peer must and must not advertise
+// in its app_versions message, for WithVersionPolicy. Abilities are the
+// protocol extension names peers exchange, such as
+// "transfer-resume-v1".
+type VersionPolicy struct {
+	Require []string
+	Forbid  []string
+}
+
+// VersionMismatchError is the error a transfer fails with when the
+// peer's app_versions do not satisfy the VersionPolicy set with
+// WithVersionPolicy.
+type VersionMismatchError struct {
+	// Missing lists the required abilities the peer lacks.
+	Missing []string
+	// Forbidden lists the forbidden abilities the peer advertised.
+	Forbidden []string
+}
+
+func (e *VersionMismatchError) Error() string {
+	var parts []string
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.Forbidden) > 0 {
+		parts = append(parts, "forbidden "+strings.Join(e.Forbidden, ", "))
+	}
+	return "peer abilities do not match policy: " + strings.Join(parts, "; ")
+}
+
+// check returns a VersionMismatchError if peer does not satisfy p.
+func (p *VersionPolicy) check(peer *appVersionsMsg) error {
+	var mismatch VersionMismatchError
+	for _, a := range p.Require {
+		if !peer.has(a) {
+			mismatch.Missing = append(mismatch.Missing, a)
+		}
+	}
+	for _, a := range p.Forbid {
+		if peer.has(a) {
+			mismatch.Forbidden = append(mismatch.Forbidden, a)
+		}
+	}
+	if len(mismatch.Missing) > 0 || len(mismatch.Forbidden) > 0 {
+		return &mismatch
+	}
+	return nil
+}
+
+type versionPolicyTransferOption struct {
+	policy VersionPolicy
+}
+
+func (o versionPolicyTransferOption) setOption(opts *transferOptions) error {
+	for _, a := range o.policy.Require {
+		for _, f := range o.policy.Forbid {
+			if a == f {
+				return fmt.Errorf("ability %q is both required and forbidden", a)
+			}
+		}
+	}
+	opts.versionPolicy = &o.policy
+	return nil
+}
+
+// WithVersionPolicy returns a TransferOption that checks the peer's
+// app_versions against p right after the version exchange, before
+// verification or any offer. If they do not match, the peer is told
+// and the transfer fails with a *VersionMismatchError, rather than
+// running into the missing support partway through.
+func WithVersionPolicy(p VersionPolicy) TransferOption {
+	return versionPolicyTransferOption{p}
+}
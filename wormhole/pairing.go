@@ -0,0 +1,75 @@
+package wormhole
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// minPairingSecret is the shortest secret WithPairingSecret accepts.
+const minPairingSecret = 16
+
+const (
+	pairingSecretPurpose    = "wormhole-william/pairing-secret"
+	pairingNameplatePurpose = "wormhole-william/pairing-nameplate"
+	pairingPasswordPurpose  = "wormhole-william/pairing-password"
+)
+
+var (
+	errPairingSecretTooShort = errors.New("pairing secret is too short")
+	errPairingWithCode       = errors.New("the code must be empty with WithPairingSecret")
+)
+
+// PairingSecret returns a long-term secret that this side and the peer
+// share, for pairing the two devices so that later transfers between
+// them can be made with WithPairingSecret rather than a new code. Both
+// sides get the same secret, which should be stored like a password.
+//
+// PairingSecret returns nil unless the session is established and not
+// yet closed.
+func (s *Session) PairingSecret() []byte {
+	return s.DeriveKey(pairingSecretPurpose)
+}
+
+type pairingTransferOption struct {
+	secret []byte
+}
+
+func (o pairingTransferOption) setOption(opts *transferOptions) error {
+	if len(o.secret) < minPairingSecret {
+		return errPairingSecretTooShort
+	}
+	opts.code = pairingCode(o.secret)
+	opts.invite = true
+	opts.pairing = true
+	return nil
+}
+
+// WithPairingSecret returns a TransferOption that makes the transfer
+// with a code derived from secret, such as one returned by
+// Session.PairingSecret, instead of a code exchanged by the users. The
+// sender and the receiver pass the same secret, and the receiver passes
+// an empty code to Receive or JoinSession.
+//
+// The derived code is used as an invite (see WithInvite), so the two
+// devices can make any number of transfers with it, one at a time, and
+// either may start first. Each transfer still runs its own key exchange
+// with fresh randomness on both sides, so transfers do not share keys.
+// Since the code is long and random, anyone who does not know the
+// secret has no real chance of guessing it. The code is as sensitive as
+// the secret itself, so it should be kept out of logs.
+func WithPairingSecret(secret []byte) TransferOption {
+	return pairingTransferOption{secret}
+}
+
+// pairingCode returns the code that transfers with the pairing secret
+// use. The nameplate is in the range invites use.
+func pairingCode(secret []byte) string {
+	n := binary.BigEndian.Uint32(deriveKey(secret, pairingNameplatePurpose))
+	n %= maxInviteNameplate - minInviteNameplate + 1
+	nameplate := strconv.Itoa(int(n) + minInviteNameplate)
+
+	password := deriveKey(secret, pairingPasswordPurpose)
+	return nameplate + "-" + hex.EncodeToString(password[:16])
+}
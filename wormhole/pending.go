@@ -0,0 +1,361 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/psanford/wormhole-william/rendezvous"
+)
+
+// A PendingSend is a send that has a code but has not finished, as
+// recorded in a Client's PendingStore.
+type PendingSend struct {
+	// ID is the transfer ID of the send.
+	ID string `json:"id"`
+	// Side is the side ID the send used on the rendezvous server,
+	// which is needed to clean up its mailbox.
+	Side string `json:"side"`
+	// Code is the code the receiver was given.
+	Code string       `json:"code"`
+	Type TransferType `json:"type"`
+	// Name is the name of the file or directory being sent.
+	Name string `json:"name,omitempty"`
+	// Text is the text message being sent.
+	Text string `json:"text,omitempty"`
+	// Message is the message sent along with a file or directory.
+	Message *string `json:"message,omitempty"`
+	// Path is where the file or directory is read from, as set with
+	// WithPendingPath.
+	Path          string        `json:"path,omitempty"`
+	DirectoryMode DirectoryMode `json:"directory_mode,omitempty"`
+	// Ignore holds the patterns of the IgnoreList the directory was
+	// sent with, as set with WithIgnore.
+	Ignore  []string  `json:"ignore,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// A PendingStore records the sends a Client has started, so that they
+// can be started again with ResumePending after the process restarts.
+// It must be safe for concurrent use.
+type PendingStore interface {
+	// SavePending records p, replacing any send with the same ID.
+	SavePending(p *PendingSend) error
+	// RemovePending forgets the send with the given ID.
+	RemovePending(id string) error
+	// LoadPending returns all the sends recorded.
+	LoadPending() ([]*PendingSend, error)
+}
+
+// DirPendingStore is a PendingStore that keeps each send in a file of
+// its own in a directory.
+type DirPendingStore struct {
+	dir string
+}
+
+const pendingFileSuffix = ".pending.json"
+
+// NewDirPendingStore returns a PendingStore that keeps its sends in
+// dir, which must exist. The files hold codes and text messages, so dir
+// should only be readable by its owner.
+func NewDirPendingStore(dir string) *DirPendingStore {
+	return &DirPendingStore{dir: dir}
+}
+
+func (s *DirPendingStore) fileName(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("invalid pending send id %q", id)
+	}
+	return filepath.Join(s.dir, id+pendingFileSuffix), nil
+}
+
+// SavePending implements PendingStore.
+func (s *DirPendingStore) SavePending(p *PendingSend) error {
+	name, err := s.fileName(p.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, data)
+}
+
+// RemovePending implements PendingStore.
+func (s *DirPendingStore) RemovePending(id string) error {
+	name, err := s.fileName(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// LoadPending implements PendingStore.
+func (s *DirPendingStore) LoadPending() ([]*PendingSend, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var sends []*PendingSend
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), pendingFileSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var p PendingSend
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("read pending send %s: %w", info.Name(), err)
+		}
+		sends = append(sends, &p)
+	}
+	return sends, nil
+}
+
+type pendingPathTransferOption struct {
+	path string
+}
+
+func (o pendingPathTransferOption) setOption(opts *transferOptions) error {
+	opts.pendingPath = o.path
+	return nil
+}
+
+// WithPendingPath returns a TransferOption for SendFile and
+// SendDirectory that names the file or directory on disk the send reads
+// from, so that a Client with a PendingStore can read it again when it
+// resumes the send after a restart. Sends of files and directories
+// without it are not recorded in the PendingStore, nor are streams.
+func WithPendingPath(path string) TransferOption {
+	return pendingPathTransferOption{path}
+}
+
+type resumedTransferOption struct{}
+
+func (o resumedTransferOption) setOption(opts *transferOptions) error {
+	opts.resumed = true
+	return nil
+}
+
+// recordPending saves the send the Client is starting with code in its
+// PendingStore, if it has one and the send can be resumed. The record
+// is removed when the send ends; see transferOptions.emit.
+func (c *Client) recordPending(options *transferOptions, sideID, code string, offer *offerMsg) {
+	if c.PendingStore == nil {
+		return
+	}
+
+	summary := offer.summary()
+	p := &PendingSend{
+		ID:            options.transferID,
+		Side:          sideID,
+		Code:          code,
+		Type:          summary.Type,
+		Name:          summary.Name,
+		Path:          options.pendingPath,
+		DirectoryMode: options.directoryMode,
+		Created:       time.Now(),
+	}
+	if options.ignore != nil {
+		p.Ignore = options.ignore.Patterns()
+	}
+	switch {
+	case summary.Type == TransferText:
+		p.Text = *offer.Message
+	case summary.UnknownLength || p.Path == "":
+		return
+	default:
+		p.Message = offer.Message
+	}
+
+	if err := c.PendingStore.SavePending(p); err != nil {
+		options.logger.Warn("pending send not recorded", "err", err)
+		return
+	}
+	options.pendingStore = c.PendingStore
+}
+
+// removePending forgets the send in the PendingStore once it has ended.
+func (o *transferOptions) removePending() {
+	if o.pendingStore == nil {
+		return
+	}
+	if err := o.pendingStore.RemovePending(o.transferID); err != nil {
+		o.logger.Warn("pending send not removed", "err", err)
+	}
+	o.pendingStore = nil
+}
+
+// A ResumedSend is the outcome of resuming a PendingSend.
+type ResumedSend struct {
+	Pending *PendingSend
+	// Result is the result channel of the new send, as returned by
+	// SendText, SendFile or SendDirectory. It is nil if Err is set.
+	Result chan SendResult
+	// Err is why the send could not be resumed.
+	Err error
+}
+
+// ResumePending starts again the sends recorded in c.PendingStore by a
+// previous run of the process, which was stopped before they finished,
+// as mobile apps often are in the background. Each send claims the
+// nameplate of its code again and waits for the receiver, who uses the
+// same code as before. The options apply to all the resumed sends.
+//
+// The mailbox of the interrupted send is closed first, so a receiver
+// that joined it while the sender was gone has to start over. A send
+// whose file or directory no longer exists is dropped from the store;
+// a send that fails to resume for other reasons, such as the rendezvous
+// server being unreachable, is kept there to be tried again later.
+//
+// A send is recorded once it has a code, if it is a text message or if
+// it was made with WithPendingPath, and removed when it completes or
+// fails, including when its context is canceled.
+func (c *Client) ResumePending(ctx context.Context, opts ...TransferOption) ([]ResumedSend, error) {
+	if c.PendingStore == nil {
+		return nil, errors.New("no PendingStore set")
+	}
+	sends, err := c.PendingStore.LoadPending()
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := make([]ResumedSend, 0, len(sends))
+	for _, p := range sends {
+		result, err := c.resumePending(ctx, p, opts)
+		if err == nil || os.IsNotExist(err) {
+			if rerr := c.PendingStore.RemovePending(p.ID); rerr != nil {
+				c.logger().Warn("pending send not removed", "err", rerr)
+			}
+		}
+		resumed = append(resumed, ResumedSend{Pending: p, Result: result, Err: err})
+	}
+	return resumed, nil
+}
+
+func (c *Client) resumePending(ctx context.Context, p *PendingSend, opts []TransferOption) (chan SendResult, error) {
+	if err := c.abandonMailbox(ctx, p); err != nil {
+		return nil, err
+	}
+
+	var sendOpts []TransferOption
+	if p.Type == TransferDirectory && p.DirectoryMode != "" {
+		sendOpts = append(sendOpts, WithDirectoryMode(p.DirectoryMode))
+	}
+	if p.Message != nil {
+		sendOpts = append(sendOpts, WithMessage(*p.Message))
+	}
+	if len(p.Ignore) > 0 {
+		ignore, err := NewIgnoreList(p.Ignore...)
+		if err != nil {
+			return nil, err
+		}
+		sendOpts = append(sendOpts, WithIgnore(ignore))
+	}
+	sendOpts = append(sendOpts, opts...)
+	sendOpts = append(sendOpts, WithCode(p.Code), resumedTransferOption{})
+	if p.Type != TransferText {
+		sendOpts = append(sendOpts, WithPendingPath(p.Path))
+	}
+
+	switch p.Type {
+	case TransferText:
+		_, result, err := c.SendText(ctx, p.Text, sendOpts...)
+		return result, err
+	case TransferFile:
+		f, err := os.Open(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		_, result, err := c.SendFile(ctx, p.Name, f, false, sendOpts...)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		retCh := make(chan SendResult, 1)
+		go func() {
+			r := <-result
+			f.Close()
+			retCh <- r
+		}()
+		return retCh, nil
+	case TransferDirectory:
+		entries, err := directoryEntries(p.Path, p.Name)
+		if err != nil {
+			return nil, err
+		}
+		_, result, err := c.SendDirectory(ctx, p.Name, entries, false, sendOpts...)
+		return result, err
+	default:
+		return nil, fmt.Errorf("unknown pending send type %d", p.Type)
+	}
+}
+
+// abandonMailbox closes the mailbox of the interrupted send p and
+// releases its nameplate, so that the resumed send gets a new mailbox
+// rather than one holding the messages of the old key exchange.
+func (c *Client) abandonMailbox(ctx context.Context, p *PendingSend) (err error) {
+	nameplate, err := nameplateFromCode(p.Code)
+	if err != nil {
+		return err
+	}
+
+	options := transferOptions{side: sideSend, logger: c.logger(), timeouts: c.Timeouts.resolve()}
+	rc := c.newRendezvousClient(p.Side, c.AppID, &options)
+	if _, err := rc.Connect(ctx); err != nil {
+		return transferError(PhaseRendezvous, err)
+	}
+	if err := rc.AttachMailbox(ctx, nameplate); err != nil {
+		// the nameplate is gone or taken by others, so there is
+		// nothing left to clean up
+		options.logger.Debug("pending send mailbox not attached", "err", err)
+		return nil
+	}
+	if err := rc.ReleaseNameplate(ctx); err != nil {
+		options.logger.Debug("pending send nameplate not released", "err", err)
+	}
+	return rc.Close(ctx, rendezvous.Lonely)
+}
+
+// directoryEntries returns the entries for sending the regular files
+// under dir as the directory name.
+func directoryEntries(dir, name string) ([]DirectoryEntry, error) {
+	var entries []DirectoryEntry
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, DirectoryEntry{
+			Path: path.Join(name, filepath.ToSlash(rel)),
+			Mode: info.Mode(),
+			Reader: func() (io.ReadCloser, error) {
+				return os.Open(p)
+			},
+		})
+		return nil
+	})
+	return entries, err
+}
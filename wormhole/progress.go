@@ -0,0 +1,221 @@
+package wormhole
+
+import (
+	"sync"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/clock"
+)
+
+// TransferStats is a snapshot of the progress of a file or directory
+// transfer, passed to callbacks registered with WithProgressStats.
+type TransferStats struct {
+	// Bytes is the number of bytes transferred so far. For a resumed
+	// transfer this includes the part the receiver already had.
+	Bytes int64
+	// Total is the expected number of bytes in the transfer.
+	Total int64
+	// Elapsed is the time since the transit connection was established.
+	Elapsed time.Duration
+	// BytesPerSecond is the average throughput since the transit
+	// connection was established.
+	BytesPerSecond float64
+	// Relayed is true if the data is going through a transit relay
+	// rather than a direct connection to the peer.
+	Relayed bool
+}
+
+// ETA estimates the time remaining until the transfer completes, based
+// on the average throughput so far. It returns 0 if no estimate is
+// available yet.
+func (s TransferStats) ETA() time.Duration {
+	if s.BytesPerSecond <= 0 || s.Bytes >= s.Total {
+		return 0
+	}
+	remaining := float64(s.Total - s.Bytes)
+	return time.Duration(remaining / s.BytesPerSecond * float64(time.Second))
+}
+
+// progressTracker reports progress to the callbacks in a transfer's
+// options once the transit connection is up.
+type progressTracker struct {
+	progressFunc progressFunc
+	statsFunc    func(TransferStats)
+	emit         func(Event)
+	start        time.Time
+	startBytes   int64
+	lastBytes    int64
+	relayed      bool
+
+	// nextMilestone is the byte count at which the next EventProgress
+	// is due, or 0 before the first update.
+	nextMilestone int64
+}
+
+func newProgressTracker(opts transferOptions, startBytes int64, relayed bool) *progressTracker {
+	p := &progressTracker{
+		progressFunc: opts.progressFunc,
+		statsFunc:    opts.statsFunc,
+		start:        time.Now(),
+		startBytes:   startBytes,
+		lastBytes:    startBytes,
+		relayed:      relayed,
+	}
+	if opts.observed() {
+		p.emit = opts.emit
+	}
+	return p
+}
+
+func (p *progressTracker) update(done, total int64) {
+	totalBytes.Add(done - p.lastBytes)
+	p.lastBytes = done
+
+	if p.progressFunc != nil {
+		p.progressFunc(done, total)
+	}
+
+	if p.emit != nil {
+		p.milestone(done, total)
+	}
+
+	if p.statsFunc == nil {
+		return
+	}
+
+	elapsed := time.Since(p.start)
+	stats := TransferStats{
+		Bytes:   done,
+		Total:   total,
+		Elapsed: elapsed,
+		Relayed: p.relayed,
+	}
+	if elapsed > 0 {
+		stats.BytesPerSecond = float64(done-p.startBytes) / elapsed.Seconds()
+	}
+	p.statsFunc(stats)
+}
+
+// milestone sends an EventProgress each time done passes another
+// tenth of total.
+func (p *progressTracker) milestone(done, total int64) {
+	step := total / 10
+	if step <= 0 {
+		step = unknownLengthMilestone
+	}
+
+	if p.nextMilestone == 0 {
+		p.nextMilestone = (p.startBytes/step + 1) * step
+	}
+
+	if done >= p.nextMilestone {
+		p.emit(Event{Type: EventProgress, Bytes: done, Total: total})
+		p.nextMilestone = (done/step + 1) * step
+	}
+}
+
+// stallWatcher detects a transfer that has not moved any bytes for
+// the timeout set with WithStallTimeout. A nil *stallWatcher does
+// nothing.
+type stallWatcher struct {
+	timeout time.Duration
+	clock   clock.Clock
+	f       func(idle time.Duration) bool
+	emit    func(Event)
+	abort   func()
+	done    chan struct{}
+
+	mu      sync.Mutex
+	last    time.Time
+	stalled bool
+	aborted bool
+}
+
+// startStallWatcher starts watching for stalls if the transfer asked
+// for it. abort is called, from another goroutine, if the stall
+// callback asks for the transfer to be aborted.
+func startStallWatcher(opts transferOptions, abort func()) *stallWatcher {
+	if opts.stallTimeout <= 0 {
+		return nil
+	}
+	w := &stallWatcher{
+		timeout: opts.stallTimeout,
+		clock:   clock.OrReal(opts.clock),
+		f:       opts.stallFunc,
+		emit:    opts.emit,
+		abort:   abort,
+		done:    make(chan struct{}),
+	}
+	w.last = w.clock.Now()
+	go w.run()
+	return w
+}
+
+func (w *stallWatcher) run() {
+	t := w.clock.NewTimer(w.timeout)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C():
+		}
+
+		w.mu.Lock()
+		idle := clock.Since(w.clock, w.last)
+		fire := idle >= w.timeout && !w.stalled
+		if fire {
+			w.stalled = true
+		}
+		next := w.timeout - idle
+		if next <= 0 {
+			next = w.timeout
+		}
+		w.mu.Unlock()
+
+		if fire {
+			w.emit(Event{Type: EventStalled, Idle: idle})
+			if w.f != nil && w.f(idle) {
+				w.mu.Lock()
+				w.aborted = true
+				w.mu.Unlock()
+				w.abort()
+				return
+			}
+		}
+		t.Reset(next)
+	}
+}
+
+// touch records that bytes have moved.
+func (w *stallWatcher) touch() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.last = w.clock.Now()
+	w.stalled = false
+	w.mu.Unlock()
+}
+
+// stop stops watching. It must be called exactly once.
+func (w *stallWatcher) stop() {
+	if w != nil {
+		close(w.done)
+	}
+}
+
+// reason returns ErrTransferStalled in place of err if the transfer
+// failed because the stall callback aborted it.
+func (w *stallWatcher) reason(err error) error {
+	if w == nil || err == nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.aborted {
+		return ErrTransferStalled
+	}
+	return err
+}
@@ -0,0 +1,436 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/clock"
+)
+
+const (
+	defaultQueueAttempts   = 3
+	defaultQueueRetryDelay = time.Second
+	maxQueueRetryDelay     = time.Minute
+)
+
+// ErrQueueClosed is returned by Queue.Add after the queue is closed,
+// and is the error of the jobs that were still queued or running when
+// it was closed.
+var ErrQueueClosed = errors.New("queue closed")
+
+// A JobFunc runs one attempt of a queued transfer with c, the Client
+// of the queue, and returns once the transfer is over with its error,
+// such as SendResult.Error for a send. It must stop when ctx is done.
+//
+// A job is retried by calling its JobFunc again. The Client refuses a
+// code whose key exchange has already started (see
+// Client.CodeReuseHook), so a job that sends or receives with a fixed
+// code is only retried if it failed before the key exchange, such as
+// when no sender had claimed the nameplate yet, unless the code is an
+// invite or comes from a pairing secret.
+type JobFunc func(ctx context.Context, c *Client) error
+
+// QueueConfig configures a Queue. The zero value runs one job at a
+// time and makes up to 3 attempts at each.
+type QueueConfig struct {
+	// Concurrency is the number of jobs run at the same time. Values
+	// less than 1 mean 1.
+	Concurrency int
+	// MaxAttempts is the number of times a job is tried before it
+	// fails. Values less than 1 mean 3.
+	MaxAttempts int
+	// RetryDelay is how long to wait before the first retry of a job.
+	// The delay doubles for each retry after that, up to a minute. If
+	// zero, it is one second.
+	RetryDelay time.Duration
+	// Retry reports whether a job that failed with err should be tried
+	// again. If nil, IsTransient is used. Jobs whose context is done
+	// are never retried.
+	Retry func(err error) bool
+}
+
+// JobState is the state of a queued job.
+type JobState int
+
+const (
+	// JobQueued means the job is waiting for its turn.
+	JobQueued JobState = iota
+	// JobRunning means an attempt of the job is running.
+	JobRunning
+	// JobRetrying means an attempt failed and the job is waiting for
+	// its retry delay to pass.
+	JobRetrying
+	// JobSucceeded means an attempt of the job succeeded.
+	JobSucceeded
+	// JobFailed means the job failed, was canceled or was still
+	// pending when the queue was closed.
+	JobFailed
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobQueued:
+		return "Queued"
+	case JobRunning:
+		return "Running"
+	case JobRetrying:
+		return "Retrying"
+	case JobSucceeded:
+		return "Succeeded"
+	case JobFailed:
+		return "Failed"
+	default:
+		return "JobStateUnknown<" + strconv.Itoa(int(s)) + ">"
+	}
+}
+
+// JobStatus is a snapshot of the state of a job.
+type JobStatus struct {
+	ID    int
+	Name  string
+	State JobState
+	// Attempts is the number of attempts started so far.
+	Attempts int
+	// Err is the error of the last failed attempt.
+	Err error
+	// Added is when the job was added to the queue.
+	Added time.Time
+}
+
+// QueueStatus is a snapshot of the state of a Queue.
+type QueueStatus struct {
+	// Jobs lists the jobs that have not finished, in the order they
+	// were added.
+	Jobs []JobStatus
+	// Queued, Running and Retrying count the jobs in Jobs by state.
+	Queued   int
+	Running  int
+	Retrying int
+	// Succeeded and Failed count the jobs that have finished.
+	Succeeded int
+	Failed    int
+}
+
+// A Queue runs transfers queued with Add on a Client, at most
+// QueueConfig.Concurrency at a time and in the order they were added,
+// and retries the ones that fail with transient errors. Create one
+// with Client.NewQueue. A Queue is safe for concurrent use.
+type Queue struct {
+	client *Client
+	cfg    QueueConfig
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	nextID  int
+	closed  bool
+	running int
+	// waiting holds the jobs ready for an attempt, in order.
+	waiting []*Job
+	// jobs holds all the jobs that have not finished, in order.
+	jobs      []*Job
+	succeeded int
+	failed    int
+	// idle is closed and replaced when the queue runs out of jobs.
+	idle chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewQueue returns a Queue that runs jobs on c.
+func (c *Client) NewQueue(cfg QueueConfig) *Queue {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = defaultQueueAttempts
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = defaultQueueRetryDelay
+	}
+	if cfg.Retry == nil {
+		cfg.Retry = IsTransient
+	}
+	return &Queue{
+		client: c,
+		cfg:    cfg,
+		clock:  clock.OrReal(c.clock),
+		idle:   make(chan struct{}),
+	}
+}
+
+// A Job is a transfer added to a Queue.
+type Job struct {
+	q      *Queue
+	ctx    context.Context
+	cancel context.CancelFunc
+	fn     JobFunc
+	done   chan struct{}
+
+	// guarded by q.mu
+	status JobStatus
+}
+
+// Add queues the transfer run by fn under name, which is only used in
+// status reports. The job is canceled when ctx is done, when Cancel is
+// called or when the queue is closed.
+func (q *Queue) Add(ctx context.Context, name string, fn JobFunc) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	q.nextID++
+	j := &Job{
+		q:    q,
+		fn:   fn,
+		done: make(chan struct{}),
+		status: JobStatus{
+			ID:    q.nextID,
+			Name:  name,
+			State: JobQueued,
+			Added: q.clock.Now(),
+		},
+	}
+	j.ctx, j.cancel = context.WithCancel(ctx)
+
+	q.jobs = append(q.jobs, j)
+	q.waiting = append(q.waiting, j)
+	q.wg.Add(1)
+	go j.watch()
+	q.schedule()
+	return j, nil
+}
+
+// Status returns the state of the queue and of its unfinished jobs.
+func (q *Queue) Status() QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := QueueStatus{
+		Jobs:      make([]JobStatus, 0, len(q.jobs)),
+		Succeeded: q.succeeded,
+		Failed:    q.failed,
+	}
+	for _, j := range q.jobs {
+		s.Jobs = append(s.Jobs, j.status)
+		switch j.status.State {
+		case JobQueued:
+			s.Queued++
+		case JobRunning:
+			s.Running++
+		case JobRetrying:
+			s.Retrying++
+		}
+	}
+	return s
+}
+
+// Wait blocks until every job added to the queue has finished, or ctx
+// is done.
+func (q *Queue) Wait(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		empty := len(q.jobs) == 0
+		idle := q.idle
+		q.mu.Unlock()
+		if empty {
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops the queue from accepting jobs, cancels the jobs that
+// have not finished, which fail with ErrQueueClosed, and waits for
+// their attempts to return.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	for _, j := range q.jobs {
+		j.cancel()
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+	return nil
+}
+
+// schedule starts attempts of waiting jobs while there is room.
+// q.mu must be held.
+func (q *Queue) schedule() {
+	for q.running < q.cfg.Concurrency && len(q.waiting) > 0 {
+		j := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.running++
+		j.status.State = JobRunning
+		j.status.Attempts++
+		go j.attempt()
+	}
+}
+
+// watch finishes the job if it is canceled while it is not running.
+func (j *Job) watch() {
+	select {
+	case <-j.done:
+		return
+	case <-j.ctx.Done():
+	}
+
+	q := j.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j.status.State == JobQueued || j.status.State == JobRetrying {
+		for i, w := range q.waiting {
+			if w == j {
+				q.waiting = append(q.waiting[:i:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+		q.finish(j, j.cancelErr())
+	}
+}
+
+// cancelErr is the error of a job whose context is done.
+func (j *Job) cancelErr() error {
+	if j.q.closed {
+		return ErrQueueClosed
+	}
+	return transferError(PhaseRendezvous, j.ctx.Err())
+}
+
+func (j *Job) attempt() {
+	err := j.fn(j.ctx, j.q.client)
+
+	q := j.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	defer q.schedule()
+
+	if err == nil {
+		q.finish(j, nil)
+		return
+	}
+	j.status.Err = err
+	if j.ctx.Err() != nil {
+		if q.closed {
+			err = ErrQueueClosed
+		}
+		q.finish(j, err)
+		return
+	}
+	if j.status.Attempts >= q.cfg.MaxAttempts || !q.cfg.Retry(err) {
+		q.finish(j, err)
+		return
+	}
+
+	j.status.State = JobRetrying
+	go j.retryAfter(q.retryDelay(j.status.Attempts))
+}
+
+// retryDelay is the delay before the retry after attempt.
+func (q *Queue) retryDelay(attempt int) time.Duration {
+	d := q.cfg.RetryDelay
+	for i := 1; i < attempt && d < maxQueueRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxQueueRetryDelay {
+		d = maxQueueRetryDelay
+	}
+	return d
+}
+
+func (j *Job) retryAfter(d time.Duration) {
+	t := j.q.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+	case <-j.ctx.Done():
+		// watch finishes the job
+		return
+	}
+
+	q := j.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j.status.State != JobRetrying {
+		return
+	}
+	j.status.State = JobQueued
+	q.waiting = append(q.waiting, j)
+	q.schedule()
+}
+
+// finish records the outcome of j. q.mu must be held.
+func (q *Queue) finish(j *Job, err error) {
+	if err == nil {
+		j.status.State = JobSucceeded
+		j.status.Err = nil
+		q.succeeded++
+	} else {
+		j.status.State = JobFailed
+		j.status.Err = err
+		q.failed++
+	}
+	for i, o := range q.jobs {
+		if o == j {
+			q.jobs = append(q.jobs[:i:i], q.jobs[i+1:]...)
+			break
+		}
+	}
+	if len(q.jobs) == 0 {
+		close(q.idle)
+		q.idle = make(chan struct{})
+	}
+	j.cancel()
+	close(j.done)
+	q.wg.Done()
+}
+
+// ID returns the ID of the job, which is unique within its queue.
+func (j *Job) ID() int {
+	j.q.mu.Lock()
+	defer j.q.mu.Unlock()
+	return j.status.ID
+}
+
+// Status returns the state of the job.
+func (j *Job) Status() JobStatus {
+	j.q.mu.Lock()
+	defer j.q.mu.Unlock()
+	return j.status
+}
+
+// Done returns a channel that is closed when the job has finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Err returns the error the job failed with, or nil if it succeeded or
+// has not finished.
+func (j *Job) Err() error {
+	j.q.mu.Lock()
+	defer j.q.mu.Unlock()
+	if j.status.State != JobFailed {
+		return nil
+	}
+	return j.status.Err
+}
+
+// Cancel cancels the job. A running attempt is canceled through its
+// context; a job waiting for its turn or a retry fails right away.
+func (j *Job) Cancel() {
+	j.cancel()
+}
@@ -1,6 +1,7 @@
 package wormhole
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -11,8 +12,8 @@ import (
 	"io"
 	"strings"
 
-	"github.com/psanford/wormhole-william/internal/crypto"
 	"github.com/psanford/wormhole-william/rendezvous"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Receive receives a message sent by a wormhole client.
@@ -20,99 +21,111 @@ import (
 // It returns an IncomingMessage with metadata about the payload being sent.
 // To read the contents of the message call IncomingMessage.Read().
 func (c *Client) Receive(ctx context.Context, code string, disableListener bool, opts ...TransferOption) (fr *IncomingMessage, returnErr error) {
-	sideID := crypto.RandSideID()
+	var options transferOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.pairing {
+		if code != "" {
+			return nil, errPairingWithCode
+		}
+		code = options.code
+	}
+	if options.strictVerification && c.VerifierOk == nil {
+		return nil, errStrictVerifierOk
+	}
+	if c.Dial != nil {
+		// there is nothing to listen on
+		disableListener = true
+	}
+	if !options.invite {
+		if err := c.checkCodeReuse(sideReceive, code); err != nil {
+			return nil, err
+		}
+	}
+	sideID, err := c.beginTransfer(&options, sideReceive)
+	if err != nil {
+		return nil, err
+	}
+
 	appID := c.AppID
-	rc := rendezvous.NewClient(c.RendezvousURL, sideID, appID)
+	rc := c.newRendezvousClient(sideID, appID, &options)
 
+	phase := PhaseRendezvous
 	defer func() {
+		returnErr = transferError(phase, returnErr)
+		if returnErr != nil {
+			options.end(returnErr)
+		}
+
 		mood := rendezvous.Errory
 		if returnErr == nil {
 			// don't close our connection in this case
 			// wait until the user actually accepts the transfer
 			return
-		} else if returnErr == errDecryptFailed {
+		} else if isScary(returnErr) {
 			mood = rendezvous.Scary
+		} else if errors.Is(returnErr, ErrOfferDeclined) {
+			mood = rendezvous.Happy
 		}
 		rc.Close(ctx, mood)
 	}()
 
-	_, err := rc.Connect(ctx)
-	if err != nil {
-		return nil, err
-	}
 	nameplate, err := nameplateFromCode(code)
 	if err != nil {
-		return nil, err
-	}
-
-	nameplates, err := rc.ListNameplates(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	nameplateFound := false
-	for _, claimedNameplate := range nameplates {
-		if nameplate == claimedNameplate {
-			nameplateFound = true
-			break
-		}
+		return nil, newTransferError(CodeWrongCode, phase, err)
 	}
+	options.audit.setNameplate(nameplate)
 
-	if !nameplateFound {
-		return nil, fmt.Errorf("Nameplate is unclaimed: %s", nameplate)
-	}
-
-	err = rc.AttachMailbox(ctx, nameplate)
+	err = c.attachReceiveMailbox(ctx, rc, nameplate, &options)
 	if err != nil {
 		return nil, err
 	}
 
 	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.rand = c.random()
+	clientProto.onTampering = options.tampering
+	clientProto.peerTimeout = options.timeouts.Peer
+	clientProto.clock = options.clock
+	defer func() {
+		if returnErr != nil {
+			clientProto.wipeKeys()
+		}
+	}()
 
-	err = clientProto.WritePake(ctx, code)
+	phase = PhasePake
+	err = c.exchangePake(ctx, clientProto, code, &options)
 	if err != nil {
 		return nil, err
 	}
+	options.emit(Event{Type: EventPakeComplete})
 
-	err = clientProto.ReadPake(ctx)
+	peerVersions, err := c.exchangeVersions(ctx, clientProto, &options)
 	if err != nil {
 		return nil, err
 	}
 
-	err = clientProto.WriteVersion(ctx)
+	err = c.verify(ctx, clientProto, peerVersions, &options)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = clientProto.ReadVersion()
+	collector, err := clientProto.Collect(collectOffer, collectTransit, collectVerified)
 	if err != nil {
 		return nil, err
 	}
+	defer collector.close()
 
-	if c.VerifierOk != nil {
-		verifier, err := clientProto.Verifier()
+	if options.strictVerification {
+		err = waitVerified(ctx, clientProto, collector)
 		if err != nil {
 			return nil, err
 		}
-
-		if ok := c.VerifierOk(hex.EncodeToString(verifier)); !ok {
-			errMsg := "sender rejected verification check, abandoned transfer"
-			writeErr := clientProto.WriteAppData(ctx, &genericMessage{
-				Error: &errMsg,
-			})
-			if writeErr != nil {
-				return nil, writeErr
-			}
-
-			return nil, errors.New(errMsg)
-		}
 	}
-
-	collector, err := clientProto.Collect(collectOffer, collectTransit)
-	if err != nil {
-		return nil, err
-	}
-	defer collector.close()
+	phase = PhaseTransit
 
 	var offer offerMsg
 	err = collector.waitFor(&offer)
@@ -120,15 +133,17 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		return nil, err
 	}
 
-	fr = &IncomingMessage{}
-	for _, opt := range opts {
-		err := opt.setOption(&fr.options)
-		if err != nil {
-			return nil, err
-		}
+	fr = &IncomingMessage{
+		TransferID:    options.transferID,
+		options:       options,
+		code:          code,
+		peerMood:      rc.PeerMood,
+		peerCanResume: peerVersions.has(abilityResumeV1),
+		peerCanSync:   peerVersions.has(abilityDeltaV1),
+		peerChecksum:  peerVersions.has(abilityChecksumV1),
 	}
 
-	if offer.Message != nil {
+	if offer.Message != nil && offer.File == nil && offer.Directory == nil {
 		answer := genericMessage{
 			Answer: &answerMsg{
 				MessageAck: "ok",
@@ -141,6 +156,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		}
 
 		rc.Close(ctx, rendezvous.Happy)
+		clientProto.wipeKeys()
 
 		text := *offer.Message
 		fr.TransferBytes = len(text)
@@ -150,6 +166,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 
 		fr.Type = TransferText
 		fr.textReader = strings.NewReader(text)
+		options.emit(Event{Type: EventCompleted, Bytes: fr.TransferBytes64, Total: fr.TransferBytes64})
 		return fr, nil
 	} else if offer.File != nil {
 		fr.Type = TransferFile
@@ -159,6 +176,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		fr.UncompressedBytes = int(offer.File.FileSize)
 		fr.UncompressedBytes64 = offer.File.FileSize
 		fr.FileCount = 1
+		fr.streaming = offer.File.Stream
 		fr.ctx = ctx
 	} else if offer.Directory != nil {
 		fr.Type = TransferDirectory
@@ -168,9 +186,42 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		fr.UncompressedBytes = int(offer.Directory.NumBytes)
 		fr.UncompressedBytes64 = offer.Directory.NumBytes
 		fr.FileCount = int(offer.Directory.NumFiles)
+		fr.DirectoryMode = DirectoryMode(offer.Directory.Mode)
+		if fr.DirectoryMode == "" {
+			fr.DirectoryMode = DirectoryModeDeflated
+		}
 		fr.ctx = ctx
 	} else {
-		return nil, errors.New("got non-file transfer offer")
+		return nil, newTransferError(CodeProtocol, phase, errors.New("got non-file transfer offer"))
+	}
+	if offer.Message != nil {
+		fr.Message = *offer.Message
+	}
+
+	options.setOffer(fr.offer())
+	// fr has its own copy of the options
+	fr.options.offer = options.offer
+
+	declined := ErrOfferDeclined
+	accept := true
+	if max := fr.options.maxOfferSize; max > 0 && (fr.TransferBytes64 > max || fr.UncompressedBytes64 > max) {
+		declined = ErrOfferTooLarge
+		accept = false
+	} else if fr.Type == TransferDirectory && fr.DirectoryMode != DirectoryModeDeflated && fr.DirectoryMode != DirectoryModeStored {
+		declined = fmt.Errorf("%w %q", ErrUnsupportedDirectoryMode, fr.DirectoryMode)
+		accept = false
+	} else if fr.options.offerFunc != nil {
+		accept = fr.options.offerFunc(fr.offer())
+	}
+	if !accept {
+		errStr := rejectedMsg
+		err = clientProto.WriteAppData(ctx, &genericMessage{
+			Error: &errStr,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, declined
 	}
 
 	var gotTransitMsg transitMsg
@@ -179,16 +230,36 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		return nil, err
 	}
 
+	fr.PeerTransitAbilities, fr.PeerTransitHints = gotTransitMsg.summary()
+
 	transitKey := deriveTransitKey(clientProto.sharedKey, appID)
+	defer func() {
+		if returnErr != nil {
+			wipe(transitKey)
+		}
+	}()
 	relayUrl, err := c.relayURL()
 	if err != nil {
-		return nil, fmt.Errorf("Invalid relay URL")
+		return nil, transitFailed(fmt.Errorf("Invalid relay URL"))
+	}
+	relayEndpoints, err := c.relayEndpoints()
+	if err != nil {
+		return nil, transitFailed(fmt.Errorf("Invalid relay endpoint"))
 	}
-	transport := newFileTransport(transitKey, appID, relayUrl, disableListener)
+	transport := newFileTransport(transitKey, appID, relayUrl, disableListener, options.logger)
+	transport.policy = fr.options.transitPolicy
+	transport.relayHandshake = fr.options.relayHandshake
+	transport.rand = c.random()
+	transport.trace = c.protocolTrace()
+	transport.tlsPins = c.TLSPins
+	transport.timeouts = options.timeouts
+	transport.clock = options.clock
+	transport.dial = c.Dial
+	transport.relayEndpoints = relayEndpoints
 
 	transitMsg, err := transport.makeTransitMsg()
 	if err != nil {
-		return nil, fmt.Errorf("make transit msg error: %s", err)
+		return nil, transitFailed(fmt.Errorf("make transit msg error: %s", err))
 	}
 
 	err = clientProto.WriteAppData(ctx, &genericMessage{
@@ -203,13 +274,13 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if isScary(returnErr) {
 				mood = rendezvous.Scary
 			}
 			rc.Close(ctx, mood)
 		}()
 
-		var errStr = "transfer rejected"
+		var errStr = rejectedMsg
 		answer := &genericMessage{
 			Error: &errStr,
 		}
@@ -229,7 +300,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if isScary(returnErr) {
 				mood = rendezvous.Scary
 			}
 			rc.Close(ctx, mood)
@@ -237,7 +308,9 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 
 		answer := &genericMessage{
 			Answer: &answerMsg{
-				FileAck: "ok",
+				FileAck:      "ok",
+				ResumeOffset: fr.resumeOffset,
+				Delta:        fr.deltaAnswer(),
 			},
 		}
 		ctx := context.Background()
@@ -247,38 +320,103 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			return err
 		}
 
-		conn, err := transport.connectDirect(&gotTransitMsg)
+		options.emit(Event{Type: EventTransitConnecting})
+		_, transitSpan := c.startSpan(fr.ctx, &options, spanTransitConnect)
+		conn, relayed, err := transport.connect(transitMsg, &gotTransitMsg)
 		if err != nil {
-			return err
+			endSpan(transitSpan, err)
+			return transitFailed(err)
 		}
+		transitSpan.SetAttributes(attrRelayed.Bool(relayed), attrRemoteAddr.String(conn.RemoteAddr().String()))
+		endSpan(transitSpan, nil)
+		options.logger.Info("transit connection established",
+			"local", conn.LocalAddr().String(),
+			"remote", conn.RemoteAddr().String(),
+			"relayed", relayed)
+		options.emit(Event{Type: EventTransitConnected, Relayed: relayed})
+		options.connStateChanged(ConnStateChange{Layer: ConnTransit, State: ConnConnected, Relayed: relayed})
+		fr.relayed = relayed
 
-		if conn == nil {
+		cryptor := newTransportCryptor(conn, transitKey, "transit_record_sender_key", "transit_record_receiver_key")
 
-			// filter relay hints and remove duplicates
-			filteredHints := filterHints(append(transitMsg.HintsV1, gotTransitMsg.HintsV1...), "relay-v1")
-			conn, err = transport.connectViaRelay(filteredHints)
+		bufferSize := fr.options.bufferSizeOrDefault()
+		if limit := fr.options.memoryLimit; limit > 0 && bufferSize > limit {
+			bufferSize = limit
+		}
+		cryptor.setReadBufferSize(bufferSize)
+		cryptor.maxRecordSize = fr.options.memoryLimit
+		cryptor.readTimeout = fr.options.timeouts.Record
+
+		fr.cryptor = cryptor
+		if fr.delta != nil {
+			err = fr.delta.writeSignature(cryptor)
 			if err != nil {
 				return err
 			}
 		}
-
-		if conn == nil {
-			return errors.New("failed to establish connection")
+		fr.progress = newProgressTracker(fr.options, fr.readCount, relayed)
+		fr.stall = startStallWatcher(fr.options, func() { cryptor.Close() })
+		_, fr.dataSpan = c.startSpan(fr.ctx, &options, spanDataTransfer,
+			attrRelayed.Bool(relayed), attrTotalBytes.Int64(fr.TransferBytes64))
+		if fr.sha256 == nil {
+			fr.sha256 = sha256.New()
 		}
-
-		cryptor := newTransportCryptor(conn, transitKey, "transit_record_sender_key", "transit_record_receiver_key")
-
-		fr.cryptor = cryptor
-		fr.sha256 = sha256.New()
 		return nil
 	}
 
 	fr.initializeTransfer = acceptAndInitialize
 	fr.rejectTransfer = reject
+	fr.wipeSession = func() {
+		clientProto.wipeKeys()
+		wipe(transitKey)
+		if fr.cryptor != nil {
+			fr.cryptor.wipeKeys()
+		}
+	}
 
 	return fr, nil
 }
 
+// attachReceiveMailbox connects rc to the rendezvous server and
+// attaches to the mailbox for nameplate, which the sender must have
+// claimed already unless the code is an invite.
+func (c *Client) attachReceiveMailbox(ctx context.Context, rc *rendezvous.Client, nameplate string, options *transferOptions) (err error) {
+	_, span := c.startSpan(ctx, options, spanRendezvousConnect,
+		attrRendezvousURL.String(c.RendezvousURL), attrNameplate.String(nameplate))
+	defer func() {
+		err = transferError(PhaseRendezvous, err)
+		endSpan(span, err)
+	}()
+
+	_, err = rc.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	if options.invite {
+		return rc.AttachMailbox(ctx, nameplate)
+	}
+
+	nameplates, err := rc.ListNameplates(ctx)
+	if err != nil {
+		return err
+	}
+
+	nameplateFound := false
+	for _, claimedNameplate := range nameplates {
+		if nameplate == claimedNameplate {
+			nameplateFound = true
+			break
+		}
+	}
+
+	if !nameplateFound {
+		return newTransferError(CodeNameplateUnclaimed, PhaseRendezvous, fmt.Errorf("Nameplate is unclaimed: %s", nameplate))
+	}
+
+	return rc.AttachMailbox(ctx, nameplate)
+}
+
 // A IncomingMessage contains information about a payload sent to this wormhole client.
 //
 // The Type field indicates if the sender sent a single file or a directory.
@@ -316,26 +454,123 @@ type IncomingMessage struct {
 	// FileCount is the number of files in a TransferDirectory offer. This is sent
 	// as part of the offer from the peer and a malicious peer could lie about this.
 	FileCount int
+	// TransferID identifies this transfer in logs, events, spans and
+	// audit records.
+	TransferID string
+	// Message is the text some clients send along with a file or
+	// directory offer, see WithMessage. It is empty for text transfers,
+	// whose text is read like the data of a file.
+	Message string
+	// DirectoryMode is how the zip of a TransferDirectory offer is
+	// compressed. Either mode is read the same way, since each entry
+	// of a zip names its own compression method.
+	DirectoryMode DirectoryMode
+	// PeerTransitAbilities are the types of transit connection the
+	// peer supports, such as "direct-tcp-v1" and "relay-v1", and
+	// PeerTransitHints are the addresses it offered for them. They are
+	// set for file and directory transfers before the transit
+	// connection is made on the first Read, and come from the peer
+	// unchecked.
+	PeerTransitAbilities []string
+	PeerTransitHints     []TransitHint
 
 	textReader io.Reader
 
 	transferInitialized bool
 	initializeTransfer  func() error
 	rejectTransfer      func() error
+	wipeSession         func()
+	peerMood            func() rendezvous.Mood
 
 	cryptor   *transportCryptor
 	buf       []byte
 	readCount int64
 	options   transferOptions
+	progress  *progressTracker
+	relayed   bool
+	stall     *stallWatcher
+	dataSpan  trace.Span
 	sha256    hash.Hash
 
 	readErr error
 
+	// code is the code the transfer was received with, for
+	// checkpoints.
+	code string
+
+	peerCanResume bool
+	peerCanSync   bool
+	peerChecksum  bool
+	resumeOffset  int64
+	// delta is set by SyncFrom.
+	delta *deltaBasis
+
+	streaming   bool
+	streamEnded bool
+
 	ctx context.Context
 }
 
+// A TransitHint is an address the peer offered for the transit
+// connection.
+type TransitHint struct {
+	// Type is the type of the hint: "direct-tcp-v1" or "tor-tcp-v1"
+	// for the peer's own addresses, "relay-v1" for a transit relay,
+	// and "direct-tcp-v1" or "websocket-v1" for the endpoints of a
+	// relay.
+	Type     string
+	Hostname string
+	Port     int
+	// URL is the address of a websocket relay endpoint.
+	URL string
+	// Priority orders hints of the same type, highest first.
+	Priority float64
+	// Name and Endpoints are set for relay-v1 hints: the relay's
+	// optional name and the addresses it can be reached at.
+	Name      string
+	Endpoints []TransitHint
+}
+
+// summary returns the abilities and hints of m.
+func (m *transitMsg) summary() ([]string, []TransitHint) {
+	abilities := make([]string, 0, len(m.AbilitiesV1))
+	for _, a := range m.AbilitiesV1 {
+		abilities = append(abilities, a.Type)
+	}
+
+	hints := make([]TransitHint, 0, len(m.HintsV1))
+	for _, h := range m.HintsV1 {
+		hint := TransitHint{
+			Type:     h.Type,
+			Hostname: h.Hostname,
+			Port:     h.Port,
+			Priority: h.Priority,
+			Name:     h.Name,
+		}
+		for _, e := range h.Hints {
+			endpointType := e.Type
+			if endpointType == "websocket" {
+				endpointType = "websocket-v1"
+			}
+			hint.Endpoints = append(hint.Endpoints, TransitHint{
+				Type:     endpointType,
+				Hostname: e.Hostname,
+				Port:     e.Port,
+				URL:      e.Url,
+				Priority: e.Priority,
+			})
+		}
+		hints = append(hints, hint)
+	}
+	return abilities, hints
+}
+
 // Return true if the msg has finished being read.
 func (f *IncomingMessage) ReadDone() bool {
+	if f.streaming {
+		// the length of a streamed file is only known at its end
+		return f.streamEnded
+	}
 	return f.readCount >= f.UncompressedBytes64
 }
 
@@ -359,6 +594,52 @@ func (f *IncomingMessage) readText(p []byte) (int, error) {
 	return f.textReader.Read(p)
 }
 
+// WriteTo writes the rest of the contents sent to this client to w. It
+// lets io.Copy, and so SaveTo and Directory, write each decrypted
+// record straight to w instead of copying it through a buffer of its
+// own. A failed write leaves the data w did not take to be read again.
+func (f *IncomingMessage) WriteTo(w io.Writer) (int64, error) {
+	if f.readErr != nil {
+		return 0, f.readErr
+	}
+
+	switch f.Type {
+	case TransferText:
+		return io.Copy(w, f.textReader)
+	case TransferFile, TransferDirectory:
+	default:
+		return 0, fmt.Errorf("unknown Receiver type %d", f.Type)
+	}
+
+	var written int64
+	for {
+		buf, err := f.fill()
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+
+		var (
+			n    int
+			werr error
+		)
+		if len(buf) > 0 {
+			n, werr = w.Write(buf)
+			written += int64(n)
+		}
+		if err := f.consume(buf[:n]); err != nil {
+			return written, err
+		}
+		if werr == nil && n < len(buf) {
+			werr = io.ErrShortWrite
+		}
+		if werr != nil {
+			return written, werr
+		}
+	}
+}
+
 // Reject an incoming file or directory transfer. This must be
 // called before any calls to Read. This does nothing for
 // text message transfers.
@@ -379,73 +660,395 @@ func (f *IncomingMessage) Reject() error {
 
 	f.transferInitialized = true
 	f.rejectTransfer()
+	f.wipeKeys()
+	f.options.end(ErrOfferDeclined)
+
+	return nil
+}
+
+var errMessageClosed = errors.New("incoming message closed")
+
+// PeerMood returns the mood the sender closed the mailbox with, so that
+// a sender that errored (Errory) can be told apart from one that
+// suspected tampering (Scary). The receiver leaves the mailbox once it
+// accepts or rejects the offer, so this is only known for a sender
+// that gave up before then, and is "" otherwise or if the rendezvous
+// server does not relay close messages.
+func (f *IncomingMessage) PeerMood() rendezvous.Mood {
+	if f.peerMood == nil {
+		return ""
+	}
+	return f.peerMood()
+}
+
+// Close ends the transfer and wipes its keys from memory. A file or
+// directory offer that has not been read yet is rejected, and one that
+// is still being read is aborted. Reads after Close fail.
+//
+// Keys are wiped as soon as a transfer completes or fails anyway, so
+// Close is only needed to end a transfer early, or to be sure that no
+// keys are left in memory whatever happened. It may be called more
+// than once, but not concurrently with Read.
+func (f *IncomingMessage) Close() error {
+	switch f.Type {
+	case TransferFile, TransferDirectory:
+		if !f.transferInitialized {
+			f.Reject()
+		} else if f.readErr == nil {
+			err := newTransferError(CodeCanceled, PhaseData, errMessageClosed)
+			f.readErr = err
+			if f.cryptor != nil {
+				f.cryptor.Close()
+			}
+			f.finish(err)
+		}
+	}
+	if f.readErr == nil {
+		f.readErr = errMessageClosed
+	}
+	f.wipeKeys()
+	return nil
+}
+
+// wipeKeys zeroes the keys of the transfer, once.
+func (f *IncomingMessage) wipeKeys() {
+	if f.wipeSession != nil {
+		f.wipeSession()
+		f.wipeSession = nil
+	}
+}
+
+func (f *IncomingMessage) offer() Offer {
+	return Offer{
+		Type:                f.Type,
+		Name:                f.Name,
+		TransferBytes64:     f.TransferBytes64,
+		UncompressedBytes64: f.UncompressedBytes64,
+		FileCount:           f.FileCount,
+		UnknownLength:       f.streaming,
+		Message:             f.Message,
+		DirectoryMode:       f.DirectoryMode,
+	}
+}
+
+// PeerCanResume reports whether the sender supports resuming this
+// transfer with ResumeFrom.
+func (f *IncomingMessage) PeerCanResume() bool {
+	return f.Type == TransferFile && f.peerCanResume && !f.streaming
+}
+
+// PeerCanSync reports whether the sender supports receiving this
+// transfer as a delta with SyncFrom.
+func (f *IncomingMessage) PeerCanSync() bool {
+	return f.Type == TransferFile && f.peerCanSync && !f.streaming
+}
+
+// SyncFrom accepts a file transfer for which the caller has a similar
+// file, such as an older version of the same file, to use as the
+// basis. Only the parts of the file that the basis lacks are sent;
+// Read still returns the whole file, reading the rest from basis.
+// size is the size of basis.
+//
+// SyncFrom reads all of basis to compute its signature before it
+// returns, and basis must not change until the transfer is done. Since
+// Read may return data from anywhere in basis, the file must not be
+// written over basis; write it to a new file and rename that over
+// basis once the transfer has succeeded.
+//
+// SyncFrom must be called before any calls to Read, cannot be combined
+// with ResumeFrom, and is only supported if PeerCanSync returns true.
+func (f *IncomingMessage) SyncFrom(basis io.ReaderAt, size int64) error {
+	if !f.PeerCanSync() {
+		return errors.New("peer does not support delta transfers of this file")
+	}
+	if f.transferInitialized {
+		return errors.New("cannot SyncFrom after calls to Read")
+	}
+	if f.resumeOffset > 0 {
+		return errors.New("cannot SyncFrom after ResumeFrom")
+	}
 
+	delta, err := newDeltaBasis(basis, size)
+	if err != nil {
+		return err
+	}
+	f.delta = delta
 	return nil
 }
 
+func (f *IncomingMessage) deltaAnswer() *deltaAnswer {
+	if f.delta == nil {
+		return nil
+	}
+	return &f.delta.answer
+}
+
+// UnknownLength reports whether the sender did not know the size of
+// the file when it made the offer (see Client.SendStream). In that case
+// TransferBytes64 and UncompressedBytes64 are 0 and Read returns data
+// until the sender signals the end of the stream.
+func (f *IncomingMessage) UnknownLength() bool {
+	return f.streaming
+}
+
+// ResumeFrom accepts a file transfer of which the caller already has
+// the first offset bytes, e.g. from an earlier interrupted transfer.
+// The sender skips those bytes, so subsequent calls to Read only return
+// the rest of the file.
+//
+// partial must provide the offset bytes the caller already has. They
+// are hashed so that the final integrity check still covers the whole
+// file: if they differ from the sender's copy the transfer fails.
+//
+// ResumeFrom must be called before any calls to Read and is only
+// supported if PeerCanResume returns true.
+func (f *IncomingMessage) ResumeFrom(offset int64, partial io.Reader) error {
+	if err := f.checkResume(offset); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, partial, offset); err != nil {
+		return fmt.Errorf("hash partial file: %w", err)
+	}
+
+	f.resume(offset, hasher)
+	return nil
+}
+
+// checkResume checks that the transfer can be resumed from offset.
+func (f *IncomingMessage) checkResume(offset int64) error {
+	if !f.PeerCanResume() {
+		return errors.New("peer does not support resuming this transfer")
+	}
+
+	if f.transferInitialized {
+		return errors.New("cannot ResumeFrom after calls to Read")
+	}
+
+	if f.delta != nil {
+		return errors.New("cannot ResumeFrom after SyncFrom")
+	}
+
+	if offset < 0 || offset > f.TransferBytes64 {
+		return fmt.Errorf("resume offset %d out of range for %d byte file", offset, f.TransferBytes64)
+	}
+	return nil
+}
+
+// resume skips the first offset bytes of the transfer, whose hash is
+// in hasher.
+func (f *IncomingMessage) resume(offset int64, hasher hash.Hash) {
+	f.sha256 = hasher
+	f.resumeOffset = offset
+	f.readCount = offset
+}
+
 func (f *IncomingMessage) readCrypt(p []byte) (int, error) {
+	buf, err := f.fill()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, buf)
+	return n, f.consume(p[:n])
+}
+
+// fill returns the decrypted data that has not been read yet, reading
+// the next record if there is none. The data is empty if the sender
+// has none left to send.
+func (f *IncomingMessage) fill() ([]byte, error) {
 	if f.readErr != nil {
-		return 0, f.readErr
+		return nil, f.readErr
 	}
 
 	if err := f.ctx.Err(); err != nil {
+		err = transferError(PhaseData, err)
 		f.readErr = err
 		if f.cryptor != nil {
 			f.cryptor.Close()
 		}
-		return 0, err
+		f.finish(err)
+		return nil, err
 	}
 
 	if !f.transferInitialized {
 		f.transferInitialized = true
 		err := f.initializeTransfer()
 		if err != nil {
-			return 0, err
+			err = transferError(PhaseTransit, err)
+			f.finish(err)
+			return nil, err
 		}
 	}
 
-	// for empty files the sender doesn't send any records
-	// so we need to short circut the read and proceed straight
-	// to sending an "ok" ack
-	emptyFile := f.TransferBytes64 == 0
+	// for empty (or fully resumed) files the sender doesn't send
+	// any records so we need to short circut the read and proceed
+	// straight to sending an "ok" ack
+	nothingToSend := !f.streaming && f.readCount >= f.TransferBytes64
 
-	if len(f.buf) == 0 && !emptyFile {
+	if len(f.buf) == 0 && !nothingToSend {
 		rec, err := f.cryptor.readRecord()
 		if err == io.EOF {
-			f.readErr = io.ErrUnexpectedEOF
-			return 0, f.readErr
-		} else if err != nil {
+			err = io.ErrUnexpectedEOF
+		}
+		err = transferError(PhaseData, f.stall.reason(err))
+		if err != nil {
 			f.readErr = err
-			return 0, err
+			// close the connection so the sender doesn't wait for
+			// an ack that will never come.
+			f.cryptor.Close()
+			f.finish(err)
+			return nil, err
+		}
+		if f.streaming && len(rec) == 0 {
+			// an empty record marks the end of a streamed file
+			f.streamEnded = true
+		}
+		if f.delta != nil {
+			rec, err = f.delta.expand(rec)
+			if err == nil && f.readCount+int64(len(rec)) > f.TransferBytes64 {
+				err = newTransferError(CodeProtocol, PhaseData, errors.New("delta transfer is longer than the offer"))
+			}
+			if err != nil {
+				err = transferError(PhaseData, err)
+				f.readErr = err
+				f.cryptor.Close()
+				f.finish(err)
+				return nil, err
+			}
+		}
+		if max := f.options.maxOfferSize; max > 0 && f.readCount+int64(len(rec)) > max {
+			err = transferError(PhaseData, ErrOfferTooLarge)
+			f.readErr = err
+			f.cryptor.Close()
+			f.finish(err)
+			return nil, err
 		}
 		f.buf = rec
 	}
+	return f.buf, nil
+}
 
-	n := copy(p, f.buf)
-	f.buf = f.buf[n:]
-	f.readCount += int64(n)
+// consume marks data, the start of what fill returned, as read, and
+// sends the final acknowledgment once all the data has been read.
+func (f *IncomingMessage) consume(data []byte) error {
+	f.buf = f.buf[len(data):]
+	f.readCount += int64(len(data))
 	f.updateProgress()
-	f.sha256.Write(p[:n])
-	if f.readCount >= f.TransferBytes64 {
+	f.sha256.Write(data)
+
+	done := f.readCount >= f.TransferBytes64
+	if f.streaming {
+		done = f.streamEnded
+	}
+	if done {
 		f.readErr = io.EOF
 
-		sum := f.sha256.Sum(nil)
-		ack := fileTransportAck{
-			Ack:    "ok",
-			SHA256: hex.EncodeToString(sum),
+		err := f.ack()
+		f.cryptor.Close()
+		if err != nil {
+			err = transferError(PhaseData, f.stall.reason(err))
+			f.readErr = err
+			f.finish(err)
+			return err
 		}
 
-		msg, _ := json.Marshal(ack)
-		f.cryptor.writeRecord(msg)
-		f.cryptor.Close()
+		f.finish(nil)
+	}
+
+	return nil
+}
+
+// ack sends the final acknowledgment for the data. It sends a rejection
+// instead if the sender's checksum does not match or the callback
+// registered with WithChecksumCallback or a BeforeAck hook fails.
+func (f *IncomingMessage) ack() error {
+	sum := Checksum{SHA256: f.sha256.Sum(nil)}
+
+	var err error
+	if f.peerChecksum {
+		sum.SenderSHA256, err = f.readSenderChecksum()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum.SenderSHA256, sum.SHA256) {
+			err = newTransferError(CodeIntegrity, PhaseData,
+				fmt.Errorf("sender sha256 mismatch %x vs %x", sum.SenderSHA256, sum.SHA256))
+		}
+	}
+	if err == nil && f.options.checksumFunc != nil {
+		if cerr := f.options.checksumFunc(sum); cerr != nil {
+			err = newTransferError(CodeIntegrity, PhaseData, cerr)
+		}
+	}
+	if err == nil {
+		err = f.options.beforeAck(f.ctx, sum)
+	}
+
+	ack := fileTransportAck{
+		Ack:    "ok",
+		SHA256: hex.EncodeToString(sum.SHA256),
+	}
+	if err != nil {
+		ack.Ack = ackRejected
+	}
+
+	msg, _ := json.Marshal(ack)
+	f.cryptor.writeRecord(msg)
+	return err
+}
+
+// readSenderChecksum reads the sha256 the sender sends after the data.
+func (f *IncomingMessage) readSenderChecksum() ([]byte, error) {
+	rec, err := f.cryptor.readRecord()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var trailer fileTransportChecksum
+	err = json.Unmarshal(rec, &trailer)
+	if err != nil {
+		return nil, newTransferError(CodeProtocol, PhaseData, fmt.Errorf("invalid checksum record: %w", err))
+	}
+	sum, err := hex.DecodeString(trailer.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, newTransferError(CodeProtocol, PhaseData, fmt.Errorf("invalid sender sha256 %q", trailer.SHA256))
+	}
+	return sum, nil
+}
+
+// finish reports the end of a file or directory transfer, with err
+// set if it failed.
+func (f *IncomingMessage) finish(err error) {
+	f.stall.stop()
+	f.stall = nil
+
+	if f.cryptor != nil {
+		f.options.connStateChanged(ConnStateChange{Layer: ConnTransit, State: ConnDisconnected, Relayed: f.relayed, Reason: err})
+	}
+
+	if err != nil {
+		f.options.emit(Event{Type: EventFailed, Err: err})
+	} else {
+		f.options.emit(Event{Type: EventCompleted, Bytes: f.readCount, Total: f.UncompressedBytes64})
+	}
+
+	if f.dataSpan != nil {
+		f.dataSpan.SetAttributes(attrBytes.Int64(f.readCount))
+		endSpan(f.dataSpan, err)
+		f.dataSpan = nil
 	}
 
-	return n, nil
+	f.wipeKeys()
 }
 
 func (f *IncomingMessage) updateProgress() {
-	if f.options.progressFunc != nil {
+	f.stall.touch()
+	if f.progress != nil {
 		// NB: f.readCount can be > f.UncompressedBytes64.
-		f.options.progressFunc(f.readCount, f.UncompressedBytes64)
+		f.progress.update(f.readCount, f.UncompressedBytes64)
 	}
 }
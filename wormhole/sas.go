@@ -0,0 +1,117 @@
+package wormhole
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/psanford/wormhole-william/wordlist"
+)
+
+// SASWordCount is the number of words VerifierWords returns. Each word
+// encodes one byte of the verifier.
+const SASWordCount = 4
+
+// SASEmojiCount is the number of emoji VerifierEmoji returns. Each
+// emoji encodes 6 bits of the verifier.
+const SASEmojiCount = 7
+
+// SASEmoji is one symbol of the emoji form of a verifier. Name is the
+// English name of the emoji, for users who cannot tell them apart or
+// whose terminal cannot show them.
+type SASEmoji struct {
+	Emoji string
+	Name  string
+}
+
+func (e SASEmoji) String() string {
+	return e.Emoji + " " + e.Name
+}
+
+// sasEmoji are the 64 emoji VerifierEmoji chooses from. They are the
+// ones used for short authentication strings in the Matrix protocol,
+// picked to be easy to tell apart and to name.
+var sasEmoji = [64]SASEmoji{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
+
+// VerifierWords returns the first SASWordCount bytes of verifier, as
+// passed to VerifierOk, as words from the PGP word list. The words are
+// easier to compare over the phone than the 64 hex characters of the
+// verifier, and both sides of a session get the same words.
+func VerifierWords(verifier string) ([]string, error) {
+	b, err := decodeVerifier(verifier, SASWordCount)
+	if err != nil {
+		return nil, err
+	}
+	return wordlist.EncodeWords(b[:SASWordCount]), nil
+}
+
+// VerifierEmoji returns the first 42 bits of verifier, as passed to
+// VerifierOk, as SASEmojiCount emoji, for comparing verifiers at a
+// glance in graphical UIs.
+func VerifierEmoji(verifier string) ([]SASEmoji, error) {
+	b, err := decodeVerifier(verifier, (SASEmojiCount*6+7)/8)
+	if err != nil {
+		return nil, err
+	}
+
+	emoji := make([]SASEmoji, SASEmojiCount)
+	for i := range emoji {
+		// the 6 bits starting at bit 6i, most significant bit first
+		bit := i * 6
+		v := uint(b[bit/8])<<8 | uint(b[bit/8+1])
+		emoji[i] = sasEmoji[v>>(10-bit%8)&0x3f]
+	}
+	return emoji, nil
+}
+
+func decodeVerifier(verifier string, n int) ([]byte, error) {
+	b, err := hex.DecodeString(verifier)
+	if err != nil {
+		return nil, fmt.Errorf("invalid verifier: %w", err)
+	}
+	if len(b) < n {
+		return nil, fmt.Errorf("verifier too short: %d bytes", len(b))
+	}
+	return b, nil
+}
+
+// CompareVerifiers reports whether a and b are the same verifier, such
+// as the one passed to VerifierOk and one the user typed in from the
+// other side. Case and whitespace are ignored. The comparison takes
+// the same time wherever a and b differ, so it does not leak how much
+// of a guess was right.
+func CompareVerifiers(a, b string) bool {
+	na, nb := normalizeVerifier(a), normalizeVerifier(b)
+	if len(na) == 0 || len(nb) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(na), []byte(nb)) == 1
+}
+
+func normalizeVerifier(v string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, v)
+}
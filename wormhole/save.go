@@ -0,0 +1,264 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CollisionPolicy says what SaveTo does when the file or directory it
+// would create already exists.
+type CollisionPolicy int
+
+const (
+	// CollisionFail rejects the offer and fails with ErrFileExists.
+	// This is the default.
+	CollisionFail CollisionPolicy = iota
+	// CollisionOverwrite replaces the existing file or directory.
+	CollisionOverwrite
+	// CollisionRename saves under a name with a number added, such as
+	// "file (1).txt".
+	CollisionRename
+	// CollisionResume treats the existing file as the start of the
+	// offered one, left by an interrupted SaveTo, and receives only the
+	// rest of it with ResumeFrom. If the file cannot be resumed, because
+	// it is larger than the offer, the offer is a directory or a stream,
+	// or the peer does not support resuming, it is handled like
+	// CollisionFail.
+	CollisionResume
+)
+
+func (p CollisionPolicy) String() string {
+	switch p {
+	case CollisionFail:
+		return "Fail"
+	case CollisionOverwrite:
+		return "Overwrite"
+	case CollisionRename:
+		return "Rename"
+	case CollisionResume:
+		return "Resume"
+	default:
+		return fmt.Sprintf("CollisionPolicyUnknown<%d>", p)
+	}
+}
+
+// ErrFileExists is the error SaveTo fails with when the file or
+// directory it would create exists and the CollisionPolicy does not
+// allow replacing or resuming it.
+var ErrFileExists = errors.New("destination already exists")
+
+// maxCollisionRenames is the number of names CollisionRename tries.
+const maxCollisionRenames = 1000
+
+type collisionTransferOption struct {
+	policy CollisionPolicy
+	f      func(path string, offer Offer) CollisionPolicy
+}
+
+func (o collisionTransferOption) setOption(opts *transferOptions) error {
+	switch o.policy {
+	case CollisionFail, CollisionOverwrite, CollisionRename, CollisionResume:
+	default:
+		return fmt.Errorf("unknown collision policy %d", o.policy)
+	}
+	opts.collisionPolicy = o.policy
+	opts.collisionFunc = o.f
+	return nil
+}
+
+// WithCollisionPolicy returns a TransferOption for Receive that sets
+// what IncomingMessage.SaveTo does when the destination already exists.
+func WithCollisionPolicy(p CollisionPolicy) TransferOption {
+	return collisionTransferOption{policy: p}
+}
+
+// WithCollisionFunc returns a TransferOption for Receive that lets f
+// choose what IncomingMessage.SaveTo does when the destination already
+// exists, for instance by asking the user. f is called with the path
+// of the existing file or directory and the offer.
+func WithCollisionFunc(f func(path string, offer Offer) CollisionPolicy) TransferOption {
+	return collisionTransferOption{f: f}
+}
+
+// SaveTo receives a file or directory offer into dir, under the name
+// the sender offered, and returns the path it was saved to. If that
+// path already exists, the CollisionPolicy set with WithCollisionPolicy
+// or WithCollisionFunc decides what happens; by default the offer is
+// rejected and SaveTo fails with ErrFileExists.
+//
+// Names that are not a single safe path element, such as "../x", are
+// rejected. A file is written in place, so a transfer that fails
+// leaves a partial file that CollisionResume can pick up later. A
+// directory is extracted into a temporary directory in dir, as
+// ExtractZip does, and only moved into place once it is complete.
+// SaveTo must be called instead of Read.
+func (f *IncomingMessage) SaveTo(dir string) (string, error) {
+	if f.Type != TransferFile && f.Type != TransferDirectory {
+		return "", errors.New("SaveTo is only supported for files and directories")
+	}
+	if f.transferInitialized {
+		return "", errors.New("cannot call SaveTo after calls to Read")
+	}
+
+	if !safeSaveName(f.Name) {
+		f.Reject()
+		return "", fmt.Errorf("unsafe name %q", f.Name)
+	}
+	target := filepath.Join(dir, f.Name)
+
+	policy := CollisionFail
+	info, err := os.Lstat(target)
+	if err == nil {
+		policy = f.options.collisionPolicy
+		if f.options.collisionFunc != nil {
+			policy = f.options.collisionFunc(target, f.offer())
+		}
+	} else if os.IsNotExist(err) {
+		info = nil
+	} else {
+		f.Reject()
+		return "", err
+	}
+
+	if f.Type == TransferDirectory {
+		return f.saveDirectory(dir, target, info, policy)
+	}
+	return f.saveFile(dir, target, info, policy)
+}
+
+// safeSaveName reports whether name can be used as the name of a file
+// or directory in the directory SaveTo saves to.
+func safeSaveName(name string) bool {
+	return name != "." && !strings.Contains(name, "/") && safeZipPath(name)
+}
+
+func (f *IncomingMessage) saveFile(dir, target string, info os.FileInfo, policy CollisionPolicy) (string, error) {
+	var (
+		file *os.File
+		err  error
+	)
+	switch {
+	case info == nil:
+		file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	case policy == CollisionOverwrite && info.Mode().IsRegular():
+		file, err = os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0666)
+	case policy == CollisionRename:
+		target, file, err = createRenamed(dir, f.Name)
+	case policy == CollisionResume && f.canResumeFrom(info):
+		file, err = os.OpenFile(target, os.O_RDWR, 0666)
+		if err == nil {
+			err = f.ResumeFrom(info.Size(), file)
+		}
+	default:
+		err = fmt.Errorf("%w: %s", ErrFileExists, target)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		f.Reject()
+		return "", err
+	}
+
+	_, err = io.Copy(file, f)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// canResumeFrom reports whether the existing file can be the start of
+// the offered one.
+func (f *IncomingMessage) canResumeFrom(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && f.PeerCanResume() && info.Size() <= f.TransferBytes64
+}
+
+// createRenamed creates the file name in dir with a number added to
+// its name, as "name (n).ext", for the lowest n that is free.
+func createRenamed(dir, name string) (string, *os.File, error) {
+	for n := 1; n <= maxCollisionRenames; n++ {
+		p := filepath.Join(dir, renamed(name, n))
+		file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return p, file, err
+	}
+	return "", nil, fmt.Errorf("%w: no free name for %s", ErrFileExists, name)
+}
+
+// renamed returns name with n added before its extension.
+func renamed(name string, n int) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		// a dot file such as ".profile" has no extension
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + " (" + strconv.Itoa(n) + ")" + ext
+}
+
+func (f *IncomingMessage) saveDirectory(dir, target string, info os.FileInfo, policy CollisionPolicy) (string, error) {
+	if info != nil && policy != CollisionOverwrite && policy != CollisionRename {
+		f.Reject()
+		return "", fmt.Errorf("%w: %s", ErrFileExists, target)
+	}
+	if info != nil && policy == CollisionOverwrite && !info.IsDir() {
+		f.Reject()
+		return "", fmt.Errorf("%w: %s is not a directory", ErrFileExists, target)
+	}
+
+	tmp, err := ioutil.TempDir(dir, "."+f.Name+".tmp")
+	if err != nil {
+		f.Reject()
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	d, err := f.Directory(dir)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+	if err := d.Extract(tmp); err != nil {
+		return "", err
+	}
+
+	if info != nil && policy == CollisionOverwrite {
+		if err := os.RemoveAll(target); err != nil {
+			return "", err
+		}
+	}
+	if info != nil && policy == CollisionRename {
+		target, err = freeName(dir, f.Name)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// freeName returns the path of name in dir with the lowest number
+// added that does not exist yet.
+func freeName(dir, name string) (string, error) {
+	for n := 1; n <= maxCollisionRenames; n++ {
+		p := filepath.Join(dir, renamed(name, n))
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%w: no free name for %s", ErrFileExists, name)
+}
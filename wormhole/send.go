@@ -1,18 +1,25 @@
 package wormhole
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
 	"github.com/psanford/wormhole-william/internal/crypto"
 	"github.com/psanford/wormhole-william/rendezvous"
@@ -26,7 +33,6 @@ import (
 // that gets written to once the receiver actually attempts to read the message
 // (either successfully or not).
 func (c *Client) SendText(ctx context.Context, msg string, opts ...TransferOption) (string, chan SendResult, error) {
-	sideID := crypto.RandSideID()
 	appID := c.AppID
 
 	var options transferOptions
@@ -36,11 +42,33 @@ func (c *Client) SendText(ctx context.Context, msg string, opts ...TransferOptio
 			return "", nil, err
 		}
 	}
+	if options.strictVerification && c.VerifierOk == nil {
+		return "", nil, errStrictVerifierOk
+	}
+	if options.message != nil {
+		return "", nil, errMessageWithText
+	}
+	if options.invite && options.code == "" {
+		return "", nil, errInviteWithoutCode
+	}
+	if options.code != "" && !options.invite && !options.resumed {
+		if err := c.checkCodeReuse(sideSend, options.code); err != nil {
+			return "", nil, err
+		}
+	}
+	sideID, err := c.beginTransfer(&options, sideSend)
+	if err != nil {
+		return "", nil, err
+	}
+	options.setOffer((&offerMsg{Message: &msg}).summary())
 
-	pwStr, rc, err := c.CreateOrAttachMailbox(ctx, sideID, appID, options.code)
+	pwStr, rc, err := c.createOrAttachMailbox(ctx, sideID, appID, options.code, &options)
 	if err != nil {
+		options.end(err)
 		return "", nil, err
 	}
+	options.emit(Event{Type: EventCodeAllocated, Code: pwStr})
+	c.recordPending(&options, sideID, pwStr, &offerMsg{Message: &msg})
 
 	ch, err := c.SendTextMsg(ctx, rc, sideID, appID, pwStr, msg, &options)
 
@@ -49,10 +77,20 @@ func (c *Client) SendText(ctx context.Context, msg string, opts ...TransferOptio
 
 // returns a code
 func (c *Client) CreateOrAttachMailbox(ctx context.Context, sideID string, appID string, code string) (string, *rendezvous.Client, error) {
+	options := transferOptions{side: sideSend, logger: c.logger(), connStateHook: c.ConnStateHook}
+	return c.createOrAttachMailbox(ctx, sideID, appID, code, &options)
+}
+
+func (c *Client) createOrAttachMailbox(ctx context.Context, sideID string, appID string, code string, options *transferOptions) (_ string, _ *rendezvous.Client, err error) {
+	_, span := c.startSpan(ctx, options, spanRendezvousConnect, attrRendezvousURL.String(c.RendezvousURL))
+	defer func() {
+		err = transferError(PhaseRendezvous, err)
+		endSpan(span, err)
+	}()
 
-	rc := rendezvous.NewClient(c.RendezvousURL, sideID, appID)
+	rc := c.newRendezvousClient(sideID, appID, options)
 
-	_, err := rc.Connect(ctx)
+	_, err = rc.Connect(ctx)
 	if err != nil {
 		return "", nil, err
 	}
@@ -62,13 +100,19 @@ func (c *Client) CreateOrAttachMailbox(ctx context.Context, sideID string, appID
 		if err != nil {
 			return "", nil, err
 		}
+		span.SetAttributes(attrNameplate.String(nameplate))
 
-		code = nameplate + "-" + wordlist.ChooseWords(c.wordCount())
+		words, err := wordlist.ChooseWordsFrom(c.random(), c.wordCount())
+		if err != nil {
+			return "", nil, err
+		}
+		code = nameplate + "-" + words
 	} else {
 		nameplate, err := nameplateFromCode(code)
 		if err != nil {
-			return "", nil, err
+			return "", nil, newTransferError(CodeWrongCode, PhaseRendezvous, err)
 		}
+		span.SetAttributes(attrNameplate.String(nameplate))
 
 		err = rc.AttachMailbox(ctx, nameplate)
 		if err != nil {
@@ -81,73 +125,79 @@ func (c *Client) CreateOrAttachMailbox(ctx context.Context, sideID string, appID
 
 func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID string, appID string, code string, msg string, options *transferOptions) (chan SendResult, error) {
 	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.rand = c.random()
+	clientProto.onTampering = options.tampering
+	clientProto.peerTimeout = options.timeouts.Peer
+	clientProto.clock = options.clock
 
 	ch := make(chan SendResult, 1)
 	go func() {
 		var returnErr error
+		defer clientProto.wipeKeys()
 		defer func() {
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if isScary(returnErr) {
 				mood = rendezvous.Scary
 			}
 
 			rc.Close(ctx, mood)
 		}()
 
+		phase := PhasePake
 		sendErr := func(err error) {
+			err = transferError(phase, err)
+			options.emit(Event{Type: EventFailed, Err: err})
 			ch <- SendResult{
-				Error: err,
+				Error:      err,
+				TransferID: options.transferID,
+				PeerMood:   rc.PeerMood(),
 			}
 			returnErr = err
 			close(ch)
 		}
 
-		err := clientProto.WritePake(ctx, code)
+		err := c.exchangePake(ctx, clientProto, code, options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
+		options.emit(Event{Type: EventPakeComplete})
 
-		err = clientProto.ReadPake(ctx)
+		peerVersions, err := c.exchangeVersions(ctx, clientProto, options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
 
-		err = clientProto.WriteVersion(ctx)
+		err = c.verify(ctx, clientProto, peerVersions, options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
 
-		_, err = clientProto.ReadVersion()
+		collector, err := clientProto.Collect()
 		if err != nil {
 			sendErr(err)
 			return
 		}
+		defer collector.close()
 
-		if c.VerifierOk != nil {
-			verifier, err := clientProto.Verifier()
+		if options.strictVerification {
+			err = waitVerified(ctx, clientProto, collector)
 			if err != nil {
 				sendErr(err)
 				return
 			}
+		}
+		phase = PhaseTransit
 
-			if ok := c.VerifierOk(hex.EncodeToString(verifier)); !ok {
-				errMsg := "sender rejected verification check, abandoned transfer"
-				writeErr := clientProto.WriteAppData(ctx, &genericMessage{
-					Error: &errMsg,
-				})
-				if writeErr != nil {
-					sendErr(writeErr)
-					return
-				}
-
-				sendErr(errors.New(errMsg))
-				return
-			}
+		err = options.beforeOffer(ctx)
+		if err != nil {
+			abandonTransfer(ctx, clientProto)
+			sendErr(err)
+			return
 		}
 
 		offer := &genericMessage{
@@ -161,13 +211,6 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 			return
 		}
 
-		collector, err := clientProto.Collect()
-		if err != nil {
-			sendErr(err)
-			return
-		}
-		defer collector.close()
-
 		var answer answerMsg
 		err = collector.waitFor(&answer)
 		if err != nil {
@@ -185,13 +228,16 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 				options.progressFunc(msgSize, msgSize)
 			}
 
+			options.emit(Event{Type: EventCompleted, Bytes: int64(len(msg)), Total: int64(len(msg))})
 			ch <- SendResult{
-				OK: true,
+				OK:         true,
+				TransferID: options.transferID,
+				PeerMood:   rendezvous.Happy,
 			}
 			close(ch)
 			return
 		} else {
-			sendErr(fmt.Errorf("unexpected answer"))
+			sendErr(newTransferError(CodeProtocol, phase, fmt.Errorf("unexpected answer")))
 			return
 		}
 	}()
@@ -200,8 +246,6 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 }
 
 func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Reader, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
-	var logFunc, loggingEnabled = ctx.Value("log-func").(LogFunc)
-
 	var options transferOptions
 	for _, opt := range opts {
 		err := opt.setOption(&options)
@@ -210,136 +254,194 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 		}
 	}
 
-	sideID := crypto.RandSideID()
-	appID := c.AppID
-	rc := rendezvous.NewClient(c.RendezvousURL, sideID, appID)
-
-	_, err := rc.Connect(ctx)
-	if err != nil {
-		return "", nil, err
+	if c.Dial != nil {
+		// there is nothing to listen on
+		disableListener = true
+	}
+	if options.transitPolicy == TransitDirectOnly && (disableListener || relayOnly) {
+		return "", nil, errors.New("direct-only transit requires a listening socket")
 	}
 
-	var pwStr string
-	if options.code == "" {
-		nameplate, err := rc.CreateMailbox(ctx)
-		if err != nil {
+	if options.strictVerification && c.VerifierOk == nil {
+		return "", nil, errStrictVerifierOk
+	}
+	if options.invite && options.code == "" {
+		return "", nil, errInviteWithoutCode
+	}
+	if options.code != "" && !options.invite && !options.resumed {
+		if err := c.checkCodeReuse(sideSend, options.code); err != nil {
 			return "", nil, err
 		}
+	}
 
-		pwStr = nameplate + "-" + wordlist.ChooseWords(c.wordCount())
-	} else {
-		pwStr = options.code
-		nameplate, err := nameplateFromCode(pwStr)
-		if err != nil {
-			return "", nil, err
-		}
+	if options.message != nil {
+		withMessage := *offer
+		withMessage.Message = options.message
+		offer = &withMessage
+	}
 
-		err = rc.AttachMailbox(ctx, nameplate)
-		if err != nil {
-			return "", nil, err
-		}
+	sideID, err := c.beginTransfer(&options, sideSend)
+	if err != nil {
+		return "", nil, err
 	}
+	options.setOffer(offer.summary())
+
+	appID := c.AppID
+
+	pwStr, rc, err := c.createOrAttachMailbox(ctx, sideID, appID, options.code, &options)
+	if err != nil {
+		options.end(err)
+		return "", nil, err
+	}
+
+	options.emit(Event{Type: EventCodeAllocated, Code: pwStr})
+	c.recordPending(&options, sideID, pwStr, offer)
 
 	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.rand = c.random()
+	clientProto.onTampering = options.tampering
+	clientProto.peerTimeout = options.timeouts.Peer
+	clientProto.clock = options.clock
 
 	ch := make(chan SendResult, 1)
 	go func() {
-		var returnErr error
+		var (
+			returnErr error
+			stall     *stallWatcher
+		)
 
+		defer clientProto.wipeKeys()
 		defer func() {
 			mood := rendezvous.Errory
 
+			var te *TransferError
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr.Error() == errOfferRejected.Error() {
+			} else if errors.As(returnErr, &te) && te.Code == CodeRejected {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if isScary(returnErr) {
 				mood = rendezvous.Scary
 			}
 
 			rc.Close(ctx, mood)
 		}()
 
+		phase := PhasePake
 		sendErr := func(err error) {
+			err = transferError(phase, stall.reason(err))
 			defer func() {
 				if r := recover(); r != nil {
-					fmt.Printf("Error writing to channel: %s. Attempted error was: %s\n", r, err)
+					options.logger.Error("send result dropped", "panic", r, "err", err)
 				}
 			}()
+			options.emit(Event{Type: EventFailed, Err: err})
 			ch <- SendResult{
-				Error: err,
+				Error:      err,
+				TransferID: options.transferID,
+				PeerMood:   rc.PeerMood(),
 			}
 			close(ch)
 			returnErr = err
 		}
 
-		err = clientProto.WritePake(ctx, pwStr)
+		err = c.exchangePake(ctx, clientProto, pwStr, &options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
+		options.emit(Event{Type: EventPakeComplete})
 
-		err = clientProto.ReadPake(ctx)
+		peerVersions, err := c.exchangeVersions(ctx, clientProto, &options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
 
-		err = clientProto.WriteVersion(ctx)
+		err = c.verify(ctx, clientProto, peerVersions, &options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
 
-		_, err = clientProto.ReadVersion()
+		collector, err := clientProto.Collect()
 		if err != nil {
 			sendErr(err)
 			return
 		}
-		if c.VerifierOk != nil {
-			verifier, err := clientProto.Verifier()
+		defer collector.close()
+
+		if options.strictVerification {
+			err = waitVerified(ctx, clientProto, collector)
 			if err != nil {
 				sendErr(err)
 				return
 			}
+		}
+		phase = PhaseTransit
 
-			if ok := c.VerifierOk(hex.EncodeToString(verifier)); !ok {
-				errMsg := "sender rejected verification check, abandoned transfer"
-				writeErr := clientProto.WriteAppData(ctx, &genericMessage{
-					Error: &errMsg,
-				})
-				if writeErr != nil {
-					sendErr(writeErr)
-					return
-				}
-
-				sendErr(errors.New(errMsg))
+		if offer.File != nil && offer.File.Stream && !peerVersions.has(abilityStreamV1) {
+			// the peer needs to know the size up front, so buffer
+			// the stream on disk first.
+			spooled, size, err := spoolToTempFile(r)
+			if err != nil {
+				sendErr(err)
 				return
 			}
+			defer spooled.Close()
+
+			r = spooled
+			offer = &offerMsg{
+				Message: offer.Message,
+				File: &offerFile{
+					FileName: offer.File.FileName,
+					FileSize: size,
+				},
+			}
 		}
+		streaming := offer.File != nil && offer.File.Stream
 
-		var relayUrl, err = c.relayURL()
+		if offer.Message != nil && !peerVersions.has(abilityOfferMessageV1) {
+			sendErr(newTransferError(CodeProtocol, phase, ErrMessageUnsupported))
+			return
+		}
+
+		relayUrl, err := c.relayURL()
+		if err != nil {
+			sendErr(transitFailed(fmt.Errorf("Invalid relay URL")))
+			return
+		}
+		relayEndpoints, err := c.relayEndpoints()
 		if err != nil {
-			sendErr(fmt.Errorf("Invalid relay URL"))
+			sendErr(transitFailed(fmt.Errorf("Invalid relay endpoint")))
 			return
 		}
 		transitKey := deriveTransitKey(clientProto.sharedKey, appID)
-		transport := newFileTransport(transitKey, appID, relayUrl, disableListener)
+		defer wipe(transitKey)
+		transport := newFileTransport(transitKey, appID, relayUrl, disableListener, options.logger)
+		transport.policy = options.transitPolicy
+		transport.relayHandshake = options.relayHandshake
+		transport.rand = c.random()
+		transport.trace = c.protocolTrace()
+		transport.tlsPins = c.TLSPins
+		transport.timeouts = options.timeouts
+		transport.clock = options.clock
+		transport.dial = c.Dial
+		transport.relayEndpoints = relayEndpoints
 		err = transport.listen()
 		if err != nil {
-			sendErr(err)
+			sendErr(transitFailed(err))
 			return
 		}
 
 		err = transport.listenRelay()
 		if err != nil {
-			sendErr(err)
+			sendErr(transitFailed(err))
 			return
 		}
 
 		transit, err := transport.makeTransitMsg()
 		if err != nil {
-			sendErr(fmt.Errorf("make transit msg error: %s", err))
+			sendErr(transitFailed(fmt.Errorf("make transit msg error: %s", err)))
 			return
 		}
 
@@ -351,21 +453,22 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			return
 		}
 
-		gmOffer := &genericMessage{
-			Offer: offer,
-		}
-		err = clientProto.WriteAppData(ctx, gmOffer)
+		options.setOffer(offer.summary())
+		err = options.beforeOffer(ctx)
 		if err != nil {
+			abandonTransfer(ctx, clientProto)
 			sendErr(err)
 			return
 		}
 
-		collector, err := clientProto.Collect()
+		gmOffer := &genericMessage{
+			Offer: offer,
+		}
+		err = clientProto.WriteAppData(ctx, gmOffer)
 		if err != nil {
 			sendErr(err)
 			return
 		}
-		defer collector.close()
 
 		var answer answerMsg
 		err = collector.waitFor(&answer)
@@ -375,26 +478,57 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 		}
 
 		if answer.FileAck != "ok" {
-			sendErr(fmt.Errorf("unexpected answer"))
+			sendErr(newTransferError(CodeProtocol, phase, fmt.Errorf("unexpected answer")))
 			return
 		}
 
-		conn, err := transport.acceptConnection(ctx)
-		// TODO temporary logging just for debugging
-		if loggingEnabled {
-			logFunc("Connection accepted. Local address: %v, Remote address: %v",
-				conn.LocalAddr().String(), conn.RemoteAddr().String())
+		options.emit(Event{Type: EventTransitConnecting})
+		_, transitSpan := c.startSpan(ctx, &options, spanTransitConnect)
+		conn, relayed, err := transport.acceptConnection(ctx)
+		if err != nil {
+			endSpan(transitSpan, err)
+			sendErr(transitFailed(err))
+			return
 		}
+		transitSpan.SetAttributes(attrRelayed.Bool(relayed), attrRemoteAddr.String(conn.RemoteAddr().String()))
+		endSpan(transitSpan, nil)
+
+		options.emit(Event{Type: EventTransitConnected, Relayed: relayed})
+		options.connStateChanged(ConnStateChange{Layer: ConnTransit, State: ConnConnected, Relayed: relayed})
+
+		err = options.afterAnswer(ctx)
 		if err != nil {
+			conn.Close()
 			sendErr(err)
 			return
 		}
+		phase = PhaseData
+		defer func() {
+			options.connStateChanged(ConnStateChange{Layer: ConnTransit, State: ConnDisconnected, Relayed: relayed, Reason: returnErr})
+		}()
+		options.logger.Info("transit connection accepted",
+			"local", conn.LocalAddr().String(),
+			"remote", conn.RemoteAddr().String(),
+			"relayed", relayed)
 
 		cryptor := newTransportCryptor(conn, transitKey, "transit_record_receiver_key", "transit_record_sender_key")
 
-		recordSize := (1 << 14)
-		// chunk
-		recordSlice := make([]byte, recordSize-secretbox.Overhead)
+		var (
+			pw   *parallelRecordWriter
+			done chan struct{}
+		)
+		defer func() {
+			// stop everything that uses the record keys before wiping them
+			conn.Close()
+			if pw != nil {
+				pw.flush()
+			}
+			if done != nil {
+				<-done
+			}
+			cryptor.wipeKeys()
+		}()
+
 		hasher := sha256.New()
 
 		var (
@@ -407,6 +541,57 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			totalSize = offer.Directory.ZipSize
 		}
 
+		if answer.ResumeOffset > 0 {
+			if offer.File == nil || answer.ResumeOffset > totalSize {
+				sendErr(newTransferError(CodeProtocol, phase, fmt.Errorf("invalid resume offset %d", answer.ResumeOffset)))
+				return
+			}
+
+			// the receiver already has the start of the file; hash
+			// it anyway so the final sha256 covers the whole file.
+			_, err = io.CopyN(hasher, r, answer.ResumeOffset)
+			if err != nil {
+				sendErr(err)
+				return
+			}
+			progress = answer.ResumeOffset
+		}
+
+		var delta *deltaSignature
+		if answer.Delta != nil {
+			if offer.File == nil || streaming || answer.ResumeOffset > 0 {
+				sendErr(newTransferError(CodeProtocol, phase, errors.New("unexpected delta request")))
+				return
+			}
+			delta, err = readDeltaSignature(cryptor, answer.Delta)
+			if err != nil {
+				sendErr(err)
+				return
+			}
+		}
+
+		// hash each chunk in parallel with encrypting and sending it
+		hashes := newPipelinedHash(hasher, options.bufferSizeOrDefault())
+		defer hashes.stop()
+
+		var records recordWriter = cryptor
+		if options.encryptionWorkers > 1 {
+			pw = newParallelRecordWriter(cryptor, options.encryptionWorkers, options.bufferSizeOrDefault())
+			defer pw.close()
+			records = pw
+		}
+
+		tracker := newProgressTracker(options, progress, relayed)
+		stall = startStallWatcher(options, func() { conn.Close() })
+		defer stall.stop()
+
+		_, dataSpan := c.startSpan(ctx, &options, spanDataTransfer,
+			attrRelayed.Bool(relayed), attrTotalBytes.Int64(totalSize))
+		defer func() {
+			dataSpan.SetAttributes(attrBytes.Int64(progress))
+			endSpan(dataSpan, returnErr)
+		}()
+
 		go func() {
 			<-ctx.Done()
 			conn.Close()
@@ -417,10 +602,9 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			err    error
 		}
 
-		var (
-			recordChan = make(chan recordOrError)
-			done       = make(chan struct{})
-		)
+		// buffered so the reader can exit if we give up before its result
+		recordChan := make(chan recordOrError, 1)
+		done = make(chan struct{})
 
 		go func() {
 			respRec, err := cryptor.readRecord()
@@ -436,37 +620,91 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			close(done)
 		}()
 
-		for {
-			select {
-			case <-done:
-				break
-			default:
+		if delta != nil {
+			// encode reuses its buffer, so the hashes get copies
+			hashChunk := func(p []byte) {
+				for len(p) > 0 {
+					chunk := hashes.buffer()
+					n := copy(chunk, p)
+					hashes.write(chunk[:n])
+					p = p[n:]
+				}
 			}
+			err = delta.encode(r, records, hashChunk, func(n int64) {
+				progress += n
+				stall.touch()
+				tracker.update(progress, totalSize)
+			})
+			if err != nil {
+				sendErr(err)
+				return
+			}
+		} else {
+			for {
+				select {
+				case <-done:
+					break
+				default:
+				}
 
-			n, err := r.Read(recordSlice)
-
-			if n > 0 {
-				hasher.Write(recordSlice[:n])
-				err = cryptor.writeRecord(recordSlice[:n])
-				if err != nil {
+				chunk := hashes.buffer()
+				n, err := r.Read(chunk)
+
+				if n > 0 {
+					hashes.write(chunk[:n])
+					err = records.writeRecord(chunk[:n])
+					if err != nil {
+						sendErr(err)
+						return
+					}
+					progress += int64(n)
+					stall.touch()
+					tracker.update(progress, totalSize)
+				} else if err == io.EOF {
+					break
+				} else if err != nil {
 					sendErr(err)
 					return
 				}
-				progress += int64(n)
-				if options.progressFunc != nil {
-					options.progressFunc(progress, totalSize)
-				}
-			} else if err == io.EOF {
-				break
-			} else if err != nil {
+			}
+		}
+
+		if streaming {
+			// an empty record tells the receiver there is no more data
+			err = records.writeRecord(nil)
+			if err != nil {
 				sendErr(err)
 				return
 			}
 		}
 
+		shaSum := hex.EncodeToString(hashes.sum())
+		if peerVersions.has(abilityChecksumV1) {
+			trailer, err := json.Marshal(fileTransportChecksum{SHA256: shaSum})
+			if err == nil {
+				err = records.writeRecord(trailer)
+			}
+			if err != nil {
+				sendErr(err)
+				return
+			}
+		}
+
+		err = records.flush()
+		if err != nil {
+			sendErr(err)
+			return
+		}
+
+		// the ack is read by the goroutine above, which has been
+		// waiting since the data started; bound it from here on.
+		if d := options.timeouts.FinalAck; d > 0 {
+			conn.SetReadDeadline(time.Now().Add(d))
+		}
+
 		recOrErr := <-recordChan
 		if recOrErr.err != nil {
-			sendErr(err)
+			sendErr(recOrErr.err)
 			return
 		}
 
@@ -479,19 +717,25 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			return
 		}
 
+		if ack.Ack == ackRejected {
+			sendErr(newTransferError(CodeIntegrity, phase, errors.New("receiver rejected the transferred data")))
+			return
+		}
 		if ack.Ack != "ok" {
-			sendErr(errors.New("got non ok final ack from receiver"))
+			sendErr(newTransferError(CodeProtocol, phase, errors.New("got non ok final ack from receiver")))
 			return
 		}
 
-		shaSum := hex.EncodeToString(hasher.Sum(nil))
 		if strings.ToLower(ack.SHA256) != shaSum {
-			sendErr(fmt.Errorf("receiver sha256 mismatch %s vs %s", ack.SHA256, shaSum))
+			sendErr(newTransferError(CodeIntegrity, phase, fmt.Errorf("receiver sha256 mismatch %s vs %s", ack.SHA256, shaSum)))
 			return
 		}
 
+		options.emit(Event{Type: EventCompleted, Bytes: progress, Total: totalSize})
 		ch <- SendResult{
-			OK: true,
+			OK:         true,
+			TransferID: options.transferID,
+			PeerMood:   rendezvous.Happy,
 		}
 		close(ch)
 	}()
@@ -518,15 +762,37 @@ func (c *Client) SendFile(ctx context.Context, fileName string, r io.ReadSeeker,
 	return c.sendFileDirectory(ctx, offer, r, disableListener, opts...)
 }
 
+// SendStream sends the contents of r as a single file when its length
+// is not known in advance, e.g. when reading from a pipe. It returns the
+// same values as SendFile.
+//
+// If the receiver supports offers of unknown length the data is
+// streamed as it is read. Otherwise r is first copied to a temporary
+// file so that its size can be included in the offer.
+func (c *Client) SendStream(ctx context.Context, fileName string, r io.Reader, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
+	offer := &offerMsg{
+		File: &offerFile{
+			FileName: fileName,
+			Stream:   true,
+		},
+	}
+
+	return c.sendFileDirectory(ctx, offer, r, disableListener, opts...)
+}
+
 // A DirectoryEntry represents a single file to be sent by SendDirectory
 type DirectoryEntry struct {
 	// Path is the relative path to the file from the top level directory.
 	Path string
 
-	// Mode controls the permission and mode bits for the file.
+	// Mode controls the permission and mode bits for the file. If it
+	// has no permission bits, 0644 is sent. On Windows only the
+	// read-only attribute is sent, as 0444, and other files get 0644.
 	Mode os.FileMode
 
 	// Reader is a function that returns a ReadCloser for the file's content.
+	// SendDirectory compresses files in parallel, so Reader may be called
+	// concurrently for different entries.
 	Reader func() (io.ReadCloser, error)
 }
 
@@ -537,7 +803,24 @@ type DirectoryEntry struct {
 // receiver, a result channel that will be written to after the receiver attempts to read (either successfully or not)
 // and an error if one occurred.
 func (c *Client) SendDirectory(ctx context.Context, directoryName string, entries []DirectoryEntry, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
-	zipInfo, err := makeTmpZip(directoryName, entries)
+	// the zip is made before the transfer starts, so look for the mode
+	// here; sendFileDirectory applies the options again
+	options := transferOptions{directoryMode: DirectoryModeDeflated}
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	entries = filterEntries(entries, directoryName, options.ignore)
+
+	method := zip.Deflate
+	if options.directoryMode == DirectoryModeStored {
+		method = zip.Store
+	}
+
+	zipInfo, err := makeTmpZip(directoryName, entries, method)
 	if err != nil {
 		return "", nil, err
 	}
@@ -545,7 +828,7 @@ func (c *Client) SendDirectory(ctx context.Context, directoryName string, entrie
 	offer := &offerMsg{
 		Directory: &offerDirectory{
 			Dirname:  directoryName,
-			Mode:     "zipfile/deflated",
+			Mode:     string(options.directoryMode),
 			NumBytes: zipInfo.numBytes,
 			NumFiles: zipInfo.numFiles,
 			ZipSize:  zipInfo.zipSize,
@@ -568,6 +851,22 @@ func (c *Client) SendDirectory(ctx context.Context, directoryName string, entrie
 	return code, retCh, err
 }
 
+// zipEntryMode returns the mode to record in a directory zip for an
+// entry with mode, on Windows if windows is set. Windows has no POSIX
+// permissions, and Go reports 0666 for its files, or 0444 for read-only
+// ones, so only the read-only attribute is kept there. An entry without
+// permissions, such as one with a zero Mode, gets 0644.
+func zipEntryMode(mode os.FileMode, windows bool) os.FileMode {
+	perm := mode.Perm()
+	switch {
+	case windows && perm&0200 == 0:
+		perm = 0444
+	case windows || perm == 0:
+		perm = 0644
+	}
+	return mode&^os.ModePerm | perm
+}
+
 type zipResult struct {
 	file     *os.File
 	numBytes int64
@@ -575,7 +874,9 @@ type zipResult struct {
 	zipSize  int64
 }
 
-func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, error) {
+// makeTmpZip writes entries to a temporary zip file, with each entry
+// compressed using method, zip.Deflate or zip.Store.
+func makeTmpZip(directoryName string, entries []DirectoryEntry, method uint16) (*zipResult, error) {
 	f, err := ioutil.TempFile("", "wormhole-william-dir")
 	if err != nil {
 		return nil, err
@@ -596,13 +897,10 @@ func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, err
 		return nil, errors.New("directoryName must not include sub directories")
 	}
 
-	w := zip.NewWriter(f)
-
-	var totalBytes int64
-
 	prefixPath := filepath.ToSlash(directoryName) + "/"
 
-	for _, entry := range entries {
+	headers := make([]*zip.FileHeader, len(entries))
+	for i, entry := range entries {
 		entryPath := filepath.ToSlash(entry.Path)
 
 		if !strings.HasPrefix(entryPath, prefixPath) {
@@ -611,32 +909,76 @@ func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, err
 
 		header := &zip.FileHeader{
 			Name:   strings.TrimPrefix(entryPath, prefixPath),
-			Method: zip.Deflate,
+			Method: method,
 		}
 
-		header.SetMode(entry.Mode)
+		header.SetMode(zipEntryMode(entry.Mode, runtime.GOOS == "windows"))
+		headers[i] = header
+	}
 
-		f, err := w.CreateHeader(header)
-		if err != nil {
-			return nil, err
+	// compress entries in parallel, keeping a bounded window of them
+	// ahead of the one being added to the zip.
+	workers := runtime.GOMAXPROCS(0)
+	queue := make(chan *deflatedEntry, workers)
+	stop := make(chan struct{})
+	go func() {
+		defer close(queue)
+		sem := make(chan struct{}, workers)
+		for i, entry := range entries {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+			d := &deflatedEntry{header: headers[i], done: make(chan struct{})}
+			go func(open func() (io.ReadCloser, error)) {
+				d.err = d.deflate(open)
+				close(d.done)
+				<-sem
+			}(entry.Reader)
+
+			select {
+			case queue <- d:
+			case <-stop:
+				<-d.done
+				d.close()
+				return
+			}
 		}
+	}()
+	defer func() {
+		close(stop)
+		for d := range queue {
+			<-d.done
+			d.close()
+		}
+	}()
 
-		r, err := entry.Reader()
-		if err != nil {
-			return nil, err
+	w := zip.NewWriter(f)
+
+	var totalBytes int64
+
+	for d := range queue {
+		<-d.done
+		if d.err != nil {
+			d.close()
+			return nil, d.err
 		}
 
-		n, err := io.Copy(f, r)
+		fw, err := w.CreateRaw(d.header)
 		if err != nil {
+			d.close()
 			return nil, err
 		}
 
-		totalBytes += n
-
-		err = r.Close()
+		_, err = io.Copy(fw, d.data())
+		d.close()
 		if err != nil {
 			return nil, err
 		}
+
+		totalBytes += int64(d.header.UncompressedSize64)
 	}
 
 	err = w.Close()
@@ -658,6 +1000,186 @@ func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, err
 
 	return &result, nil
 }
+
+// zipDeflateLevel is the compression level the zip package uses for
+// zip.Deflate.
+const zipDeflateLevel = 5
+
+// Zip format constants that zip.Writer.CreateRaw leaves to the caller.
+const (
+	zipVersion20 = 20 // version needed to extract: deflate
+	zipVersion45 = 45 // version needed to extract: Zip64 extensions
+
+	zipDataDescriptor = 0x8 // general purpose flag: sizes follow the data
+
+	zipUint32Max = 1<<32 - 1
+)
+
+// maxInMemoryEntry is the compressed size up to which a deflatedEntry
+// is kept in memory rather than in a temporary file.
+const maxInMemoryEntry = 1 << 20
+
+var flateWriterPool sync.Pool
+
+// deflatedEntry is a directory entry compressed ahead of being added
+// to a zip with zip.Writer.CreateRaw, so that entries can be
+// compressed in parallel. Entries of stored zips are copied as they
+// are. Small entries are kept in memory; larger ones spill to an
+// unlinked temporary file.
+type deflatedEntry struct {
+	header *zip.FileHeader
+	buf    bytes.Buffer
+	file   *os.File
+	err    error
+	done   chan struct{}
+}
+
+// deflate compresses the contents of the entry, unless its header
+// says to store it, and fills in the sizes and checksum in its header.
+func (d *deflatedEntry) deflate(open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+
+	var (
+		w  io.Writer = d
+		fw *flate.Writer
+	)
+	if d.header.Method == zip.Deflate {
+		fw, _ = flateWriterPool.Get().(*flate.Writer)
+		if fw == nil {
+			fw, err = flate.NewWriter(d, zipDeflateLevel)
+			if err != nil {
+				r.Close()
+				return err
+			}
+		} else {
+			fw.Reset(d)
+		}
+		defer func() {
+			fw.Reset(ioutil.Discard)
+			flateWriterPool.Put(fw)
+		}()
+		w = fw
+	}
+
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, crc), r)
+	if err != nil {
+		r.Close()
+		return err
+	}
+
+	err = r.Close()
+	if err != nil {
+		return err
+	}
+
+	if fw != nil {
+		err = fw.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	compressed := int64(d.buf.Len())
+	if d.file != nil {
+		compressed, err = d.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		_, err = d.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.header.CRC32 = crc.Sum32()
+	d.header.CompressedSize64 = uint64(compressed)
+	d.header.UncompressedSize64 = uint64(n)
+	prepareRawZipHeader(d.header)
+	return nil
+}
+
+// Write appends compressed data to the entry, moving it to a temporary
+// file once it outgrows maxInMemoryEntry.
+func (d *deflatedEntry) Write(p []byte) (int, error) {
+	if d.file == nil && d.buf.Len()+len(p) > maxInMemoryEntry {
+		f, err := ioutil.TempFile("", "wormhole-william-entry")
+		if err != nil {
+			return 0, err
+		}
+		os.Remove(f.Name())
+		d.file = f
+
+		_, err = d.buf.WriteTo(f)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d.file != nil {
+		return d.file.Write(p)
+	}
+	return d.buf.Write(p)
+}
+
+// data returns the compressed contents of the entry.
+func (d *deflatedEntry) data() io.Reader {
+	if d.file != nil {
+		return d.file
+	}
+	return &d.buf
+}
+
+func (d *deflatedEntry) close() {
+	if d.file != nil {
+		d.file.Close()
+	}
+}
+
+// prepareRawZipHeader sets the fields of h that zip.Writer.CreateHeader
+// would set but CreateRaw does not. CreateRaw writes the sizes into the
+// local file header capped at 4GB and without a Zip64 extra field, so
+// entries of 4GB or more are given a data descriptor instead, which the
+// zip package writes with 64-bit sizes. The central directory always
+// gets Zip64 sizes for such entries.
+func prepareRawZipHeader(h *zip.FileHeader) {
+	h.CreatorVersion = h.CreatorVersion&0xff00 | zipVersion20
+	h.ReaderVersion = zipVersion20
+	h.Flags &^= zipDataDescriptor
+
+	if h.CompressedSize64 >= zipUint32Max || h.UncompressedSize64 >= zipUint32Max {
+		h.ReaderVersion = zipVersion45
+		h.Flags |= zipDataDescriptor
+	}
+}
+
+// spoolToTempFile copies r to an unlinked temporary file and returns
+// the file, positioned at its start, along with its size.
+func spoolToTempFile(r io.Reader) (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "wormhole-william-stream")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(f.Name())
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, size, nil
+}
+
 func readSeekerSize(r io.ReadSeeker) (int64, error) {
 	size, err := r.Seek(0, io.SeekEnd)
 	if err != nil {
@@ -686,3 +1208,193 @@ func validateCode(code string) error {
 	}
 	return nil
 }
+
+// pipelinedHashDepth is the number of chunks a pipelinedHash can have
+// queued or being hashed at once.
+const pipelinedHashDepth = 4
+
+// pipelinedHash feeds chunks of data to a hash in a separate
+// goroutine, so that hashing a chunk overlaps with encrypting and
+// sending it rather than holding up the record loop.
+type pipelinedHash struct {
+	h        hash.Hash
+	in       chan []byte
+	free     chan []byte
+	done     chan struct{}
+	cur      []byte
+	stopOnce sync.Once
+}
+
+func newPipelinedHash(h hash.Hash, chunkSize int) *pipelinedHash {
+	p := &pipelinedHash{
+		h:    h,
+		in:   make(chan []byte, pipelinedHashDepth),
+		free: make(chan []byte, pipelinedHashDepth),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < pipelinedHashDepth; i++ {
+		p.free <- make([]byte, chunkSize)
+	}
+	go p.run()
+	return p
+}
+
+func (p *pipelinedHash) run() {
+	defer close(p.done)
+	for chunk := range p.in {
+		p.h.Write(chunk)
+		p.free <- chunk[:cap(chunk)]
+	}
+}
+
+// buffer returns a buffer to read the next chunk into. It returns the
+// same buffer until that buffer is passed to write.
+func (p *pipelinedHash) buffer() []byte {
+	if p.cur == nil {
+		p.cur = <-p.free
+	}
+	return p.cur
+}
+
+// write queues chunk, a prefix of the buffer returned by buffer, to be
+// hashed. The caller may keep reading chunk but must not modify it.
+func (p *pipelinedHash) write(chunk []byte) {
+	p.cur = nil
+	p.in <- chunk
+}
+
+// sum waits for all queued chunks to be hashed and returns the hash.
+func (p *pipelinedHash) sum() []byte {
+	p.stop()
+	<-p.done
+	return p.h.Sum(nil)
+}
+
+// stop ends the hashing goroutine once the queued chunks are hashed.
+func (p *pipelinedHash) stop() {
+	p.stopOnce.Do(func() { close(p.in) })
+}
+
+// recordWriter sends the records of a file or directory transfer.
+// flush waits until every record passed to writeRecord has been
+// written to the connection.
+type recordWriter interface {
+	writeRecord(msg []byte) error
+	flush() error
+}
+
+// parallelRecordWriter is a recordWriter that seals records on a pool
+// of worker goroutines and writes them to the connection in order.
+type parallelRecordWriter struct {
+	cryptor *transportCryptor
+	jobs    chan *sealJob
+	ordered chan *sealJob
+	free    chan *sealJob
+	done    chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	closeOnce sync.Once
+}
+
+// sealJob is a record that is being sealed. It is reused once the
+// record has been written.
+type sealJob struct {
+	nonce  [crypto.NonceSize]byte
+	msg    []byte
+	record []byte
+	sealed chan struct{}
+}
+
+func newParallelRecordWriter(cryptor *transportCryptor, workers, chunkSize int) *parallelRecordWriter {
+	// allow two records per worker in flight so the workers are not
+	// left idle while the writer goroutine waits on the connection.
+	window := 2 * workers
+	p := &parallelRecordWriter{
+		cryptor: cryptor,
+		jobs:    make(chan *sealJob, window),
+		ordered: make(chan *sealJob, window),
+		free:    make(chan *sealJob, window),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < window; i++ {
+		p.free <- &sealJob{
+			msg:    make([]byte, 0, chunkSize),
+			record: make([]byte, 0, 4+crypto.NonceSize+chunkSize+secretbox.Overhead),
+			sealed: make(chan struct{}, 1),
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go p.seal()
+	}
+	go p.write()
+	return p
+}
+
+func (p *parallelRecordWriter) seal() {
+	for job := range p.jobs {
+		job.record = p.cryptor.sealRecord(job.record[:0], job.msg, &job.nonce)
+		job.sealed <- struct{}{}
+	}
+}
+
+func (p *parallelRecordWriter) write() {
+	defer close(p.done)
+	for job := range p.ordered {
+		<-job.sealed
+		if p.error() == nil {
+			_, err := p.cryptor.conn.Write(job.record)
+			if err != nil {
+				p.setError(err)
+			}
+		}
+		p.free <- job
+	}
+}
+
+// writeRecord queues msg to be sealed and written. The caller may
+// reuse msg once writeRecord returns. Errors writing earlier records
+// are returned by later calls.
+func (p *parallelRecordWriter) writeRecord(msg []byte) error {
+	if err := p.error(); err != nil {
+		return err
+	}
+
+	job := <-p.free
+	job.msg = append(job.msg[:0], msg...)
+	job.nonce = *p.cryptor.takeWriteNonce()
+
+	p.ordered <- job
+	p.jobs <- job
+	return nil
+}
+
+// flush waits for all queued records to be written and stops the
+// workers. writeRecord must not be called after flush.
+func (p *parallelRecordWriter) flush() error {
+	p.close()
+	<-p.done
+	return p.error()
+}
+
+// close stops the workers once the queued records are sealed, without
+// waiting for them to be written.
+func (p *parallelRecordWriter) close() {
+	p.closeOnce.Do(func() {
+		close(p.jobs)
+		close(p.ordered)
+	})
+}
+
+func (p *parallelRecordWriter) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *parallelRecordWriter) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
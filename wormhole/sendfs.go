@@ -0,0 +1,56 @@
+//go:build go1.16
+// +build go1.16
+
+package wormhole
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+)
+
+// SendDirectoryFS sends the files of fsys to a receiving client as the
+// directory directoryName, like SendDirectory. fsys can be any file
+// system, such as an embed.FS or the result of fs.Sub; use fs.Sub to
+// send a subtree. Only regular files and the directories holding them
+// are sent.
+//
+// Files keep the permissions fsys reports for them, so files from an
+// embed.FS, which are all 0444, arrive read-only.
+func (c *Client) SendDirectoryFS(ctx context.Context, directoryName string, fsys fs.FS, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
+	entries, err := DirectoryEntriesFS(fsys, directoryName)
+	if err != nil {
+		return "", nil, err
+	}
+	return c.SendDirectory(ctx, directoryName, entries, disableListener, opts...)
+}
+
+// DirectoryEntriesFS returns the entries for sending the regular files
+// of fsys as the directory directoryName with SendDirectory, for
+// callers that want to add to or filter them first. The files are
+// opened when SendDirectory reads them.
+func DirectoryEntriesFS(fsys fs.FS, directoryName string) ([]DirectoryEntry, error) {
+	var entries []DirectoryEntry
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, DirectoryEntry{
+			Path: path.Join(directoryName, p),
+			Mode: info.Mode(),
+			Reader: func() (io.ReadCloser, error) {
+				return fsys.Open(p)
+			},
+		})
+		return nil
+	})
+	return entries, err
+}
@@ -0,0 +1,103 @@
+//go:build go1.16
+// +build go1.16
+
+package wormhole
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
+)
+
+// The SendDirectoryFS tests live here rather than with the other
+// SendDirectory tests in wormhole_test.go because they need io/fs,
+// which CI's Go 1.15 job can't build.
+
+func TestSendDirectoryFS(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = rs.WebSocketURL()
+
+	var c1 Client
+	c1.RendezvousURL = rs.WebSocketURL()
+
+	fsys := fstest.MapFS{
+		"site/index.html":      {Data: []byte("<h1>hi</h1>"), Mode: 0644},
+		"site/css/style.css":   {Data: []byte("h1 {}"), Mode: 0444},
+		"site/link":            {Data: []byte("index.html"), Mode: fs.ModeSymlink},
+		"site/empty/.keep":     {Mode: 0600},
+		"other/not-sent.txt":   {Data: []byte("nope")},
+		"site/scripts/main.js": {Data: []byte("main()"), Mode: 0755},
+	}
+	site, err := fs.Sub(fsys, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := DirectoryEntriesFS(site, "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	expectPaths := []string{"site/css/style.css", "site/empty/.keep", "site/index.html", "site/scripts/main.js"}
+	if !reflect.DeepEqual(paths, expectPaths) {
+		t.Fatalf("Expected entries %q but got %q", expectPaths, paths)
+	}
+
+	code, resultCh, err := c0.SendDirectoryFS(ctx, "site", site, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Name != "site" || msg.FileCount != 4 {
+		t.Fatalf("Unexpected offer %s with %d files", msg.Name, msg.FileCount)
+	}
+
+	type file struct {
+		data string
+		mode os.FileMode
+	}
+	got := make(map[string]file)
+	err = msg.EachFile("", func(f *ReceivedFile, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		got[f.Path] = file{string(data), f.Mode.Perm()}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]file{
+		"index.html":      {"<h1>hi</h1>", 0644},
+		"css/style.css":   {"h1 {}", 0444},
+		"empty/.keep":     {"", 0600},
+		"scripts/main.js": {"main()", 0755},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Expected %v but got %v", expect, got)
+	}
+
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
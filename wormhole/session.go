@@ -0,0 +1,641 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/psanford/wormhole-william/rendezvous"
+)
+
+// ErrSessionClosed is returned by the methods of a Session after Close.
+var ErrSessionClosed = errors.New("session closed")
+
+var errSessionNotEstablished = errors.New("session not established")
+
+// A Session is an encrypted channel to a peer over a rendezvous
+// mailbox, without the file transfer protocol on top. Applications can
+// use it to build their own protocols on magic wormhole, such as
+// device pairing or key exchange, the way the generic API of the
+// Python implementation is used.
+//
+// One side creates the session with NewSession and gives the code to
+// the other, which joins it with JoinSession. Both then call Establish
+// and exchange messages with Send and Receive. Messages are delivered
+// in order, each at most once. They pass through the rendezvous
+// server, so they should be small; use SendFile or SendStream for bulk
+// data.
+//
+// Send and Receive may be called concurrently with each other, but
+// each must not be called concurrently with itself.
+type Session struct {
+	c       *Client
+	rc      *rendezvous.Client
+	cp      *clientProtocol
+	code    string
+	options transferOptions
+
+	sendMu sync.Mutex
+
+	recvMu  sync.Mutex
+	nextIn  int
+	pending map[int][]byte
+
+	// connects counts the calls to Connect, so that each transit
+	// connection gets its own key.
+	connects int
+
+	mu          sync.Mutex
+	established bool
+	err         error
+	closed      bool
+	done        chan struct{}
+}
+
+// NewSession claims a nameplate on the rendezvous server and opens a
+// session on its mailbox. The code for the peer to pass to JoinSession
+// is allocated like that of SendText, or set with WithCode.
+//
+// Of the TransferOptions, only WithCode, WithInvite, WithPairingSecret,
+// WithVersionPolicy, WithEvents and, for Connect, WithTransitPolicy and
+// WithRelayHandshake apply to sessions.
+func (c *Client) NewSession(ctx context.Context, opts ...TransferOption) (*Session, error) {
+	options, err := c.sessionOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if options.invite && options.code == "" {
+		return nil, errInviteWithoutCode
+	}
+	if options.code != "" && !options.invite {
+		if err := c.checkCodeReuse(sideSend, options.code); err != nil {
+			return nil, err
+		}
+	}
+	sideID, err := c.beginTransfer(&options, sideSend)
+	if err != nil {
+		return nil, err
+	}
+
+	code, rc, err := c.createOrAttachMailbox(ctx, sideID, c.AppID, options.code, &options)
+	if err != nil {
+		options.end(err)
+		return nil, err
+	}
+	options.emit(Event{Type: EventCodeAllocated, Code: code})
+
+	return c.newSession(rc, sideID, code, options), nil
+}
+
+// JoinSession joins the session that the peer created with NewSession
+// and gave code for.
+func (c *Client) JoinSession(ctx context.Context, code string, opts ...TransferOption) (_ *Session, returnErr error) {
+	options, err := c.sessionOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if options.pairing {
+		if code != "" {
+			return nil, errPairingWithCode
+		}
+		code = options.code
+	}
+	if !options.invite {
+		if err := c.checkCodeReuse(sideReceive, code); err != nil {
+			return nil, err
+		}
+	}
+	sideID, err := c.beginTransfer(&options, sideReceive)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := c.newRendezvousClient(sideID, c.AppID, &options)
+	defer func() {
+		if returnErr != nil {
+			options.end(returnErr)
+			rc.Close(ctx, rendezvous.Errory)
+		}
+	}()
+
+	nameplate, err := nameplateFromCode(code)
+	if err != nil {
+		return nil, newTransferError(CodeWrongCode, PhaseRendezvous, err)
+	}
+	options.audit.setNameplate(nameplate)
+
+	err = c.attachReceiveMailbox(ctx, rc, nameplate, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.newSession(rc, sideID, code, options), nil
+}
+
+func (c *Client) sessionOptions(opts []TransferOption) (transferOptions, error) {
+	var options transferOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return options, err
+		}
+	}
+	if options.strictVerification {
+		return options, errors.New("WithStrictVerification is not supported by sessions")
+	}
+	return options, nil
+}
+
+func (c *Client) newSession(rc *rendezvous.Client, sideID, code string, options transferOptions) *Session {
+	// The mailbox is read for as long as the session is open, not
+	// just for the call that opened it.
+	cp := newClientProtocol(context.Background(), rc, sideID, c.AppID)
+	cp.rand = c.random()
+	cp.onTampering = options.tampering
+	cp.peerTimeout = options.timeouts.Peer
+	cp.clock = options.clock
+
+	return &Session{
+		c:       c,
+		rc:      rc,
+		cp:      cp,
+		code:    code,
+		options: options,
+		pending: make(map[int][]byte),
+		done:    make(chan struct{}),
+	}
+}
+
+// Code returns the session's nameplate+passphrase code.
+func (s *Session) Code() string {
+	return s.code
+}
+
+// TransferID returns the ID identifying the session in events, audit
+// records and logs.
+func (s *Session) TransferID() string {
+	return s.options.transferID
+}
+
+// Establish runs the PAKE and version exchanges with the peer, after
+// which the session is encrypted with a key only the two sides know.
+// If the Client has a VerifierOk callback, it is asked to approve the
+// verifier before Establish returns.
+//
+// If Establish fails, the session is closed and its error is a
+// *TransferError; a wrong code fails with CodeWrongCode.
+func (s *Session) Establish(ctx context.Context) (err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSessionClosed
+	}
+	if s.established {
+		s.mu.Unlock()
+		return errors.New("session already established")
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			err = transferError(PhasePake, err)
+			s.fail(ctx, err)
+		}
+	}()
+
+	err = s.c.exchangePake(ctx, s.cp, s.code, &s.options)
+	if err != nil {
+		return err
+	}
+	s.options.emit(Event{Type: EventPakeComplete})
+
+	err = s.exchangeVersions(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.options.emitVerifier(s.cp)
+	if s.c.VerifierOk != nil {
+		verifier, err := s.cp.Verifier()
+		if err != nil {
+			return err
+		}
+		if !s.c.VerifierOk(hex.EncodeToString(verifier)) {
+			return newTransferError(CodeVerifierRejected, PhasePake, errors.New(verifierRejectedMsg))
+		}
+	}
+
+	s.recvMu.Lock()
+	for _, msg := range s.cp.early {
+		if err := s.stash(msg); err != nil {
+			s.recvMu.Unlock()
+			return err
+		}
+	}
+	s.cp.early = nil
+	s.recvMu.Unlock()
+
+	s.mu.Lock()
+	s.established = true
+	s.mu.Unlock()
+	return nil
+}
+
+// exchangeVersions is Client.exchangeVersions for a session, which
+// advertises none of the file transfer abilities.
+func (s *Session) exchangeVersions(ctx context.Context) (err error) {
+	_, span := s.c.startSpan(ctx, &s.options, spanVersionExchange)
+	defer func() { endSpan(span, err) }()
+
+	err = s.cp.writeVersion(ctx, nil)
+	if err != nil {
+		return err
+	}
+	versions, err := s.cp.ReadVersion()
+	if err != nil {
+		return err
+	}
+	if s.options.versionPolicy != nil {
+		err = s.options.versionPolicy.check(versions)
+		if err != nil {
+			return newTransferError(CodeProtocol, PhasePake, err)
+		}
+	}
+	return nil
+}
+
+// Verifier returns the hex encoded verifier of the session key, for
+// the users of both sides to compare out of band. It fails until
+// Establish has run the PAKE exchange.
+func (s *Session) Verifier() (string, error) {
+	verifier, err := s.cp.Verifier()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(verifier), nil
+}
+
+// DeriveKey derives a 32 byte key for purpose from the session key,
+// for the application to secure its own channels to the peer with. The
+// peer derives the same key for the same purpose, and keys for
+// different purposes are unrelated. Purposes should be namespaced by
+// the application, like the app ID.
+//
+// DeriveKey returns nil unless the session is established and not yet
+// closed.
+func (s *Session) DeriveKey(purpose string) []byte {
+	// Close wipes the key while holding sendMu
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if s.usable() != nil {
+		return nil
+	}
+	return deriveKey(s.cp.sharedKey, purpose)
+}
+
+// Send sends msg to the peer, encrypted with the session key.
+func (s *Session) Send(ctx context.Context, msg []byte) error {
+	if err := s.usable(); err != nil {
+		return err
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	phase := strconv.Itoa(s.cp.phaseCounter)
+	s.cp.phaseCounter++
+
+	err := sendEncryptedMessage(ctx, s.rc, s.cp.rand, msg, s.cp.sharedKey, s.cp.sideID, phase)
+	if err != nil {
+		return transferError(PhaseData, err)
+	}
+	return nil
+}
+
+// Receive returns the next message from the peer, waiting for it until
+// ctx is done. A message that fails to decrypt or shows signs of
+// tampering fails the session, closing it.
+func (s *Session) Receive(ctx context.Context) (_ []byte, err error) {
+	if err := s.usable(); err != nil {
+		return nil, err
+	}
+
+	var fatal error
+	defer func() {
+		// after recvMu is released, for Close
+		if fatal != nil {
+			s.fail(ctx, fatal)
+		}
+	}()
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	for {
+		if msg, ok := s.pending[s.nextIn]; ok {
+			delete(s.pending, s.nextIn)
+			s.nextIn++
+			return msg, nil
+		}
+
+		var (
+			gotMsg rendezvous.MailboxEvent
+			ok     bool
+		)
+		select {
+		case gotMsg, ok = <-s.cp.ch:
+		case <-ctx.Done():
+			return nil, transferError(PhaseData, ctx.Err())
+		case <-s.done:
+			return nil, ErrSessionClosed
+		}
+		if !ok {
+			select {
+			case <-s.done:
+				return nil, ErrSessionClosed
+			default:
+			}
+			gotMsg.Error = io.ErrUnexpectedEOF
+		}
+		if gotMsg.Error != nil {
+			return nil, transferError(PhaseData, gotMsg.Error)
+		}
+
+		err := s.cp.checkMessage(gotMsg)
+		if err == nil {
+			err = s.stash(gotMsg)
+		}
+		if err != nil {
+			fatal = transferError(PhaseData, err)
+			return nil, fatal
+		}
+	}
+}
+
+// maxPendingMessages is the most messages a session holds that arrived
+// ahead of one that has not. The mailbox keeps messages in order, so a
+// well behaved peer never needs any.
+const maxPendingMessages = 64
+
+// stash decrypts the peer's message msg into s.pending. s.recvMu must
+// be held.
+func (s *Session) stash(msg rendezvous.MailboxEvent) error {
+	n, err := strconv.Atoi(msg.Phase)
+	if err != nil || n < s.nextIn || n >= s.nextIn+maxPendingMessages {
+		return newTransferError(CodeProtocol, PhaseData, fmt.Errorf("unexpected phase %q", msg.Phase))
+	}
+	body, err := openMessage(msg, s.cp.sharedKey)
+	if err != nil {
+		return err
+	}
+	s.pending[n] = body
+	return nil
+}
+
+// Connect makes a transit connection to the peer, directly or through
+// the transit relay as a file transfer does, and returns it as a
+// stream encrypted with a key derived from the session's. Unlike
+// messages, data sent on the connection does not pass through the
+// rendezvous server.
+//
+// Connect sends the peer one message and receives one, so both sides
+// must call it at the same point in their exchange of messages, and not
+// while a Receive is in progress. The connection stays usable after
+// the session is closed.
+func (s *Session) Connect(ctx context.Context) (_ net.Conn, err error) {
+	defer func() {
+		err = transferError(PhaseTransit, err)
+	}()
+
+	relayURL, err := s.c.relayURL()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid relay URL")
+	}
+	relayEndpoints, err := s.c.relayEndpoints()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid relay endpoint")
+	}
+
+	s.sendMu.Lock()
+	if err := s.usable(); err != nil {
+		s.sendMu.Unlock()
+		return nil, err
+	}
+	transitKey := deriveKey(s.cp.sharedKey, fmt.Sprintf("%s/session-transit-key/%d", s.c.AppID, s.connects))
+	s.connects++
+	s.sendMu.Unlock()
+	defer wipe(transitKey)
+
+	// the side that made the session listens, like a sender
+	accept := s.options.side == sideSend
+	transport := newFileTransport(transitKey, s.c.AppID, relayURL, !accept || s.c.Dial != nil, s.options.logger)
+	transport.policy = s.options.transitPolicy
+	transport.relayHandshake = s.options.relayHandshake
+	transport.rand = s.c.random()
+	transport.trace = s.c.protocolTrace()
+	transport.tlsPins = s.c.TLSPins
+	transport.timeouts = s.options.timeouts
+	transport.clock = s.options.clock
+	transport.dial = s.c.Dial
+	transport.relayEndpoints = relayEndpoints
+	if accept {
+		err = transport.listen()
+		if err != nil {
+			return nil, transitFailed(err)
+		}
+		err = transport.listenRelay()
+		if err != nil {
+			return nil, transitFailed(err)
+		}
+	}
+
+	ours, err := transport.makeTransitMsg()
+	if err != nil {
+		return nil, transitFailed(fmt.Errorf("make transit msg error: %s", err))
+	}
+	out, err := json.Marshal(ours)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Send(ctx, out)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := s.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var theirs transitMsg
+	err = json.Unmarshal(in, &theirs)
+	if err != nil {
+		return nil, newTransferError(CodeProtocol, PhaseTransit, fmt.Errorf("bad transit message: %w", err))
+	}
+
+	s.options.emit(Event{Type: EventTransitConnecting})
+	_, span := s.c.startSpan(ctx, &s.options, spanTransitConnect)
+	var (
+		conn    net.Conn
+		relayed bool
+	)
+	if accept {
+		conn, relayed, err = transport.acceptConnection(ctx)
+	} else {
+		conn, relayed, err = transport.connect(ours, &theirs)
+	}
+	if err != nil {
+		endSpan(span, err)
+		return nil, transitFailed(err)
+	}
+	span.SetAttributes(attrRelayed.Bool(relayed), attrRemoteAddr.String(conn.RemoteAddr().String()))
+	endSpan(span, nil)
+	s.options.emit(Event{Type: EventTransitConnected, Relayed: relayed})
+
+	readPurpose, writePurpose := "transit_record_sender_key", "transit_record_receiver_key"
+	if accept {
+		readPurpose, writePurpose = writePurpose, readPurpose
+	}
+	return &transitConn{
+		Conn:    conn,
+		cryptor: newTransportCryptor(conn, transitKey, readPurpose, writePurpose),
+	}, nil
+}
+
+// maxTransitConnRecord is the most data a transitConn sends in one
+// record.
+const maxTransitConnRecord = 64 << 10
+
+// transitConn is a transit connection as a net.Conn, which sends what
+// is written to it in records. The embedded Conn provides the
+// addresses and deadlines.
+type transitConn struct {
+	net.Conn
+	cryptor *transportCryptor
+
+	readMu sync.Mutex
+	buf    []byte
+
+	writeMu sync.Mutex
+
+	closeOnce sync.Once
+}
+
+func (c *transitConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.buf) == 0 {
+		rec, err := c.cryptor.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.buf = rec
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *transitConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxTransitConnRecord {
+			n = maxTransitConnRecord
+		}
+		err := c.cryptor.writeRecord(p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the connection and wipes its keys once nothing is
+// reading or writing records.
+func (c *transitConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.readMu.Lock()
+		c.writeMu.Lock()
+		c.cryptor.wipeKeys()
+		c.writeMu.Unlock()
+		c.readMu.Unlock()
+	})
+	return err
+}
+
+// usable returns an error if messages cannot be sent or received.
+func (s *Session) usable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closed:
+		return ErrSessionClosed
+	case !s.established:
+		return errSessionNotEstablished
+	}
+	return nil
+}
+
+// fail closes the session after err, with the mood err calls for.
+func (s *Session) fail(ctx context.Context, err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.Close(ctx)
+}
+
+// Close closes the mailbox and wipes the session key. The mood the
+// mailbox is closed with is happy unless the session failed. Close
+// stops any Receive in progress; calling it more than once does
+// nothing.
+func (s *Session) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.err
+	close(s.done)
+	s.mu.Unlock()
+
+	mood := rendezvous.Happy
+	if err != nil {
+		mood = rendezvous.Errory
+		if isScary(err) {
+			mood = rendezvous.Scary
+		}
+		s.options.emit(Event{Type: EventFailed, Err: err})
+	} else {
+		s.options.emit(Event{Type: EventCompleted})
+	}
+	closeErr := s.rc.Close(ctx, mood)
+
+	// the mailbox reader only stops once it can hand over what it has
+	go func(ch <-chan rendezvous.MailboxEvent) {
+		for range ch {
+		}
+	}(s.cp.ch)
+
+	s.sendMu.Lock()
+	s.recvMu.Lock()
+	s.cp.wipeKeys()
+	s.recvMu.Unlock()
+	s.sendMu.Unlock()
+
+	return closeErr
+}
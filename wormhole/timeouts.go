@@ -0,0 +1,86 @@
+package wormhole
+
+import (
+	"errors"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/clock"
+)
+
+// Timeouts bounds how long a transfer waits on the network, so that a
+// silent rendezvous server, relay or peer fails the transfer with
+// CodeTimeout instead of hanging it, even if the context passed in has
+// no deadline. A zero field uses the default given for it; a negative
+// one disables that timeout.
+type Timeouts struct {
+	// Rendezvous bounds each request to the rendezvous server, from
+	// connecting or sending it to reading the server's reply.
+	// Default 1 minute.
+	Rendezvous time.Duration
+
+	// Peer bounds waiting for each mailbox message from the peer, and
+	// for the peer to open the transit connection. It does not apply to
+	// waiting for the peer's first message, which takes as long as the
+	// code takes to get to the other person; use the context for that.
+	// The peer's user may need to check the verifier or accept the
+	// offer in between messages, so the default is 10 minutes.
+	Peer time.Duration
+
+	// Handshake bounds each read of the transit handshake. Default 30
+	// seconds.
+	Handshake time.Duration
+
+	// Record bounds each read of a record of file or directory data by
+	// the receiver. Default 2 minutes.
+	Record time.Duration
+
+	// FinalAck bounds the sender's wait for the receiver to acknowledge
+	// the data, from when the last record has been sent. Default 2
+	// minutes.
+	FinalAck time.Duration
+}
+
+const (
+	defaultRendezvousTimeout = time.Minute
+	defaultPeerTimeout       = 10 * time.Minute
+	defaultRecordTimeout     = 2 * time.Minute
+	defaultFinalAckTimeout   = 2 * time.Minute
+)
+
+// ErrPeerTimeout is the error a transfer fails with when the peer
+// sends nothing for the Peer timeout while a mailbox message is
+// expected from it.
+var ErrPeerTimeout = errors.New("timed out waiting for peer")
+
+// resolve returns t with zero fields set to their defaults and
+// disabled ones set to zero, which is how the rest of the package
+// reads them.
+func (t Timeouts) resolve() Timeouts {
+	return Timeouts{
+		Rendezvous: resolveTimeout(t.Rendezvous, defaultRendezvousTimeout),
+		Peer:       resolveTimeout(t.Peer, defaultPeerTimeout),
+		Handshake:  resolveTimeout(t.Handshake, handshakeTimeout),
+		Record:     resolveTimeout(t.Record, defaultRecordTimeout),
+		FinalAck:   resolveTimeout(t.FinalAck, defaultFinalAckTimeout),
+	}
+}
+
+func resolveTimeout(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+// peerTimer returns a channel that fires after d on clk, and a
+// function to stop it. The channel never fires if d is zero.
+func peerTimer(clk clock.Clock, d time.Duration) (<-chan time.Time, func() bool) {
+	if d <= 0 {
+		return nil, func() bool { return false }
+	}
+	t := clk.NewTimer(d)
+	return t.C(), t.Stop
+}
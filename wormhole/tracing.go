@@ -0,0 +1,110 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+
+	"github.com/psanford/wormhole-william/internal/redact"
+	"github.com/psanford/wormhole-william/version"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/psanford/wormhole-william/wormhole"
+
+// Span names for the phases of a transfer.
+const (
+	spanRendezvousConnect = "wormhole.rendezvous.connect"
+	spanPake              = "wormhole.pake"
+	spanVersionExchange   = "wormhole.version_exchange"
+	spanTransitConnect    = "wormhole.transit.connect"
+	spanDataTransfer      = "wormhole.transfer"
+)
+
+// Span attribute keys.
+const (
+	attrSide          = attribute.Key("wormhole.side")
+	attrTransferID    = attribute.Key("wormhole.transfer.id")
+	attrRendezvousURL = attribute.Key("wormhole.rendezvous.url")
+	attrNameplate     = attribute.Key("wormhole.nameplate")
+	attrTransferType  = attribute.Key("wormhole.transfer.type")
+	attrRelayed       = attribute.Key("wormhole.transit.relayed")
+	attrRemoteAddr    = attribute.Key("wormhole.transit.remote_addr")
+	attrBytes         = attribute.Key("wormhole.transfer.bytes")
+	attrTotalBytes    = attribute.Key("wormhole.transfer.total_bytes")
+)
+
+func (c *Client) tracer() trace.Tracer {
+	tp := c.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName, trace.WithInstrumentationVersion(version.AgentVersion))
+}
+
+// startSpan starts a span for one phase of a transfer as a child of
+// any span in ctx.
+func (c *Client) startSpan(ctx context.Context, options *transferOptions, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return c.tracer().Start(ctx, name,
+		trace.WithAttributes(attrSide.String(options.side), attrTransferID.String(options.transferID)),
+		trace.WithAttributes(attrs...))
+}
+
+// endSpan marks span as failed if err is non-nil and ends it. Spans
+// are exported, so secrets are scrubbed from the error first.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		if msg := redact.String(err.Error()); msg != err.Error() {
+			err = errors.New(msg)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// exchangePake runs the PAKE exchange with the peer inside a span.
+func (c *Client) exchangePake(ctx context.Context, cp *clientProtocol, code string, options *transferOptions) (err error) {
+	_, span := c.startSpan(ctx, options, spanPake)
+	defer func() { endSpan(span, err) }()
+
+	c.rememberCode(options.side, code)
+
+	err = cp.WritePake(ctx, code)
+	if err != nil {
+		return err
+	}
+	return cp.ReadPake(ctx)
+}
+
+// exchangeVersions sends our app versions to the peer and reads
+// theirs inside a span, checking them against any VersionPolicy.
+func (c *Client) exchangeVersions(ctx context.Context, cp *clientProtocol, options *transferOptions) (_ *appVersionsMsg, err error) {
+	_, span := c.startSpan(ctx, options, spanVersionExchange)
+	defer func() { endSpan(span, err) }()
+
+	err = cp.WriteVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := cp.ReadVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.versionPolicy != nil {
+		err = options.versionPolicy.check(versions)
+		if err != nil {
+			errMsg := versionMismatchMsg
+			writeErr := cp.WriteAppData(ctx, &genericMessage{
+				Error: &errMsg,
+			})
+			if writeErr != nil {
+				return nil, writeErr
+			}
+			return nil, newTransferError(CodeProtocol, PhasePake, err)
+		}
+	}
+	return versions, nil
+}
@@ -0,0 +1,25 @@
+//go:build js || wormhole_relayonly
+// +build js wormhole_relayonly
+
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// relayOnly is set in builds where raw TCP isn't available (js/wasm, or
+// the wormhole_relayonly build tag). All transit then goes through a
+// WebSocket relay.
+const relayOnly = true
+
+var errRelayOnly = errors.New("tcp connections are not supported in relay-only builds")
+
+func listenTCP() (net.Listener, error) {
+	return nil, errRelayOnly
+}
+
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, errRelayOnly
+}
@@ -0,0 +1,23 @@
+//go:build !js && !wormhole_relayonly
+// +build !js,!wormhole_relayonly
+
+package wormhole
+
+import (
+	"context"
+	"net"
+)
+
+// relayOnly is set in builds where raw TCP isn't available (js/wasm, or
+// the wormhole_relayonly build tag). All transit then goes through a
+// WebSocket relay.
+const relayOnly = false
+
+func listenTCP() (net.Listener, error) {
+	return net.Listen("tcp", ":0")
+}
+
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
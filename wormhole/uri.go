@@ -0,0 +1,104 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TransferURIScheme is the scheme of the URIs described in the
+// magic-wormhole-protocols uri-scheme document, which carry a code and
+// the server to use it with. They let codes be shared as links or QR
+// codes that mobile clients open instead of having the code typed in.
+const TransferURIScheme = "wormhole-transfer"
+
+// transferURIVersion is the only version of the URI format there is.
+const transferURIVersion = "0"
+
+// ErrNotTransferURI is returned by ParseTransferURI for strings that
+// are not wormhole-transfer URIs, such as a plain code.
+var ErrNotTransferURI = errors.New("not a " + TransferURIScheme + " URI")
+
+// TransferURI is a parsed wormhole-transfer URI.
+type TransferURI struct {
+	// Code is the wormhole code.
+	Code string
+
+	// RendezvousURL is the rendezvous server the code was allocated
+	// on. It is empty if the URI doesn't name one, in which case the
+	// default server is meant.
+	RendezvousURL string
+
+	// Leader is set for URIs with role=leader rather than the default
+	// role=follower. Clients that show and scan these URIs use the role
+	// to agree which of them leads the exchange.
+	Leader bool
+}
+
+// String returns u as a URI, in the form other implementations
+// generate and parse:
+//
+//	wormhole-transfer:4-purple-sausages?version=0&rendezvous=ws%3A%2F%2F...
+func (u TransferURI) String() string {
+	params := url.Values{}
+	params.Set("version", transferURIVersion)
+	if u.RendezvousURL != "" {
+		params.Set("rendezvous", u.RendezvousURL)
+	}
+	if u.Leader {
+		params.Set("role", "leader")
+	}
+
+	uri := url.URL{
+		Scheme:   TransferURIScheme,
+		Opaque:   url.PathEscape(u.Code),
+		RawQuery: params.Encode(),
+	}
+	return uri.String()
+}
+
+// ParseTransferURI parses a wormhole-transfer URI. It returns
+// ErrNotTransferURI if s does not use the scheme, and an error for
+// URIs of a version or role it doesn't know. Unknown parameters are
+// ignored.
+func ParseTransferURI(s string) (*TransferURI, error) {
+	if !strings.HasPrefix(strings.ToLower(s), TransferURIScheme+":") {
+		return nil, ErrNotTransferURI
+	}
+
+	uri, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s URI: %w", TransferURIScheme, err)
+	}
+	if uri.Opaque == "" {
+		return nil, fmt.Errorf("invalid %s URI: no code", TransferURIScheme)
+	}
+
+	code, err := url.PathUnescape(uri.Opaque)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s URI: %w", TransferURIScheme, err)
+	}
+	if err := validateCode(code); err != nil {
+		return nil, fmt.Errorf("invalid %s URI: %w", TransferURIScheme, err)
+	}
+
+	params := uri.Query()
+	if v := params.Get("version"); v != "" && v != transferURIVersion {
+		return nil, fmt.Errorf("unsupported %s URI version %q", TransferURIScheme, v)
+	}
+
+	u := TransferURI{
+		Code:          code,
+		RendezvousURL: params.Get("rendezvous"),
+	}
+	switch role := params.Get("role"); role {
+	case "", "follower":
+	case "leader":
+		u.Leader = true
+	default:
+		return nil, fmt.Errorf("unknown %s URI role %q", TransferURIScheme, role)
+	}
+
+	return &u, nil
+}
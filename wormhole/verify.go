@@ -0,0 +1,75 @@
+package wormhole
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+)
+
+var errStrictVerifierOk = errors.New("WithStrictVerification requires a VerifierOk callback")
+
+// verify checks the session verifier with c.VerifierOk, telling the
+// peer if the check failed and, if the peer supports it, that it
+// passed. With WithStrictVerification it fails before asking if the
+// peer cannot confirm its own check.
+func (c *Client) verify(ctx context.Context, cp *clientProtocol, peerVersions *appVersionsMsg, options *transferOptions) error {
+	options.emitVerifier(cp)
+
+	peerConfirms := peerVersions.has(abilityVerifyV1)
+	if options.strictVerification && !peerConfirms {
+		return abandonUnverified(ctx, cp, newTransferError(CodeProtocol, PhasePake, ErrVerificationUnsupported))
+	}
+
+	if c.VerifierOk != nil {
+		verifier, err := cp.Verifier()
+		if err != nil {
+			return err
+		}
+
+		if ok := c.VerifierOk(hex.EncodeToString(verifier)); !ok {
+			errMsg := verifierRejectedMsg
+			writeErr := cp.WriteAppData(ctx, &genericMessage{
+				Error: &errMsg,
+			})
+			if writeErr != nil {
+				return writeErr
+			}
+
+			return newTransferError(CodeVerifierRejected, PhasePake, errors.New(errMsg))
+		}
+	}
+
+	if !peerConfirms {
+		return nil
+	}
+	return cp.WriteAppData(ctx, &genericMessage{
+		Verified: &verifiedMsg{Checked: c.VerifierOk != nil},
+	})
+}
+
+// waitVerified waits for the peer to confirm that its VerifierOk
+// callback approved the verifier, for WithStrictVerification.
+func waitVerified(ctx context.Context, cp *clientProtocol, collector *msgCollector) error {
+	var verified verifiedMsg
+	err := collector.waitFor(&verified)
+	if err != nil {
+		return err
+	}
+	if !verified.Checked {
+		return abandonUnverified(ctx, cp, newTransferError(CodeVerifierRejected, PhasePake, ErrPeerUnverified))
+	}
+	return nil
+}
+
+// abandonUnverified tells the peer that the transfer is abandoned
+// because the verifier could not be confirmed, and returns err.
+func abandonUnverified(ctx context.Context, cp *clientProtocol, err error) error {
+	errMsg := verificationRequiredMsg
+	writeErr := cp.WriteAppData(ctx, &genericMessage{
+		Error: &errMsg,
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
@@ -3,20 +3,26 @@ package wormhole
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/psanford/wormhole-william/internal/clock"
 	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/internal/prototrace"
 	"github.com/psanford/wormhole-william/rendezvous"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
 	"salsa.debian.org/vasudev/gospake2"
@@ -38,6 +44,13 @@ type Client struct {
 	// If empty, DefaultTransitRelayURL will be used.
 	TransitRelayURL string
 
+	// TransitRelayEndpoints lists other addresses of the same relay as
+	// TransitRelayURL, such as the websocket endpoint of a relay that
+	// also listens on TCP. They are offered to the peer as endpoints of
+	// a single relay-v1 hint, as the python client does, so that the
+	// peer can use whichever it supports.
+	TransitRelayEndpoints []string
+
 	// PassPhraseComponentLength is the number of words to use
 	// when generating a passprase. Any value less than 2 will
 	// default to 2.
@@ -51,7 +64,105 @@ type Client struct {
 	// can then prompt the user to confirm the code matches via an out
 	// of band mechanism before proceeding with the file transmission.
 	// If VerifierOk returns false the transmission will be aborted.
+	// Each side only waits for its own VerifierOk; use
+	// WithStrictVerification to also wait for the peer's.
 	VerifierOk func(verifier string) bool
+
+	// Logger receives diagnostic messages from the rendezvous and
+	// transit parts of a transfer. If nil, nothing is logged.
+	Logger Logger
+
+	// TracerProvider, if set, is used to create OpenTelemetry spans for
+	// the phases of each transfer: rendezvous connect, PAKE, version
+	// exchange, transit connection and data transfer. Spans are
+	// children of any span in the context passed to SendText, SendFile,
+	// SendDirectory, SendStream or Receive.
+	TracerProvider trace.TracerProvider
+
+	// AuditLog, if set, receives one JSON encoded AuditRecord line per
+	// transfer once it has finished, succeeded or not. Each record is
+	// written with a single call to Write; if the Client is used for
+	// concurrent transfers AuditLog must be safe for concurrent use.
+	AuditLog io.Writer
+
+	// ProtocolTrace, if set, receives a debugging trace of every
+	// rendezvous and transit protocol message, one JSON object per
+	// line. Encrypted mailbox bodies, transit keys and file data are
+	// left out, so traces are suitable for attaching to bug reports.
+	ProtocolTrace io.Writer
+
+	// ConnStateHook, if set, is called whenever the rendezvous or
+	// transit connection of a transfer comes up or goes down, so that
+	// applications can show the state of their connections. It is
+	// called synchronously from the transfer's goroutines and must not
+	// block.
+	ConnStateHook func(ConnStateChange)
+
+	// CodeReuseHook is called when a transfer is started with a code
+	// this Client already used for an earlier transfer on the same
+	// side, by passing it to Receive or WithCode. If it returns true
+	// the transfer goes ahead, so it can be used to warn about the
+	// reuse instead. If CodeReuseHook is nil or returns false the
+	// transfer fails with a *CodeReusedError.
+	//
+	// A code counts as used once the key exchange with it has started.
+	// The Client remembers the last 1024 codes, as hashes, in
+	// CodeHistory.
+	CodeReuseHook func(code string) bool
+
+	// CodeHistory remembers the codes used for transfers, for
+	// CodeReuseHook. Clients that share a CodeHistory, such as copies
+	// of a Client, detect codes reused by any of them. If nil, the
+	// Client sets it to a new CodeHistory on first use, which copies
+	// made before then do not share.
+	CodeHistory *CodeHistory
+
+	// PendingStore, if set, records the sends that have a code but
+	// have not finished, so that ResumePending can start them again
+	// after the process restarts. See ResumePending for which sends
+	// are recorded.
+	PendingStore PendingStore
+
+	// Hooks are called at the points of every transfer where
+	// applications apply their own policy; see TransferHooks.
+	Hooks []TransferHooks
+
+	// TLSPins, if set, pins the certificates of wss:// rendezvous
+	// servers and transit relays: a server is only accepted if the
+	// public key of its certificate matches one of the pins, and the
+	// system roots are not consulted, so self-signed certificates work.
+	// Each pin is "sha256/" followed by the base64 encoded sha256 of
+	// the certificate's DER encoded SubjectPublicKeyInfo, as printed by
+	//
+	//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+	//
+	// Pins are not supported in browsers.
+	TLSPins []string
+
+	// Timeouts bounds how long transfers wait on the rendezvous server,
+	// transit relay and peer. The zero value uses the defaults
+	// documented on Timeouts.
+	Timeouts Timeouts
+
+	// Dial, if set, opens every connection the Client makes, to the
+	// rendezvous server and to transit relays, in place of the system's
+	// network stack, and the Client never listens for direct transit
+	// connections. wormholetest.NewMemServer provides one that reaches
+	// servers running in memory, so that tests and benchmarks need no
+	// sockets. Dial is not supported in browsers.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// clock, if set, replaces the system clock for the timers of
+	// transfers, so that tests can advance time instead of sleeping.
+	clock clock.Clock
+
+	// rand, if set, is read instead of crypto/rand for the random parts
+	// of transfers this Client chooses itself: side IDs, the words of
+	// generated codes, transfer IDs, message IDs and nonces, so that
+	// tests can reproduce codes and protocol traces exactly. The PAKE
+	// key exchange always uses crypto/rand, and nameplates are chosen
+	// by the rendezvous server. Tests set it with setRand.
+	rand *lockedReader
 }
 
 var (
@@ -67,8 +178,6 @@ var (
 	DefaultTransitRelayURL = "tcp://transit.magic-wormhole.io:4001"
 )
 
-type LogFunc func(string, ...interface{})
-
 func (c *Client) wordCount() int {
 	if c.PassPhraseComponentLength > 1 {
 		return c.PassPhraseComponentLength
@@ -77,11 +186,124 @@ func (c *Client) wordCount() int {
 	}
 }
 
+// random returns the source of randomness for the Client's transfers.
+func (c *Client) random() io.Reader {
+	if c.rand == nil {
+		return rand.Reader
+	}
+	return c.rand
+}
+
+// setRand makes the Client read r instead of crypto/rand. It is only
+// meant for tests.
+func (c *Client) setRand(r io.Reader) {
+	c.rand = &lockedReader{r: r}
+}
+
+// lockedReader serializes reads from r, since a transfer reads from
+// several goroutines and a seeded source is usually not safe for
+// concurrent use.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
+// Sides of a transfer, as used in spans and audit records.
+const (
+	sideSend    = "send"
+	sideReceive = "receive"
+)
+
+// beginTransfer gives a send or receive a new transfer ID and sets up
+// the per-transfer state in options that carries it. It returns the
+// side ID for the transfer's rendezvous client.
+func (c *Client) beginTransfer(options *transferOptions, side string) (string, error) {
+	transferID, err := crypto.RandHexFrom(c.random(), 8)
+	if err != nil {
+		return "", err
+	}
+	sideID, err := crypto.RandSideIDFrom(c.random())
+	if err != nil {
+		return "", err
+	}
+
+	options.transferID = transferID
+	options.side = side
+	options.logger = withKeyvals(c.logger(), "transfer_id", options.transferID)
+	options.audit = c.newAuditTrail(options)
+	options.counter = startTransferCounter()
+	options.connStateHook = c.ConnStateHook
+	options.timeouts = c.Timeouts.resolve()
+	options.clock = clock.OrReal(c.clock)
+	if len(c.Hooks) > 0 {
+		options.hooks = append(append([]TransferHooks(nil), c.Hooks...), options.hooks...)
+	}
+	return sideID, nil
+}
+
+// newRendezvousClient returns a rendezvous client for a transfer that
+// logs, traces and reports its state according to the Client's
+// settings.
+func (c *Client) newRendezvousClient(sideID, appID string, options *transferOptions) *rendezvous.Client {
+	opts := []rendezvous.ClientOption{rendezvous.WithLogger(options.logger)}
+	if c.rand != nil {
+		opts = append(opts, rendezvous.WithRand(c.random()))
+	}
+	if c.Dial != nil {
+		opts = append(opts, rendezvous.WithDialer(c.Dial))
+	}
+	if hook := options.rendezvousConnStateHook(); hook != nil {
+		opts = append(opts, hook)
+	}
+	if c.ProtocolTrace != nil {
+		opts = append(opts, rendezvous.WithProtocolTrace(c.ProtocolTrace))
+	}
+	if len(c.TLSPins) > 0 {
+		opts = append(opts, rendezvous.WithTLSPins(c.TLSPins...))
+	}
+	if d := options.timeouts.Rendezvous; d > 0 {
+		opts = append(opts, rendezvous.WithRequestTimeout(d))
+	}
+	return rendezvous.NewClient(c.RendezvousURL, sideID, appID, opts...)
+}
+
+// protocolTrace returns the writer for the Client's protocol trace, or
+// nil if tracing is disabled.
+func (c *Client) protocolTrace() *prototrace.Writer {
+	if c.ProtocolTrace == nil {
+		return nil
+	}
+	return prototrace.NewWriter(c.ProtocolTrace)
+}
+
 func (c *Client) relayURL() (*url.URL, error) {
 	var rurl = c.TransitRelayURL
 	if rurl == "" {
 		rurl = DefaultTransitRelayURL
 	}
+	return parseRelayURL(rurl)
+}
+
+// relayEndpoints returns the parsed TransitRelayEndpoints.
+func (c *Client) relayEndpoints() ([]*url.URL, error) {
+	var endpoints []*url.URL
+	for _, rurl := range c.TransitRelayEndpoints {
+		u, err := parseRelayURL(rurl)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, u)
+	}
+	return endpoints, nil
+}
+
+func parseRelayURL(rurl string) (*url.URL, error) {
 	var url, err = url.Parse(rurl)
 	if err != nil {
 		return nil, err
@@ -98,38 +320,87 @@ func (c *Client) relayURL() (*url.URL, error) {
 type SendResult struct {
 	OK    bool
 	Error error
+	// TransferID identifies the transfer in logs, events, spans and
+	// audit records.
+	TransferID string
+	// PeerMood is the mood the receiver closed the mailbox with, which
+	// tells a receiver that errored (Errory) apart from one that
+	// suspected tampering (Scary). It is Happy once the receiver has
+	// acknowledged the transfer, and "" if the receiver had not closed
+	// yet or the rendezvous server does not relay close messages.
+	PeerMood rendezvous.Mood
 }
 
 var errDecryptFailed = errors.New("decrypt message failed")
 
-var errOfferRejected = errors.New("TransferError: transfer rejected")
+// ThirdSideError is the error a transfer fails with when the mailbox
+// has messages from more than one other side. Only the peer should be
+// using the mailbox, so either someone is attempting to intercept the
+// transfer or a misbehaving client is using the same code.
+type ThirdSideError struct {
+	// Peer is the side the first message came from.
+	Peer string
+	// Side is the unexpected side.
+	Side string
+}
+
+func (e *ThirdSideError) Error() string {
+	return fmt.Sprintf("message from unexpected side %s in mailbox with peer %s", e.Side, e.Peer)
+}
+
+// ErrReplayedMessage is the error a transfer fails with when a mailbox
+// message arrives with a phase the peer has already used. The peer
+// never reuses a phase, so the message was replayed by the rendezvous
+// server or someone else with access to the mailbox.
+var ErrReplayedMessage = errors.New("replayed mailbox message")
+
+// ErrOfferDeclined is returned by Receive when the callback registered
+// with WithOfferCallback rejects the offer.
+var ErrOfferDeclined = errors.New("offer declined")
 
 func openAndUnmarshal(v interface{}, mb rendezvous.MailboxEvent, sharedKey []byte) error {
-	keySlice := derivePhaseKey(string(sharedKey), mb.Side, mb.Phase)
-	nonceAndSealedMsg, err := hex.DecodeString(mb.Body)
+	out, err := openMessage(mb, sharedKey)
 	if err != nil {
 		return err
 	}
 
+	return json.Unmarshal(out, v)
+}
+
+// openMessage decrypts the body of mb.
+func openMessage(mb rendezvous.MailboxEvent, sharedKey []byte) ([]byte, error) {
+	keySlice := derivePhaseKey(sharedKey, mb.Side, mb.Phase)
+	defer wipe(keySlice)
+	nonceAndSealedMsg, err := hex.DecodeString(mb.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	nonce, sealedMsg := splitNonce(nonceAndSealedMsg)
 
 	var openKey [32]byte
 	copy(openKey[:], keySlice)
+	defer wipe(openKey[:])
 
 	out, ok := secretbox.Open(nil, sealedMsg, &nonce, &openKey)
 	if !ok {
-		return errDecryptFailed
+		return nil, errDecryptFailed
 	}
 
-	return json.Unmarshal(out, v)
+	return out, nil
 }
 
-func sendEncryptedMessage(ctx context.Context, rc *rendezvous.Client, msg, sharedKey []byte, sideID, phase string) error {
+func sendEncryptedMessage(ctx context.Context, rc *rendezvous.Client, rand io.Reader, msg, sharedKey []byte, sideID, phase string) error {
 	var sealKey [32]byte
-	nonce := crypto.RandNonce()
+	nonce, err := crypto.RandNonceFrom(rand)
+	if err != nil {
+		return err
+	}
 
-	msgKey := derivePhaseKey(string(sharedKey), sideID, phase)
+	msgKey := derivePhaseKey(sharedKey, sideID, phase)
 	copy(sealKey[:], msgKey)
+	wipe(msgKey)
+	defer wipe(sealKey[:])
 
 	sealedMsg := secretbox.Seal(nil, msg, &nonce, &sealKey)
 	nonceAndSealedMsg := append(nonce[:], sealedMsg...)
@@ -158,12 +429,12 @@ func jsonHexUnmarshal(hexStr string, msg interface{}) error {
 
 const secreboxKeySize = 32
 
-func derivePhaseKey(key, side, phase string) []byte {
+func derivePhaseKey(key []byte, side, phase string) []byte {
 	sideSha := sha256.Sum256([]byte(side))
 	phaseSha := sha256.Sum256([]byte(phase))
 	purpose := "wormhole:phase:" + string(sideSha[:]) + string(phaseSha[:])
 
-	r := hkdf.New(sha256.New, []byte(key), nil, []byte(purpose))
+	r := hkdf.New(sha256.New, key, nil, []byte(purpose))
 	out := make([]byte, secreboxKeySize)
 
 	_, err := io.ReadFull(r, out)
@@ -174,21 +445,16 @@ func derivePhaseKey(key, side, phase string) []byte {
 }
 
 func deriveTransitKey(key []byte, appID string) []byte {
-	purpose := appID + "/transit-key"
-
-	r := hkdf.New(sha256.New, key, nil, []byte(purpose))
-	out := make([]byte, secreboxKeySize)
-
-	_, err := io.ReadFull(r, out)
-	if err != nil {
-		panic(err)
-	}
-	return out
+	return deriveKey(key, appID+"/transit-key")
 }
 
 func deriveVerifier(key []byte) []byte {
-	purpose := "wormhole:verifier"
+	return deriveKey(key, "wormhole:verifier")
+}
 
+// deriveKey derives a key for purpose from the session key, the same
+// way as the derive_key of the Python implementation.
+func deriveKey(key []byte, purpose string) []byte {
 	r := hkdf.New(sha256.New, key, nil, []byte(purpose))
 	out := make([]byte, secreboxKeySize)
 
@@ -199,6 +465,13 @@ func deriveVerifier(key []byte) []byte {
 	return out
 }
 
+// wipe overwrites key material in b with zeros.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 type pakeMsg struct {
 	Body string `json:"pake_v1"`
 }
@@ -213,6 +486,45 @@ func (m *offerMsg) Type() collectType {
 	return collectOffer
 }
 
+// summary describes the offer the way WithOfferCallback sees it. Some
+// clients send a message along with a file or directory, so an offer
+// is only a text offer if it has neither.
+func (m *offerMsg) summary() Offer {
+	var message string
+	if m.Message != nil {
+		message = *m.Message
+	}
+
+	switch {
+	case m.File != nil:
+		return Offer{
+			Type:                TransferFile,
+			Name:                m.File.FileName,
+			TransferBytes64:     m.File.FileSize,
+			UncompressedBytes64: m.File.FileSize,
+			FileCount:           1,
+			UnknownLength:       m.File.Stream,
+			Message:             message,
+		}
+	case m.Directory != nil:
+		return Offer{
+			Type:                TransferDirectory,
+			Name:                m.Directory.Dirname,
+			TransferBytes64:     m.Directory.ZipSize,
+			UncompressedBytes64: m.Directory.NumBytes,
+			FileCount:           int(m.Directory.NumFiles),
+			Message:             message,
+		}
+	case m.Message != nil:
+		return Offer{
+			Type:                TransferText,
+			TransferBytes64:     int64(len(message)),
+			UncompressedBytes64: int64(len(message)),
+		}
+	}
+	return Offer{}
+}
+
 type offerDirectory struct {
 	Dirname  string `json:"dirname"`
 	Mode     string `json:"mode"`
@@ -224,6 +536,10 @@ type offerDirectory struct {
 type offerFile struct {
 	FileName string `json:"filename"`
 	FileSize int64  `json:"filesize"`
+	// Stream marks a file of unknown length. FileSize is 0 and the
+	// sender ends the data with an empty transit record. It is only
+	// sent to peers advertising abilityStreamV1.
+	Stream bool `json:"stream,omitempty"`
 }
 
 type genericMessage struct {
@@ -231,21 +547,83 @@ type genericMessage struct {
 	Answer      *answerMsg      `json:"answer,omitempty"`
 	Transit     *transitMsg     `json:"transit,omitempty"`
 	AppVersions *appVersionsMsg `json:"app_versions,omitempty"`
+	Verified    *verifiedMsg    `json:"verified,omitempty"`
 	Error       *string         `json:"error,omitempty"`
 }
 
 type appVersionsMsg struct {
+	// Abilities lists the protocol extensions this client supports,
+	// e.g. abilityResumeV1.
+	Abilities []string `json:"abilities,omitempty"`
+}
+
+// abilityResumeV1 marks support for resuming file transfers: the
+// receiver's answer may carry a resume_offset and the sender then only
+// sends the file from that offset on.
+const abilityResumeV1 = "transfer-resume-v1"
+
+// abilityDeltaV1 marks support for delta transfers of files: the
+// receiver's answer may carry a delta request and the sender then only
+// sends the parts of the file that the receiver's basis lacks. See
+// delta.go.
+const abilityDeltaV1 = "transfer-delta-v1"
+
+// abilityStreamV1 marks support for file offers of unknown length
+// (offerFile.Stream).
+const abilityStreamV1 = "transfer-stream-v1"
+
+// abilityChecksumV1 marks support for the sender's checksum: after the
+// data the sender sends a transit record holding a
+// fileTransportChecksum, which the receiver checks before its ack.
+const abilityChecksumV1 = "transfer-checksum-v1"
+
+// abilityVerifyV1 marks support for confirming the verifier: after the
+// version exchange the client sends a verified message once its
+// VerifierOk callback has approved the verifier, for peers using
+// WithStrictVerification.
+const abilityVerifyV1 = "verify-confirm-v1"
+
+// abilityOfferMessageV1 marks support for file and directory offers
+// that also carry a message (WithMessage). Other clients treat any
+// offer with a message as a text offer.
+const abilityOfferMessageV1 = "transfer-offer-message-v1"
+
+func (m *appVersionsMsg) has(ability string) bool {
+	for _, a := range m.Abilities {
+		if a == ability {
+			return true
+		}
+	}
+	return false
 }
 
 type answerMsg struct {
 	MessageAck string `json:"message_ack,omitempty"`
 	FileAck    string `json:"file_ack,omitempty"`
+	// ResumeOffset is the number of bytes of the file the receiver
+	// already has. It is only sent to peers advertising abilityResumeV1.
+	ResumeOffset int64 `json:"resume_offset,omitempty"`
+	// Delta asks for a delta transfer against the receiver's copy of
+	// the file. It is only sent to peers advertising abilityDeltaV1.
+	Delta *deltaAnswer `json:"delta,omitempty"`
 }
 
 func (m *answerMsg) Type() collectType {
 	return collectAnswer
 }
 
+// verifiedMsg tells the peer that this side is done checking the
+// verifier. It is only sent to peers advertising abilityVerifyV1.
+type verifiedMsg struct {
+	// Checked is false if this side has no VerifierOk callback, so
+	// nobody compared the verifiers.
+	Checked bool `json:"checked"`
+}
+
+func (m *verifiedMsg) Type() collectType {
+	return collectVerified
+}
+
 type collectable interface {
 	Type() collectType
 }
@@ -276,7 +654,7 @@ type transitHintsRelay struct {
 	Hostname string  `json:"hostname,omitempty"`
 	Port     int     `json:"port,omitempty"`
 	Priority float64 `json:"priority,omitempty"`
-	// When type is "websocket"
+	// When type is "websocket-v1" or "websocket"
 	Url string `json:"url,omitempty"`
 }
 
@@ -290,10 +668,15 @@ func (m *transitMsg) Type() collectType {
 }
 
 type msgCollector struct {
-	sharedKey      []byte
-	collectOffer   bool
-	collectTransit bool
-	collectAnswer  bool
+	sharedKey       []byte
+	checkMessage    func(rendezvous.MailboxEvent) error
+	collectOffer    bool
+	collectTransit  bool
+	collectAnswer   bool
+	collectVerified bool
+	// timeout, if non-zero, bounds each waitFor.
+	timeout time.Duration
+	clock   clock.Clock
 
 	subscribe chan *collectSubscription
 
@@ -307,6 +690,7 @@ func newMsgCollector(sharedKey []byte) *msgCollector {
 		sharedKey: sharedKey,
 		subscribe: make(chan *collectSubscription),
 		done:      make(chan error, 1),
+		clock:     clock.Real{},
 	}
 }
 
@@ -347,7 +731,15 @@ func (c *msgCollector) waitFor(msg collectable) error {
 	case c.subscribe <- &sub:
 	}
 
-	result := <-sub.result
+	timeout, stop := peerTimer(c.clock, c.timeout)
+	defer stop()
+
+	var result collectResult
+	select {
+	case result = <-sub.result:
+	case <-timeout:
+		return fmt.Errorf("%w: no %s message", ErrPeerTimeout, msg.Type())
+	}
 	if result.err != nil {
 		return result.err
 	}
@@ -370,7 +762,14 @@ type collectSubscription struct {
 	result     chan collectResult
 }
 
-func (c *msgCollector) collect(ch <-chan rendezvous.MailboxEvent) {
+// collect reads the peer's app data messages, starting with early,
+// which have already been checked, and then from ch. Messages are
+// buffered by type until waited for, so peers may send them in any
+// order, several to a message, and alongside messages of phases that
+// this client doesn't use, such as dilation's.
+func (c *msgCollector) collect(early []rendezvous.MailboxEvent, ch <-chan rendezvous.MailboxEvent) {
+	defer wipe(c.sharedKey)
+
 	pendingMsgs := make(map[collectType]collectable)
 	waiters := make(map[collectType]*collectSubscription)
 
@@ -386,6 +785,61 @@ func (c *msgCollector) collect(ch <-chan rendezvous.MailboxEvent) {
 		}
 	}
 
+	// deliver passes the messages in gotMsg to their waiters, or
+	// buffers them until they are waited for.
+	deliver := func(gotMsg rendezvous.MailboxEvent) error {
+		if _, err := strconv.Atoi(gotMsg.Phase); err != nil {
+			// not app data, and not for us
+			return nil
+		}
+
+		var msg genericMessage
+		err := openAndUnmarshal(&msg, gotMsg, c.sharedKey)
+		if err != nil {
+			return err
+		}
+		if msg.Error != nil {
+			return &peerError{msg: *msg.Error}
+		}
+
+		var found []collectable
+		if msg.Offer != nil {
+			found = append(found, msg.Offer)
+		}
+		if msg.Transit != nil {
+			found = append(found, msg.Transit)
+		}
+		if msg.Answer != nil {
+			found = append(found, msg.Answer)
+		}
+		if msg.Verified != nil {
+			found = append(found, msg.Verified)
+		}
+
+		for _, resultMsg := range found {
+			t := resultMsg.Type()
+			if sub := waiters[t]; sub != nil {
+				sub.result <- collectResult{
+					result: resultMsg,
+				}
+				delete(waiters, t)
+			} else {
+				if pendingMsgs[t] != nil {
+					return fmt.Errorf("got multiple messages of type %s", t)
+				}
+				pendingMsgs[t] = resultMsg
+			}
+		}
+		return nil
+	}
+
+	for _, gotMsg := range early {
+		if err := deliver(gotMsg); err != nil {
+			errorResult(err)
+			return
+		}
+	}
+
 	for {
 		select {
 		case <-c.done:
@@ -416,48 +870,13 @@ func (c *msgCollector) collect(ch <-chan rendezvous.MailboxEvent) {
 				errorResult(gotMsg.Error)
 				return
 			}
-
-			if _, err := strconv.Atoi(gotMsg.Phase); err != nil {
-				errorResult(fmt.Errorf("got unexpected phase: %s", gotMsg.Phase))
-				return
-			}
-
-			var msg genericMessage
-			err := openAndUnmarshal(&msg, gotMsg, c.sharedKey)
-			if err != nil {
+			if err := c.checkMessage(gotMsg); err != nil {
 				errorResult(err)
 				return
 			}
-
-			var resultMsg collectable
-			var t collectType
-			if msg.Offer != nil {
-				t = collectOffer
-				resultMsg = msg.Offer
-			} else if msg.Transit != nil {
-				t = collectTransit
-				resultMsg = msg.Transit
-			} else if msg.Answer != nil {
-				t = collectAnswer
-				resultMsg = msg.Answer
-			} else if msg.Error != nil {
-				errorResult(fmt.Errorf("TransferError: %s", *msg.Error))
+			if err := deliver(gotMsg); err != nil {
+				errorResult(err)
 				return
-			} else {
-				continue
-			}
-
-			if sub := waiters[t]; sub != nil {
-				sub.result <- collectResult{
-					result: resultMsg,
-				}
-				delete(waiters, t)
-			} else {
-				if pendingMsgs[t] != nil {
-					errorResult(fmt.Errorf("got multiple messages of type %s", t))
-					return
-				}
-				pendingMsgs[t] = resultMsg
 			}
 		}
 	}
@@ -466,11 +885,25 @@ func (c *msgCollector) collect(ch <-chan rendezvous.MailboxEvent) {
 type clientProtocol struct {
 	sharedKey    []byte
 	phaseCounter int
+	guard        *mailboxGuard
 	ch           <-chan rendezvous.MailboxEvent
 	rc           *rendezvous.Client
 	spake        *gospake2.SPAKE2
 	sideID       string
 	appID        string
+	// rand is read for the nonces of messages to the peer.
+	rand io.Reader
+
+	// onTampering, if set, is called when a message shows that the
+	// mailbox has been tampered with.
+	onTampering func(error)
+	// peerTimeout, if non-zero, bounds waiting for each message from
+	// the peer after the first.
+	peerTimeout time.Duration
+	clock       clock.Clock
+	// early holds the peer's app data messages that arrived before its
+	// version message, already checked, for the collector.
+	early []rendezvous.MailboxEvent
 }
 
 func newClientProtocol(ctx context.Context, rc *rendezvous.Client, sideID, appID string) *clientProtocol {
@@ -479,9 +912,51 @@ func newClientProtocol(ctx context.Context, rc *rendezvous.Client, sideID, appID
 	return &clientProtocol{
 		ch:     recvChan,
 		rc:     rc,
+		guard:  &mailboxGuard{},
 		sideID: sideID,
 		appID:  appID,
+		rand:   rand.Reader,
+		clock:  clock.Real{},
+	}
+}
+
+// mailboxGuard checks the messages received from the peer for signs
+// of tampering. The first message fixes the peer's side; a message
+// from any other side means a third party is using the mailbox. Each
+// side uses every phase once, so a message with a phase that was seen
+// before is a replay.
+type mailboxGuard struct {
+	mu     sync.Mutex
+	peer   string
+	phases map[string]bool
+}
+
+// check records msg, failing with a *ThirdSideError or
+// ErrReplayedMessage if it should not be acted on.
+func (g *mailboxGuard) check(msg rendezvous.MailboxEvent) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.peer == "" {
+		g.peer = msg.Side
+		g.phases = make(map[string]bool)
+	} else if msg.Side != g.peer {
+		return &ThirdSideError{Peer: g.peer, Side: msg.Side}
+	}
+	if g.phases[msg.Phase] {
+		return fmt.Errorf("%w: phase %q", ErrReplayedMessage, msg.Phase)
 	}
+	g.phases[msg.Phase] = true
+	return nil
+}
+
+// checkMessage checks gotMsg with cc.guard before it is decrypted or
+// acted on, reporting any tampering to onTampering.
+func (cc *clientProtocol) checkMessage(gotMsg rendezvous.MailboxEvent) error {
+	err := cc.guard.check(gotMsg)
+	if err != nil && cc.onTampering != nil {
+		cc.onTampering(err)
+	}
+	return err
 }
 
 func (cc *clientProtocol) WritePake(ctx context.Context, code string) error {
@@ -515,6 +990,9 @@ func (cc *clientProtocol) ReadPake(ctx context.Context) error {
 	}
 
 	cc.sharedKey = sharedKey
+	// gospake2 keeps its secrets in unexported fields that can't be
+	// wiped, so at least don't keep them reachable.
+	cc.spake = nil
 
 	return nil
 }
@@ -527,10 +1005,23 @@ func (cc *clientProtocol) Verifier() ([]byte, error) {
 	return deriveVerifier(cc.sharedKey), nil
 }
 
+// wipeKeys zeroes the session key once the transfer no longer needs
+// it. Anything that needs the key after that fails to decrypt.
+func (cc *clientProtocol) wipeKeys() {
+	wipe(cc.sharedKey)
+}
+
 func (cc *clientProtocol) WriteVersion(ctx context.Context) error {
+	return cc.writeVersion(ctx, []string{abilityResumeV1, abilityStreamV1, abilityVerifyV1, abilityChecksumV1, abilityOfferMessageV1, abilityDeltaV1})
+}
+
+// writeVersion sends the version message advertising abilities.
+func (cc *clientProtocol) writeVersion(ctx context.Context, abilities []string) error {
 	phase := "version"
 	verInfo := genericMessage{
-		AppVersions: &appVersionsMsg{},
+		AppVersions: &appVersionsMsg{
+			Abilities: abilities,
+		},
 	}
 
 	jsonOut, err := json.Marshal(verInfo)
@@ -538,17 +1029,20 @@ func (cc *clientProtocol) WriteVersion(ctx context.Context) error {
 		return err
 	}
 
-	err = sendEncryptedMessage(ctx, cc.rc, jsonOut, cc.sharedKey, cc.sideID, phase)
+	err = sendEncryptedMessage(ctx, cc.rc, cc.rand, jsonOut, cc.sharedKey, cc.sideID, phase)
 	return err
 }
 
 func (cc *clientProtocol) ReadVersion() (*appVersionsMsg, error) {
-	var v appVersionsMsg
+	var v genericMessage
 	err := cc.openAndUnmarshal("version", &v)
 	if err != nil {
 		return nil, err
 	}
-	return &v, nil
+	if v.AppVersions == nil {
+		return &appVersionsMsg{}, nil
+	}
+	return v.AppVersions, nil
 }
 
 func (cc *clientProtocol) WriteAppData(ctx context.Context, v *genericMessage) error {
@@ -562,22 +1056,44 @@ func (cc *clientProtocol) WriteAppData(ctx context.Context, v *genericMessage) e
 
 	phase := strconv.Itoa(nextPhase)
 
-	return sendEncryptedMessage(ctx, cc.rc, jsonOut, cc.sharedKey, cc.sideID, phase)
+	return sendEncryptedMessage(ctx, cc.rc, cc.rand, jsonOut, cc.sharedKey, cc.sideID, phase)
 }
 
+// openAndUnmarshal reads the peer's message for phase. App data
+// messages that some clients send before it are kept in cc.early for
+// the collector instead of failing the transfer.
 func (cc *clientProtocol) openAndUnmarshal(phase string, v interface{}) error {
-	gotMsg := <-cc.ch
-	if gotMsg.Error != nil {
-		return gotMsg.Error
-	}
+	timeout, stop := peerTimer(cc.clock, cc.peerTimeout)
+	defer stop()
 
-	if gotMsg.Phase != phase {
-		return fmt.Errorf("got unexpected phase while waiting for %s: %s", phase, gotMsg.Phase)
-	}
+	for {
+		var gotMsg rendezvous.MailboxEvent
+		select {
+		case gotMsg = <-cc.ch:
+		case <-timeout:
+			return fmt.Errorf("%w: no %s message", ErrPeerTimeout, phase)
+		}
+		if gotMsg.Error != nil {
+			return gotMsg.Error
+		}
+		if err := cc.checkMessage(gotMsg); err != nil {
+			return err
+		}
 
-	return openAndUnmarshal(v, gotMsg, cc.sharedKey)
+		if gotMsg.Phase == phase {
+			return openAndUnmarshal(v, gotMsg, cc.sharedKey)
+		}
+		if _, err := strconv.Atoi(gotMsg.Phase); err != nil || len(cc.early) >= maxEarlyMessages {
+			return fmt.Errorf("got unexpected phase while waiting for %s: %s", phase, gotMsg.Phase)
+		}
+		cc.early = append(cc.early, gotMsg)
+	}
 }
 
+// maxEarlyMessages is the most app data messages kept while waiting
+// for the peer's version. A transfer needs no more than a few.
+const maxEarlyMessages = 8
+
 func (cc *clientProtocol) readPlaintext(ctx context.Context, phase string, v interface{}) error {
 	var gotMsg rendezvous.MailboxEvent
 	select {
@@ -588,6 +1104,9 @@ func (cc *clientProtocol) readPlaintext(ctx context.Context, phase string, v int
 	if gotMsg.Error != nil {
 		return gotMsg.Error
 	}
+	if err := cc.checkMessage(gotMsg); err != nil {
+		return err
+	}
 
 	if gotMsg.Phase != phase {
 		return fmt.Errorf("got unexpected phase while waiting for %s: %s", phase, gotMsg.Phase)
@@ -607,6 +1126,7 @@ const (
 	collectOffer collectType = iota + 1
 	collectTransit
 	collectAnswer
+	collectVerified
 )
 
 func (ct collectType) String() string {
@@ -617,13 +1137,20 @@ func (ct collectType) String() string {
 		return "Transit"
 	case collectAnswer:
 		return "Answer"
+	case collectVerified:
+		return "Verified"
 	default:
 		return fmt.Sprintf("collectTypeUnkown<%d>", ct)
 	}
 }
 
 func (cc *clientProtocol) Collect(msgTypes ...collectType) (*msgCollector, error) {
-	collector := newMsgCollector(cc.sharedKey)
+	// the collector's goroutine may outlive the transfer, so it gets
+	// a copy of the key to wipe when it exits.
+	collector := newMsgCollector(append([]byte(nil), cc.sharedKey...))
+	collector.checkMessage = cc.checkMessage
+	collector.timeout = cc.peerTimeout
+	collector.clock = cc.clock
 
 	for _, mt := range msgTypes {
 		switch mt {
@@ -633,12 +1160,16 @@ func (cc *clientProtocol) Collect(msgTypes ...collectType) (*msgCollector, error
 			collector.collectTransit = true
 		case collectAnswer:
 			collector.collectAnswer = true
+		case collectVerified:
+			collector.collectVerified = true
 		default:
 			return nil, fmt.Errorf("unknown collect msg type %d", msgTypes)
 		}
 	}
 
-	go collector.collect(cc.ch)
+	early := cc.early
+	cc.early = nil
+	go collector.collect(early, cc.ch)
 	return collector, nil
 }
 
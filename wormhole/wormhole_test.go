@@ -3,33 +3,50 @@ package wormhole
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	mathrand "math/rand"
 	"net"
-	"net/http"
-	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/zip"
+	"github.com/psanford/wormhole-william/internal/clock"
 	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/internal/prototrace"
 	"github.com/psanford/wormhole-william/rendezvous"
 	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
-	"nhooyr.io/websocket"
+	"github.com/psanford/wormhole-william/wordlist"
+	"github.com/psanford/wormhole-william/wormhole/wormholetest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
-var relayServerConstructors = map[string]func() *testRelayServer{
-	"TCP": newTestTCPRelayServer,
-	"WS":  newTestWSRelayServer,
+var relayServerConstructors = map[string]func() *wormholetest.Relay{
+	"TCP": wormholetest.NewTCPRelay,
+	"WS":  wormholetest.NewWSRelay,
 }
 
 func TestWormholeSendRecvText(t *testing.T) {
@@ -69,14 +86,16 @@ func TestWormholeSendRecvText(t *testing.T) {
 
 	// recv with wrong code
 	_, err = c1.Receive(ctx, fmt.Sprintf("%s-intermarrying-aliased", nameplate), false)
-	if err != errDecryptFailed {
+	if !errors.Is(err, errDecryptFailed) {
 		t.Fatalf("Recv side expected decrypt failed due to wrong code but got: %s", err)
 	}
+	expectTransferError(t, err, CodeWrongCode, PhasePake)
 
 	status := <-statusChan
-	if status.OK || status.Error != errDecryptFailed {
+	if status.OK || !errors.Is(status.Error, errDecryptFailed) {
 		t.Fatalf("Send side expected decrypt failed but got status: %+v", status)
 	}
+	expectTransferError(t, status.Error, CodeWrongCode, PhasePake)
 
 	code, statusChan, err = c0.SendText(ctx, secretText)
 	if err != nil {
@@ -198,15 +217,17 @@ func TestVerifierAbort(t *testing.T) {
 	if err.Error() != expectErr.Error() {
 		t.Fatalf("Expected recv err %q got %q", expectErr, err)
 	}
+	expectTransferError(t, err, CodeVerifierRejected, PhaseTransit)
 
 	status := <-statusChan
 	expectErr = errors.New("sender rejected verification check, abandoned transfer")
 	if status.Error.Error() != expectErr.Error() {
 		t.Fatalf("Send side expected %q error but got: %q", expectErr, status.Error)
 	}
+	expectTransferError(t, status.Error, CodeVerifierRejected, PhasePake)
 }
 
-func TestWormholeFileReject(t *testing.T) {
+func TestStrictVerification(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
@@ -214,56 +235,266 @@ func TestWormholeFileReject(t *testing.T) {
 
 	url := rs.WebSocketURL()
 
-	// disable transit relay for this test
+	// disable transit relay
 	DefaultTransitRelayURL = "tcp://"
 
+	var verified int32
+	verifierOk := func(code string) bool {
+		atomic.AddInt32(&verified, 1)
+		return true
+	}
+
 	var c0 Client
 	c0.RendezvousURL = url
+	c0.VerifierOk = verifierOk
 
 	var c1 Client
 	c1.RendezvousURL = url
+	c1.VerifierOk = verifierOk
+
+	secretText := "pinwheel-obstinacy"
+	code, statusChan, err := c0.SendText(ctx, secretText, WithStrictVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, false, WithStrictVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != secretText {
+		t.Fatalf("Got text %q expected %q", got, secretText)
+	}
+	if status := <-statusChan; !status.OK || status.Error != nil {
+		t.Fatalf("Send side error: %+v", status)
+	}
+	if n := atomic.LoadInt32(&verified); n != 2 {
+		t.Fatalf("Expected 2 VerifierOk calls but got %d", n)
+	}
 
 	fileContent := make([]byte, 1<<16)
-	for i := 0; i < len(fileContent); i++ {
-		fileContent[i] = byte(i)
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, WithStrictVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = c1.Receive(ctx, code, false, WithStrictVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
 	}
 
-	buf := bytes.NewReader(fileContent)
+	// a strict sender never sends the offer to a receiver whose user
+	// did not check the verifier.
+	var unchecked Client
+	unchecked.RendezvousURL = url
 
-	code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, false)
+	code, statusChan, err = c0.SendText(ctx, secretText, WithStrictVerification())
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = unchecked.Receive(ctx, code, false)
+	expectTransferError(t, err, CodeVerifierRejected, PhaseTransit)
+	status := <-statusChan
+	if !errors.Is(status.Error, ErrPeerUnverified) {
+		t.Fatalf("Expected %q error but got: %v", ErrPeerUnverified, status.Error)
+	}
+	expectTransferError(t, status.Error, CodeVerifierRejected, PhasePake)
 
-	receiver, err := c1.Receive(ctx, code, false)
+	// and a strict receiver does not accept one from such a sender.
+	code, statusChan, err = unchecked.SendText(ctx, secretText)
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = c1.Receive(ctx, code, false, WithStrictVerification())
+	if !errors.Is(err, ErrPeerUnverified) {
+		t.Fatalf("Expected %q error but got: %v", ErrPeerUnverified, err)
+	}
+	expectTransferError(t, err, CodeVerifierRejected, PhasePake)
+	status = <-statusChan
+	expectTransferError(t, status.Error, CodeVerifierRejected, PhaseTransit)
 
-	receiver.Reject()
+	_, _, err = unchecked.SendText(ctx, secretText, WithStrictVerification())
+	if err == nil {
+		t.Fatal("Expected strict verification without VerifierOk to fail")
+	}
+}
 
-	result := <-resultCh
-	expectErr := "TransferError: transfer rejected"
-	expectMood := "happy"
+func TestVerifierSAS(t *testing.T) {
+	verifier := "0420c41461c0" + strings.Repeat("00", 26)
 
-	//checks clients closure status in Mailbox
-	closeMoods := rs.CloseMoods()
+	words, err := VerifierWords(verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectWords := []string{"alkali", "bison", "reproduce", "baboon"}
+	if !reflect.DeepEqual(words, expectWords) {
+		t.Fatalf("Got words %q expected %q", words, expectWords)
+	}
 
-	if closeMoods == nil {
-		t.Fatalf("Expected to get mood, but got nothing")
+	emoji, err := VerifierEmoji(verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emoji) != SASEmojiCount {
+		t.Fatalf("Got %d emoji expected %d", len(emoji), SASEmojiCount)
+	}
+	for i, e := range emoji {
+		if e != sasEmoji[i+1] {
+			t.Fatalf("Emoji %d: got %s expected %s", i, e, sasEmoji[i+1])
+		}
 	}
 
-	for side, mood := range closeMoods {
-		if mood != expectMood {
-			t.Fatalf("Expected %q result, but got: %+v, side: %+v", expectMood, mood, side)
+	emoji, err = VerifierEmoji(strings.Repeat("ff", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range emoji {
+		if e.Name != "Pin" {
+			t.Fatalf("Expected all Pin emoji but got %v", emoji)
 		}
 	}
-	if result.Error.Error() != expectErr {
-		t.Fatalf("Expected %q result, but got: %+v", expectErr, result)
+
+	for _, bad := range []string{"", "0420", "not hex"} {
+		if _, err := VerifierWords(bad); err == nil {
+			t.Fatalf("Expected error for verifier %q", bad)
+		}
+		if _, err := VerifierEmoji(bad); err == nil {
+			t.Fatalf("Expected error for verifier %q", bad)
+		}
 	}
 }
 
-func TestWormholeFileTransportSendRecvViaRelayServer(t *testing.T) {
+func TestCompareVerifiers(t *testing.T) {
+	verifier := "0420c41461c0" + strings.Repeat("ab", 26)
+
+	cases := []struct {
+		a, b   string
+		expect bool
+	}{
+		{verifier, verifier, true},
+		{verifier, strings.ToUpper(verifier), true},
+		{verifier, " 0420 C414 61c0\t" + strings.Repeat("AB", 26) + "\n", true},
+		{verifier, verifier[:len(verifier)-2], false},
+		{verifier, verifier[:len(verifier)-1] + "c", false},
+		{verifier, verifier + "00", false},
+		{"", "", false},
+		{" ", "", false},
+	}
+
+	for _, tc := range cases {
+		if got := CompareVerifiers(tc.a, tc.b); got != tc.expect {
+			t.Errorf("CompareVerifiers(%q, %q) = %t, expected %t", tc.a, tc.b, got, tc.expect)
+		}
+	}
+}
+
+func TestCodeWordParity(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	var c0 Client
+	c0.RendezvousURL = rs.WebSocketURL()
+	c0.PassPhraseComponentLength = 4
+
+	code, _, err := c0.SendText(ctx, "unanimous-wiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	words := strings.Split(code, "-")[1:]
+	if len(words) != 4 {
+		t.Fatalf("got code %q, expected 4 words", code)
+	}
+	if err := wordlist.CheckWords(words); err != nil {
+		t.Fatalf("generated code %q: %s", code, err)
+	}
+
+	// the reference implementation starts with the odd list
+	if err := wordlist.CheckWords([]string{"adroitness", "aardvark"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wordlist.CheckWords([]string{"aardvark", "adroitness"}); err == nil {
+		t.Fatal("Expected words from the wrong lists to be rejected")
+	}
+}
+
+func TestTransferURI(t *testing.T) {
+	tests := []struct {
+		uri    string
+		expect TransferURI
+	}{
+		{
+			uri:    "wormhole-transfer:4-purple-sausages?version=0",
+			expect: TransferURI{Code: "4-purple-sausages"},
+		},
+		{
+			uri: "wormhole-transfer:8-correct-horse?rendezvous=ws%3A%2F%2Fexample.com%3A4000%2Fv1&role=leader&version=0",
+			expect: TransferURI{
+				Code:          "8-correct-horse",
+				RendezvousURL: "ws://example.com:4000/v1",
+				Leader:        true,
+			},
+		},
+		{
+			uri:    "wormhole-transfer:3-caf%C3%A9-cr%C3%A8me?version=0",
+			expect: TransferURI{Code: "3-café-crème"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTransferURI(tt.uri)
+		if err != nil {
+			t.Fatalf("ParseTransferURI(%q): %s", tt.uri, err)
+		}
+		if *got != tt.expect {
+			t.Fatalf("ParseTransferURI(%q) got %+v expected %+v", tt.uri, *got, tt.expect)
+		}
+		if got.String() != tt.uri {
+			t.Fatalf("got %q expected %q", got.String(), tt.uri)
+		}
+	}
+
+	// other implementations leave out the version
+	got, err := ParseTransferURI("wormhole-transfer:4-purple-sausages?rendezvous=ws%3A%2F%2Fexample.com%2Fv1&extra=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Code != "4-purple-sausages" || got.RendezvousURL != "ws://example.com/v1" {
+		t.Fatalf("got %+v", *got)
+	}
+
+	if _, err := ParseTransferURI("4-purple-sausages"); err != ErrNotTransferURI {
+		t.Fatalf("got %v expected ErrNotTransferURI", err)
+	}
+
+	for _, uri := range []string{
+		"wormhole-transfer:",
+		"wormhole-transfer:4-purple-sausages?version=1",
+		"wormhole-transfer:4-purple-sausages?role=bystander",
+		"wormhole-transfer:purple-sausages",
+	} {
+		if _, err := ParseTransferURI(uri); err == nil {
+			t.Fatalf("Expected ParseTransferURI(%q) to fail", uri)
+		}
+	}
+}
+
+func TestCodeReuse(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
@@ -271,52 +502,5537 @@ func TestWormholeFileTransportSendRecvViaRelayServer(t *testing.T) {
 
 	url := rs.WebSocketURL()
 
-	for relayProtocol, newRelayServer := range relayServerConstructors {
-		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
-			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+	// disable transit relay
+	DefaultTransitRelayURL = "tcp://"
 
-			var c0 Client
-			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayURL
+	var c0 Client
+	c0.RendezvousURL = url
 
-			var c1 Client
-			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayURL
+	var c1 Client
+	c1.RendezvousURL = url
 
-			fileContent := make([]byte, 1<<16)
-			for i := 0; i < len(fileContent); i++ {
-				fileContent[i] = byte(i)
-			}
+	code := "7-guitarist-revenge"
+	sendRecv := func() error {
+		_, statusChan, err := c0.SendText(ctx, "first", WithCode(code))
+		if err != nil {
+			return err
+		}
+		msg, err := c1.Receive(ctx, code, false)
+		if err != nil {
+			return err
+		}
+		if _, err := ioutil.ReadAll(msg); err != nil {
+			return err
+		}
+		if status := <-statusChan; status.Error != nil {
+			return status.Error
+		}
+		return nil
+	}
 
-			buf := bytes.NewReader(fileContent)
+	if err := sendRecv(); err != nil {
+		t.Fatal(err)
+	}
 
-			code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, true)
-			if err != nil {
-				t.Fatal(err)
-			}
+	var reuseErr *CodeReusedError
+	_, _, err := c0.SendText(ctx, "second", WithCode(code))
+	if !errors.As(err, &reuseErr) || reuseErr.Nameplate != "7" {
+		t.Fatalf("Expected CodeReusedError for nameplate 7 but got: %v", err)
+	}
+	if strings.Contains(err.Error(), "guitarist") {
+		t.Fatalf("Error leaks the code: %v", err)
+	}
+	_, err = c1.Receive(ctx, code, false)
+	if !errors.As(err, &reuseErr) {
+		t.Fatalf("Expected CodeReusedError but got: %v", err)
+	}
 
-			receiver, err := c1.Receive(ctx, code, true)
-			if err != nil {
-				t.Fatal(err)
-			}
+	var warned []string
+	warn := func(code string) bool {
+		warned = append(warned, code)
+		return true
+	}
+	c0.CodeReuseHook = warn
+	c1.CodeReuseHook = warn
+	if err := sendRecv(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(warned, []string{code, code}) {
+		t.Fatalf("Expected CodeReuseHook calls for both sides but got %q", warned)
+	}
 
-			got, err := ioutil.ReadAll(receiver)
-			if err != nil {
-				t.Fatal(err)
-			}
+	// a client may receive a code it is sending with
+	var c2 Client
+	c2.RendezvousURL = url
+	code2 := "8-revenge-guitarist"
+	_, statusChan, err := c2.SendText(ctx, "loopback", WithCode(code2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c2.Receive(ctx, code2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(msg); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-statusChan; status.Error != nil {
+		t.Fatal(status.Error)
+	}
 
-			if !bytes.Equal(got, fileContent) {
-				t.Fatalf("File contents mismatch")
-			}
+	// copies of a client share its history, as do clients given the
+	// same CodeHistory
+	c3 := Client{RendezvousURL: url, CodeHistory: NewCodeHistory()}
+	code3 := "9-guitarist-revenge"
+	cp := c3
+	_, statusChan, err = cp.SendText(ctx, "copy", WithCode(code3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c4 := Client{RendezvousURL: url, CodeHistory: c3.CodeHistory}
+	msg, err = c4.Receive(ctx, code3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(msg); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-statusChan; status.Error != nil {
+		t.Fatal(status.Error)
+	}
 
-			result := <-resultCh
-			if !result.OK {
-				t.Fatalf("Expected ok result but got: %+v", result)
-			}
-		})
+	cp = c3
+	_, _, err = cp.SendText(ctx, "copy", WithCode(code3))
+	if !errors.As(err, &reuseErr) {
+		t.Fatalf("Expected CodeReusedError from a copy but got: %v", err)
+	}
+	c5 := Client{RendezvousURL: url, CodeHistory: c3.CodeHistory}
+	_, err = c5.Receive(ctx, code3, false)
+	if !errors.As(err, &reuseErr) {
+		t.Fatalf("Expected CodeReusedError from a client sharing the history but got: %v", err)
+	}
+}
+
+func TestInviteCode(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay
+	DefaultTransitRelayURL = "tcp://"
+
+	var host Client
+	host.RendezvousURL = url
+
+	invite, err := host.NewInviteCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parts := strings.Split(invite, "-"); len(parts) != 1+inviteWordCount || len(parts[0]) != 6 {
+		t.Fatalf("Unexpected invite code %q", invite)
+	}
+
+	_, _, err = host.SendText(ctx, "no code", WithInvite())
+	if err != errInviteWithoutCode {
+		t.Fatalf("Expected errInviteWithoutCode but got: %v", err)
+	}
+
+	receive := func() (string, error) {
+		msg, err := host.Receive(ctx, invite, false, WithInvite())
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(msg)
+		return string(body), err
+	}
+
+	for i, hostFirst := range []bool{true, false, true} {
+		var guest Client
+		guest.RendezvousURL = url
+
+		text := fmt.Sprintf("drop %d", i)
+		type result struct {
+			body string
+			err  error
+		}
+		received := make(chan result, 1)
+		recv := func() {
+			body, err := receive()
+			received <- result{body, err}
+		}
+
+		if hostFirst {
+			go recv()
+		}
+		_, statusChan, err := guest.SendText(ctx, text, WithCode(invite), WithInvite())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hostFirst {
+			go recv()
+		}
+
+		r := <-received
+		if r.err != nil {
+			t.Fatalf("Receive %d: %v", i, r.err)
+		}
+		if r.body != text {
+			t.Fatalf("Receive %d got %q, expected %q", i, r.body, text)
+		}
+		if status := <-statusChan; status.Error != nil {
+			t.Fatalf("Send %d: %v", i, status.Error)
+		}
+	}
+
+	// without WithInvite the code is still checked for reuse
+	var reuseErr *CodeReusedError
+	_, err = host.Receive(ctx, invite, false)
+	if !errors.As(err, &reuseErr) {
+		t.Fatalf("Expected CodeReusedError but got: %v", err)
+	}
+}
+
+func TestPairingSecret(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	// pair the clients with a session made with a human code
+	s0, err := c0.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1, err := c1.JoinSession(ctx, s0.Code())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s0.PairingSecret() != nil {
+		t.Fatal("Expected no pairing secret before the session is established")
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s0.Establish(ctx)
+	}()
+	if err := s1.Establish(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	secret0, secret1 := s0.PairingSecret(), s1.PairingSecret()
+	if len(secret0) < minPairingSecret || !bytes.Equal(secret0, secret1) {
+		t.Fatalf("Expected matching pairing secrets but got %x and %x", secret0, secret1)
+	}
+	s0.Close(ctx)
+	s1.Close(ctx)
+
+	if code := pairingCode(secret0); strings.Contains(code, s0.Code()) || validateCode(code) != nil {
+		t.Fatalf("Unexpected pairing code %q", code)
+	}
+
+	for i := 0; i < 2; i++ {
+		text := fmt.Sprintf("to my other device %d", i)
+		_, statusChan, err := c0.SendText(ctx, text, WithPairingSecret(secret0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c1.Receive(ctx, "", false, WithPairingSecret(secret1))
+		if err != nil {
+			t.Fatalf("Receive %d: %v", i, err)
+		}
+		body, err := ioutil.ReadAll(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != text {
+			t.Fatalf("Receive %d got %q, expected %q", i, body, text)
+		}
+		if status := <-statusChan; status.Error != nil {
+			t.Fatalf("Send %d: %v", i, status.Error)
+		}
+	}
+
+	if _, err := c1.Receive(ctx, s0.Code(), false, WithPairingSecret(secret1)); err != errPairingWithCode {
+		t.Fatalf("Expected errPairingWithCode but got: %v", err)
+	}
+	if _, _, err := c0.SendText(ctx, "short", WithPairingSecret(secret0[:8])); err != errPairingSecretTooShort {
+		t.Fatalf("Expected errPairingSecretTooShort but got: %v", err)
+	}
+}
+
+func TestPendingSends(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay
+	DefaultTransitRelayURL = "tcp://"
+
+	dir, err := ioutil.TempDir("", "wormhole-pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storeDir := filepath.Join(dir, "store")
+	restartDir := filepath.Join(dir, "restart")
+	for _, d := range []string{storeDir, restartDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileContent := []byte("left in the background")
+	filePath := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(filePath, fileContent, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.PendingStore = NewDirPendingStore(storeDir)
+
+	sendCtx, cancel := context.WithCancel(ctx)
+	textCode, textResult, err := c0.SendText(sendCtx, "still there?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fileCode, fileResult, err := c0.SendFile(sendCtx, "notes.txt", f, true, WithPendingPath(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// streams have no path to read again from, so are not recorded
+	_, streamResult, err := c0.SendStream(sendCtx, "stream.txt", bytes.NewReader(fileContent), true, WithPendingPath(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := c0.PendingStore.LoadPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("Expected 2 pending sends but got %d", len(pending))
+	}
+
+	// the process is killed: its store survives as it is now
+	restartStore := NewDirPendingStore(restartDir)
+	for _, p := range pending {
+		if err := restartStore.SavePending(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = restartStore.SavePending(&PendingSend{
+		ID:   "0123456789abcdef",
+		Side: crypto.RandSideID(),
+		Code: "42-removed-file",
+		Type: TransferFile,
+		Name: "gone.txt",
+		Path: filepath.Join(dir, "gone.txt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sends that end are removed from the store
+	cancel()
+	for _, result := range []chan SendResult{textResult, fileResult, streamResult} {
+		if r := <-result; r.Error == nil {
+			t.Fatal("Expected canceled send to fail")
+		}
+	}
+	pending, err = c0.PendingStore.LoadPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending sends after they ended but got %d", len(pending))
+	}
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.PendingStore = restartStore
+
+	resumed, err := c1.ResumePending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resumed) != 3 {
+		t.Fatalf("Expected 3 resumed sends but got %d", len(resumed))
+	}
+
+	var receiver Client
+	receiver.RendezvousURL = url
+
+	for _, r := range resumed {
+		if r.Pending.Name == "gone.txt" {
+			if !os.IsNotExist(r.Err) {
+				t.Fatalf("Expected not exist error for missing file but got: %v", r.Err)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+
+		expect := map[string]string{
+			textCode: "still there?",
+			fileCode: string(fileContent),
+		}[r.Pending.Code]
+
+		msg, err := receiver.Receive(ctx, r.Pending.Code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != expect {
+			t.Fatalf("Resumed send got %q, expected %q", got, expect)
+		}
+		if status := <-r.Result; status.Error != nil {
+			t.Fatal(status.Error)
+		}
+	}
+
+	pending, err = restartStore.LoadPending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected no pending sends after resuming but got %d", len(pending))
+	}
+}
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("concurrency", func(t *testing.T) {
+		var c Client
+		q := c.NewQueue(QueueConfig{Concurrency: 2})
+		defer q.Close()
+
+		started := make(chan int, 5)
+		release := make(chan struct{})
+		var jobs []*Job
+		for i := 0; i < 5; i++ {
+			i := i
+			j, err := q.Add(ctx, fmt.Sprintf("job%d", i), func(ctx context.Context, c *Client) error {
+				started <- i
+				select {
+				case <-release:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs = append(jobs, j)
+		}
+
+		// the first two jobs run, in either order
+		if a, b := <-started, <-started; a+b != 1 {
+			t.Fatalf("Expected jobs 0 and 1 to start but got %d and %d", a, b)
+		}
+		s := q.Status()
+		if s.Running != 2 || s.Queued != 3 || len(s.Jobs) != 5 {
+			t.Fatalf("Unexpected status: %+v", s)
+		}
+		if s.Jobs[2].Name != "job2" || s.Jobs[2].State != JobQueued || s.Jobs[2].Attempts != 0 {
+			t.Fatalf("Unexpected job status: %+v", s.Jobs[2])
+		}
+
+		close(release)
+		if err := q.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+		s = q.Status()
+		if s.Succeeded != 5 || s.Failed != 0 || len(s.Jobs) != 0 {
+			t.Fatalf("Unexpected status: %+v", s)
+		}
+		for _, j := range jobs {
+			<-j.Done()
+			if st := j.Status(); st.State != JobSucceeded || st.Attempts != 1 || j.Err() != nil {
+				t.Fatalf("Unexpected job status: %+v", st)
+			}
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		clk := clock.NewFake(time.Unix(1600000000, 0))
+		var c Client
+		c.clock = clk
+		q := c.NewQueue(QueueConfig{})
+		defer q.Close()
+
+		var attempts int32
+		j, err := q.Add(ctx, "flaky", func(ctx context.Context, c *Client) error {
+			if atomic.AddInt32(&attempts, 1) < 3 {
+				return newTransferError(CodeNetwork, PhaseTransit, io.EOF)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clk.WaitForTimers(1)
+		if st := j.Status(); st.State != JobRetrying || st.Attempts != 1 {
+			t.Fatalf("Unexpected job status: %+v", st)
+		}
+		expectTransferError(t, j.Status().Err, CodeNetwork, PhaseTransit)
+		clk.Advance(time.Second)
+
+		// the second retry waits twice as long
+		clk.WaitForTimers(1)
+		clk.Advance(time.Second)
+		select {
+		case <-j.Done():
+			t.Fatal("Job retried before its delay")
+		case <-time.After(50 * time.Millisecond):
+		}
+		clk.Advance(time.Second)
+
+		<-j.Done()
+		if st := j.Status(); st.State != JobSucceeded || st.Attempts != 3 || st.Err != nil {
+			t.Fatalf("Unexpected job status: %+v", st)
+		}
+	})
+
+	t.Run("give up", func(t *testing.T) {
+		clk := clock.NewFake(time.Unix(1600000000, 0))
+		var c Client
+		c.clock = clk
+		q := c.NewQueue(QueueConfig{MaxAttempts: 2})
+		defer q.Close()
+
+		rejected, err := q.Add(ctx, "rejected", func(ctx context.Context, c *Client) error {
+			return newTransferError(CodeRejected, PhaseTransit, errors.New("rejected"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-rejected.Done()
+		expectTransferError(t, rejected.Err(), CodeRejected, PhaseTransit)
+		if st := rejected.Status(); st.Attempts != 1 {
+			t.Fatalf("Expected no retry of a permanent error but got %+v", st)
+		}
+
+		down, err := q.Add(ctx, "down", func(ctx context.Context, c *Client) error {
+			return newTransferError(CodeTimeout, PhaseRendezvous, context.DeadlineExceeded)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clk.WaitForTimers(1)
+		clk.Advance(time.Second)
+		<-down.Done()
+		expectTransferError(t, down.Err(), CodeTimeout, PhaseRendezvous)
+		if st := down.Status(); st.Attempts != 2 || st.State != JobFailed {
+			t.Fatalf("Unexpected job status: %+v", st)
+		}
+		if s := q.Status(); s.Failed != 2 || s.Succeeded != 0 {
+			t.Fatalf("Unexpected status: %+v", s)
+		}
+	})
+
+	t.Run("cancel and close", func(t *testing.T) {
+		var c Client
+		q := c.NewQueue(QueueConfig{})
+
+		started := make(chan struct{})
+		running, err := q.Add(ctx, "running", func(ctx context.Context, c *Client) error {
+			close(started)
+			<-ctx.Done()
+			return transferError(PhaseData, ctx.Err())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queued, err := q.Add(ctx, "queued", func(ctx context.Context, c *Client) error {
+			t.Error("Canceled job was run")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-started
+
+		queued.Cancel()
+		<-queued.Done()
+		expectTransferError(t, queued.Err(), CodeCanceled, PhaseRendezvous)
+
+		q.Close()
+		<-running.Done()
+		if err := running.Err(); err != ErrQueueClosed {
+			t.Fatalf("Expected ErrQueueClosed but got %v", err)
+		}
+		if _, err := q.Add(ctx, "late", nil); err != ErrQueueClosed {
+			t.Fatalf("Expected ErrQueueClosed but got %v", err)
+		}
+	})
+
+	t.Run("transfers", func(t *testing.T) {
+		rs := rendezvousservertest.NewServerLegacy()
+		defer rs.Close()
+
+		// disable transit relay for this test
+		DefaultTransitRelayURL = "tcp://"
+
+		var c0 Client
+		c0.RendezvousURL = rs.WebSocketURL()
+		q := c0.NewQueue(QueueConfig{Concurrency: 2})
+		defer q.Close()
+
+		code, err := c0.NewInviteCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got string
+		recv, err := q.Add(ctx, "recv", func(ctx context.Context, c *Client) error {
+			msg, err := c.Receive(ctx, code, false, WithInvite())
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(msg)
+			got = string(b)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		send, err := q.Add(ctx, "send", func(ctx context.Context, c *Client) error {
+			_, resultCh, err := c.SendText(ctx, "queued hello", WithCode(code), WithInvite())
+			if err != nil {
+				return err
+			}
+			return (<-resultCh).Error
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := q.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := recv.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := send.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got != "queued hello" {
+			t.Fatalf("Expected queued hello but got %q", got)
+		}
+	})
+}
+
+func TestTransferHooks(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	record := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, fmt.Sprintf(format, args...))
+	}
+	takeCalls := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		c := calls
+		calls = nil
+		return c
+	}
+	recorder := TransferHooks{
+		BeforeOffer: func(ctx context.Context, info TransferInfo) error {
+			record("%s BeforeOffer %s", info.Side, info.Offer.Name)
+			return nil
+		},
+		AfterAnswer: func(ctx context.Context, info TransferInfo) error {
+			record("%s AfterAnswer %s", info.Side, info.Offer.Name)
+			return nil
+		},
+		BeforeAck: func(ctx context.Context, info TransferInfo, sum Checksum) error {
+			record("%s BeforeAck %s %x", info.Side, info.Offer.Name, sum.SHA256[:4])
+			return nil
+		},
+		AfterComplete: func(info TransferInfo, err error) {
+			record("%s AfterComplete %s %v", info.Side, info.Offer.Name, err)
+		},
+	}
+
+	var c0 Client
+	c0.RendezvousURL = rs.WebSocketURL()
+	c0.TransitRelayURL = relayServer.URL()
+	c0.Hooks = []TransferHooks{recorder}
+
+	var c1 Client
+	c1.RendezvousURL = rs.WebSocketURL()
+	c1.TransitRelayURL = relayServer.URL()
+	c1.Hooks = []TransferHooks{recorder}
+
+	data := []byte("scan me")
+	sum := sha256.Sum256(data)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Expected %q but got %q", data, got)
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	gotCalls := takeCalls()
+	sort.Strings(gotCalls)
+	expectCalls := []string{
+		fmt.Sprintf("receive BeforeAck file.txt %x", sum[:4]),
+		"receive AfterComplete file.txt <nil>",
+		"send AfterAnswer file.txt",
+		"send AfterComplete file.txt <nil>",
+		"send BeforeOffer file.txt",
+	}
+	sort.Strings(expectCalls)
+	if !reflect.DeepEqual(gotCalls, expectCalls) {
+		t.Fatalf("Expected calls %q but got %q", expectCalls, gotCalls)
+	}
+
+	errPolicy := errors.New("not allowed")
+
+	// a sender's BeforeOffer stops a text message from being sent
+	code, resultCh, err = c0.SendText(ctx, "secret", WithHooks(TransferHooks{
+		BeforeOffer: func(ctx context.Context, info TransferInfo) error {
+			if info.Offer.Type != TransferText {
+				t.Errorf("Expected a text offer but got %+v", info.Offer)
+			}
+			return errPolicy
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c1.Receive(ctx, code, true)
+	expectTransferError(t, err, CodePeerError, PhaseTransit)
+	result := <-resultCh
+	expectTransferError(t, result.Error, CodeDeclined, PhaseTransit)
+	if !errors.Is(result.Error, errPolicy) {
+		t.Fatalf("Expected the hook's error but got %v", result.Error)
+	}
+	takeCalls()
+
+	// a receiver's BeforeAck withholds the acknowledgment
+	code, resultCh, err = c0.SendFile(ctx, "virus.exe", bytes.NewReader(data), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = c1.Receive(ctx, code, true, WithHooks(TransferHooks{
+		BeforeAck: func(ctx context.Context, info TransferInfo, sum Checksum) error {
+			return errPolicy
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(receiver)
+	expectTransferError(t, err, CodeDeclined, PhaseData)
+	result = <-resultCh
+	expectTransferError(t, result.Error, CodeIntegrity, PhaseData)
+
+	gotCalls = takeCalls()
+	var receiverFailed bool
+	for _, c := range gotCalls {
+		if c == "receive AfterComplete virus.exe not allowed" {
+			receiverFailed = true
+		}
+	}
+	if !receiverFailed {
+		t.Fatalf("Expected the receiver's AfterComplete to see the hook's error but got %q", gotCalls)
+	}
+
+	// a sender's AfterAnswer stops the data from being sent
+	code, resultCh, err = c0.SendFile(ctx, "over-quota.bin", bytes.NewReader(data), true, WithHooks(TransferHooks{
+		AfterAnswer: func(ctx context.Context, info TransferInfo) error {
+			return errPolicy
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(receiver); err == nil {
+		t.Fatal("Expected read to fail")
+	}
+	result = <-resultCh
+	expectTransferError(t, result.Error, CodeDeclined, PhaseTransit)
+}
+
+func TestSaveTo(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = rs.WebSocketURL()
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = rs.WebSocketURL()
+	c1.TransitRelayURL = relayServer.URL()
+
+	dir, err := ioutil.TempDir("", "wormhole-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saveFile := func(name string, data []byte, opts ...TransferOption) (string, error, SendResult) {
+		t.Helper()
+		code, resultCh, err := c0.SendFile(ctx, name, bytes.NewReader(data), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c1.Receive(ctx, code, true, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := msg.SaveTo(dir)
+		return p, err, <-resultCh
+	}
+	expectFile := func(p string, data []byte) {
+		t.Helper()
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("Expected %s to hold %d bytes %.20q but got %d bytes %.20q", p, len(data), data, len(got), got)
+		}
+	}
+
+	first := []byte("first version")
+	second := []byte("second version")
+
+	p, err, result := saveFile("file.txt", first)
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	if p != filepath.Join(dir, "file.txt") {
+		t.Fatalf("Unexpected path %s", p)
+	}
+	expectFile(p, first)
+
+	_, err, result = saveFile("file.txt", second)
+	if !errors.Is(err, ErrFileExists) {
+		t.Fatalf("Expected ErrFileExists but got %v", err)
+	}
+	expectTransferError(t, result.Error, CodeRejected, PhaseTransit)
+	expectFile(p, first)
+
+	_, err, result = saveFile("file.txt", second, WithCollisionPolicy(CollisionOverwrite))
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	expectFile(p, second)
+
+	for i, name := range []string{"file (1).txt", "file (2).txt"} {
+		p, err, result := saveFile("file.txt", []byte{byte(i)}, WithCollisionPolicy(CollisionRename))
+		if err != nil || !result.OK {
+			t.Fatalf("Save failed: %v %+v", err, result)
+		}
+		if p != filepath.Join(dir, name) {
+			t.Fatalf("Expected %s but got %s", name, p)
+		}
+		expectFile(p, []byte{byte(i)})
+	}
+
+	var asked []string
+	p, err, result = saveFile("file.txt", first, WithCollisionFunc(func(path string, offer Offer) CollisionPolicy {
+		asked = append(asked, path, offer.Name)
+		return CollisionOverwrite
+	}))
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	if expect := []string{p, "file.txt"}; !reflect.DeepEqual(asked, expect) {
+		t.Fatalf("Expected callback with %q but got %q", expect, asked)
+	}
+	expectFile(p, first)
+
+	// resume a partial file
+	big := make([]byte, 100000)
+	mathrand.New(mathrand.NewSource(1)).Read(big)
+	bigPath := filepath.Join(dir, "big.bin")
+	if err := ioutil.WriteFile(bigPath, big[:40000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	var progressStart int64 = -1
+	_, err, result = saveFile("big.bin", big, WithCollisionPolicy(CollisionResume), WithProgress(func(sent, total int64) {
+		if progressStart < 0 {
+			progressStart = sent
+		}
+	}))
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	expectFile(bigPath, big)
+	if progressStart < 40000 {
+		t.Fatalf("Expected the transfer to start after the partial file but it started at %d", progressStart)
+	}
+
+	// a file larger than the offer is not a partial copy of it
+	_, err, _ = saveFile("big.bin", big[:10], WithCollisionPolicy(CollisionResume))
+	if !errors.Is(err, ErrFileExists) {
+		t.Fatalf("Expected ErrFileExists but got %v", err)
+	}
+	expectFile(bigPath, big)
+
+	for _, name := range []string{"..", "a/b"} {
+		if safeSaveName(name) {
+			t.Errorf("Expected %q to be refused", name)
+		}
+	}
+	for name, expect := range map[string]string{
+		"file.txt":  "file (3).txt",
+		"a.tar.gz":  "a.tar (3).gz",
+		".profile":  ".profile (3)",
+		"noext":     "noext (3)",
+		"trailing.": "trailing (3).",
+	} {
+		if got := renamed(name, 3); got != expect {
+			t.Errorf("renamed(%q) = %q, expected %q", name, got, expect)
+		}
+	}
+
+	saveDir := func(files map[string]string, opts ...TransferOption) (string, error, SendResult) {
+		t.Helper()
+		var entries []DirectoryEntry
+		for name, content := range files {
+			content := content
+			entries = append(entries, DirectoryEntry{
+				Path: "photos/" + name,
+				Mode: 0644,
+				Reader: func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(content)), nil
+				},
+			})
+		}
+		code, resultCh, err := c0.SendDirectory(ctx, "photos", entries, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := c1.Receive(ctx, code, true, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := msg.SaveTo(dir)
+		return p, err, <-resultCh
+	}
+
+	p, err, result = saveDir(map[string]string{"a.jpg": "a", "sub/b.jpg": "b"})
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	expectFile(filepath.Join(p, "a.jpg"), []byte("a"))
+	expectFile(filepath.Join(p, "sub", "b.jpg"), []byte("b"))
+
+	_, err, _ = saveDir(map[string]string{"c.jpg": "c"})
+	if !errors.Is(err, ErrFileExists) {
+		t.Fatalf("Expected ErrFileExists but got %v", err)
+	}
+
+	p, err, result = saveDir(map[string]string{"c.jpg": "c"}, WithCollisionPolicy(CollisionRename))
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	if p != filepath.Join(dir, "photos (1)") {
+		t.Fatalf("Unexpected path %s", p)
+	}
+	expectFile(filepath.Join(p, "c.jpg"), []byte("c"))
+
+	p, err, result = saveDir(map[string]string{"d.jpg": "d"}, WithCollisionPolicy(CollisionOverwrite))
+	if err != nil || !result.OK {
+		t.Fatalf("Save failed: %v %+v", err, result)
+	}
+	expectFile(filepath.Join(p, "d.jpg"), []byte("d"))
+	if _, err := os.Stat(filepath.Join(p, "a.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old directory to be replaced but got %v", err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	expectNames := []string{"big.bin", "file (1).txt", "file (2).txt", "file.txt", "photos", "photos (1)"}
+	if !reflect.DeepEqual(names, expectNames) {
+		t.Fatalf("Expected %q in %s but got %q", expectNames, dir, names)
+	}
+}
+
+// recordingWriter records the size of each write, and fails once it
+// has taken failAfter bytes if failAfter is set.
+type recordingWriter struct {
+	bytes.Buffer
+	writes    []int
+	failAfter int
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.failAfter > 0 && w.Len()+len(p) > w.failAfter {
+		n, _ := w.Buffer.Write(p[:w.failAfter-w.Len()])
+		w.writes = append(w.writes, n)
+		return n, errors.New("disk full")
+	}
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func TestIncomingMessageWriteTo(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = rs.WebSocketURL()
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = rs.WebSocketURL()
+	c1.TransitRelayURL = relayServer.URL()
+
+	const recordSize = 64 << 10
+	data := make([]byte, 5*recordSize+1000)
+	mathrand.New(mathrand.NewSource(1)).Read(data)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.bin", bytes.NewReader(data), true, WithBufferSize(recordSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w recordingWriter
+	n, err := io.Copy(&w, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(w.Bytes(), data) {
+		t.Fatalf("Expected %d bytes to be copied but got %d", len(data), n)
+	}
+	// each record is written whole, rather than through io.Copy's
+	// smaller buffer
+	expectWrites := []int{recordSize, recordSize, recordSize, recordSize, recordSize, 1000}
+	if !reflect.DeepEqual(w.writes, expectWrites) {
+		t.Fatalf("Expected writes of %v but got %v", expectWrites, w.writes)
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+	if n, err := msg.WriteTo(&w); n != 0 || err != io.EOF {
+		t.Fatalf("Expected io.EOF after the end of the data but got %d, %v", n, err)
+	}
+
+	// a failed write leaves the rest of the data to be read
+	code, resultCh, err = c0.SendFile(ctx, "file.bin", bytes.NewReader(data), true, WithBufferSize(recordSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := recordingWriter{failAfter: recordSize + 100}
+	n, err = msg.WriteTo(&failing)
+	if err == nil || err.Error() != "disk full" {
+		t.Fatalf("Expected the write error but got %v", err)
+	}
+	if n != recordSize+100 {
+		t.Fatalf("Expected %d bytes to be written but got %d", recordSize+100, n)
+	}
+	rest, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(failing.Bytes(), rest...); !bytes.Equal(got, data) {
+		t.Fatal("Expected the rest of the data after the failed write")
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// text messages
+	code, resultCh, err = c0.SendText(ctx, "some text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text bytes.Buffer
+	if _, err := msg.WriteTo(&text); err != nil || text.String() != "some text" {
+		t.Fatalf("Expected some text but got %q, %v", text.String(), err)
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestVersionPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	_, err := c1.Receive(ctx, "1-a-b", false, WithVersionPolicy(VersionPolicy{
+		Require: []string{abilityResumeV1},
+		Forbid:  []string{abilityResumeV1},
+	}))
+	if err == nil {
+		t.Fatal("Expected error for contradictory policy")
+	}
+
+	code, statusChan, err := c0.SendText(ctx, "compatible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c1.Receive(ctx, code, false, WithVersionPolicy(VersionPolicy{
+		Require: []string{abilityResumeV1, abilityStreamV1},
+		Forbid:  []string{"transfer-unknown-v1"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(msg); err != nil {
+		t.Fatal(err)
+	}
+	if status := <-statusChan; status.Error != nil {
+		t.Fatal(status.Error)
+	}
+
+	code, statusChan, err = c0.SendText(ctx, "incompatible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c1.Receive(ctx, code, false, WithVersionPolicy(VersionPolicy{
+		Require: []string{"transfer-unknown-v1", abilityStreamV1},
+		Forbid:  []string{abilityResumeV1},
+	}))
+	var mismatch *VersionMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected VersionMismatchError but got: %v", err)
+	}
+	if !reflect.DeepEqual(mismatch.Missing, []string{"transfer-unknown-v1"}) ||
+		!reflect.DeepEqual(mismatch.Forbidden, []string{abilityResumeV1}) {
+		t.Fatalf("Unexpected mismatch: %+v", mismatch)
+	}
+	expectTransferError(t, err, CodeProtocol, PhasePake)
+
+	status := <-statusChan
+	expectTransferError(t, status.Error, CodePeerError, PhaseTransit)
+}
+
+// expectTransferError checks that err is a TransferError with code and
+// phase.
+func expectTransferError(t *testing.T, err error, code ErrorCode, phase TransferPhase) {
+	t.Helper()
+
+	var te *TransferError
+	if !errors.As(err, &te) {
+		t.Fatalf("Expected a TransferError but got %T: %v", err, err)
+	}
+	if te.Code != code || te.Phase != phase {
+		t.Fatalf("Expected TransferError %s in phase %s but got %s in phase %s: %v", code, phase, te.Code, te.Phase, err)
+	}
+}
+
+func TestWormholeFileReject(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	buf := bytes.NewReader(fileContent)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.Reject()
+
+	result := <-resultCh
+	expectErr := "TransferError: transfer rejected"
+	expectMood := "happy"
+
+	//checks clients closure status in Mailbox
+	closeMoods := rs.CloseMoods()
+
+	if closeMoods == nil {
+		t.Fatalf("Expected to get mood, but got nothing")
+	}
+
+	for side, mood := range closeMoods {
+		if mood != expectMood {
+			t.Fatalf("Expected %q result, but got: %+v, side: %+v", expectMood, mood, side)
+		}
+	}
+	if result.Error.Error() != expectErr {
+		t.Fatalf("Expected %q result, but got: %+v", expectErr, result)
+	}
+	expectTransferError(t, result.Error, CodeRejected, PhaseTransit)
+}
+
+func TestWormholePeerMood(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mood := receiver.PeerMood(); mood != "" {
+		t.Fatalf("got peer mood %q before the sender closed", mood)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Fatal("received file differs from the one sent")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+	if result.PeerMood != rendezvous.Happy {
+		t.Fatalf("got peer mood %q expected %q", result.PeerMood, rendezvous.Happy)
+	}
+}
+
+func TestWormholetestServer(t *testing.T) {
+	ctx := context.Background()
+
+	for name, newServer := range map[string]func() *wormholetest.Server{
+		"TCP":    wormholetest.NewServer,
+		"WS":     wormholetest.NewWSServer,
+		"Memory": wormholetest.NewMemServer,
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := newServer()
+			defer srv.Close()
+
+			var c0 Client
+			c0.RendezvousURL = srv.RendezvousURL()
+			c0.TransitRelayURL = srv.TransitRelayURL()
+
+			var c1 Client
+			c1.RendezvousURL = srv.RendezvousURL()
+			c1.TransitRelayURL = srv.TransitRelayURL()
+
+			if srv.Network != nil {
+				c0.Dial = srv.Network.Dial
+				c1.Dial = srv.Network.Dial
+			}
+
+			fileContent := []byte("pyramid-gremlin")
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithTransitPolicy(TransitRelayOnly))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true, WithTransitPolicy(TransitRelayOnly))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+}
+
+func TestWormholeSeededRand(t *testing.T) {
+	ctx := context.Background()
+
+	fileContent := []byte("quadrant-wormwood")
+
+	// transfer returns the code and the sender's transfer ID of a file
+	// transfer with a sender seeded with seed, on fresh servers so
+	// that the nameplates match too.
+	transfer := func(seed int64) (string, string) {
+		srv := wormholetest.NewServer()
+		defer srv.Close()
+
+		var sendLog bytes.Buffer
+
+		var c0 Client
+		c0.RendezvousURL = srv.RendezvousURL()
+		c0.TransitRelayURL = srv.TransitRelayURL()
+		c0.AuditLog = &sendLog
+		c0.setRand(mathrand.New(mathrand.NewSource(seed)))
+
+		var c1 Client
+		c1.RendezvousURL = srv.RendezvousURL()
+		c1.TransitRelayURL = srv.TransitRelayURL()
+
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithTransitPolicy(TransitRelayOnly))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver, err := c1.Receive(ctx, code, true, WithTransitPolicy(TransitRelayOnly))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadAll(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, fileContent) {
+			t.Fatalf("File contents mismatch")
+		}
+
+		result := <-resultCh
+		if !result.OK {
+			t.Fatalf("Expected ok result but got: %+v", result)
+		}
+
+		var rec AuditRecord
+		err = json.Unmarshal(sendLog.Bytes(), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code, rec.TransferID
+	}
+
+	code0, id0 := transfer(1)
+	code1, id1 := transfer(1)
+	if code0 != code1 || id0 != id1 {
+		t.Fatalf("Expected the same seed to give the same code and transfer ID but got %s %s and %s %s", code0, id0, code1, id1)
+	}
+
+	code2, id2 := transfer(2)
+	if code2 == code0 || id2 == id0 {
+		t.Fatalf("Expected another seed to give another code and transfer ID but got %s %s twice", code2, id2)
+	}
+}
+
+func TestWormholeExhaustedRand(t *testing.T) {
+	ctx := context.Background()
+
+	srv := wormholetest.NewServer()
+	defer srv.Close()
+
+	var c0 Client
+	c0.RendezvousURL = srv.RendezvousURL()
+	c0.TransitRelayURL = srv.TransitRelayURL()
+	// enough for the transfer ID but not the side ID
+	c0.setRand(bytes.NewReader(make([]byte, 8)))
+
+	_, _, err := c0.SendText(ctx, "hello")
+	if err == nil {
+		t.Fatal("Expected an error from an exhausted random source")
+	}
+}
+
+func TestWormholePeerTransitHints(t *testing.T) {
+	ctx := context.Background()
+
+	srv := wormholetest.NewServer()
+	defer srv.Close()
+
+	relay, err := url.Parse(srv.TransitRelayURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c0 Client
+	c0.RendezvousURL = srv.RendezvousURL()
+	c0.TransitRelayURL = srv.TransitRelayURL()
+
+	var c1 Client
+	c1.RendezvousURL = srv.RendezvousURL()
+	c1.TransitRelayURL = srv.TransitRelayURL()
+
+	fileContent := []byte("hexagram-lowland")
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abilities := strings.Join(receiver.PeerTransitAbilities, ",")
+	if abilities != "direct-tcp-v1,relay-v1" {
+		t.Fatalf("Expected direct and relay abilities but got %s", abilities)
+	}
+
+	var direct, relays int
+	for _, hint := range receiver.PeerTransitHints {
+		switch hint.Type {
+		case "direct-tcp-v1":
+			direct++
+			if hint.Hostname == "" || hint.Port == 0 {
+				t.Fatalf("Expected an address in direct hint but got %+v", hint)
+			}
+		case "relay-v1":
+			relays++
+			if len(hint.Endpoints) != 1 {
+				t.Fatalf("Expected one relay endpoint but got %+v", hint)
+			}
+			endpoint := hint.Endpoints[0]
+			if endpoint.Type != "direct-tcp-v1" || endpoint.Hostname != relay.Hostname() || strconv.Itoa(endpoint.Port) != relay.Port() {
+				t.Fatalf("Expected endpoint %s but got %+v", relay.Host, endpoint)
+			}
+		}
+	}
+	if direct == 0 || relays != 1 {
+		t.Fatalf("Expected direct hints and one relay hint but got %+v", receiver.PeerTransitHints)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestWormholeTransitFaults(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	fileContent := make([]byte, 1<<18)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		fault func(p *wormholetest.Proxy)
+		code  ErrorCode
+	}{
+		{
+			name: "corrupt record",
+			fault: func(p *wormholetest.Proxy) {
+				p.CorruptAt(wormholetest.ToClient, 1<<16)
+			},
+			code: CodeIntegrity,
+		},
+		{
+			name: "drop mid-transfer",
+			fault: func(p *wormholetest.Proxy) {
+				p.DropAt(wormholetest.ToClient, 1<<16)
+			},
+			code: CodeNetwork,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			relayServer := wormholetest.NewTCPRelay()
+			defer relayServer.Close()
+
+			proxy, err := wormholetest.NewProxy(relayServer.URL())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+			proxy.SetLatency(time.Millisecond)
+			tc.fault(proxy)
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = proxy.URL()
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = proxy.URL()
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, WithTransitPolicy(TransitRelayOnly))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, false, WithTransitPolicy(TransitRelayOnly))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ioutil.ReadAll(receiver)
+			expectTransferError(t, err, tc.code, PhaseData)
+
+			// either way the sender sees the connection close without an ack
+			result := <-resultCh
+			if result.OK {
+				t.Fatal("Expected the sender to see the transfer fail")
+			}
+			expectTransferError(t, result.Error, CodeNetwork, PhaseData)
+
+			if proxy.Connections() != 2 {
+				t.Fatalf("Expected 2 connections through the proxy, got %d", proxy.Connections())
+			}
+		})
+	}
+}
+
+func TestWormholeMemNetwork(t *testing.T) {
+	ctx := context.Background()
+
+	srv := wormholetest.NewMemServer()
+	defer srv.Close()
+
+	// every connection is dialed in memory
+	var dials int32
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return srv.Network.Dial(ctx, network, addr)
+	}
+
+	var c0 Client
+	c0.RendezvousURL = srv.RendezvousURL()
+	c0.TransitRelayURL = srv.TransitRelayURL()
+	c0.Dial = dial
+
+	var c1 Client
+	c1.RendezvousURL = srv.RendezvousURL()
+	c1.TransitRelayURL = srv.TransitRelayURL()
+	c1.Dial = dial
+
+	fileContent := make([]byte, 1<<18)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	// no transit policy: the clients must not offer direct hints
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// two rendezvous connections and two relay connections
+	if n := atomic.LoadInt32(&dials); n != 4 {
+		t.Fatalf("Expected 4 dials but got %d", n)
+	}
+
+	// direct-only transit can't work without a listener
+	_, _, err = c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, WithTransitPolicy(TransitDirectOnly))
+	if err == nil {
+		t.Fatal("Expected direct-only transit to be rejected")
+	}
+
+	var unreachable Client
+	unreachable.RendezvousURL = "ws://nowhere.wormhole.test:4000/v1"
+	unreachable.Dial = srv.Network.Dial
+	_, _, err = unreachable.SendText(ctx, "hello")
+	if err == nil {
+		t.Fatal("Expected dialing an address with no listener to fail")
+	}
+}
+
+func TestWormholeOfferBeforeVersion(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// a sender that sends its offer before its version, and then a
+	// message of a phase we don't use
+	var c0 Client
+	side := crypto.RandSideID()
+	rc := rendezvous.NewClient(url, side, c0.AppID)
+	if _, err := rc.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close(ctx, rendezvous.Happy)
+
+	nameplate, err := rc.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := nameplate + "-quadrant-hydraulic"
+
+	sendErr := make(chan error, 1)
+	go func() {
+		cp := newClientProtocol(ctx, rc, side, c0.AppID)
+		if err := cp.WritePake(ctx, code); err != nil {
+			sendErr <- err
+			return
+		}
+		if err := cp.ReadPake(ctx); err != nil {
+			sendErr <- err
+			return
+		}
+		text := "sardine-endorse"
+		err := cp.WriteAppData(ctx, &genericMessage{Offer: &offerMsg{Message: &text}})
+		if err == nil {
+			err = cp.WriteVersion(ctx)
+		}
+		if err == nil {
+			err = sendEncryptedMessage(ctx, rc, rand.Reader, []byte("{}"), cp.sharedKey, side, "dilate-0")
+		}
+		sendErr <- err
+	}()
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "sardine-endorse" {
+		t.Fatalf("got message %q", got)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMsgCollectorOutOfOrder(t *testing.T) {
+	key := make([]byte, 32)
+	side := crypto.RandSideID()
+
+	seal := func(phase string, msg genericMessage) rendezvous.MailboxEvent {
+		out, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sealKey [32]byte
+		copy(sealKey[:], derivePhaseKey(key, side, phase))
+		nonce := crypto.RandNonce()
+		sealed := secretbox.Seal(nonce[:], out, &nonce, &sealKey)
+		return rendezvous.MailboxEvent{Side: side, Phase: phase, Body: hex.EncodeToString(sealed)}
+	}
+
+	ch := make(chan rendezvous.MailboxEvent, 3)
+	// the transit hints and offer arrive together, after the answer to
+	// an offer of ours and a message of a phase we don't use
+	ch <- rendezvous.MailboxEvent{Side: side, Phase: "dilate-0", Body: "not even hex"}
+	ch <- seal("1", genericMessage{
+		Offer:   &offerMsg{File: &offerFile{FileName: "tapeworm.txt"}},
+		Transit: &transitMsg{HintsV1: []transitHintsV1{}},
+	})
+	ch <- seal("2", genericMessage{Verified: &verifiedMsg{}})
+	early := []rendezvous.MailboxEvent{
+		seal("0", genericMessage{Answer: &answerMsg{FileAck: "ok"}}),
+	}
+
+	collector := newMsgCollector(append([]byte(nil), key...))
+	collector.checkMessage = func(rendezvous.MailboxEvent) error { return nil }
+	go collector.collect(early, ch)
+	defer collector.close()
+
+	var verified verifiedMsg
+	if err := collector.waitFor(&verified); err != nil {
+		t.Fatal(err)
+	}
+	var transit transitMsg
+	if err := collector.waitFor(&transit); err != nil {
+		t.Fatal(err)
+	}
+	var offer offerMsg
+	if err := collector.waitFor(&offer); err != nil {
+		t.Fatal(err)
+	}
+	if offer.File == nil || offer.File.FileName != "tapeworm.txt" {
+		t.Fatalf("got offer %+v", offer)
+	}
+	var answer answerMsg
+	if err := collector.waitFor(&answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.FileAck != "ok" {
+		t.Fatalf("got answer %+v", answer)
+	}
+}
+
+func TestWormholeOfferMessage(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	t.Run("with file", func(t *testing.T) {
+		var c0 Client
+		c0.RendezvousURL = url
+
+		var c1 Client
+		c1.RendezvousURL = url
+
+		note := "Dalmatians-hydroponic"
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, WithMessage(note))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var offer Offer
+		receiver, err := c1.Receive(ctx, code, false, WithOfferCallback(func(o Offer) bool {
+			offer = o
+			return true
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if receiver.Type != TransferFile || receiver.Message != note {
+			t.Fatalf("got %s offer with message %q, expected a file with message %q", receiver.Type, receiver.Message, note)
+		}
+		if offer.Type != TransferFile || offer.Message != note {
+			t.Fatalf("offer callback got %+v", offer)
+		}
+
+		got, err := ioutil.ReadAll(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, fileContent) {
+			t.Fatalf("File contents mismatch")
+		}
+
+		result := <-resultCh
+		if !result.OK {
+			t.Fatalf("Expected ok result but got: %+v", result)
+		}
+	})
+
+	t.Run("with text", func(t *testing.T) {
+		var c0 Client
+		c0.RendezvousURL = url
+
+		_, _, err := c0.SendText(ctx, "ignobly-ravines", WithMessage("cornflowers"))
+		if err != errMessageWithText {
+			t.Fatalf("got %v, expected errMessageWithText", err)
+		}
+	})
+
+	t.Run("peer without support", func(t *testing.T) {
+		var c0 Client
+		c0.RendezvousURL = url
+
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, WithMessage("subsidy-catamarans"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a receiver that takes any offer with a message for text, like
+		// the python client, and so doesn't claim the ability
+		side := crypto.RandSideID()
+		rc := rendezvous.NewClient(url, side, c0.AppID)
+		if _, err := rc.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close(ctx, rendezvous.Happy)
+
+		nameplate, err := nameplateFromCode(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rc.AttachMailbox(ctx, nameplate); err != nil {
+			t.Fatal(err)
+		}
+
+		cp := newClientProtocol(ctx, rc, side, c0.AppID)
+		if err := cp.WritePake(ctx, code); err != nil {
+			t.Fatal(err)
+		}
+		if err := cp.ReadPake(ctx); err != nil {
+			t.Fatal(err)
+		}
+		versions, err := json.Marshal(genericMessage{AppVersions: &appVersionsMsg{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sendEncryptedMessage(ctx, rc, rand.Reader, versions, cp.sharedKey, side, "version"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case result := <-resultCh:
+			if !errors.Is(result.Error, ErrMessageUnsupported) {
+				t.Fatalf("Expected ErrMessageUnsupported but got: %+v", result)
+			}
+			expectTransferError(t, result.Error, CodeProtocol, PhaseTransit)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the send result")
+		}
+	})
+}
+
+func TestWormholeChecksumCallback(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+	expectSum := sha256.Sum256(fileContent)
+
+	for _, streaming := range []bool{false, true} {
+		var got []Checksum
+		checksumOpt := WithChecksumCallback(func(sum Checksum) error {
+			got = append(got, sum)
+			return nil
+		})
+
+		var (
+			code     string
+			resultCh chan SendResult
+			err      error
+		)
+		if streaming {
+			code, resultCh, err = c0.SendStream(ctx, "file.txt", bytes.NewReader(fileContent), false)
+		} else {
+			code, resultCh, err = c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver, err := c1.Receive(ctx, code, false, checksumOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotContent, err := ioutil.ReadAll(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotContent, fileContent) {
+			t.Fatalf("File contents mismatch")
+		}
+		if result := <-resultCh; !result.OK {
+			t.Fatalf("Expected ok result but got: %+v", result)
+		}
+
+		if len(got) != 1 {
+			t.Fatalf("Expected one checksum callback but got %d", len(got))
+		}
+		if !bytes.Equal(got[0].SHA256, expectSum[:]) || !bytes.Equal(got[0].SenderSHA256, expectSum[:]) {
+			t.Fatalf("Got checksums %x and %x, expected %x", got[0].SHA256, got[0].SenderSHA256, expectSum)
+		}
+	}
+
+	// a failing callback withholds the ack
+	errInvalid := errors.New("not a valid archive")
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := c1.Receive(ctx, code, false, WithChecksumCallback(func(Checksum) error {
+		return errInvalid
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(receiver)
+	if !errors.Is(err, errInvalid) {
+		t.Fatalf("Expected %q error but got: %v", errInvalid, err)
+	}
+	expectTransferError(t, err, CodeIntegrity, PhaseData)
+
+	result := <-resultCh
+	if result.OK {
+		t.Fatalf("Expected send to fail but got: %+v", result)
+	}
+	expectTransferError(t, result.Error, CodeIntegrity, PhaseData)
+}
+
+func TestWormholeMaxOfferSize(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	fileContent := make([]byte, 1<<16)
+
+	if _, err := c1.Receive(ctx, "1-a-b", false, WithMaxOfferSize(0)); err == nil {
+		t.Fatal("Expected error for max offer size 0")
+	}
+
+	// at the limit
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := c1.Receive(ctx, code, false, WithMaxOfferSize(int64(len(fileContent))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(receiver); err != nil {
+		t.Fatal(err)
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// over the limit
+	offerCalled := false
+	code, resultCh, err = c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c1.Receive(ctx, code, false, WithMaxOfferSize(int64(len(fileContent)-1)), WithOfferCallback(func(Offer) bool {
+		offerCalled = true
+		return true
+	}))
+	if !errors.Is(err, ErrOfferTooLarge) || !errors.Is(err, ErrOfferDeclined) {
+		t.Fatalf("Expected %q error but got: %v", ErrOfferTooLarge, err)
+	}
+	expectTransferError(t, err, CodeDeclined, PhaseTransit)
+	if offerCalled {
+		t.Fatal("Offer callback called for an offer over the limit")
+	}
+	result := <-resultCh
+	expectTransferError(t, result.Error, CodeRejected, PhaseTransit)
+
+	// streams are cut off once they pass the limit
+	code, resultCh, err = c0.SendStream(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = c1.Receive(ctx, code, false, WithMaxOfferSize(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(receiver)
+	if !errors.Is(err, ErrOfferTooLarge) {
+		t.Fatalf("Expected %q error but got: %v", ErrOfferTooLarge, err)
+	}
+	if result := <-resultCh; result.OK {
+		t.Fatalf("Expected send to fail but got: %+v", result)
+	}
+}
+
+func TestWormholeFileTransportSendRecvViaRelayServer(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+			relayURL := relayServer.URL()
+			defer relayServer.Close()
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayURL
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayURL
+
+			fileContent := make([]byte, 1<<16)
+			for i := 0; i < len(fileContent); i++ {
+				fileContent[i] = byte(i)
+			}
+
+			buf := bytes.NewReader(fileContent)
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+}
+
+func TestWormholeRelayHintEndpoints(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	// an endpoint of the relay hint that nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "tcp://" + l.Addr().String()
+	l.Close()
+
+	var c0 Client
+	c0.RendezvousURL = rs.WebSocketURL()
+	c0.TransitRelayURL = relayServer.URL()
+	c0.TransitRelayEndpoints = []string{deadURL}
+
+	// the receiver only learns of the relay from the sender's hint
+	var c1 Client
+	c1.RendezvousURL = rs.WebSocketURL()
+	c1.TransitRelayURL = "tcp://"
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestWormholeFileTransportProgressStats(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<16)
+
+	var sendStats, recvStats []TransferStats
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithProgressStats(func(s TransferStats) {
+		sendStats = append(sendStats, s)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true, WithProgressStats(func(s TransferStats) {
+		recvStats = append(recvStats, s)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	for name, stats := range map[string][]TransferStats{"send": sendStats, "recv": recvStats} {
+		if len(stats) == 0 {
+			t.Fatalf("%s: expected progress stats", name)
+		}
+		last := stats[len(stats)-1]
+		if last.Bytes != int64(len(fileContent)) || last.Total != int64(len(fileContent)) {
+			t.Errorf("%s: expected %d/%d bytes, got %d/%d", name, len(fileContent), len(fileContent), last.Bytes, last.Total)
+		}
+		// both sides have the listener disabled, so this must have gone through the relay
+		if !last.Relayed {
+			t.Errorf("%s: expected transfer to be relayed", name)
+		}
+	}
+}
+
+func TestWormholeStreamTransportSendRecv(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	for _, size := range []int{0, 1 << 16} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			fileContent := make([]byte, size)
+			for i := 0; i < len(fileContent); i++ {
+				fileContent[i] = byte(i)
+			}
+
+			// hide the Seek method so nothing can learn the length up front
+			r := ioutil.NopCloser(bytes.NewReader(fileContent))
+
+			code, resultCh, err := c0.SendStream(ctx, "stream.bin", r, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !receiver.UnknownLength() {
+				t.Fatal("Expected an offer of unknown length")
+			}
+			if receiver.PeerCanResume() {
+				t.Fatal("Expected streamed offers not to be resumable")
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+}
+
+func TestWormholeStreamReadDone(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 10000)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	code, resultCh, err := c0.SendStream(ctx, "stream.bin", ioutil.NopCloser(bytes.NewReader(fileContent)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !receiver.UnknownLength() {
+		t.Fatal("Expected an offer of unknown length")
+	}
+
+	// read in small chunks until ReadDone, the way the wasm bindings do
+	var got []byte
+	buf := make([]byte, 1000)
+	for !receiver.ReadDone() {
+		n, err := receiver.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receiver.ReadDone() && len(got) < len(fileContent) {
+			t.Fatalf("ReadDone after %d of %d bytes", len(got), len(fileContent))
+		}
+	}
+
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch: got %d bytes, expected %d", len(got), len(fileContent))
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestWormholeOfferCallback(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1000)
+
+	for _, accept := range []bool{true, false} {
+		t.Run(fmt.Sprintf("accept %t", accept), func(t *testing.T) {
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotOffer Offer
+			receiver, err := c1.Receive(ctx, code, true, WithOfferCallback(func(o Offer) bool {
+				gotOffer = o
+				return accept
+			}))
+
+			expectOffer := Offer{
+				Type:                TransferFile,
+				Name:                "file.txt",
+				TransferBytes64:     int64(len(fileContent)),
+				UncompressedBytes64: int64(len(fileContent)),
+				FileCount:           1,
+			}
+			if gotOffer != expectOffer {
+				t.Fatalf("Offer mismatch got=%+v expected=%+v", gotOffer, expectOffer)
+			}
+
+			if !accept {
+				if !errors.Is(err, ErrOfferDeclined) {
+					t.Fatalf("Expected ErrOfferDeclined but got: %v", err)
+				}
+				expectTransferError(t, err, CodeDeclined, PhaseTransit)
+
+				result := <-resultCh
+				if result.OK || result.Error == nil {
+					t.Fatalf("Expected send to fail after rejection but got: %+v", result)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+}
+
+func TestWormholeTransitPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<16)
+
+	for _, policy := range []TransitPolicy{TransitRelayOnly, TransitDirectOnly} {
+		t.Run(fmt.Sprintf("policy %d", policy), func(t *testing.T) {
+			var relayed []bool
+			statsOpt := WithProgressStats(func(s TransferStats) {
+				relayed = append(relayed, s.Relayed)
+			})
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, WithTransitPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, false, WithTransitPolicy(policy), statsOpt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+
+			expectRelayed := policy == TransitRelayOnly
+			for _, r := range relayed {
+				if r != expectRelayed {
+					t.Fatalf("Expected relayed=%t for policy %d", expectRelayed, policy)
+				}
+			}
+		})
+	}
+
+	_, _, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithTransitPolicy(TransitDirectOnly))
+	if err == nil {
+		t.Fatal("Expected direct-only send without a listener to fail")
+	}
+}
+
+func TestWormholeEvents(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<16)
+
+	sendEvents := make(chan Event, 100)
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithEvents(sendEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recvEvents := make(chan Event, 100)
+	receiver, err := c1.Receive(ctx, code, true, WithEvents(recvEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	checkEvents := func(name string, ch chan Event, expect []EventType) {
+		close(ch)
+
+		var (
+			got       []EventType
+			progress  int
+			lastEvent Event
+		)
+		for e := range ch {
+			lastEvent = e
+			switch e.Type {
+			case EventCodeAllocated:
+				if e.Code != code {
+					t.Errorf("%s: code mismatch got=%s expected=%s", name, e.Code, code)
+				}
+			case EventVerifier:
+				if e.Verifier == "" {
+					t.Errorf("%s: empty verifier", name)
+				}
+			case EventTransitConnected:
+				if !e.Relayed {
+					t.Errorf("%s: expected relayed connection", name)
+				}
+			case EventProgress:
+				progress++
+				continue
+			}
+			got = append(got, e.Type)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(expect) {
+			t.Errorf("%s: events got=%v expected=%v", name, got, expect)
+		}
+		if progress == 0 || progress > 10 {
+			t.Errorf("%s: expected 1-10 progress events but got %d", name, progress)
+		}
+		if lastEvent.Bytes != int64(len(fileContent)) || lastEvent.Total != int64(len(fileContent)) {
+			t.Errorf("%s: final event %+v does not cover the whole file", name, lastEvent)
+		}
+	}
+
+	checkEvents("send", sendEvents, []EventType{
+		EventCodeAllocated,
+		EventPakeComplete,
+		EventVerifier,
+		EventTransitConnecting,
+		EventTransitConnected,
+		EventCompleted,
+	})
+	checkEvents("recv", recvEvents, []EventType{
+		EventPakeComplete,
+		EventVerifier,
+		EventTransitConnecting,
+		EventTransitConnected,
+		EventCompleted,
+	})
+}
+
+func TestWormholeTracing(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	tp := &testTracerProvider{}
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+	c0.TracerProvider = tp
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+	c1.TracerProvider = tp
+
+	fileContent := make([]byte, 1<<16)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	got := make(map[string]*testSpan)
+	for _, span := range tp.spans {
+		if !span.ended {
+			t.Errorf("span %s was not ended", span.name)
+		}
+		if span.err != nil {
+			t.Errorf("span %s recorded error: %s", span.name, span.err)
+		}
+		got[span.name+" "+span.attrs[attrSide].AsString()] = span
+	}
+
+	for _, side := range []string{"send", "receive"} {
+		for _, name := range []string{spanRendezvousConnect, spanPake, spanVersionExchange, spanTransitConnect, spanDataTransfer} {
+			if got[name+" "+side] == nil {
+				t.Errorf("missing %s span for %s side", name, side)
+			}
+		}
+
+		if span := got[spanTransitConnect+" "+side]; span != nil && !span.attrs[attrRelayed].AsBool() {
+			t.Errorf("expected %s transit span to be relayed", side)
+		}
+		if span := got[spanDataTransfer+" "+side]; span != nil && span.attrs[attrBytes].AsInt64() != int64(len(fileContent)) {
+			t.Errorf("%s data span bytes got=%d expected=%d", side, span.attrs[attrBytes].AsInt64(), len(fileContent))
+		}
+	}
+}
+
+type testTracerProvider struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tp *testTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return testTracer{tp}
+}
+
+type testTracer struct {
+	tp *testTracerProvider
+}
+
+func (t testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &testSpan{
+		Span:  trace.SpanFromContext(context.Background()),
+		tp:    t.tp,
+		name:  name,
+		attrs: make(map[attribute.Key]attribute.Value),
+	}
+	cfg := trace.NewSpanStartConfig(opts...)
+	span.SetAttributes(cfg.Attributes()...)
+
+	t.tp.mu.Lock()
+	t.tp.spans = append(t.tp.spans, span)
+	t.tp.mu.Unlock()
+
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+// testSpan records what is done to it on top of a no-op span.
+type testSpan struct {
+	trace.Span
+	tp    *testTracerProvider
+	name  string
+	attrs map[attribute.Key]attribute.Value
+	err   error
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.tp.mu.Lock()
+	defer s.tp.mu.Unlock()
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.tp.mu.Lock()
+	defer s.tp.mu.Unlock()
+	s.err = err
+}
+
+func (s *testSpan) End(...trace.SpanEndOption) {
+	s.tp.mu.Lock()
+	defer s.tp.mu.Unlock()
+	s.ended = true
+}
+
+func TestWormholeAuditLog(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	fileContent := make([]byte, 1000)
+
+	for _, accept := range []bool{true, false} {
+		t.Run(fmt.Sprintf("accept %t", accept), func(t *testing.T) {
+			var sendLog, recvLog bytes.Buffer
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayServer.URL()
+			c0.AuditLog = &sendLog
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayServer.URL()
+			c1.AuditLog = &recvLog
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true, WithOfferCallback(func(Offer) bool {
+				return accept
+			}))
+			if accept {
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = ioutil.ReadAll(receiver)
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.Is(err, ErrOfferDeclined) {
+				t.Fatalf("Expected ErrOfferDeclined but got: %v", err)
+			}
+
+			result := <-resultCh
+			if result.OK != accept {
+				t.Fatalf("Unexpected send result: %+v", result)
+			}
+
+			readRecord := func(buf *bytes.Buffer) AuditRecord {
+				lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+				if len(lines) != 1 {
+					t.Fatalf("Expected one audit record but got: %q", buf.String())
+				}
+				var rec AuditRecord
+				err := json.Unmarshal([]byte(lines[0]), &rec)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return rec
+			}
+
+			sendRec := readRecord(&sendLog)
+			recvRec := readRecord(&recvLog)
+
+			nameplate := strings.SplitN(code, "-", 2)[0]
+			for _, rec := range []AuditRecord{sendRec, recvRec} {
+				if rec.Nameplate != nameplate || rec.Type != "file" || rec.Name != "file.txt" || rec.Size != int64(len(fileContent)) {
+					t.Errorf("Unexpected audit record: %+v", rec)
+				}
+				if rec.Verifier == "" || rec.End.Before(rec.Start) {
+					t.Errorf("Unexpected audit record: %+v", rec)
+				}
+			}
+			if sendRec.Side != "send" || recvRec.Side != "receive" {
+				t.Errorf("Unexpected sides: %s %s", sendRec.Side, recvRec.Side)
+			}
+			if sendRec.Verifier != recvRec.Verifier {
+				t.Errorf("Verifier mismatch: %s vs %s", sendRec.Verifier, recvRec.Verifier)
+			}
+
+			if accept {
+				for _, rec := range []AuditRecord{sendRec, recvRec} {
+					if rec.Result != "ok" || rec.Transit != "relay" || rec.Bytes != int64(len(fileContent)) {
+						t.Errorf("Unexpected audit record: %+v", rec)
+					}
+				}
+			} else {
+				if recvRec.Result != "declined" {
+					t.Errorf("Expected declined receive record but got: %+v", recvRec)
+				}
+				if sendRec.Result != "error" || sendRec.Error == "" {
+					t.Errorf("Expected failed send record but got: %+v", sendRec)
+				}
+			}
+		})
+	}
+}
+
+func TestWormholeProtocolTrace(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	// the sender keeps tracing its rendezvous close after the result
+	traceBuf := &syncBuffer{}
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+	c0.ProtocolTrace = traceBuf
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1000)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	trace := traceBuf.String()
+	if strings.Contains(trace, code) {
+		t.Fatalf("Trace contains the code")
+	}
+	if regexp.MustCompile(`[0-9a-f]{64}`).MatchString(trace) {
+		t.Fatalf("Trace contains an unredacted key or body: %s", trace)
+	}
+
+	entries, err := prototrace.ReadEntries(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		bodies     int
+		handshakes []string
+		records    int
+	)
+	for _, e := range entries {
+		switch e.Layer {
+		case prototrace.LayerRendezvous:
+			if strings.Contains(string(e.Msg), `"body":"[redacted`) {
+				bodies++
+			}
+		case prototrace.LayerTransit:
+			if e.Line != "" {
+				handshakes = append(handshakes, e.Dir+" "+e.Line)
+			} else {
+				records++
+			}
+		}
+	}
+
+	if bodies == 0 {
+		t.Errorf("Expected redacted mailbox bodies in trace")
+	}
+	if records == 0 {
+		t.Errorf("Expected transit records in trace")
+	}
+	for _, expectHandshake := range []string{
+		"send transit sender [redacted] ready\n\n",
+		// read from the relay one byte at a time
+		"recv ok\n",
+	} {
+		var found bool
+		for _, h := range handshakes {
+			if h == expectHandshake {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected handshake %q in %q", expectHandshake, handshakes)
+		}
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWormholeLogger(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	logger := LogFuncLogger(func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, fmt.Sprintf(format, args...))
+	})
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+	c0.Logger = logger
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+	c1.Logger = logger
+
+	fileContent := make([]byte, 1000)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, expect := range []string{
+		"debug rendezvous connected url=" + url,
+		"info transit connection accepted",
+		"info transit connection established",
+	} {
+		var found bool
+		for _, m := range messages {
+			if strings.HasPrefix(m, expect) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected a log message starting with %q, got: %q", expect, messages)
+		}
+	}
+}
+
+func TestLogFuncLogger(t *testing.T) {
+	var got string
+	logger := LogFuncLogger(func(format string, args ...interface{}) {
+		got = fmt.Sprintf(format, args...)
+	})
+
+	logger.Warn("something happened", "count", 3, "dangling")
+	expect := "warn something happened count=3 dangling=(missing)"
+	if got != expect {
+		t.Fatalf("got %q expected %q", got, expect)
+	}
+}
+
+func TestWormholeTransferIDs(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	logger := LogFuncLogger(func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, fmt.Sprintf(format, args...))
+	})
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.Logger = logger
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.Logger = logger
+
+	sendEvents := make(chan Event, 100)
+	code, resultCh, err := c0.SendText(ctx, "hello", WithEvents(sendEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recvEvents := make(chan Event, 100)
+	receiver, err := c1.Receive(ctx, code, true, WithEvents(recvEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	if result.TransferID == "" || receiver.TransferID == "" {
+		t.Fatalf("Expected transfer IDs, got send=%q receive=%q", result.TransferID, receiver.TransferID)
+	}
+	if result.TransferID == receiver.TransferID {
+		t.Fatalf("Expected each side to have its own transfer ID, got %q for both", result.TransferID)
+	}
+
+	checkEvents := func(name string, ch chan Event, id string) {
+		close(ch)
+		for e := range ch {
+			if e.TransferID != id {
+				t.Errorf("%s: %s transfer ID got=%q expected=%q", name, e.Type, e.TransferID, id)
+			}
+		}
+	}
+	checkEvents("send", sendEvents, result.TransferID)
+	checkEvents("receive", recvEvents, receiver.TransferID)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, id := range []string{result.TransferID, receiver.TransferID} {
+		var found bool
+		for _, m := range messages {
+			if strings.HasPrefix(m, "debug rendezvous connected ") && strings.HasSuffix(m, " transfer_id="+id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected a rendezvous connected message for transfer %s, got: %q", id, messages)
+		}
+	}
+}
+
+func TestWormholeStallTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<20)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stalls int32
+	events := make(chan Event, 100)
+	receiver, err := c1.Receive(ctx, code, true, WithEvents(events), WithStallTimeout(50*time.Millisecond, func(idle time.Duration) bool {
+		atomic.AddInt32(&stalls, 1)
+		if idle < 50*time.Millisecond {
+			t.Errorf("stall callback called after only %s", idle)
+		}
+		return true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1<<16)
+	_, err = receiver.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stop reading so that no bytes move
+	time.Sleep(300 * time.Millisecond)
+
+	_, err = ioutil.ReadAll(receiver)
+	if !errors.Is(err, ErrTransferStalled) {
+		t.Fatalf("Expected ErrTransferStalled but got: %v", err)
+	}
+	expectTransferError(t, err, CodeStalled, PhaseData)
+
+	if got := atomic.LoadInt32(&stalls); got != 1 {
+		t.Fatalf("Expected 1 call to the stall callback but got %d", got)
+	}
+
+	result := <-resultCh
+	if result.OK {
+		t.Fatalf("Expected the sender to fail after the receiver aborted")
+	}
+
+	close(events)
+	var sawStall bool
+	for e := range events {
+		if e.Type == EventStalled {
+			sawStall = true
+			if e.Idle < 50*time.Millisecond {
+				t.Errorf("EventStalled with idle time %s", e.Idle)
+			}
+		}
+	}
+	if !sawStall {
+		t.Fatal("Expected an EventStalled")
+	}
+}
+
+func TestTimeoutsResolve(t *testing.T) {
+	got := Timeouts{}.resolve()
+	expect := Timeouts{
+		Rendezvous: defaultRendezvousTimeout,
+		Peer:       defaultPeerTimeout,
+		Handshake:  handshakeTimeout,
+		Record:     defaultRecordTimeout,
+		FinalAck:   defaultFinalAckTimeout,
+	}
+	if got != expect {
+		t.Fatalf("got defaults %+v expected %+v", got, expect)
+	}
+
+	got = Timeouts{Rendezvous: time.Second, Peer: -1, Record: -time.Minute}.resolve()
+	expect.Rendezvous = time.Second
+	expect.Peer = 0
+	expect.Record = 0
+	if got != expect {
+		t.Fatalf("got %+v expected %+v", got, expect)
+	}
+}
+
+func TestWormholePeerTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.Timeouts.Peer = 200 * time.Millisecond
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(make([]byte, 1<<10)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver never reads, so never answers the offer
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	select {
+	case result := <-resultCh:
+		if !errors.Is(result.Error, ErrPeerTimeout) {
+			t.Fatalf("Expected ErrPeerTimeout but got: %+v", result)
+		}
+		expectTransferError(t, result.Error, CodeTimeout, PhaseTransit)
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not give up on the silent receiver")
+	}
+}
+
+func TestWormholePeerTimeoutFakeClock(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = "tcp://"
+
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.Timeouts.Peer = time.Hour
+	c0.clock = clk
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(make([]byte, 1<<10)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver never reads, so never answers the offer
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	// the sender is waiting for the answer
+	clk.WaitForTimers(1)
+	clk.Advance(59 * time.Minute)
+
+	select {
+	case result := <-resultCh:
+		t.Fatalf("sender gave up before the timeout: %+v", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Minute)
+
+	select {
+	case result := <-resultCh:
+		if !errors.Is(result.Error, ErrPeerTimeout) {
+			t.Fatalf("Expected ErrPeerTimeout but got: %+v", result)
+		}
+		expectTransferError(t, result.Error, CodeTimeout, PhaseTransit)
+	case <-time.After(10 * time.Second):
+		t.Fatal("sender did not give up on the silent receiver")
+	}
+}
+
+// blockingReader returns data and then blocks until unblock is closed,
+// when it returns io.EOF.
+type blockingReader struct {
+	data    []byte
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.unblock
+	return 0, io.EOF
+}
+
+func TestWormholeRecordTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+	c1.Timeouts.Record = 200 * time.Millisecond
+
+	r := &blockingReader{
+		data:    make([]byte, 1<<10),
+		unblock: make(chan struct{}),
+	}
+
+	code, resultCh, err := c0.SendStream(ctx, "stream.bin", r, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = ioutil.ReadAll(receiver)
+	close(r.unblock)
+	expectTransferError(t, err, CodeTimeout, PhaseData)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("receiver took %s to give up on the stalled sender", elapsed)
+	}
+
+	result := <-resultCh
+	if result.OK {
+		t.Fatal("Expected the sender to fail after the receiver gave up")
+	}
+}
+
+func TestWormholeExpvar(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	PublishExpvar()
+	PublishExpvar()
+
+	counters := func() map[string]int64 {
+		var m map[string]int64
+		err := json.Unmarshal([]byte(expvar.Get("wormhole").String()), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	before := counters()
+
+	fileContent := make([]byte, 100000)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	_, err = c1.Receive(ctx, "1-not-a-real-code", true)
+	if err == nil {
+		t.Fatal("Expected receive with a bad code to fail")
+	}
+
+	after := counters()
+	expect := map[string]int64{
+		"active_transfers": 0,
+		"transfers":        3,
+		"failed_transfers": 1,
+		"bytes":            2 * int64(len(fileContent)),
+	}
+	for name, delta := range expect {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("%s changed by %d, expected %d", name, got, delta)
+		}
+	}
+}
+
+func TestWormholeConnStateHook(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var (
+		mu      sync.Mutex
+		changes []ConnStateChange
+	)
+	hook := func(change ConnStateChange) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, change)
+	}
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+	c0.ConnStateHook = hook
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+	c1.ConnStateHook = hook
+
+	fileContent := make([]byte, 1000)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// the sender closes its rendezvous connection after sending
+	// the result.
+	expectCount := 8
+	for i := 0; ; i++ {
+		mu.Lock()
+		n := len(changes)
+		mu.Unlock()
+		if n >= expectCount {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("timed out waiting for state changes, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(changes) != expectCount {
+		t.Fatalf("Expected %d state changes but got %+v", expectCount, changes)
+	}
+
+	type key struct {
+		id    string
+		layer ConnLayer
+		state ConnState
+	}
+	seen := make(map[key]bool)
+	for _, change := range changes {
+		if change.Reason != nil {
+			t.Errorf("Unexpected reason for %+v", change)
+		}
+		seen[key{change.TransferID, change.Layer, change.State}] = true
+	}
+	for _, id := range []string{result.TransferID, receiver.TransferID} {
+		for _, layer := range []ConnLayer{ConnRendezvous, ConnTransit} {
+			for _, state := range []ConnState{ConnConnected, ConnDisconnected} {
+				if !seen[key{id, layer, state}] {
+					t.Errorf("Missing %s %s for transfer %s: %+v", layer, state, id, changes)
+				}
+			}
+		}
+	}
+}
+
+func TestPipelinedHash(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	p := newPipelinedHash(sha256.New(), 1000)
+	r := bytes.NewReader(data)
+	for {
+		chunk := p.buffer()
+		n, err := r.Read(chunk)
+		if n > 0 {
+			p.write(chunk[:n])
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expect := sha256.Sum256(data)
+	if got := p.sum(); !bytes.Equal(got, expect[:]) {
+		t.Fatalf("got hash %x expected %x", got, expect)
+	}
+}
+
+func TestWormholeDirectoryReader(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	expect := map[string]string{
+		"personalize.txt":        strings.Repeat("personalize", 10000),
+		"sub/bodice-Maytag.txt":  "placarding-whereat",
+		"sub/deeper/radiant.txt": "",
+	}
+
+	var entries []DirectoryEntry
+	for name, content := range expect {
+		content := content
+		entries = append(entries, DirectoryEntry{
+			Path: filepath.Join("skyjacking", filepath.FromSlash(name)),
+			Mode: 0640,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(content)), nil
+			},
+		})
+	}
+
+	code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := receiver.Directory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+
+	got := make(map[string]string)
+	for {
+		f, err := dir.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Mode.Perm() != 0640 {
+			t.Errorf("%s: got mode %s", f.Path, f.Mode)
+		}
+
+		body, err := ioutil.ReadAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(body)) != f.Size {
+			t.Errorf("%s: got %d bytes, expected %d", f.Path, len(body), f.Size)
+		}
+		got[f.Path] = string(body)
+	}
+
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("directory contents mismatch, got %d files expected %d", len(got), len(expect))
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestWormholeEachFile(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	contents := map[string]string{
+		"skipped.bin":     strings.Repeat("unimpeded", 10000),
+		"sub/kept.txt":    "thatch-limerick",
+		"sub/another.txt": "fumigant",
+	}
+
+	var entries []DirectoryEntry
+	for name, content := range contents {
+		content := content
+		entries = append(entries, DirectoryEntry{
+			Path: filepath.Join("caravel", filepath.FromSlash(name)),
+			Mode: 0644,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(content)), nil
+			},
+		})
+	}
+
+	send := func() *IncomingMessage {
+		code, resultCh, err := c0.SendDirectory(ctx, "caravel", entries, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			<-resultCh
+		}()
+
+		receiver, err := c1.Receive(ctx, code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receiver
+	}
+
+	got := make(map[string]string)
+	err := send().EachFile("", func(f *ReceivedFile, r io.Reader) error {
+		if strings.HasSuffix(f.Path, ".bin") {
+			return nil
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		got[strings.TrimPrefix(f.Path, "caravel/")] = string(body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]string{
+		"sub/kept.txt":    contents["sub/kept.txt"],
+		"sub/another.txt": contents["sub/another.txt"],
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("Expected %v but got %v", expect, got)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = send().EachFile("", func(f *ReceivedFile, r io.Reader) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("Expected EachFile to stop after the first error but got %v after %d calls", err, calls)
+	}
+}
+
+func TestWormholeDirectoryMode(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	content := strings.Repeat("outflanking-", 10000)
+	entries := []DirectoryEntry{
+		{
+			Path: filepath.Join("pinafore", "lowbrow.txt"),
+			Mode: 0644,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(content)), nil
+			},
+		},
+	}
+
+	code, resultCh, err := c0.SendDirectory(ctx, "pinafore", entries, true, WithDirectoryMode(DirectoryModeStored))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offer Offer
+	receiver, err := c1.Receive(ctx, code, true, WithOfferCallback(func(o Offer) bool {
+		offer = o
+		return true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.DirectoryMode != DirectoryModeStored || offer.DirectoryMode != DirectoryModeStored {
+		t.Fatalf("got mode %q, offer mode %q", receiver.DirectoryMode, offer.DirectoryMode)
+	}
+
+	zipData, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Method != zip.Store {
+		t.Fatalf("expected a single stored entry, got %+v", zr.File)
+	}
+	rc, err := zr.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != content {
+		t.Fatal("lowbrow.txt file content does not match")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// a mode we can't read is declined before any data is sent
+	code, resultCh, err = c0.sendFileDirectory(ctx, &offerMsg{
+		Directory: &offerDirectory{
+			Dirname:  "pinafore",
+			Mode:     "tarball/xz",
+			NumBytes: 1,
+			NumFiles: 1,
+			ZipSize:  1,
+		},
+	}, bytes.NewReader([]byte{0}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c1.Receive(ctx, code, true)
+	if !errors.Is(err, ErrUnsupportedDirectoryMode) || !errors.Is(err, ErrOfferDeclined) {
+		t.Fatalf("Expected ErrUnsupportedDirectoryMode but got: %v", err)
+	}
+
+	result = <-resultCh
+	if result.OK {
+		t.Fatal("Expected the send to fail")
+	}
+
+	_, _, err = c0.SendDirectory(ctx, "pinafore", entries, true, WithDirectoryMode("tarball/xz"))
+	if err == nil {
+		t.Fatal("Expected an unknown directory mode to be rejected")
+	}
+}
+
+func TestSafeZipPath(t *testing.T) {
+	for name, expect := range map[string]bool{
+		"a.txt":         true,
+		"sub/a.txt":     true,
+		"sub/..a/b.txt": true,
+		"":              false,
+		"/etc/passwd":   false,
+		"../a.txt":      false,
+		"sub/../../a":   false,
+		"..\\a.txt":     false,
+		"sub\\a.txt":    false,
+	} {
+		if got := safeZipPath(name); got != expect {
+			t.Errorf("safeZipPath(%q) = %t, expected %t", name, got, expect)
+		}
+	}
+
+	// names that Windows reserves or alters are only refused there
+	for name, expect := range map[string]bool{
+		"sub/a.txt":     true,
+		"console.txt":   true,
+		"sub/CONx":      true,
+		"./a.txt":       true,
+		"CON":           false,
+		"sub/nul.txt":   false,
+		"Com1.tar.gz":   false,
+		"lpt9 .txt":     false,
+		"a.txt:evil":    false,
+		"sub/what?.txt": false,
+		"trailing.":     false,
+		"trailing /a":   false,
+		"tab\there.txt": false,
+	} {
+		if got := safeZipPathOn(name, true); got != expect {
+			t.Errorf("safeZipPathOn(%q, windows) = %t, expected %t", name, got, expect)
+		}
+	}
+	for _, name := range []string{"CON", "a.txt:evil", "trailing."} {
+		if !safeZipPathOn(name, false) {
+			t.Errorf("safeZipPathOn(%q) = false, expected true off Windows", name)
+		}
+	}
+}
+
+func TestZipEntryModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode    os.FileMode
+		windows bool
+		expect  os.FileMode
+	}{
+		{0755, false, 0755},
+		{0600, false, 0600},
+		{0, false, 0644},
+		{os.ModeDir, false, os.ModeDir | 0644},
+		{0666, true, 0644},
+		{0444, true, 0444},
+		{0755, true, 0644},
+		{os.ModeDir | 0777, true, os.ModeDir | 0644},
+	} {
+		if got := zipEntryMode(tc.mode, tc.windows); got != tc.expect {
+			t.Errorf("zipEntryMode(%s, %t) = %s, expected %s", tc.mode, tc.windows, got, tc.expect)
+		}
+	}
+
+	for mode, expect := range map[os.FileMode]os.FileMode{
+		0644:              0644,
+		0666:              0644,
+		0777:              0755,
+		0444:              0444,
+		04755:             0755,
+		0:                 0644,
+		os.ModeDir:        os.ModeDir | 0755,
+		os.ModeDir | 0777: os.ModeDir | 0755,
+	} {
+		if got := extractMode(mode); got != expect {
+			t.Errorf("extractMode(%s) = %s, expected %s", mode, got, expect)
+		}
+	}
+}
+
+func TestIgnoreList(t *testing.T) {
+	ignore, err := ReadIgnoreList(strings.NewReader(`# build output
+node_modules/
+/build
+*.log
+!keep.log
+docs/*.pdf
+**/tmp
+cache/**
+a/**/z
+\#literal
+trailing   
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"node_modules", true, true},
+		{"node_modules/left-pad/index.js", false, true},
+		{"web/node_modules/x.js", false, true},
+		{"node_modules", false, false},
+		{"build", true, true},
+		{"build/out.o", false, true},
+		{"src/build/out.o", false, false},
+		{"debug.log", false, true},
+		{"logs/debug.log", false, true},
+		{"keep.log", false, false},
+		{"node_modules/keep.log", false, true},
+		{"docs/manual.pdf", false, true},
+		{"docs/sub/manual.pdf", false, false},
+		{"x/docs/manual.pdf", false, false},
+		{"tmp/a", false, true},
+		{"deep/er/tmp", true, true},
+		{"cache", true, false},
+		{"cache/entry", false, true},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"b/a/z", false, false},
+		{"#literal", false, true},
+		{"trailing", false, true},
+		{"src/main.go", false, false},
+	} {
+		if got := ignore.Ignored(tc.name, tc.isDir); got != tc.ignored {
+			t.Errorf("Ignored(%q, %t) = %t, expected %t", tc.name, tc.isDir, got, tc.ignored)
+		}
+	}
+
+	expectPatterns := []string{"node_modules/", "/build", "*.log", "!keep.log", "docs/*.pdf", "**/tmp", "cache/**", "a/**/z", `\#literal`, "trailing"}
+	if got := ignore.Patterns(); !reflect.DeepEqual(got, expectPatterns) {
+		t.Fatalf("Expected patterns %q but got %q", expectPatterns, got)
+	}
+
+	for _, bad := range []string{"/", "!", "a//b", "[x"} {
+		if _, err := NewIgnoreList(bad); err == nil {
+			t.Errorf("Expected pattern %q to be refused", bad)
+		}
+	}
+
+	var nilList *IgnoreList
+	if nilList.Ignored("anything", false) {
+		t.Fatal("Expected a nil IgnoreList to ignore nothing")
+	}
+
+	vcs, err := NewIgnoreList(VCSIgnorePatterns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []DirectoryEntry
+	for _, p := range []string{"proj/main.go", "proj/.git/HEAD", "proj/sub/.hg/store", "proj/.gitignore"} {
+		entries = append(entries, DirectoryEntry{Path: p})
+	}
+	var kept []string
+	for _, e := range filterEntries(entries, "proj", vcs) {
+		kept = append(kept, e.Path)
+	}
+	if expect := []string{"proj/main.go", "proj/.gitignore"}; !reflect.DeepEqual(kept, expect) {
+		t.Fatalf("Expected %q to be kept but got %q", expect, kept)
+	}
+
+	all, err := NewIgnoreList("*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Client
+	_, _, err = c.SendDirectory(context.Background(), "proj", entries, true, WithIgnore(all))
+	if err == nil || !strings.Contains(err.Error(), "no files provided") {
+		t.Fatalf("Expected no files to be left to send but got %v", err)
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	type entry struct {
+		name string
+		mode os.FileMode
+		body string
+	}
+	makeZip := func(entries ...entry) *bytes.Reader {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, e := range entries {
+			h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			h.SetMode(e.mode)
+			w, err := zw.CreateHeader(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, e.body)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(buf.Bytes())
+	}
+	extract := func(dir string, r *bytes.Reader) error {
+		return ExtractZip(r, r.Size(), dir)
+	}
+
+	dir, err := ioutil.TempDir("", "wormhole-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	err = extract(dest, makeZip(
+		entry{"a.txt", 0644, "a"},
+		entry{"sub/", os.ModeDir | 0755, ""},
+		entry{"sub/deeper/b.sh", 04755, "b"},
+		entry{"windows.txt", 0666, "w"},
+		entry{"nomode.txt", 0, "n"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"a.txt": "a", "sub/deeper/b.sh": "b"} {
+		got, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Fatalf("%s: got %q expected %q", name, got, body)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dest, "sub", "deeper", "b.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0755 {
+		t.Fatalf("Expected setuid bit to be dropped but got mode %s", fi.Mode())
+	}
+	for _, name := range []string{"windows.txt", "nomode.txt"} {
+		fi, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != 0644 {
+			t.Fatalf("Expected %s to be extracted with mode 0644 but got %s", name, fi.Mode())
+		}
+	}
+
+	// existing files are never overwritten
+	if err := extract(dest, makeZip(entry{"a.txt", 0644, "changed"})); err == nil {
+		t.Fatal("Expected error overwriting an existing file")
+	}
+
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range [][]entry{
+		{{"../escape.txt", 0644, "x"}},
+		{{"/abs.txt", 0644, "x"}},
+		{{"evil", os.ModeSymlink | 0777, "../outside"}},
+		{{"link/escape.txt", 0644, "x"}},
+		{{"link/sub/escape.txt", 0644, "x"}},
+	} {
+		if err := extract(dest, makeZip(bad...)); err == nil {
+			t.Fatalf("Expected error extracting %q", bad[0].name)
+		}
+	}
+
+	left, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("Files were written outside the destination: %v", left)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "escape.txt")); !os.IsNotExist(err) {
+		t.Fatalf("escape.txt was written outside the destination")
+	}
+}
+
+func TestZipLimits(t *testing.T) {
+	makeZip := func(method uint16, files ...string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for i, body := range files {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("f%d", i), Method: method})
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, body)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	extract := func(limits ZipLimits, z []byte) error {
+		dir, err := ioutil.TempDir("", "wormhole-ziplimits")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		return limits.ExtractZip(bytes.NewReader(z), int64(len(z)), dir)
+	}
+	expectLimitErr := func(err error) {
+		t.Helper()
+		var limitErr *ZipLimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("Expected ZipLimitError but got: %v", err)
+		}
+	}
+
+	zeros := strings.Repeat("\x00", 1<<20)
+	small := makeZip(zip.Deflate, "a", "b", zeros)
+
+	if err := extract(DefaultZipLimits, small); err != nil {
+		t.Fatal(err)
+	}
+	if err := extract(ZipLimits{}, small); err != nil {
+		t.Fatal(err)
+	}
+	expectLimitErr(extract(ZipLimits{MaxEntries: 2}, small))
+	expectLimitErr(extract(ZipLimits{MaxUncompressedBytes: 1 << 20}, small))
+	expectLimitErr(extract(ZipLimits{MaxCompressionRatio: 10}, small))
+
+	// point the second entry at the data of the first, as overlapping
+	// zip bombs do
+	overlap := makeZip(zip.Store, "aaaa", "bbbb")
+	centralSig := []byte{'P', 'K', 1, 2}
+	first := bytes.Index(overlap, centralSig)
+	second := first + 1 + bytes.Index(overlap[first+1:], centralSig)
+	binary.LittleEndian.PutUint32(overlap[second+42:], 0)
+	expectLimitErr(extract(ZipLimits{}, overlap))
+}
+
+func TestTransportCryptorRecords(t *testing.T) {
+	key := make([]byte, 32)
+
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	sender := newTransportCryptor(c0, key, "transit_record_receiver_key", "transit_record_sender_key")
+	receiver := newTransportCryptor(c1, key, "transit_record_sender_key", "transit_record_receiver_key")
+
+	records := [][]byte{
+		[]byte("first"),
+		bytes.Repeat([]byte("x"), 1<<14),
+		nil,
+		[]byte("last"),
+	}
+
+	go func() {
+		for _, rec := range records {
+			if err := sender.writeRecord(rec); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i, expect := range records {
+		got, err := receiver.readRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expect) {
+			t.Fatalf("record %d mismatch: got %d bytes expected %d", i, len(got), len(expect))
+		}
+	}
+}
+
+func TestTransportCryptorAllocs(t *testing.T) {
+	key := make([]byte, 32)
+
+	// reading and writing with the same purpose lets the cryptor read
+	// back its own records.
+	var conn loopbackConn
+	cryptor := newTransportCryptor(&conn, key, "transit_record_sender_key", "transit_record_sender_key")
+	cryptor.setReadBufferSize(1 << 14)
+
+	msg := bytes.Repeat([]byte("x"), 1<<14)
+	var roundTripErr error
+	roundTrip := func() {
+		if err := cryptor.writeRecord(msg); err != nil {
+			roundTripErr = err
+			return
+		}
+		got, err := cryptor.readRecord()
+		if err != nil {
+			roundTripErr = err
+			return
+		}
+		if len(got) != len(msg) {
+			roundTripErr = fmt.Errorf("got %d bytes expected %d", len(got), len(msg))
+		}
+	}
+
+	// AllocsPerRun counts allocations made by every goroutine, so goroutines
+	// left behind by other tests can add to the count. Use the best of a few
+	// measurements.
+	allocs := testing.AllocsPerRun(100, roundTrip)
+	for i := 0; i < 4 && allocs != 0; i++ {
+		if a := testing.AllocsPerRun(100, roundTrip); a < allocs {
+			allocs = a
+		}
+	}
+	if roundTripErr != nil {
+		t.Fatal(roundTripErr)
+	}
+	if allocs != 0 {
+		t.Fatalf("writeRecord and readRecord made %.1f allocations per record, expected 0", allocs)
+	}
+}
+
+func TestTransferErrorClassify(t *testing.T) {
+	cases := []struct {
+		phase TransferPhase
+		err   error
+		code  ErrorCode
+	}{
+		{PhaseData, context.Canceled, CodeCanceled},
+		{PhaseRendezvous, fmt.Errorf("dial: %w", context.DeadlineExceeded), CodeTimeout},
+		{PhaseTransit, ErrOfferDeclined, CodeDeclined},
+		{PhaseData, ErrTransferStalled, CodeStalled},
+		{PhaseData, ErrRecordTooLarge, CodeRecordTooLarge},
+		{PhaseTransit, fmt.Errorf("%w: phase \"3\"", ErrReplayedMessage), CodeTampering},
+		{PhaseTransit, &ThirdSideError{Peer: "a", Side: "b"}, CodeTampering},
+		{PhasePake, errDecryptFailed, CodeWrongCode},
+		{PhaseData, errDecryptFailed, CodeIntegrity},
+		{PhaseTransit, &peerError{msg: rejectedMsg}, CodeRejected},
+		{PhasePake, &peerError{msg: verifierRejectedMsg}, CodeVerifierRejected},
+		{PhaseTransit, &peerError{msg: "disk full"}, CodePeerError},
+		{PhaseData, io.ErrUnexpectedEOF, CodeNetwork},
+		{PhaseData, &net.OpError{Op: "read", Err: errors.New("connection reset")}, CodeNetwork},
+		{PhaseData, errors.New("read failed"), CodeUnknown},
+	}
+
+	for _, tc := range cases {
+		err := transferError(tc.phase, tc.err)
+		expectTransferError(t, err, tc.code, tc.phase)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Expected %v to wrap %v", err, tc.err)
+		}
+		if err.Error() != tc.err.Error() {
+			t.Fatalf("Expected error text %q but got %q", tc.err, err)
+		}
+
+		// already classified errors keep their code and phase
+		if again := transferError(PhaseRendezvous, err); again != err {
+			t.Fatalf("Expected %v to be returned unchanged but got %v", err, again)
+		}
+	}
+
+	err := transitFailed(errors.New("no route to host"))
+	expectTransferError(t, err, CodeTransitFailed, PhaseTransit)
+	err = transitFailed(context.Canceled)
+	expectTransferError(t, err, CodeCanceled, PhaseTransit)
+}
+
+func TestIncrementNonce(t *testing.T) {
+	var n [crypto.NonceSize]byte
+	incrementNonce(&n)
+	if n[crypto.NonceSize-1] != 1 {
+		t.Fatalf("got nonce %x", n)
+	}
+
+	for i := crypto.NonceSize - 8; i < crypto.NonceSize; i++ {
+		n[i] = 0xff
+	}
+	incrementNonce(&n)
+	var expect [crypto.NonceSize]byte
+	expect[crypto.NonceSize-9] = 1
+	if n != expect {
+		t.Fatalf("got nonce %x expected %x", n, expect)
+	}
+}
+
+// loopbackConn is a net.Conn that reads back what was written to it.
+type loopbackConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *loopbackConn) Read(p []byte) (int, error)  { return c.buf.Read(p) }
+func (c *loopbackConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+func (c *loopbackConn) Close() error                { return nil }
+
+func TestParallelRecordWriter(t *testing.T) {
+	key := make([]byte, 32)
+
+	var conn loopbackConn
+	cryptor := newTransportCryptor(&conn, key, "transit_record_sender_key", "transit_record_sender_key")
+	pw := newParallelRecordWriter(cryptor, 4, 1<<10)
+
+	// records of varying sizes finish sealing out of order
+	var expect [][]byte
+	msg := make([]byte, 1<<12)
+	for i := 0; i < 100; i++ {
+		for j := range msg {
+			msg[j] = byte(i)
+		}
+		rec := msg[:(i*97)%len(msg)]
+		expect = append(expect, append([]byte(nil), rec...))
+		if err := pw.writeRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, rec := range expect {
+		got, err := cryptor.readRecord()
+		if err != nil {
+			t.Fatalf("record %d: %s", i, err)
+		}
+		if !bytes.Equal(got, rec) {
+			t.Fatalf("record %d mismatch: got %d bytes expected %d", i, len(got), len(rec))
+		}
+	}
+
+	writeErr := errors.New("write failed")
+	cryptor = newTransportCryptor(failingConn{writeErr}, key, "transit_record_sender_key", "transit_record_sender_key")
+	pw = newParallelRecordWriter(cryptor, 4, 1<<10)
+	for i := 0; i < 100; i++ {
+		if err := pw.writeRecord(msg); err != nil {
+			if err != writeErr {
+				t.Fatalf("Expected %v but got %v", writeErr, err)
+			}
+			break
+		}
+	}
+	if err := pw.flush(); err != writeErr {
+		t.Fatalf("Expected %v from flush but got %v", writeErr, err)
+	}
+}
+
+// failingConn is a net.Conn whose writes fail with err.
+type failingConn struct {
+	err error
+}
+
+func (c failingConn) Read(p []byte) (int, error)         { return 0, c.err }
+func (c failingConn) Write(p []byte) (int, error)        { return 0, c.err }
+func (c failingConn) Close() error                       { return nil }
+func (c failingConn) LocalAddr() net.Addr                { return nil }
+func (c failingConn) RemoteAddr() net.Addr               { return nil }
+func (c failingConn) SetDeadline(t time.Time) error      { return nil }
+func (c failingConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c failingConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestWormholeEncryptionWorkers(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	_, _, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(nil), true, WithEncryptionWorkers(0))
+	if err == nil {
+		t.Fatal("Expected error for 0 encryption workers")
+	}
+
+	fileContent := make([]byte, 1<<20+123)
+	for i := range fileContent {
+		fileContent[i] = byte(i * 7)
+	}
+
+	for _, stream := range []bool{false, true} {
+		var (
+			code     string
+			resultCh chan SendResult
+		)
+		if stream {
+			code, resultCh, err = c0.SendStream(ctx, "file.txt", bytes.NewReader(fileContent), true, WithEncryptionWorkers(4))
+		} else {
+			code, resultCh, err = c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithEncryptionWorkers(4))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver, err := c1.Receive(ctx, code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ioutil.ReadAll(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, fileContent) {
+			t.Fatalf("stream=%t: file contents mismatch", stream)
+		}
+
+		result := <-resultCh
+		if !result.OK {
+			t.Fatalf("stream=%t: expected ok result but got: %+v", stream, result)
+		}
+	}
+}
+
+func TestBench(t *testing.T) {
+	result, err := Bench(context.Background(), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSamples := len(benchBufferSizes) + len(benchWorkerCounts())
+	if len(result.Samples) != expectSamples {
+		t.Fatalf("got %d samples expected %d", len(result.Samples), expectSamples)
+	}
+	for _, s := range result.Samples {
+		if s.BytesPerSecond <= 0 {
+			t.Fatalf("got non-positive throughput in %+v", s)
+		}
+	}
+
+	var opts transferOptions
+	for _, opt := range result.Options() {
+		if err := opt.setOption(&opts); err != nil {
+			t.Fatalf("recommended options are invalid: %s", err)
+		}
+	}
+	if opts.bufferSize != result.BufferSize || opts.encryptionWorkers != result.EncryptionWorkers {
+		t.Fatalf("options %+v do not match result %+v", opts, result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Bench(ctx, time.Second)
+	if err != context.Canceled {
+		t.Fatalf("Expected %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestBenchRelay(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c Client
+	c.RendezvousURL = rs.WebSocketURL()
+	c.TransitRelayURL = relayServer.URL()
+
+	result, err := c.BenchRelay(ctx, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectSamples := len(benchBufferSizes) + len(benchWorkerCounts())
+	if len(result.Samples) != expectSamples {
+		t.Fatalf("got %d samples expected %d", len(result.Samples), expectSamples)
+	}
+	for _, s := range result.Samples {
+		if s.BytesPerSecond <= 0 {
+			t.Fatalf("got non-positive throughput in %+v", s)
+		}
+	}
+}
+
+func TestWormholeBufferSize(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	_, _, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(nil), true, WithBufferSize(10))
+	if err == nil {
+		t.Fatal("Expected error for a buffer size that is too small")
+	}
+
+	fileContent := make([]byte, 1<<18+123)
+	for i := range fileContent {
+		fileContent[i] = byte(i)
+	}
+
+	var records int
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true,
+		WithBufferSize(1<<16),
+		WithProgress(func(sent, total int64) { records++ }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true, WithBufferSize(1<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	if records != 5 {
+		t.Fatalf("Expected 5 records of 64 KiB but got %d", records)
+	}
+}
+
+func TestMakeTmpZipParallel(t *testing.T) {
+	var entries []DirectoryEntry
+	for i := 0; i < 50; i++ {
+		content := strings.Repeat(fmt.Sprintf("file %d ", i), i*100)
+		entries = append(entries, DirectoryEntry{
+			Path: filepath.Join("dir", fmt.Sprintf("file%02d.txt", i)),
+			Mode: 0644,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(content)), nil
+			},
+		})
+	}
+
+	result, err := makeTmpZip("dir", entries, zip.Deflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.file.Close()
+
+	zr, err := zip.NewReader(result.file, result.zipSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zr.File) != len(entries) {
+		t.Fatalf("got %d files in zip, expected %d", len(zr.File), len(entries))
+	}
+
+	var total int64
+	for i, zf := range zr.File {
+		expectName := fmt.Sprintf("file%02d.txt", i)
+		if zf.Name != expectName {
+			t.Fatalf("file %d: got name %s expected %s", i, zf.Name, expectName)
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := strings.Repeat(fmt.Sprintf("file %d ", i), i*100)
+		if string(body) != expect {
+			t.Fatalf("file %d: content mismatch", i)
+		}
+		total += int64(len(body))
+	}
+
+	if result.numBytes != total {
+		t.Fatalf("got numBytes %d expected %d", result.numBytes, total)
+	}
+
+	readErr := errors.New("read failed")
+	entries[7].Reader = func() (io.ReadCloser, error) {
+		return nil, readErr
+	}
+	_, err = makeTmpZip("dir", entries, zip.Deflate)
+	if err != readErr {
+		t.Fatalf("Expected %v but got %v", readErr, err)
+	}
+}
+
+func TestPrepareRawZipHeader(t *testing.T) {
+	const big = 5 << 30
+
+	cases := []struct {
+		name           string
+		compressed     uint64
+		uncompressed   uint64
+		expectVersion  uint16
+		expectDataDesc bool
+	}{
+		{"empty", 0, 0, zipVersion20, false},
+		{"small", 1000, 4000, zipVersion20, false},
+		{"just under 4GB", zipUint32Max - 1, zipUint32Max - 1, zipVersion20, false},
+		{"uncompressed 4GB", 1 << 20, zipUint32Max, zipVersion45, true},
+		{"compressed 4GB", zipUint32Max, zipUint32Max, zipVersion45, true},
+		{"over 4GB", big, big, zipVersion45, true},
+	}
+
+	for _, c := range cases {
+		h := &zip.FileHeader{
+			Name:               "f",
+			Method:             zip.Deflate,
+			CompressedSize64:   c.compressed,
+			UncompressedSize64: c.uncompressed,
+		}
+		h.SetMode(0644)
+		prepareRawZipHeader(h)
+
+		if h.ReaderVersion != c.expectVersion {
+			t.Errorf("%s: got reader version %d expected %d", c.name, h.ReaderVersion, c.expectVersion)
+		}
+		if h.CreatorVersion&0xff != zipVersion20 {
+			t.Errorf("%s: got creator version %d expected %d", c.name, h.CreatorVersion&0xff, zipVersion20)
+		}
+		if h.Mode() != 0644 {
+			t.Errorf("%s: mode changed to %s", c.name, h.Mode())
+		}
+		if hasDataDesc := h.Flags&zipDataDescriptor != 0; hasDataDesc != c.expectDataDesc {
+			t.Errorf("%s: got data descriptor %t expected %t", c.name, hasDataDesc, c.expectDataDesc)
+		}
+	}
+}
+
+func TestZip64RawEntry(t *testing.T) {
+	// CreateRaw does not check the sizes in the header against the data
+	// written, so a 5GB entry can be described without writing 5GB.
+	const big = 5 << 30
+	body := []byte("not really five gigabytes")
+
+	h := &zip.FileHeader{
+		Name:               "big.bin",
+		Method:             zip.Deflate,
+		CRC32:              0x12345678,
+		CompressedSize64:   big,
+		UncompressedSize64: big + 1,
+	}
+	prepareRawZipHeader(h)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	fw, err := w.CreateRaw(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// local file header: the sizes are deferred to the data descriptor
+	flags := binary.LittleEndian.Uint16(data[6:8])
+	if flags&zipDataDescriptor == 0 {
+		t.Fatalf("local header flags %#x do not have the data descriptor bit", flags)
+	}
+	for i, off := range []int{14, 18, 22} {
+		if v := binary.LittleEndian.Uint32(data[off : off+4]); v != 0 {
+			t.Fatalf("local header field %d is %#x expected 0", i, v)
+		}
+	}
+
+	// the data descriptor that follows the data has 64-bit sizes
+	dd := data[30+len(h.Name)+len(body):]
+	if sig := binary.LittleEndian.Uint32(dd[0:4]); sig != 0x08074b50 {
+		t.Fatalf("got data descriptor signature %#x", sig)
+	}
+	if crc := binary.LittleEndian.Uint32(dd[4:8]); crc != h.CRC32 {
+		t.Fatalf("got data descriptor crc %#x expected %#x", crc, h.CRC32)
+	}
+	if size := binary.LittleEndian.Uint64(dd[8:16]); size != big {
+		t.Fatalf("got data descriptor compressed size %d expected %d", size, uint64(big))
+	}
+	if size := binary.LittleEndian.Uint64(dd[16:24]); size != big+1 {
+		t.Fatalf("got data descriptor uncompressed size %d expected %d", size, uint64(big+1))
+	}
+
+	// the central directory has the sizes in a Zip64 extra field
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 {
+		t.Fatalf("got %d files expected 1", len(zr.File))
+	}
+	zf := zr.File[0]
+	if zf.CompressedSize64 != big || zf.UncompressedSize64 != big+1 {
+		t.Fatalf("got sizes %d/%d expected %d/%d", zf.CompressedSize64, zf.UncompressedSize64, uint64(big), uint64(big+1))
+	}
+	if zf.ReaderVersion != zipVersion45 {
+		t.Fatalf("got reader version %d expected %d", zf.ReaderVersion, zipVersion45)
+	}
+}
+
+func TestMakeTmpZipManyEntries(t *testing.T) {
+	// more entries than fit in the 16-bit counts of the end of central
+	// directory record, so the zip needs a Zip64 end record.
+	const count = 1<<16 + 10
+
+	entries := make([]DirectoryEntry, count)
+	for i := range entries {
+		name := fmt.Sprintf("f%05d", i)
+		entries[i] = DirectoryEntry{
+			Path: "dir/" + name,
+			Mode: 0644,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(name)), nil
+			},
+		}
+	}
+
+	result, err := makeTmpZip("dir", entries, zip.Deflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.file.Close()
+
+	if result.numFiles != count {
+		t.Fatalf("got numFiles %d expected %d", result.numFiles, count)
+	}
+
+	zr, err := zip.NewReader(result.file, result.zipSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != count {
+		t.Fatalf("got %d files in zip, expected %d", len(zr.File), count)
+	}
+
+	var total int64
+	for _, i := range []int{0, 1 << 15, 1<<16 - 1, 1 << 16, count - 1} {
+		zf := zr.File[i]
+		expect := fmt.Sprintf("f%05d", i)
+		if zf.Name != expect {
+			t.Fatalf("file %d: got name %s expected %s", i, zf.Name, expect)
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expect {
+			t.Fatalf("file %d: got content %q expected %q", i, body, expect)
+		}
+	}
+	for _, zf := range zr.File {
+		total += int64(zf.UncompressedSize64)
+	}
+	if result.numBytes != total {
+		t.Fatalf("got numBytes %d expected %d", result.numBytes, total)
+	}
+}
+
+func TestDeflatedEntrySpill(t *testing.T) {
+	content := make([]byte, 3*maxInMemoryEntry)
+	rand.Read(content)
+
+	for _, size := range []int{0, 100, len(content)} {
+		h := &zip.FileHeader{Name: "f", Method: zip.Deflate}
+		d := &deflatedEntry{header: h}
+		err := d.deflate(func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content[:size])), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spilled := d.file != nil
+		if expect := size > maxInMemoryEntry; spilled != expect {
+			t.Fatalf("size %d: got spilled=%t expected %t", size, spilled, expect)
+		}
+
+		compressed, err := ioutil.ReadAll(d.data())
+		d.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(compressed)) != h.CompressedSize64 {
+			t.Fatalf("size %d: got %d compressed bytes, header says %d", size, len(compressed), h.CompressedSize64)
+		}
+
+		got, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content[:size]) || h.UncompressedSize64 != uint64(size) {
+			t.Fatalf("size %d: content mismatch", size)
+		}
+		if h.CRC32 != crc32.ChecksumIEEE(content[:size]) {
+			t.Fatalf("size %d: crc mismatch", size)
+		}
+	}
+}
+
+func TestWormholeReceiveMemoryLimit(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<17)
+
+	for _, tc := range []struct {
+		name       string
+		recordSize int
+		expectErr  error
+	}{
+		{"under limit", 1 << 15, nil},
+		{"over limit", 1 << 16, ErrRecordTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithBufferSize(tc.recordSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true, WithReceiveMemoryLimit(1<<15))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if !errors.Is(err, tc.expectErr) {
+				t.Fatalf("Expected error %v but got %v", tc.expectErr, err)
+			}
+
+			result := <-resultCh
+			if tc.expectErr == nil {
+				if !result.OK || !bytes.Equal(got, fileContent) {
+					t.Fatalf("Expected successful transfer but got: %+v", result)
+				}
+			} else if result.OK {
+				t.Fatal("Expected the sender to fail")
+			}
+		})
+	}
+}
+
+func TestWormholeFileTransportResume(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	for _, offset := range []int64{0, 1000, int64(len(fileContent))} {
+		t.Run(fmt.Sprintf("offset %d", offset), func(t *testing.T) {
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !receiver.PeerCanResume() {
+				t.Fatal("Expected peer to support resuming")
+			}
+
+			err = receiver.ResumeFrom(offset, bytes.NewReader(fileContent[:offset]))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, fileContent[offset:]) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+
+	t.Run("corrupt partial file", func(t *testing.T) {
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver, err := c1.Receive(ctx, code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		partial := make([]byte, 1000)
+		err = receiver.ResumeFrom(int64(len(partial)), bytes.NewReader(partial))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the sender sends its sha256, so the receiver notices too
+		_, err = ioutil.ReadAll(receiver)
+		expectTransferError(t, err, CodeIntegrity, PhaseData)
+
+		result := <-resultCh
+		if result.OK || result.Error == nil {
+			t.Fatalf("Expected sha256 mismatch error but got: %+v", result)
+		}
+		expectTransferError(t, result.Error, CodeIntegrity, PhaseData)
+	})
+}
+
+func TestWormholeDeltaSync(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	rnd := mathrand.New(mathrand.NewSource(1))
+	basis := make([]byte, 300<<10+123)
+	rnd.Read(basis)
+
+	edit := func(edits ...func([]byte) []byte) []byte {
+		b := append([]byte(nil), basis...)
+		for _, e := range edits {
+			b = e(b)
+		}
+		return b
+	}
+	insert := func(at int, data string) func([]byte) []byte {
+		return func(b []byte) []byte {
+			return append(b[:at:at], append([]byte(data), b[at:]...)...)
+		}
+	}
+	overwrite := func(at int, data string) func([]byte) []byte {
+		return func(b []byte) []byte {
+			copy(b[at:], data)
+			return b
+		}
+	}
+	truncate := func(n int) func([]byte) []byte {
+		return func(b []byte) []byte {
+			return b[:n]
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		file     []byte
+		maxBytes int
+	}{
+		{"unchanged", basis, 0},
+		{"inserted", edit(insert(50000, "a few new bytes")), 16 << 10},
+		{"overwritten", edit(overwrite(1000, "xx"), overwrite(200000, "yy")), 32 << 10},
+		{"appended", edit(insert(len(basis), strings.Repeat("tail", 1000))), 4000 + 16<<10},
+		{"truncated", edit(truncate(100000)), 16 << 10},
+		{"unrelated", bytes.Repeat([]byte("unrelated"), 10000), 90000},
+		{"empty", nil, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// encode against the basis directly to see how much
+			// data is sent
+			b, err := newDeltaBasis(bytes.NewReader(basis), int64(len(basis)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sigRecs recordCollector
+			if err := b.writeSignature(&sigRecs); err != nil {
+				t.Fatal(err)
+			}
+			sig, err := readDeltaSignature(&sigRecs, &b.answer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var recs recordCollector
+			var hashed []byte
+			var progress int64
+			err = sig.encode(bytes.NewReader(tc.file), &recs, func(p []byte) {
+				hashed = append(hashed, p...)
+			}, func(n int64) {
+				progress += n
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(hashed, tc.file) || progress != int64(len(tc.file)) {
+				t.Fatalf("Expected all of the file to be hashed and counted, got %d hashed and %d counted", len(hashed), progress)
+			}
+			var literal int
+			var got []byte
+			for _, rec := range recs.recs {
+				if rec[0] == deltaOpLiteral {
+					literal += len(rec) - 1
+				}
+				data, err := b.expand(rec)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, data...)
+			}
+			if !bytes.Equal(got, tc.file) {
+				t.Fatal("Expanded delta does not match the file")
+			}
+			if literal > tc.maxBytes {
+				t.Fatalf("Expected at most %d literal bytes but got %d", tc.maxBytes, literal)
+			}
+
+			code, resultCh, err := c0.SendFile(ctx, "file.bin", bytes.NewReader(tc.file), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !receiver.PeerCanSync() {
+				t.Fatal("Expected peer to support delta transfers")
+			}
+			if err := receiver.SyncFrom(bytes.NewReader(basis), int64(len(basis))); err != nil {
+				t.Fatal(err)
+			}
+			if err := receiver.ResumeFrom(0, bytes.NewReader(nil)); err == nil {
+				t.Fatal("Expected ResumeFrom to fail after SyncFrom")
+			}
+			got, err = ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.file) {
+				t.Fatal("Received file does not match")
+			}
+			if result := <-resultCh; !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+
+	t.Run("bad copy", func(t *testing.T) {
+		b, err := newDeltaBasis(bytes.NewReader(basis), int64(len(basis)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range [][]byte{
+			{deltaOpCopy, 200, 1},
+			{deltaOpCopy, 0, 0},
+			{deltaOpCopy, 0, 1, 0},
+			{deltaOpLiteral},
+			{7, 1},
+		} {
+			_, err := b.expand(rec)
+			expectTransferError(t, err, CodeProtocol, PhaseData)
+		}
+	})
+}
+
+// recordCollector is a recordWriter and recordReader that keeps the
+// records in memory.
+type recordCollector struct {
+	recs [][]byte
+	next int
+}
+
+func (c *recordCollector) writeRecord(msg []byte) error {
+	c.recs = append(c.recs, append([]byte(nil), msg...))
+	return nil
+}
+
+func (c *recordCollector) flush() error {
+	return nil
+}
+
+func (c *recordCollector) readRecord() ([]byte, error) {
+	if c.next == len(c.recs) {
+		return nil, io.EOF
+	}
+	c.next++
+	return c.recs[c.next-1], nil
+}
+
+func TestWormholeForward(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	// the service on c1's side that c0 forwards to
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	target := echo.Addr().String()
+
+	s0, err := c0.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s0.Close(ctx)
+	s1, err := c1.JoinSession(ctx, s0.Code())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close(ctx)
+
+	type connResult struct {
+		conn net.Conn
+		err  error
+	}
+	connCh := make(chan connResult, 1)
+	go func() {
+		err := s0.Establish(ctx)
+		if err != nil {
+			connCh <- connResult{err: err}
+			return
+		}
+		conn, err := s0.Connect(ctx)
+		connCh <- connResult{conn, err}
+	}()
+	err = s1.Establish(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn1, err := s1.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-connCh
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	f0 := NewForwarder(r.conn, ForwardOptions{})
+	f1 := NewForwarder(conn1, ForwardOptions{Allow: []string{target}})
+	defer f1.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- f0.Listen(l, target)
+	}()
+
+	// enough data for each connection to use up its window many times
+	data := make([]byte, 1<<20)
+	mathrand.New(mathrand.NewSource(1)).Read(data)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			go func() {
+				conn.Write(data)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(conn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Expected %d bytes echoed but got %d different ones", len(data), len(got))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// each side only connects to the targets it allows
+	_, err = f0.Dial(ctx, "127.0.0.1:1")
+	if !errors.Is(err, ErrForwardRefused) {
+		t.Fatalf("Expected ErrForwardRefused for a target that is not allowed but got: %v", err)
+	}
+	_, err = f1.Dial(ctx, target)
+	if !errors.Is(err, ErrForwardRefused) {
+		t.Fatalf("Expected ErrForwardRefused from a peer that allows nothing but got: %v", err)
+	}
+
+	f0.Close()
+	if err := <-listenErr; err != ErrForwarderClosed {
+		t.Fatalf("Expected Listen to return ErrForwarderClosed but got: %v", err)
+	}
+	select {
+	case <-f1.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the peer's forwarder to stop")
+	}
+}
+
+func TestWormholeResumeFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	dir, err := ioutil.TempDir("", "wormhole-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateName := filepath.Join(dir, "file.txt.part.json")
+
+	// receive the start of the file, then give up on the transfer
+	recvCtx, cancel := context.WithCancel(ctx)
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := c1.Receive(recvCtx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partial := make([]byte, 1000)
+	_, err = io.ReadFull(receiver, partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err := receiver.Checkpoint("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Offset != int64(len(partial)) || cp.Code != code {
+		t.Fatalf("Expected checkpoint at %d for %s but got %+v", len(partial), code, cp)
+	}
+	err = WriteCheckpoint(stateName, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := ioutil.ReadAll(receiver); err == nil {
+		t.Fatal("Expected the canceled transfer to fail")
+	}
+	<-resultCh
+
+	cp, err = ReadCheckpoint(stateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, resultCh, err = c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Matches(receiver) {
+		t.Fatalf("Expected checkpoint to match the offer")
+	}
+	err = receiver.ResumeFromCheckpoint(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(partial, got...), fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// a checkpoint of another file is refused
+	code, resultCh, err = c0.SendFile(ctx, "other.txt", bytes.NewReader(fileContent), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.ResumeFromCheckpoint(cp); err == nil {
+		t.Fatal("Expected a checkpoint of another file to be refused")
 	}
+	receiver.Reject()
+	<-resultCh
 }
 
 func TestWormholeBigFileTransportSendRecvViaRelayServer(t *testing.T) {
@@ -330,8 +6046,8 @@ func TestWormholeBigFileTransportSendRecvViaRelayServer(t *testing.T) {
 	for relayProtocol, newRelayServer := range relayServerConstructors {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+			relayURL := relayServer.URL()
+			defer relayServer.Close()
 
 			var c0 Client
 			c0.RendezvousURL = url
@@ -383,8 +6099,8 @@ func TestWormholeFileTransportRecvMidStreamCancel(t *testing.T) {
 	for relayProtocol, newRelayServer := range relayServerConstructors {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+			relayURL := relayServer.URL()
+			defer relayServer.Close()
 
 			var c0 Client
 			c0.RendezvousURL = url
@@ -448,8 +6164,8 @@ func TestWormholeFileTransportSendMidStreamCancel(t *testing.T) {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 
 			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+			relayURL := relayServer.URL()
+			defer relayServer.Close()
 
 			var c0 Client
 			c0.RendezvousURL = url
@@ -506,11 +6222,11 @@ func TestPendingSendCancelable(t *testing.T) {
 	for relayProtocol, newRelayServer := range relayServerConstructors {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
-			defer relayServer.close()
+			defer relayServer.Close()
 
 			c0 := Client{
 				RendezvousURL:   url,
-				TransitRelayURL: relayServer.url.String(),
+				TransitRelayURL: relayServer.URL(),
 			}
 
 			fileContent := make([]byte, 1<<16)
@@ -585,11 +6301,11 @@ func TestPendingRecvCancelable(t *testing.T) {
 	for relayProtocol, newRelayServer := range relayServerConstructors {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
-			defer relayServer.close()
+			defer relayServer.Close()
 
 			c0 := Client{
 				RendezvousURL:   url,
-				TransitRelayURL: relayServer.url.String(),
+				TransitRelayURL: relayServer.URL(),
 			}
 
 			childCtx, cancel := context.WithCancel(ctx)
@@ -780,17 +6496,17 @@ func TestSendRecvEmptyFileDirect(t *testing.T) {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 
 			relayServer := newRelayServer()
-			defer relayServer.close()
+			defer relayServer.Close()
 
 			url := rs.WebSocketURL()
 
 			var c0 Client
 			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayServer.url.String()
+			c0.TransitRelayURL = relayServer.URL()
 
 			var c1 Client
 			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayServer.url.String()
+			c1.TransitRelayURL = relayServer.URL()
 
 			fileContent := make([]byte, 0)
 			buf := bytes.NewReader(fileContent)
@@ -832,17 +6548,17 @@ func TestSendRecvEmptyFileViaRelay(t *testing.T) {
 			defer rs.Close()
 
 			relayServer := newRelayServer()
-			defer relayServer.close()
+			defer relayServer.Close()
 
 			url := rs.WebSocketURL()
 
 			var c0 Client
 			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayServer.url.String()
+			c0.TransitRelayURL = relayServer.URL()
 
 			var c1 Client
 			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayServer.url.String()
+			c1.TransitRelayURL = relayServer.URL()
 
 			fileContent := make([]byte, 0)
 
@@ -886,8 +6602,8 @@ func TestWormholeDirectoryTransportSendRecvRelay(t *testing.T) {
 	for relayProtocol, newRelayServer := range relayServerConstructors {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
-			defer relayServer.close()
-			relayURL := relayServer.url.String()
+			defer relayServer.Close()
+			relayURL := relayServer.URL()
 
 			var c0Verifier string
 			var c0 Client
@@ -1006,8 +6722,8 @@ func TestWormholeDirectoryTransportSendRecvRelayOneFail(t *testing.T) {
 	for relayProtocol, newRelayServer := range relayServerConstructors {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
-			defer relayServer.close()
-			relayURL := relayServer.url.String()
+			defer relayServer.Close()
+			relayURL := relayServer.URL()
 
 			var c0Verifier string
 			var c0 Client
@@ -1124,11 +6840,11 @@ func TestWormholeDirectoryTransportSendRecvTwoRelays(t *testing.T) {
 		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
 			relayServer := newRelayServer()
 			relayServerSecond := newRelayServer()
-			defer relayServer.close()
-			defer relayServerSecond.close()
+			defer relayServer.Close()
+			defer relayServerSecond.Close()
 
-			relayURL := relayServer.url.String()
-			relayURLSecond := relayServerSecond.url.String()
+			relayURL := relayServer.URL()
+			relayURLSecond := relayServerSecond.URL()
 
 			var c0Verifier string
 			var c0 Client
@@ -1225,242 +6941,711 @@ func TestWormholeDirectoryTransportSendRecvTwoRelays(t *testing.T) {
 				t.Fatalf("Failed to get verifier code c0=%q c1=%q", c0Verifier, c1Verifier)
 			}
 
-			if c0Verifier != c1Verifier {
-				t.Fatalf("Expected verifiers to match but were different")
-			}
-		})
+			if c0Verifier != c1Verifier {
+				t.Fatalf("Expected verifiers to match but were different")
+			}
+		})
+	}
+}
+
+type splitReader struct {
+	*bytes.Reader
+	offset    int
+	cancelAt  int
+	cancel    func()
+	didCancel bool
+}
+
+func (s *splitReader) Read(b []byte) (int, error) {
+	n, err := s.Reader.Read(b)
+	s.offset += n
+	if !s.didCancel && s.offset >= s.cancelAt {
+		s.cancel()
+		s.didCancel = true
+		// yield the cpu to give the cancellation goroutine a chance
+		// to run (esp important for when GOMAXPROCS=1)
+		time.Sleep(1 * time.Millisecond)
+	}
+	return n, err
+}
+
+func TestWormholeLegacyRelayHandshake(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	for _, mode := range []RelayHandshake{RelayHandshakeAuto, RelayHandshakeLegacy} {
+		t.Run(fmt.Sprintf("mode %d", mode), func(t *testing.T) {
+			relayServer := wormholetest.NewLegacyTCPRelay()
+			defer relayServer.Close()
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayServer.URL()
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayServer.URL()
+
+			opts := []TransferOption{WithTransitPolicy(TransitRelayOnly)}
+			if mode != RelayHandshakeAuto {
+				opts = append(opts, WithRelayHandshake(mode))
+			}
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, false, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+
+			// in auto mode both sides first try the current handshake
+			expectRefused := 0
+			if mode == RelayHandshakeAuto {
+				expectRefused = 2
+			}
+			if refused := relayServer.RefusedHandshakes(); refused != expectRefused {
+				t.Fatalf("relay refused %d handshakes, expected %d", refused, expectRefused)
+			}
+		})
+	}
+
+	var c0 Client
+	_, _, err := c0.SendText(ctx, "hello", WithRelayHandshake(RelayHandshake(42)))
+	if err == nil {
+		t.Fatal("Expected an unknown relay handshake to be rejected")
+	}
+}
+
+func TestFilterHints(t *testing.T) {
+	// relay-v1 hints as sent by the python client, with several
+	// endpoints for one relay
+	var ours, theirs transitMsg
+	err := json.Unmarshal([]byte(`{"abilities-v1": [{"type": "direct-tcp-v1"}, {"type": "relay-v1"}], "hints-v1": [
+		{"type": "direct-tcp-v1", "priority": 0.0, "hostname": "10.0.0.2", "port": 41234},
+		{"type": "relay-v1", "hints": [
+			{"type": "direct-tcp-v1", "priority": 0.0, "hostname": "transit.example.com", "port": 4001},
+			{"type": "websocket-v1", "priority": 0.5, "url": "wss://transit.example.com/ws"}
+		]}
+	]}`), &theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(`{"abilities-v1": [], "hints-v1": [
+		{"type": "relay-v1", "hints": [
+			{"type": "direct-tcp-v1", "hostname": "other.example.com", "port": 4001},
+			{"type": "direct-tcp-v1", "priority": 1.0, "hostname": "transit.example.com", "port": 4001},
+			{"type": "websocket", "url": "wss://transit.example.com/ws"},
+			{"type": "websocket", "url": "wss://other.example.com/ws"}
+		]}
+	]}`), &ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := filterHints(append(ours.HintsV1, theirs.HintsV1...), "relay-v1")
+	expect := []transitHintsRelay{
+		{Type: "direct-tcp-v1", Hostname: "transit.example.com", Port: 4001, Priority: 1.0},
+		{Type: "websocket-v1", Url: "wss://transit.example.com/ws", Priority: 0.5},
+		{Type: "direct-tcp-v1", Hostname: "other.example.com", Port: 4001},
+		{Type: "websocket-v1", Url: "wss://other.example.com/ws"},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("got hints %+v expected %+v", got, expect)
+	}
+}
+
+func TestMakeTransitMsgRelayEndpoints(t *testing.T) {
+	relayURL, err := parseRelayURL("tcp://transit.example.com:4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsURL, err := parseRelayURL("wss://transit.example.com/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := newFileTransport(make([]byte, 32), "appid", relayURL, true, nil)
+	transport.relayEndpoints = []*url.URL{wsURL}
+
+	msg, err := transport.makeTransitMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []transitHintsV1{
+		{
+			Type: "relay-v1",
+			Hints: []transitHintsRelay{
+				{Type: "direct-tcp-v1", Hostname: "transit.example.com", Port: 4001},
+				{Type: "websocket-v1", Url: "wss://transit.example.com/ws"},
+				{Type: "websocket", Url: "wss://transit.example.com/ws"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(msg.HintsV1, expect) {
+		t.Fatalf("got hints %+v expected %+v", msg.HintsV1, expect)
+	}
+}
+
+func TestClient_relayURL_default(t *testing.T) {
+	var c Client
+
+	DefaultTransitRelayURL = "tcp://transit.magic-wormhole.io:8001"
+	url, err := c.relayURL()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if url.Scheme != "tcp" {
+		t.Error(fmt.Sprintf("invalid protocol, expected tcp, got %v", url))
+	}
+}
+
+func TestClient_relayURL_backwards_compatibility(t *testing.T) {
+	var c Client
+
+	DefaultTransitRelayURL = "tcp:transit.magic-wormhole.io:8001"
+	url, err := c.relayURL()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if url.String() != "tcp://transit.magic-wormhole.io:8001" {
+		t.Error(fmt.Sprintf("invalid URL, expected 'tcp://[…]', got %v", url))
+	}
+}
+
+func TestWormholeFileTransportSendRecvViaWSRelayServer(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewWSRelay()
+	relayURL := relayServer.URL()
+	defer relayServer.Close()
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayURL
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayURL
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	buf := bytes.NewReader(fileContent)
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestReceiveWithoutSender(t *testing.T) {
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+
+			c0 := Client{
+				RendezvousURL:   url,
+				TransitRelayURL: relayServer.URL(),
+			}
+
+			_, err := c0.Receive(context.Background(), "666-fireball-fallacy", false)
+
+			if err == nil {
+				t.Error("Receiver should not be able to claim the nameplate")
+			}
+
+			if err.Error() != "Nameplate is unclaimed: 666" {
+				t.Error(fmt.Sprintf("Unexpected error: %s", err.Error()))
+			}
+			expectTransferError(t, err, CodeNameplateUnclaimed, PhaseRendezvous)
+		})
+	}
+}
+
+func TestHandshakeLine(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "ok\n", want: "ok"},
+		{in: "ok\r\n", want: "ok"},
+		{in: "go\ntrailing data", want: "go"},
+		{in: "bad handshake\n", want: "bad handshake"},
+		{in: "\n", want: ""},
+		{in: "ok", wantErr: true},
+		{in: "", wantErr: true},
+		{in: strings.Repeat("a", maxHandshakeLine) + "\n", want: strings.Repeat("a", maxHandshakeLine)},
+		{in: strings.Repeat("a", maxHandshakeLine+1) + "\n", wantErr: true},
+	} {
+		r := strings.NewReader(tc.in)
+		got, err := readHandshakeLine(r)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %q, expected error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %q, %v, expected %q", tc.in, got, err, tc.want)
+		}
+		if rest := len(tc.in) - len(tc.want) - r.Len(); rest > 2 {
+			t.Errorf("%q: read %d bytes past the line", tc.in, rest)
+		}
+	}
+
+	// an endless line is cut off rather than read forever
+	_, err := readHandshakeLine(endlessReader{})
+	if !errors.Is(err, errBadHandshake) {
+		t.Fatalf("got %v, expected errBadHandshake", err)
+	}
+
+	err = expectHandshakeLine(strings.NewReader("nevermind\n"), "go")
+	if !errors.Is(err, errBadHandshake) {
+		t.Fatalf("got %v, expected errBadHandshake", err)
+	}
+	if err := expectHandshakeLine(strings.NewReader("go\n"), "go"); err != nil {
+		t.Fatal(err)
+	}
+
+	header := []byte("transit sender 0123 ready\n\n")
+	if err := expectHandshakeHeader(bytes.NewReader(header), header); err != nil {
+		t.Fatal(err)
+	}
+	err = expectHandshakeHeader(strings.NewReader("transit sender 4567 ready\n\n"), header)
+	if !errors.Is(err, errBadHandshake) {
+		t.Fatalf("got %v, expected errBadHandshake", err)
+	}
+	err = expectHandshakeHeader(strings.NewReader("transit"), header)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestHandshakeDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// a peer that never answers is given up on after the deadline
+	err := withHandshakeDeadline(a, 10*time.Millisecond, func() error {
+		return expectHandshakeLine(a, "ok")
+	})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+
+	// the deadline is cleared once the handshake is over
+	go b.Write([]byte("ok\n"))
+	err = withHandshakeDeadline(a, handshakeTimeout, func() error {
+		return expectHandshakeLine(a, "ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Write([]byte("go\n"))
+	}()
+	if err := expectHandshakeLine(a, "go"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestNoSecretsInDebugOutput(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
+
+	logBuf := &syncBuffer{}
+	traceBuf := &syncBuffer{}
+	tp := &testTracerProvider{}
+	logger := LogFuncLogger(func(format string, args ...interface{}) {
+		fmt.Fprintf(logBuf, format+"\n", args...)
+	})
+
+	var (
+		verifierMu sync.Mutex
+		verifiers  []string
+	)
+	verifierOk := func(verifier string) bool {
+		verifierMu.Lock()
+		defer verifierMu.Unlock()
+		verifiers = append(verifiers, verifier)
+		return true
 	}
-}
 
-type testRelayServer struct {
-	*httptest.Server
-	l       net.Listener
-	url     *url.URL
-	proto   string
-	wg      sync.WaitGroup
-	mu      sync.Mutex
-	streams map[string]net.Conn
-}
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+	c0.Logger = logger
+	c0.ProtocolTrace = traceBuf
+	c0.TracerProvider = tp
+	c0.VerifierOk = verifierOk
 
-func newTestTCPRelayServer() *testRelayServer {
-	l, err := net.Listen("tcp4", ":0")
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+	c1.Logger = logger
+	c1.ProtocolTrace = traceBuf
+	c1.TracerProvider = tp
+	c1.VerifierOk = verifierOk
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(make([]byte, 1000)), true)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
 
-	url, err := url.Parse("tcp://" + l.Addr().String())
+	receiver, err := c1.Receive(ctx, code, true)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
 	}
-	rs := &testRelayServer{
-		l:       l,
-		url:     url,
-		proto:   "tcp",
-		streams: make(map[string]net.Conn),
+
+	_, err = ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	go rs.run()
-	return rs
-}
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
 
-func (ts *testRelayServer) close() {
-	ts.l.Close()
-	ts.wg.Wait()
-}
+	tp.mu.Lock()
+	var spans strings.Builder
+	for _, span := range tp.spans {
+		fmt.Fprintf(&spans, "%s %v %v\n", span.name, span.attrs, span.err)
+	}
+	tp.mu.Unlock()
+
+	words := code[strings.Index(code, "-")+1:]
+	secrets := []string{code, words}
+	verifierMu.Lock()
+	secrets = append(secrets, verifiers...)
+	verifierMu.Unlock()
+	if len(secrets) != 4 {
+		t.Fatalf("expected a verifier from each side, got %d", len(secrets)-2)
+	}
 
-func (ts *testRelayServer) run() {
-	for {
-		conn, err := ts.l.Accept()
-		if err != nil {
-			return
+	for name, out := range map[string]string{
+		"log":   logBuf.String(),
+		"trace": traceBuf.String(),
+		"spans": spans.String(),
+	} {
+		if out == "" {
+			t.Errorf("no %s output", name)
+		}
+		for _, secret := range secrets {
+			if strings.Contains(out, secret) {
+				t.Errorf("%s output contains secret %q:\n%s", name, secret, out)
+			}
+		}
+		if regexp.MustCompile(`[0-9a-f]{32}`).MatchString(out) {
+			t.Errorf("%s output contains key material:\n%s", name, out)
 		}
-
-		ts.wg.Add(1)
-		go ts.handleConn(conn)
 	}
 }
 
-func newTestWSRelayServer() *testRelayServer {
-	rs := &testRelayServer{
-		proto:   "ws",
-		streams: make(map[string]net.Conn),
+func TestLoggerRedaction(t *testing.T) {
+	var lines []string
+	var c Client
+	c.Logger = LogFuncLogger(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+
+	key := strings.Repeat("ab", 32)
+	c.logger().Debug("pake", "code", "4-purple-sausages", "Verifier", key, "side", "0123456789abcdef")
+	c.logger().Warn("relay", "err", fmt.Errorf("got %q from 4-purple-sausages", "transit sender "+key+" ready"), "bytes", 42)
+	c.logger().Info("keys", "data", []byte(key), "odd")
+
+	expect := []string{
+		"debug pake code=[redacted] Verifier=[redacted] side=0123456789abcdef",
+		`warn relay err=got "transit sender [redacted] ready" from 4-[redacted] bytes=42`,
+		"info keys data=[redacted] odd=(missing)",
+	}
+	if !reflect.DeepEqual(lines, expect) {
+		t.Fatalf("got:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(expect, "\n"))
 	}
+}
 
-	smux := http.NewServeMux()
-	smux.HandleFunc("/", rs.handleWSRelay)
+func TestKeysWipedAfterTransfer(t *testing.T) {
+	ctx := context.Background()
 
-	rs.Server = httptest.NewServer(smux)
-	url, err := url.Parse("ws://" + rs.Server.Listener.Addr().String())
-	if err != nil {
-		panic(err)
-	}
-	rs.url = url
-	rs.l = rs.Server.Listener
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
 
-	return rs
-}
+	url := rs.WebSocketURL()
 
-func (rs *testRelayServer) handleWSRelay(w http.ResponseWriter, r *http.Request) {
-	c, err := websocket.Accept(w, r, nil)
+	relayServer := wormholetest.NewTCPRelay()
+	defer relayServer.Close()
 
-	if err != nil {
-		return
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.TransitRelayURL = relayServer.URL()
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.TransitRelayURL = relayServer.URL()
+
+	var zero [32]byte
+	expectWiped := func(t *testing.T, fr *IncomingMessage) {
+		t.Helper()
+		if fr.wipeSession != nil {
+			t.Errorf("session keys were not wiped")
+		}
+		if fr.cryptor != nil && (fr.cryptor.readKey != zero || fr.cryptor.writeKey != zero) {
+			t.Errorf("record keys were not wiped")
+		}
 	}
 
-	ctx := context.Background()
-	conn := websocket.NetConn(ctx, c, websocket.MessageBinary)
-	rs.wg.Add(1)
-	go rs.handleConn(conn)
-}
+	fileContent := make([]byte, 1<<16)
+
+	t.Run("completed", func(t *testing.T) {
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver, err := c1.Receive(ctx, code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receiver.wipeSession == nil {
+			t.Fatal("keys wiped before the transfer started")
+		}
 
-var headerPrefix = []byte("please relay ")
-var headerSide = []byte(" for side ")
+		_, err = ioutil.ReadAll(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receiver.cryptor == nil {
+			t.Fatal("no transit connection")
+		}
+		expectWiped(t, receiver)
 
-func (ts *testRelayServer) handleConn(c net.Conn) {
-	// requests look like:
-	// "please relay 10bf5ab71e48a3ca74b0a0d4d54f66f38704a76d15885442a8df141680fd for side 4a74cb8a377c970a\n"
+		result := <-resultCh
+		if !result.OK {
+			t.Fatalf("Expected ok result but got: %+v", result)
+		}
 
-	defer ts.wg.Done()
-	headerBuf := make([]byte, 64)
+		if err := receiver.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
 
-	matchExpect := func(expect []byte) bool {
-		got := headerBuf[:len(expect)]
-		_, err := io.ReadFull(c, got)
+	t.Run("closed while reading", func(t *testing.T) {
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true, WithBufferSize(1024))
 		if err != nil {
-			c.Close()
-			return false
+			t.Fatal(err)
 		}
 
-		if !bytes.Equal(got, expect) {
-			c.Write([]byte("bad handshake\n"))
-			c.Close()
-			return false
+		receiver, err := c1.Receive(ctx, code, true)
+		if err != nil {
+			t.Fatal(err)
 		}
 
-		return true
-	}
+		_, err = io.ReadFull(receiver, make([]byte, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := receiver.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expectWiped(t, receiver)
+
+		_, err = receiver.Read(make([]byte, 10))
+		expectTransferError(t, err, CodeCanceled, PhaseData)
 
-	isHex := func(str string) bool {
-		_, err := hex.DecodeString(str)
+		result := <-resultCh
+		if result.OK {
+			t.Fatalf("Expected failed send after the receiver closed")
+		}
+	})
+
+	t.Run("closed before reading", func(t *testing.T) {
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
 		if err != nil {
-			c.Write([]byte("bad handshake\n"))
-			c.Close()
-			return false
+			t.Fatal(err)
 		}
-		return true
-	}
 
-	if !matchExpect(headerPrefix) {
-		return
-	}
+		receiver, err := c1.Receive(ctx, code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	_, err := io.ReadFull(c, headerBuf)
-	if err != nil {
-		c.Close()
-		return
-	}
+		if err := receiver.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expectWiped(t, receiver)
 
-	chanID := string(headerBuf)
-	if !isHex(chanID) {
-		return
-	}
+		if _, err := receiver.Read(make([]byte, 10)); err == nil {
+			t.Fatalf("Expected read after Close to fail")
+		}
 
-	if !matchExpect(headerSide) {
-		return
-	}
+		result := <-resultCh
+		expectTransferError(t, result.Error, CodeRejected, PhaseTransit)
+	})
+}
 
-	sideBuf := headerBuf[:16]
-	_, err = io.ReadFull(c, sideBuf)
-	if err != nil {
-		c.Close()
-		return
+func TestMailboxTampering(t *testing.T) {
+	isReplay := func(err error) bool { return errors.Is(err, ErrReplayedMessage) }
+	isThirdSide := func(err error) bool {
+		var tse *ThirdSideError
+		return errors.As(err, &tse)
 	}
 
-	side := string(sideBuf)
-	if !isHex(side) {
-		return
-	}
+	for _, tc := range []struct {
+		name   string
+		tamper func(*rendezvousservertest.TestServer, string)
+		is     func(error) bool
+	}{
+		{"replay", (*rendezvousservertest.TestServer).ReplayPhase, isReplay},
+		{"third side", (*rendezvousservertest.TestServer).ThirdSidePhase, isThirdSide},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
 
-	// read \n
-	_, err = io.ReadFull(c, headerBuf[:1])
-	if err != nil {
-		c.Close()
-		return
-	}
+			rs := rendezvousservertest.NewServerLegacy()
+			defer rs.Close()
 
-	ts.mu.Lock()
-	existing, found := ts.streams[chanID]
-	if !found {
-		ts.streams[chanID] = c
-	}
-	ts.mu.Unlock()
+			// every side reads the version message before it starts
+			// collecting the rest, so both see the tampering there
+			tc.tamper(rs, "version")
 
-	if found {
-		existing.Write([]byte("ok\n"))
-		c.Write([]byte("ok\n"))
-		go func() {
-			io.Copy(c, existing)
-			existing.Close()
-			c.Close()
+			var c0 Client
+			c0.RendezvousURL = rs.WebSocketURL()
 
-		}()
+			var c1 Client
+			c1.RendezvousURL = rs.WebSocketURL()
 
-		io.Copy(existing, c)
-		c.Close()
-		existing.Close()
-	}
-}
+			events := make(chan Event, 20)
 
-type splitReader struct {
-	*bytes.Reader
-	offset    int
-	cancelAt  int
-	cancel    func()
-	didCancel bool
-}
+			code, resultCh, err := c0.SendText(ctx, "tamper with me")
+			if err != nil {
+				t.Fatal(err)
+			}
 
-func (s *splitReader) Read(b []byte) (int, error) {
-	n, err := s.Reader.Read(b)
-	s.offset += n
-	if !s.didCancel && s.offset >= s.cancelAt {
-		s.cancel()
-		s.didCancel = true
-		// yield the cpu to give the cancellation goroutine a chance
-		// to run (esp important for when GOMAXPROCS=1)
-		time.Sleep(1 * time.Millisecond)
-	}
-	return n, err
-}
+			// depending on timing the tampering is seen while reading
+			// the version or afterwards
+			expectTampering := func(err error) {
+				t.Helper()
+				var te *TransferError
+				if !errors.As(err, &te) || te.Code != CodeTampering || !tc.is(err) {
+					t.Fatalf("got %v, expected tampering", err)
+				}
+			}
 
-func TestClient_relayURL_default(t *testing.T) {
-	var c Client
+			_, err = c1.Receive(ctx, code, true, WithEvents(events))
+			expectTampering(err)
 
-	DefaultTransitRelayURL = "tcp://transit.magic-wormhole.io:8001"
-	url, err := c.relayURL()
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	if url.Scheme != "tcp" {
-		t.Error(fmt.Sprintf("invalid protocol, expected tcp, got %v", url))
-	}
-}
+			result := <-resultCh
+			expectTampering(result.Error)
 
-func TestClient_relayURL_backwards_compatibility(t *testing.T) {
-	var c Client
+			var tampering bool
+			for len(events) > 0 {
+				e := <-events
+				if e.Type == EventTampering && tc.is(e.Err) {
+					tampering = true
+				}
+			}
+			if !tampering {
+				t.Errorf("expected an EventTampering")
+			}
 
-	DefaultTransitRelayURL = "tcp:transit.magic-wormhole.io:8001"
-	url, err := c.relayURL()
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	if url.String() != "tcp://transit.magic-wormhole.io:8001" {
-		t.Error(fmt.Sprintf("invalid URL, expected 'tcp://[…]', got %v", url))
+			// the sender closes its mailbox after sending the result
+			moods := rs.CloseMoods()
+			for i := 0; len(moods) < 2 && i < 100; i++ {
+				time.Sleep(10 * time.Millisecond)
+				moods = rs.CloseMoods()
+			}
+			if len(moods) != 2 {
+				t.Fatalf("expected both sides to close, got %v", moods)
+			}
+			for side, mood := range moods {
+				if mood != string(rendezvous.Scary) {
+					t.Errorf("side %s closed with mood %q, expected scary", side, mood)
+				}
+			}
+		})
 	}
 }
 
-func TestWormholeFileTransportSendRecvViaWSRelayServer(t *testing.T) {
+func TestWormholeSession(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
@@ -1468,74 +7653,126 @@ func TestWormholeFileTransportSendRecvViaWSRelayServer(t *testing.T) {
 
 	url := rs.WebSocketURL()
 
-	relayServer := newTestWSRelayServer()
-	relayURL := relayServer.url.String()
-	defer relayServer.close()
-
 	var c0 Client
 	c0.RendezvousURL = url
-	c0.TransitRelayURL = relayURL
 
+	var c1Verifier string
 	var c1 Client
 	c1.RendezvousURL = url
-	c1.TransitRelayURL = relayURL
-
-	fileContent := make([]byte, 1<<16)
-	for i := 0; i < len(fileContent); i++ {
-		fileContent[i] = byte(i)
+	c1.VerifierOk = func(verifier string) bool {
+		c1Verifier = verifier
+		return true
 	}
 
-	buf := bytes.NewReader(fileContent)
+	// establish creates a session on c0 and joins it from c1 with the
+	// code returned by codeFor, returning the sessions and the errors
+	// from establishing them.
+	establish := func(codeFor func(string) string) (*Session, *Session, error, error) {
+		s0, err := c0.NewSession(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s1, err := c1.JoinSession(ctx, codeFor(s0.Code()))
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, true)
-	if err != nil {
-		t.Fatal(err)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s0.Establish(ctx)
+		}()
+		err1 := s1.Establish(ctx)
+		return s0, s1, <-errCh, err1
 	}
 
-	receiver, err := c1.Receive(ctx, code, true)
-	if err != nil {
-		t.Fatal(err)
+	s0, s1, err0, err1 := establish(func(code string) string { return code })
+	if err0 != nil {
+		t.Fatal(err0)
+	}
+	if err1 != nil {
+		t.Fatal(err1)
 	}
 
-	got, err := ioutil.ReadAll(receiver)
+	v0, err := s0.Verifier()
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if !bytes.Equal(got, fileContent) {
-		t.Fatalf("File contents mismatch")
+	if v0 != c1Verifier {
+		t.Fatalf("Expected matching verifiers but got %s and %s", v0, c1Verifier)
 	}
 
-	result := <-resultCh
-	if !result.OK {
-		t.Fatalf("Expected ok result but got: %+v", result)
+	// both sides send at once
+	msgs := []string{"reactant", "preachy-fusion", ""}
+	sendErr := make(chan error, 1)
+	go func() {
+		for _, msg := range msgs {
+			if err := s1.Send(ctx, []byte("re: "+msg)); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+	for _, msg := range msgs {
+		if err := s0.Send(ctx, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestReceiveWithoutSender(t *testing.T) {
-	rs := rendezvousservertest.NewServerLegacy()
-	defer rs.Close()
 
-	url := rs.WebSocketURL()
+	for _, msg := range msgs {
+		got, err := s1.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Fatalf("Expected %q but got %q", msg, got)
+		}
 
-	for relayProtocol, newRelayServer := range relayServerConstructors {
-		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
-			relayServer := newRelayServer()
+		got, err = s0.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "re: "+msg {
+			t.Fatalf("Expected %q but got %q", "re: "+msg, got)
+		}
+	}
 
-			c0 := Client{
-				RendezvousURL:   url,
-				TransitRelayURL: relayServer.url.String(),
-			}
+	k0, k1 := s0.DeriveKey("example.com/side-channel"), s1.DeriveKey("example.com/side-channel")
+	if len(k0) != 32 || !bytes.Equal(k0, k1) {
+		t.Fatalf("Expected matching 32 byte keys but got %x and %x", k0, k1)
+	}
+	if other := s0.DeriveKey("example.com/other"); bytes.Equal(other, k0) {
+		t.Fatalf("Expected keys for different purposes to differ")
+	}
 
-			_, err := c0.Receive(context.Background(), "666-fireball-fallacy", false)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = s0.Receive(timeoutCtx)
+	cancel()
+	expectTransferError(t, err, CodeTimeout, PhaseData)
 
-			if err == nil {
-				t.Error("Receiver should not be able to claim the nameplate")
-			}
+	if err := s0.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s0.Send(ctx, []byte("late")); err != ErrSessionClosed {
+		t.Fatalf("Expected ErrSessionClosed but got: %v", err)
+	}
+	if key := s0.DeriveKey("example.com/side-channel"); key != nil {
+		t.Fatalf("Expected no key after Close but got %x", key)
+	}
 
-			if err.Error() != "Nameplate is unclaimed: 666" {
-				t.Error(fmt.Sprintf("Unexpected error: %s", err.Error()))
-			}
-		})
+	s0, s1, err0, err1 = establish(func(code string) string {
+		nameplate := strings.SplitN(code, "-", 2)[0]
+		return nameplate + "-intermarrying-aliased"
+	})
+	expectTransferError(t, err0, CodeWrongCode, PhasePake)
+	expectTransferError(t, err1, CodeWrongCode, PhasePake)
+	if _, err := s1.Receive(ctx); err != ErrSessionClosed {
+		t.Fatalf("Expected ErrSessionClosed after failing to establish but got: %v", err)
 	}
 }
@@ -0,0 +1,111 @@
+package wormholetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// MemNetwork is a network that exists only in memory. Each connection
+// between one of its listeners and a dialer is a net.Pipe, so no
+// sockets are opened, and tests using it run in sandboxes without
+// network access.
+type MemNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+// NewMemNetwork returns an empty in-memory network.
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+	}
+}
+
+// Listen returns a listener for connections dialed to addr, which
+// should be a host:port so that it can be used in URLs.
+func (n *MemNetwork) Listen(addr string) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("listen %s: address already in use", addr)
+	}
+	l := &memListener{
+		n:     n,
+		addr:  memAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+var (
+	errConnRefused    = errors.New("connection refused")
+	errListenerClosed = errors.New("use of closed network connection")
+)
+
+// Dial connects to the listener for addr. It has the signature of
+// wormhole.Client.Dial, and ignores network.
+func (n *MemNetwork) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l := n.listeners[addr]
+	n.mu.Unlock()
+
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: memAddr(addr), Err: errConnRefused}
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: memAddr(addr), Err: errConnRefused}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type memListener struct {
+	n         *MemNetwork
+	addr      memAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.Network(), Addr: l.addr, Err: errListenerClosed}
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.n.mu.Lock()
+		delete(l.n.listeners, string(l.addr))
+		l.n.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,231 @@
+package wormholetest
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Direction is the direction of the data a Proxy fault applies to.
+type Direction int
+
+const (
+	// ToServer is data sent by the client to the server.
+	ToServer Direction = iota
+	// ToClient is data sent by the server to the client.
+	ToClient
+)
+
+// Proxy forwards TCP connections to a server, such as the rendezvous
+// server or a relay, and injects faults into them on demand, so that
+// tests can exercise the paths taken when the network misbehaves. It
+// works below the websocket layer, so it proxies ws:// URLs as well as
+// tcp:// ones.
+//
+// Faults apply to every connection through the proxy, each counting
+// byte offsets from its own start. They can be changed at any time and
+// take effect from the next read.
+type Proxy struct {
+	l      net.Listener
+	target string
+	url    *url.URL
+
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	latency  time.Duration
+	dropAt   [2]int64
+	corrupts [2]int64
+	conns    map[net.Conn]struct{}
+	accepted int
+	closed   bool
+}
+
+// NewProxy starts a proxy in front of the server at serverURL, which
+// is a tcp://, ws:// or http:// URL with a host and port.
+func NewProxy(serverURL string) (*Proxy, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	proxied := *u
+	proxied.Host = l.Addr().String()
+
+	p := &Proxy{
+		l:        l,
+		target:   u.Host,
+		url:      &proxied,
+		dropAt:   [2]int64{-1, -1},
+		corrupts: [2]int64{-1, -1},
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	go p.run()
+	return p, nil
+}
+
+// URL returns the server's URL with the host replaced by the proxy's,
+// for use in place of the server's.
+func (p *Proxy) URL() string {
+	return p.url.String()
+}
+
+// SetLatency delays each read forwarded in either direction by d.
+func (p *Proxy) SetLatency(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latency = d
+}
+
+// DropAt closes each connection once offset bytes have been forwarded
+// in dir. A negative offset cancels it.
+func (p *Proxy) DropAt(dir Direction, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropAt[dir] = offset
+}
+
+// CorruptAt flips the bits of the byte at offset of the data forwarded
+// in dir on each connection. A negative offset cancels it.
+func (p *Proxy) CorruptAt(dir Direction, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.corrupts[dir] = offset
+}
+
+// DropConnections closes every connection open through the proxy. New
+// connections are still accepted.
+func (p *Proxy) DropConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// Connections returns the number of connections the proxy has
+// accepted, so tests can check that a client reconnected.
+func (p *Proxy) Connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+// Close stops the proxy and closes its connections.
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	p.l.Close()
+	p.DropConnections()
+	p.wg.Wait()
+}
+
+func (p *Proxy) run() {
+	for {
+		client, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+
+		if !p.track(client, server) {
+			client.Close()
+			server.Close()
+			return
+		}
+
+		p.wg.Add(2)
+		go p.forward(ToServer, server, client)
+		go p.forward(ToClient, client, server)
+	}
+}
+
+func (p *Proxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.accepted++
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// forward copies from src to dst, applying the faults for dir, until
+// either fails. It then closes both, which ends the copy the other way.
+func (p *Proxy) forward(dir Direction, dst, src net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(dst, src)
+	defer dst.Close()
+	defer src.Close()
+
+	var offset int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.mu.Lock()
+			latency, dropAt, corruptAt := p.latency, p.dropAt[dir], p.corrupts[dir]
+			p.mu.Unlock()
+
+			if latency > 0 {
+				time.Sleep(latency)
+			}
+
+			chunk := buf[:n]
+			if corruptAt >= offset && corruptAt < offset+int64(n) {
+				chunk[corruptAt-offset] ^= 0xff
+			}
+			drop := dropAt >= 0 && dropAt < offset+int64(n)
+			if drop {
+				if dropAt < offset {
+					return
+				}
+				chunk = chunk[:dropAt-offset]
+			}
+
+			if _, werr := dst.Write(chunk); werr != nil {
+				return
+			}
+			offset += int64(len(chunk))
+			if drop {
+				return
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				// pass on the half close, if the connection supports it
+				if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+					continue
+				}
+			}
+			return
+		}
+	}
+}
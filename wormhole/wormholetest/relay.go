@@ -0,0 +1,261 @@
+package wormholetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+// Relay is a transit relay listening on a local port. It pairs
+// connections that send the same relay token, as the public relay
+// does, and copies data between them.
+type Relay struct {
+	server  *httptest.Server
+	l       net.Listener
+	url     *url.URL
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	streams map[string]net.Conn
+
+	// legacy relays only accept "please relay <token>\n", and answer
+	// "bad handshake" to requests with a side.
+	legacy  bool
+	refused int
+}
+
+// NewTCPRelay starts a relay that accepts TCP connections.
+func NewTCPRelay() *Relay {
+	return newTCPRelay(false)
+}
+
+// NewLegacyTCPRelay starts a TCP relay that behaves like those from
+// before sides were added to the relay handshake: it only accepts
+// requests without a side, and answers "bad handshake" to others.
+func NewLegacyTCPRelay() *Relay {
+	return newTCPRelay(true)
+}
+
+func newTCPRelay(legacy bool) *Relay {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	return newRelayOn(l, legacy)
+}
+
+// newRelayOn starts a relay that accepts connections from l, which it
+// closes when it is closed.
+func newRelayOn(l net.Listener, legacy bool) *Relay {
+	url, err := url.Parse("tcp://" + l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	r := &Relay{
+		l:       l,
+		url:     url,
+		streams: make(map[string]net.Conn),
+		legacy:  legacy,
+	}
+
+	go r.run()
+	return r
+}
+
+// NewWSRelay starts a relay that accepts websocket connections.
+func NewWSRelay() *Relay {
+	r := &Relay{
+		streams: make(map[string]net.Conn),
+	}
+
+	smux := http.NewServeMux()
+	smux.HandleFunc("/", r.handleWSRelay)
+
+	r.server = httptest.NewServer(smux)
+	url, err := url.Parse("ws://" + r.server.Listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	r.url = url
+	r.l = r.server.Listener
+
+	return r
+}
+
+// URL returns the address of the relay, for Client.TransitRelayURL.
+func (r *Relay) URL() string {
+	return r.url.String()
+}
+
+// RefusedHandshakes returns the number of requests a legacy relay has
+// answered with "bad handshake" because they had a side.
+func (r *Relay) RefusedHandshakes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refused
+}
+
+// Close stops the relay from accepting connections and waits for the
+// ones it is relaying to close.
+func (r *Relay) Close() {
+	if r.server != nil {
+		r.server.Close()
+	} else {
+		r.l.Close()
+	}
+	r.wg.Wait()
+}
+
+func (r *Relay) run() {
+	for {
+		conn, err := r.l.Accept()
+		if err != nil {
+			return
+		}
+
+		r.wg.Add(1)
+		go r.handleConn(conn)
+	}
+}
+
+func (r *Relay) handleWSRelay(w http.ResponseWriter, req *http.Request) {
+	c, err := websocket.Accept(w, req, nil)
+
+	if err != nil {
+		return
+	}
+
+	ctx := context.Background()
+	conn := websocket.NetConn(ctx, c, websocket.MessageBinary)
+	r.wg.Add(1)
+	go r.handleConn(conn)
+}
+
+var headerPrefix = []byte("please relay ")
+var headerSide = []byte(" for side ")
+
+func (r *Relay) handleConn(c net.Conn) {
+	// requests look like:
+	// "please relay 10bf5ab71e48a3ca74b0a0d4d54f66f38704a76d15885442a8df141680fd for side 4a74cb8a377c970a\n"
+
+	defer r.wg.Done()
+	headerBuf := make([]byte, 64)
+
+	matchExpect := func(expect []byte) bool {
+		got := headerBuf[:len(expect)]
+		_, err := io.ReadFull(c, got)
+		if err != nil {
+			c.Close()
+			return false
+		}
+
+		if !bytes.Equal(got, expect) {
+			c.Write([]byte("bad handshake\n"))
+			c.Close()
+			return false
+		}
+
+		return true
+	}
+
+	isHex := func(str string) bool {
+		_, err := hex.DecodeString(str)
+		if err != nil {
+			c.Write([]byte("bad handshake\n"))
+			c.Close()
+			return false
+		}
+		return true
+	}
+
+	if !matchExpect(headerPrefix) {
+		return
+	}
+
+	_, err := io.ReadFull(c, headerBuf)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	chanID := string(headerBuf)
+	if !isHex(chanID) {
+		return
+	}
+
+	if r.legacy {
+		_, err = io.ReadFull(c, headerBuf[:1])
+		if err != nil {
+			c.Close()
+			return
+		}
+		if headerBuf[0] != '\n' {
+			r.mu.Lock()
+			r.refused++
+			r.mu.Unlock()
+			c.Write([]byte("bad handshake\n"))
+			c.Close()
+			return
+		}
+		r.pair(chanID, c)
+		return
+	}
+
+	if !matchExpect(headerSide) {
+		return
+	}
+
+	sideBuf := headerBuf[:16]
+	_, err = io.ReadFull(c, sideBuf)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	side := string(sideBuf)
+	if !isHex(side) {
+		return
+	}
+
+	// read \n
+	_, err = io.ReadFull(c, headerBuf[:1])
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	r.pair(chanID, c)
+}
+
+// pair connects c with the other connection for chanID, if it has
+// arrived, and relays between them until either closes.
+func (r *Relay) pair(chanID string, c net.Conn) {
+	r.mu.Lock()
+	existing, found := r.streams[chanID]
+	if !found {
+		r.streams[chanID] = c
+	}
+	r.mu.Unlock()
+
+	if found {
+		existing.Write([]byte("ok\n"))
+		c.Write([]byte("ok\n"))
+		go func() {
+			io.Copy(c, existing)
+			existing.Close()
+			c.Close()
+
+		}()
+
+		io.Copy(existing, c)
+		c.Close()
+		existing.Close()
+	}
+}
@@ -0,0 +1,99 @@
+// Package wormholetest provides a rendezvous server and transit relays
+// that run in-process, for hermetic tests of applications built on the
+// wormhole package. Transfers between clients pointed at them run the
+// real protocol, without network access or the public servers:
+//
+//	srv := wormholetest.NewServer()
+//	defer srv.Close()
+//
+//	var c wormhole.Client
+//	c.RendezvousURL = srv.RendezvousURL()
+//	c.TransitRelayURL = srv.TransitRelayURL()
+//
+// NewMemServer runs the servers on a MemNetwork instead, for tests
+// that may not open sockets; clients then also need
+//
+//	c.Dial = srv.Network.Dial
+package wormholetest
+
+import (
+	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
+)
+
+// Server is a rendezvous server and a transit relay.
+type Server struct {
+	// Rendezvous is the rendezvous server. Its methods can be used to
+	// inspect the mailboxes, or to make the server misbehave.
+	Rendezvous *rendezvousservertest.TestServer
+
+	// Relay is the transit relay.
+	Relay *Relay
+
+	// Network is the in-memory network the servers run on, for servers
+	// started with NewMemServer. It is nil for the others.
+	Network *MemNetwork
+}
+
+// NewServer starts a rendezvous server and a TCP transit relay.
+func NewServer() *Server {
+	return &Server{
+		Rendezvous: rendezvousservertest.NewServerLegacy(),
+		Relay:      NewTCPRelay(),
+	}
+}
+
+// NewWSServer starts a rendezvous server and a websocket transit
+// relay, as clients built for the browser need.
+func NewWSServer() *Server {
+	return &Server{
+		Rendezvous: rendezvousservertest.NewServerLegacy(),
+		Relay:      NewWSRelay(),
+	}
+}
+
+// Addresses of the servers started by NewMemServer on their network.
+const (
+	memRendezvousAddr = "rendezvous.wormhole.test:4000"
+	memRelayAddr      = "relay.wormhole.test:4001"
+)
+
+// NewMemServer starts a rendezvous server and a TCP transit relay on a
+// new MemNetwork rather than on local ports. Clients reach them with
+// Client.Dial set to the Network's Dial method, and make their
+// transfers without opening any sockets.
+func NewMemServer() *Server {
+	n := NewMemNetwork()
+
+	rl, err := n.Listen(memRendezvousAddr)
+	if err != nil {
+		panic(err)
+	}
+	tl, err := n.Listen(memRelayAddr)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Server{
+		Rendezvous: rendezvousservertest.NewServerLegacyOn(rl),
+		Relay:      newRelayOn(tl, false),
+		Network:    n,
+	}
+}
+
+// RendezvousURL returns the address of the rendezvous server, for
+// Client.RendezvousURL.
+func (s *Server) RendezvousURL() string {
+	return s.Rendezvous.WebSocketURL()
+}
+
+// TransitRelayURL returns the address of the relay, for
+// Client.TransitRelayURL.
+func (s *Server) TransitRelayURL() string {
+	return s.Relay.URL()
+}
+
+// Close stops the servers.
+func (s *Server) Close() {
+	s.Relay.Close()
+	s.Rendezvous.Close()
+}